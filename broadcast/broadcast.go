@@ -0,0 +1,93 @@
+package broadcast
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/ReshiAdavan/Sentinel/raft"
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// OrderedMsg is a message delivered by a Broadcast, in the total order every peer agrees on.
+type OrderedMsg struct {
+	Index  int      // Position of the message in the order, counting from 1 with no gaps
+	Data   []byte   // The message, as passed to Propose
+	Digest [32]byte // SHA-256 over the previous message's digest, Index, and Data
+}
+
+// Broadcast is a total-order broadcast on top of a Raft peer: every message proposed on any
+// peer and committed is delivered on every peer, in the same order. The digest of each
+// delivered message covers every message before it, so two peers that delivered the same
+// index with the same digest have delivered the same sequence.
+type Broadcast struct {
+	rf        *raft.Raft
+	applyCh   chan raft.ApplyMsg
+	delivered chan OrderedMsg
+}
+
+// Make starts a broadcast peer; the arguments are those of raft.Make.
+func Make(peers []*rpc.ClientEnd, me int, persister *raft.Persister) *Broadcast {
+	b, _ := MakeWithConfig(peers, me, persister, raft.Config{})
+	return b
+}
+
+// MakeWithConfig is like Make, but passes cfg to the Raft peer.
+// Returns an error, without starting the peer, if cfg is invalid.
+func MakeWithConfig(peers []*rpc.ClientEnd, me int, persister *raft.Persister, cfg raft.Config) (*Broadcast, error) {
+	b := new(Broadcast)
+	b.applyCh = make(chan raft.ApplyMsg, 100)
+	b.delivered = make(chan OrderedMsg, 100)
+	rf, err := raft.MakeWithConfig(peers, me, persister, b.applyCh, cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.rf = rf
+	go b.run()
+	return b, nil
+}
+
+// Propose submits a message for delivery. Like raft.Raft.Start, it returns the index the
+// message will be delivered at if it commits, the current term, and whether this peer is the
+// leader; only the leader accepts messages, and even then a message may be lost if leadership
+// changes before it commits, in which case another message is delivered at that index.
+func (b *Broadcast) Propose(msg []byte) (int, int, bool) {
+	return b.rf.Start(msg)
+}
+
+// Delivered returns the channel committed messages are delivered on, in index order. Nothing
+// about delivery is persisted, so a restarted peer delivers the whole sequence again from index
+// 1, with the same digests; a consumer that keeps state should skip indexes it has processed.
+// The channel must be drained, or Raft blocks.
+func (b *Broadcast) Delivered() <-chan OrderedMsg {
+	return b.delivered
+}
+
+// Raft returns the underlying Raft peer, e.g. to register it as an RPC service or check its state.
+func (b *Broadcast) Raft() *raft.Raft {
+	return b.rf
+}
+
+// Kill stops the peer.
+func (b *Broadcast) Kill() {
+	b.rf.Kill()
+}
+
+// run turns committed log entries into delivered messages, chaining their digests.
+func (b *Broadcast) run() {
+	var digest [32]byte
+	for msg := range b.applyCh {
+		if !msg.CommandValid {
+			// a snapshot carries no messages, and Broadcast never takes one.
+			continue
+		}
+		data, _ := msg.Command.([]byte)
+		var index [8]byte
+		binary.BigEndian.PutUint64(index[:], uint64(msg.CommandIndex))
+		h := sha256.New()
+		h.Write(digest[:])
+		h.Write(index[:])
+		h.Write(data)
+		copy(digest[:], h.Sum(nil))
+		b.delivered <- OrderedMsg{Index: msg.CommandIndex, Data: data, Digest: digest}
+	}
+}
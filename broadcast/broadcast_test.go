@@ -0,0 +1,176 @@
+package broadcast
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/raft"
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// TestTotalOrder starts three peers and has several proposers broadcast numbered messages
+// through whichever peer leads, first with the network whole and then with the leader cut off
+// for a while. Every peer must deliver the same sequence, from index 1 with no gaps, with the
+// same digests; each proposer's messages must appear at most once and in the order it sent
+// them; and every message accepted while the network was whole, some sent while the leader
+// was cut off, and a final one sent after it healed, must be delivered.
+func TestTotalOrder(t *testing.T) {
+	const n, nproposers, nmsgs = 3, 4, 10
+
+	net := rpc.MakeNetwork()
+	defer net.Cleanup()
+	endname := func(from, to int) string { return fmt.Sprintf("broadcast-%d-%d", from, to) }
+	peers := make([]*Broadcast, n)
+	for i := 0; i < n; i++ {
+		ends := make([]*rpc.ClientEnd, n)
+		for j := 0; j < n; j++ {
+			ends[j] = net.MakeEnd(endname(i, j))
+			net.Connect(endname(i, j), j)
+			net.Enable(endname(i, j), true)
+		}
+		peers[i] = Make(ends, i, raft.MakePersister())
+		defer peers[i].Kill()
+		srv := rpc.MakeServer()
+		srv.AddService(rpc.MakeService(peers[i].Raft()))
+		net.AddServer(i, srv)
+	}
+	connect := func(i int, yes bool) {
+		for j := 0; j < n; j++ {
+			net.Enable(endname(i, j), yes)
+			net.Enable(endname(j, i), yes)
+		}
+	}
+
+	var mu sync.Mutex
+	delivered := make([][]OrderedMsg, n)
+	for i := range peers {
+		go func(i int) {
+			for m := range peers[i].Delivered() {
+				mu.Lock()
+				delivered[i] = append(delivered[i], m)
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	// propose sends msg through the first peer to accept it, trying them in turn from peer
+	// from, and returns the index it was accepted at and the peer that accepted it, or false
+	// if none did within a few seconds.
+	propose := func(msg string, from int) (int, int, bool) {
+		for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+			for j := 0; j < n; j++ {
+				i := (from + j) % n
+				if index, _, ok := peers[i].Propose([]byte(msg)); ok {
+					return index, i, true
+				}
+			}
+		}
+		t.Errorf("no peer accepted %q", msg)
+		return 0, 0, false
+	}
+	// round has every proposer send its messages first to last-1, trying the peers from a
+	// different one each time, so that while a leader is cut off some messages still go to it
+	// and are lost, and returns the index each was accepted at.
+	round := func(first, last int) map[string]int {
+		var wg sync.WaitGroup
+		var amu sync.Mutex
+		accepted := make(map[string]int)
+		for p := 0; p < nproposers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for k := first; k < last; k++ {
+					msg := fmt.Sprintf("%d/%d", p, k)
+					index, _, ok := propose(msg, p+k)
+					if !ok {
+						return
+					}
+					amu.Lock()
+					accepted[msg] = index
+					amu.Unlock()
+					time.Sleep(time.Millisecond)
+				}
+			}(p)
+		}
+		wg.Wait()
+		return accepted
+	}
+
+	whole := round(0, nmsgs/2)
+	_, leader, ok := propose("cut", 0)
+	if !ok {
+		t.FailNow()
+	}
+	connect(leader, false)
+	round(nmsgs/2, nmsgs)
+	connect(leader, true)
+	final, _, ok := propose("end", 0)
+	if !ok || t.Failed() {
+		t.FailNow()
+	}
+
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		mu.Lock()
+		caught := 0
+		for i := range delivered {
+			if len(delivered[i]) >= final {
+				caught++
+			}
+		}
+		mu.Unlock()
+		if caught == n {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("only %d of %d peers delivered index %d", caught, n, final)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range delivered {
+		for k, m := range delivered[i][:final] {
+			if m.Index != k+1 {
+				t.Fatalf("peer %d delivered index %d in position %d", i, m.Index, k+1)
+			}
+			if want := delivered[0][k]; string(m.Data) != string(want.Data) || m.Digest != want.Digest {
+				t.Fatalf("at index %d peer %d delivered %q and peer 0 %q, or their digests differ", m.Index, i, m.Data, want.Data)
+			}
+		}
+	}
+	if got := string(delivered[0][final-1].Data); got != "end" {
+		t.Fatalf("index %d, at which %q was accepted after the network healed, delivered %q", final, "end", got)
+	}
+	at := make(map[string]int)
+	next := make([]int, nproposers)
+	for _, m := range delivered[0][:final] {
+		var p, k int
+		if _, err := fmt.Sscanf(string(m.Data), "%d/%d", &p, &k); err != nil {
+			continue
+		}
+		if _, dup := at[string(m.Data)]; dup {
+			t.Fatalf("message %q was delivered twice", m.Data)
+		}
+		if k < next[p] {
+			t.Fatalf("proposer %d's message %d was delivered after its message %d", p, k, next[p]-1)
+		}
+		at[string(m.Data)] = m.Index
+		next[p] = k + 1
+	}
+	late := 0
+	for p := range next {
+		if next[p] > nmsgs/2 {
+			late++
+		}
+	}
+	if late == 0 {
+		t.Fatalf("no message sent while the leader was cut off was delivered")
+	}
+	for msg, index := range whole {
+		if at[msg] != index {
+			t.Fatalf("message %q, accepted at index %d while the network was whole, was delivered at %d", msg, index, at[msg])
+		}
+	}
+}
@@ -4,9 +4,12 @@ package gobWrapper
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"sync"
 	"unicode"
 	"unicode/utf8"
@@ -16,6 +19,27 @@ var mu sync.Mutex // Mutex for synchronizing access to global variables
 var errorCount int // Tracks the number of capitalization errors encountered
 var checked map[reflect.Type]bool // Keeps track of already checked types
 
+// strict makes capitalization errors panic instead of printing a warning.
+var strict bool
+
+// SetStrict makes every capitalization error found from now on panic instead of printing a
+// warning, so that a test fails at the first value whose lower-case fields RPC or persist
+// would silently drop. Types are checked once, the first time they are encoded, decoded or
+// registered, so call it before any of them are, e.g. from TestMain.
+func SetStrict(on bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	strict = on
+}
+
+// ErrorCount returns the number of problems found so far, capitalization errors and
+// decoding into non-default values alike, so a test can assert that its encoding was clean.
+func ErrorCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return errorCount
+}
+
 type Encoder struct {
 	gob *gob.Encoder // Embeds gob.Encoder to handle the actual encoding
 }
@@ -69,6 +93,59 @@ func RegisterName(name string, value interface{}) {
 	gob.RegisterName(name, value)
 }
 
+// CheckRegistered verifies that each value can travel as an interface{} field, such as a Raft
+// log entry's Command: its concrete type must have been registered with Register or RegisterName,
+// and its struct fields must be capitalized. Unlike the other checks in this package, it prints
+// nothing and instead returns an error listing every problem found, or nil if there are none.
+func CheckRegistered(values ...interface{}) error {
+	var problems []string
+	for _, value := range values {
+		problems = append(problems, lowerCaseFields(reflect.TypeOf(value), map[reflect.Type]bool{})...)
+
+		v := value
+		if err := gob.NewEncoder(ioutil.Discard).Encode(&v); err != nil {
+			problems = append(problems, fmt.Sprintf("%T cannot be encoded as an interface value: %v", value, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("gobWrapper: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ValidateEncodable is CheckRegistered for a single value, meant to be called on each value
+// just before it is persisted, so that one that would not survive a restart is refused up front
+// instead of being found when the persisted state fails to decode.
+func ValidateEncodable(v interface{}) error {
+	return CheckRegistered(v)
+}
+
+// lowerCaseFields describes every lower-case struct field reachable from type t.
+func lowerCaseFields(t reflect.Type, seen map[reflect.Type]bool) []string {
+	if t == nil || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			rune, _ := utf8.DecodeRuneInString(f.Name)
+			if !unicode.IsUpper(rune) {
+				problems = append(problems, fmt.Sprintf("lower-case field %v of %v", f.Name, t.Name()))
+			}
+			problems = append(problems, lowerCaseFields(f.Type, seen)...)
+		}
+	case reflect.Slice, reflect.Array, reflect.Ptr:
+		problems = lowerCaseFields(t.Elem(), seen)
+	case reflect.Map:
+		problems = append(lowerCaseFields(t.Elem(), seen), lowerCaseFields(t.Key(), seen)...)
+	}
+	return problems
+}
+
 // checkValue performs capitalization checks on the provided value.
 func checkValue(value interface{}) {
 	checkType(reflect.TypeOf(value))
@@ -96,11 +173,16 @@ func checkType(t reflect.Type) {
 			f := t.Field(i)
 			rune, _ := utf8.DecodeRuneInString(f.Name)
 			if !unicode.IsUpper(rune) {
-				fmt.Printf("gobWrapper warning: lower-case field %v of %v won't work over RPC or in persist/snapshot\n",
-					f.Name, t.Name())
 				mu.Lock()
 				errorCount += 1
+				fatal := strict
 				mu.Unlock()
+				if fatal {
+					panic(fmt.Sprintf("gobWrapper: lower-case field %v of %v won't work over RPC or in persist/snapshot",
+						f.Name, t.Name()))
+				}
+				fmt.Printf("gobWrapper warning: lower-case field %v of %v won't work over RPC or in persist/snapshot\n",
+					f.Name, t.Name())
 			}
 			checkType(f.Type)
 		}
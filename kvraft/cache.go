@@ -0,0 +1,52 @@
+package raftkv
+
+// The read cache holds the values of recently read keys, up to cfg.ReadCacheSize of them.
+// It belongs to the default state machine, kvStore: an entry is added when a get is applied
+// and dropped when a write to its key is applied, so a cached value always equals the stored
+// one. Every replica keeps its cache in step with its own apply loop, which lets a newly
+// elected leader start with a warm cache.
+
+// cacheRead returns the cached value of key if the leader may answer a get from it: it holds
+// a lease and has applied everything committed before the lease was checked, so no write to
+// key can have been committed without invalidating the entry.
+func (kv *KVServer) cacheRead(key string) (string, bool) {
+	index, ok := kv.rf.LeaseRead()
+	if !ok {
+		return "", false
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	store, ok := kv.sm.(*kvStore)
+	if !ok {
+		return "", false
+	}
+	value, hit := store.cache[key]
+	if kv.lastApplied < index || !hit {
+		kv.stats.ReadCacheMisses++
+		return "", false
+	}
+	kv.stats.ReadCacheHits++
+	return value, true
+}
+
+// fill caches the value of key, just read by an applied get, evicting an
+// arbitrary entry if the cache is full.
+func (s *kvStore) fill(key string, value string) {
+	if s.cacheSize <= 0 {
+		return
+	}
+	if _, ok := s.cache[key]; !ok && len(s.cache) >= s.cacheSize {
+		for victim := range s.cache {
+			delete(s.cache, victim)
+			break
+		}
+	}
+	s.cache[key] = value
+}
+
+// invalidate drops the cached values of keys an applied operation writes.
+func (s *kvStore) invalidate(keys ...string) {
+	for _, key := range keys {
+		delete(s.cache, key)
+	}
+}
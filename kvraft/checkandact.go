@@ -0,0 +1,60 @@
+package raftkv
+
+// A check-and-act reads a key and, if its value equals the expected one, writes a new value,
+// all at one log position. A missing key has the empty value, as for Get. It acts with OK and
+// otherwise fails with ErrMismatch, and either way returns the value it observed. A retry must
+// see the same value, so the server remembers the values observed by check-and-acts that did
+// not act, by client and request id; one that acted observed the expected value, so it needs
+// nothing more than the remembered outcome. The values transforms leave, and the values renames
+// move, are remembered alike, since they depend on the state they were applied to. A client that does not
+// pipeline keeps at most its latest such value, and a pipelining client's are dropped as its
+// floor rises.
+
+// checkAndAct applies a check-and-act to the store and returns the value it observed.
+func (s *kvStore) checkAndAct(op Op) (string, Err) {
+	value := s.data[op.Key]
+	s.touch(op.Key)
+	if value != op.Expected {
+		return value, ErrMismatch
+	}
+	s.data[op.Key] = op.Value
+	s.invalidate(op.Key)
+	s.reindex(op.Key)
+	return value, OK
+}
+
+// rememberValue remembers the value a check-and-act observed when it did not act, the value a
+// transform left or the value a rename moved, and forgets a non-pipelining client's earlier ones.
+func (kv *KVServer) rememberValue(op Op, result Result) {
+	if op.Command != "checkandact" && op.Command != "transform" && op.Command != "rename" {
+		return
+	}
+	if op.Floor == 0 {
+		delete(kv.remembered, op.ClientId)
+	}
+	if op.Command == "checkandact" && result.Err != ErrMismatch || op.Command != "checkandact" && result.Err != OK {
+		return
+	}
+	if kv.remembered[op.ClientId] == nil {
+		kv.remembered[op.ClientId] = make(map[int64]string)
+	}
+	kv.remembered[op.ClientId][op.RequestId] = result.Value
+}
+
+// rememberedValue returns the value a check-and-act observed, a transform left or a rename moved
+// when it was first applied, given the outcome remembered for it.
+func (kv *KVServer) rememberedValue(op Op, err Err) string {
+	if op.Command == "checkandact" && err == OK {
+		return op.Expected
+	}
+	return kv.remembered[op.ClientId][op.RequestId]
+}
+
+// dropRemembered forgets the values remembered for a pipelining client's requests below its floor.
+func (kv *KVServer) dropRemembered(clientId int64, floor int64) {
+	for requestId := range kv.remembered[clientId] {
+		if requestId < floor {
+			delete(kv.remembered[clientId], requestId)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package raftkv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PutChunked stores a value longer than ClerkConfig.ChunkSize in parts, under keys of the form
+// <key>_part_<tag>_<i>, each put through its own log entry, so that no entry, and so no single
+// step of replication or snapshotting, has to carry the whole value. Once every part is in, a
+// check-and-act swaps in, under the key itself, a manifest naming the tag and the number of
+// parts: the write takes effect at that one log position, and until then readers see the old
+// value whole. The tag is drawn at random for each write, so parts are never overwritten, and
+// the writer whose check-and-act displaces a manifest deletes that manifest's parts. GetChunked
+// reads the key and, for a manifest, every part at one linearization point with MultiGet; if a
+// concurrent PutChunked has deleted them since, the value it read was replaced, and it reads
+// the key again.
+//
+// Only PutChunked knows to delete parts: a Put or Delete of a chunked key leaves them behind,
+// and an Append to one corrupts its manifest.
+
+// defaultChunkSize is the largest part PutChunked writes if ClerkConfig.ChunkSize is not set.
+const defaultChunkSize = 64 << 10
+
+// manifestPrefix begins every manifest. Values written with PutChunked must not begin with it.
+const manifestPrefix = "\x00chunks:"
+
+// partKey returns the key of the i-th part of the value written to key under tag.
+func partKey(key string, tag int64, i int) string {
+	return fmt.Sprintf("%s_part_%x_%d", key, tag, i)
+}
+
+// parseManifest returns the keys of the parts a manifest stored under key names, in order.
+// ok is false if value is not a manifest.
+func parseManifest(key string, value string) (keys []string, ok bool) {
+	if !strings.HasPrefix(value, manifestPrefix) {
+		return nil, false
+	}
+	var tag int64
+	var parts int
+	if _, err := fmt.Sscanf(value[len(manifestPrefix):], "%x:%d", &tag, &parts); err != nil {
+		return nil, false
+	}
+	keys = make([]string, parts)
+	for i := range keys {
+		keys[i] = partKey(key, tag, i)
+	}
+	return keys, true
+}
+
+/*
+ * PutChunked is like Put, but stores a value longer than ClerkConfig.ChunkSize in parts, each
+ * through its own log entry, and then switches key over to them in one more; see chunk.go.
+ * Whatever value key held before, in parts or whole, is replaced atomically, and its parts are
+ * deleted. A value of at most ChunkSize bytes is stored whole. Unlike Put it returns a
+ * *RetryError if ClerkConfig.MaxRetries runs out, which may leave parts behind.
+ */
+func (ck *Clerk) PutChunked(key string, value string) error {
+	stored := value
+	size := ck.cfg.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	if len(value) > size {
+		tag := nrand()
+		parts := (len(value) + size - 1) / size
+		for i := 0; i < parts; i++ {
+			end := (i + 1) * size
+			if end > len(value) {
+				end = len(value)
+			}
+			if err := ck.TryPutAppend(partKey(key, tag, i), value[i*size:end], "put"); err != nil {
+				return err
+			}
+		}
+		stored = fmt.Sprintf("%s%x:%d", manifestPrefix, tag, parts)
+	}
+
+	old, err := ck.TryGet(key)
+	if err != nil {
+		return err
+	}
+	for {
+		observed, acted, err := ck.CheckAndAct(key, old, stored)
+		if err != nil {
+			return err
+		}
+		if acted {
+			break
+		}
+		old = observed
+	}
+	if keys, ok := parseManifest(key, old); ok {
+		for _, part := range keys {
+			if err := ck.TryPutAppend(part, "", "delete"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * GetChunked is like TryGet, but reassembles a value PutChunked stored in parts. The parts are
+ * read together at one linearization point, and never change once the value is stored, so the
+ * value returned is the one key held when it was read.
+ */
+func (ck *Clerk) GetChunked(key string) (string, error) {
+	for {
+		value, err := ck.TryGet(key)
+		if err != nil {
+			return "", err
+		}
+		keys, ok := parseManifest(key, value)
+		if !ok {
+			return value, nil
+		}
+		parts, err := ck.MultiGet(keys)
+		if err != nil {
+			return "", err
+		}
+		if len(parts) < len(keys) {
+			// replaced since, and its parts deleted by the writer that replaced it
+			continue
+		}
+		var b strings.Builder
+		for _, part := range keys {
+			b.WriteString(parts[part])
+		}
+		return b.String(), nil
+	}
+}
@@ -2,19 +2,36 @@ package raftkv
 
 import (
 	"crypto/rand"
+	"math"
 	"math/big"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/ReshiAdavan/Sentinel/linearizability"
 	"github.com/ReshiAdavan/Sentinel/rpc"
 )
 
+// busyBackoff is how long the Clerk waits before retrying a request the leader refused with ErrBusy.
+const busyBackoff = 20 * time.Millisecond
+
 // Clerk is a client for a Raft-based key-value store.
 type Clerk struct {
-	servers   []*rpc.ClientEnd // List of RPC client endpoints for the Raft servers.
-	mu        sync.Mutex       // Mutex to protect concurrent access to the next fields.
-	clientId  int64            // Unique client identifier.
-	requestId int64            // Incrementing request ID to distinguish different requests from the same client.
-	leader    int              // Index of the server believed to be the leader.
+	mu        sync.Mutex                  // Mutex to protect concurrent access to the next fields.
+	servers   []*rpc.ClientEnd            // List of RPC client endpoints for the Raft servers of the group the Clerk talks to.
+	gid       int                         // Id of that group, or -1 until cfg.ShardMap first moves the Clerk.
+	clientId  int64                       // Unique client identifier.
+	known     map[int]bool                // Groups, by gid, that have applied a write sent under clientId.
+	requestId int64                       // Incrementing request ID to distinguish different requests from the same client.
+	leader    int                         // Index of the server believed to be the leader.
+	positions map[int]int                 // Position in servers of each Raft peer seen so far.
+	cfg       ClerkConfig                 // Optional behaviour supplied at construction.
+	history   []linearizability.Operation // Completed operations, if cfg.Record or cfg.VerifyEvery is set.
+	unmodeled map[string]bool             // Keys left out of the history, see unmodel.
+	violation *ViolationError             // First failed check of the history, if cfg.OnViolation is nil.
+	inflight  map[int64]bool              // Request ids not yet completed, if cfg.Pipeline is set.
+	keyTails  map[string]chan struct{}    // Closed when the latest operation in flight on each key completes, if cfg.Pipeline is set.
+	load      float64                     // Load the leader reported in its latest reply.
 }
 
 // nrand generates a random 62-bit integer, used for generating unique client IDs.
@@ -30,37 +47,734 @@ func MakeClerk(servers []*rpc.ClientEnd) *Clerk {
 	ck := new(Clerk)
 	ck.servers = servers
 	ck.clientId = nrand()
+	ck.known = make(map[int]bool)
 	ck.requestId = 0
 	ck.leader = 0
+	ck.positions = make(map[int]int)
+	ck.gid = -1
+	return ck
+}
+
+// MakeClerkWithConfig is like MakeClerk, but lets the caller tune the Clerk through cfg.
+func MakeClerkWithConfig(servers []*rpc.ClientEnd, cfg ClerkConfig) *Clerk {
+	ck := MakeClerk(servers)
+	ck.cfg = cfg
+	if cfg.Pipeline {
+		// request ids start at 1, so that every request can carry a positive floor.
+		ck.requestId = 1
+		ck.inflight = make(map[int64]bool)
+		ck.keyTails = make(map[string]chan struct{})
+	}
 	return ck
 }
 
+// History returns a copy of the operations the Clerk has recorded so far,
+// or nil if recording is not enabled.
+func (ck *Clerk) History() []linearizability.Operation {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.history == nil {
+		return nil
+	}
+	return ck.modeled()
+}
+
+// historyKeys returns the keys of the operations in the history, in order.
+func (ck *Clerk) historyKeys() []string {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	seen := make(map[string]bool)
+	var keys []string
+	for _, op := range ck.history {
+		if key := op.Input.(linearizability.KvInput).Key; !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// modeled returns a copy of the history without the operations on keys left out of it.
+// Must be called with the lock held.
+func (ck *Clerk) modeled() []linearizability.Operation {
+	history := make([]linearizability.Operation, 0, len(ck.history))
+	for _, op := range ck.history {
+		if !ck.unmodeled[op.Input.(linearizability.KvInput).Key] {
+			history = append(history, op)
+		}
+	}
+	return history
+}
+
+// unmodel leaves keys out of the history from now on, past operations included, once the Clerk
+// has written them a value it does not know, such as the result of an abandoned transform.
+// KvModel checks keys independently, so the rest of the history can still be checked.
+func (ck *Clerk) unmodel(keys ...string) {
+	if !ck.cfg.Record && ck.cfg.VerifyEvery <= 0 {
+		return
+	}
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.unmodeled == nil {
+		ck.unmodeled = make(map[string]bool)
+	}
+	for _, key := range keys {
+		ck.unmodeled[key] = true
+	}
+}
+
+// Violation returns a *ViolationError once a check of the Clerk's history has failed with no
+// ClerkConfig.OnViolation to report it to, and nil otherwise.
+func (ck *Clerk) Violation() error {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.violation == nil {
+		return nil
+	}
+	return ck.violation
+}
+
+// record appends a completed operation, invoked at start, to the history if recording is
+// enabled, and checks the history when cfg.VerifyEvery operations have built up since the last check.
+func (ck *Clerk) record(input linearizability.KvInput, output linearizability.KvOutput, start int64) {
+	ck.recordUntil(input, output, start, time.Now().UnixNano())
+}
+
+// recordAbandoned records a write the Clerk gave up on. It may or may not have been applied, so
+// it is recorded as never returning, which lets the checker place it anywhere after its call.
+func (ck *Clerk) recordAbandoned(input linearizability.KvInput, start int64) {
+	ck.recordUntil(input, linearizability.KvOutput{}, start, math.MaxInt64)
+}
+
+// recordUntil is the helper behind record and recordAbandoned.
+func (ck *Clerk) recordUntil(input linearizability.KvInput, output linearizability.KvOutput, start int64, end int64) {
+	if !ck.cfg.Record && ck.cfg.VerifyEvery <= 0 {
+		return
+	}
+	ck.mu.Lock()
+	ck.history = append(ck.history, linearizability.Operation{
+		Input:  input,
+		Call:   start,
+		Output: output,
+		Return: end,
+	})
+	var history []linearizability.Operation
+	if ck.cfg.VerifyEvery > 0 && len(ck.history)%ck.cfg.VerifyEvery == 0 && ck.violation == nil {
+		history = ck.modeled()
+	}
+	ck.mu.Unlock()
+
+	if history == nil || linearizability.CheckOperations(linearizability.KvModel(), history) {
+		return
+	}
+	if ck.cfg.OnViolation != nil {
+		ck.cfg.OnViolation(history)
+		return
+	}
+	ck.mu.Lock()
+	if ck.violation == nil {
+		ck.violation = &ViolationError{History: history}
+	}
+	ck.mu.Unlock()
+}
+
+// reply is implemented by the reply structure of every RPC the Clerk sends to the servers.
+type reply interface {
+	wrongLeader() bool
+	err() Err
+	redirect() (server int, leaderHint int)
+	load() float64
+}
+
+func (reply *GetReply) wrongLeader() bool         { return reply.WrongLeader }
+func (reply *PutAppendReply) wrongLeader() bool   { return reply.WrongLeader }
+func (reply *BulkLoadReply) wrongLeader() bool    { return reply.WrongLeader }
+func (reply *RenameReply) wrongLeader() bool      { return reply.WrongLeader }
+func (reply *TransformReply) wrongLeader() bool   { return reply.WrongLeader }
+func (reply *CheckAndActReply) wrongLeader() bool { return reply.WrongLeader }
+func (reply *MultiGetReply) wrongLeader() bool    { return reply.WrongLeader }
+func (reply *NextIDReply) wrongLeader() bool      { return reply.WrongLeader }
+func (reply *FindByValueReply) wrongLeader() bool { return reply.WrongLeader }
+func (reply *FlushAllReply) wrongLeader() bool    { return reply.WrongLeader }
+
+func (reply *GetReply) err() Err         { return reply.Err }
+func (reply *PutAppendReply) err() Err   { return reply.Err }
+func (reply *BulkLoadReply) err() Err    { return reply.Err }
+func (reply *RenameReply) err() Err      { return reply.Err }
+func (reply *TransformReply) err() Err   { return reply.Err }
+func (reply *CheckAndActReply) err() Err { return reply.Err }
+func (reply *MultiGetReply) err() Err    { return reply.Err }
+func (reply *NextIDReply) err() Err      { return reply.Err }
+func (reply *FindByValueReply) err() Err { return reply.Err }
+func (reply *FlushAllReply) err() Err    { return reply.Err }
+
+func (reply *GetReply) redirect() (int, int)         { return reply.Server, reply.LeaderHint }
+func (reply *PutAppendReply) redirect() (int, int)   { return reply.Server, reply.LeaderHint }
+func (reply *BulkLoadReply) redirect() (int, int)    { return reply.Server, reply.LeaderHint }
+func (reply *RenameReply) redirect() (int, int)      { return reply.Server, reply.LeaderHint }
+func (reply *TransformReply) redirect() (int, int)   { return reply.Server, reply.LeaderHint }
+func (reply *CheckAndActReply) redirect() (int, int) { return reply.Server, reply.LeaderHint }
+func (reply *MultiGetReply) redirect() (int, int)    { return reply.Server, reply.LeaderHint }
+func (reply *NextIDReply) redirect() (int, int)      { return reply.Server, reply.LeaderHint }
+func (reply *FindByValueReply) redirect() (int, int) { return reply.Server, reply.LeaderHint }
+func (reply *FlushAllReply) redirect() (int, int)    { return reply.Server, reply.LeaderHint }
+
+func (reply *GetReply) load() float64         { return reply.Load }
+func (reply *PutAppendReply) load() float64   { return reply.Load }
+func (reply *BulkLoadReply) load() float64    { return reply.Load }
+func (reply *RenameReply) load() float64      { return reply.Load }
+func (reply *TransformReply) load() float64   { return reply.Load }
+func (reply *CheckAndActReply) load() float64 { return reply.Load }
+func (reply *MultiGetReply) load() float64    { return reply.Load }
+func (reply *NextIDReply) load() float64      { return reply.Load }
+func (reply *FindByValueReply) load() float64 { return reply.Load }
+func (reply *FlushAllReply) load() float64    { return reply.Load }
+
+// id returns the client id to send a request under.
+func (ck *Clerk) id() int64 {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.clientId
+}
+
+// stampKnown sets the Known field of a write's args to whether the group the Clerk talks to
+// has applied a write sent under the client id. It reports false for a read, which carries no
+// such field, since it leaves no state on the servers to expire.
+func (ck *Clerk) stampKnown(args interface{}) bool {
+	ck.mu.Lock()
+	known := ck.known[ck.gid]
+	ck.mu.Unlock()
+	switch args := args.(type) {
+	case *PutAppendArgs:
+		args.Known = known
+	case *BulkLoadArgs:
+		args.Known = known
+	case *RenameArgs:
+		args.Known = known
+	case *TransformArgs:
+		args.Known = known
+	case *CheckAndActArgs:
+		args.Known = known
+	case *NextIDArgs:
+		args.Known = known
+	case *FlushAllArgs:
+		args.Known = known
+	default:
+		return false
+	}
+	return true
+}
+
+// settle records how the group answered a write. An applied write makes the client
+// known to the group; one turned away with ErrExpired means the group dropped the client's
+// state as dormant, so the Clerk starts afresh under a new client id, unknown to every group.
+func (ck *Clerk) settle(err Err) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	switch err {
+	case ErrExpired:
+		ck.clientId = nrand()
+		ck.known = make(map[int]bool)
+	case ErrRejected, ErrWrongGroup:
+		// turned away before reaching the log
+	default:
+		ck.known[ck.gid] = true
+	}
+}
+
+// nextRequestId returns a fresh request id for this client.
+func (ck *Clerk) nextRequestId() int64 {
+	// Locking to ensure that requestId is incremented atomically.
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	requestId := ck.requestId
+	ck.requestId++
+	return requestId
+}
+
+// begin returns the request id and floor of a new operation on keys, and the function to
+// call once it completes. With cfg.Pipeline set, it first waits for the Clerk's earlier
+// operations on any of the keys to complete; otherwise the floor is zero.
+func (ck *Clerk) begin(keys ...string) (int64, int64, func()) {
+	if !ck.cfg.Pipeline {
+		return ck.nextRequestId(), 0, func() {}
+	}
+	ck.mu.Lock()
+	requestId := ck.requestId
+	ck.requestId++
+	ck.inflight[requestId] = true
+	floor := requestId
+	for id := range ck.inflight {
+		if id < floor {
+			floor = id
+		}
+	}
+	done := make(chan struct{})
+	var waits []chan struct{}
+	for _, key := range keys {
+		// tail is done itself if keys names a key twice.
+		if tail, ok := ck.keyTails[key]; ok && tail != done {
+			waits = append(waits, tail)
+		}
+		ck.keyTails[key] = done
+	}
+	ck.mu.Unlock()
+
+	for _, tail := range waits {
+		<-tail
+	}
+	return requestId, floor, func() {
+		ck.mu.Lock()
+		delete(ck.inflight, requestId)
+		for _, key := range keys {
+			if ck.keyTails[key] == done {
+				delete(ck.keyTails, key)
+			}
+		}
+		ck.mu.Unlock()
+		close(done)
+	}
+}
+
+// answer is the outcome of sending a request to one server.
+type answer struct {
+	server    int   // position of the server in ck.servers
+	reply     reply // the server's reply, meaningful only if delivered
+	delivered bool  // false if the RPC was lost or the server unreachable
+}
+
+// accepted reports whether the server took the request as leader.
+func (a answer) accepted() bool {
+	return a.delivered && !a.reply.wrongLeader()
+}
+
+// call sends an RPC to the server believed to be the leader and returns its reply.
+// It keeps trying different servers until one of them accepts the request as leader,
+// going straight to the leader a follower points it at when it can, and backs off and
+// retries the same server while the leader reports ErrBusy or ErrThrottled. With cfg.ShardMap set,
+// it follows the map to another group when a server reports ErrWrongGroup. With cfg.MaxRetries set,
+// it returns a *RetryError once the retries run out, and ErrExpired if the servers had dropped the
+// client's state, see ServerConfig.AckRetention.
+func (ck *Clerk) call(svcMeth string, args interface{}, newReply func() reply) (reply, error) {
+	if ck.cfg.LoadDelay > 0 {
+		time.Sleep(time.Duration(ck.Load() * float64(ck.cfg.LoadDelay)))
+	}
+	followedHint := false
+	failures := RetryError{}
+	for {
+		// stamped afresh for every attempt, since the Clerk may have moved to another group.
+		write := ck.stampKnown(args)
+		var a answer
+		if ck.cfg.HedgeDelay > 0 && len(ck.group()) > 1 {
+			a = ck.callHedged(svcMeth, args, newReply, ck.currentLeader())
+		} else {
+			a = ck.send(svcMeth, args, newReply, ck.currentLeader())
+		}
+		if a.delivered {
+			ck.learn(a)
+		}
+		if a.accepted() {
+			ck.observeLoad(a.reply.load())
+		}
+		wrongGroup := a.delivered && a.reply.err() == ErrWrongGroup && ck.cfg.ShardMap != nil
+		if a.accepted() && a.reply.err() != ErrBusy && a.reply.err() != ErrThrottled && !wrongGroup {
+			ck.setLeader(a.server)
+			if write {
+				ck.settle(a.reply.err())
+			}
+			if a.reply.err() == ErrExpired {
+				// the write may or may not have been applied before the servers dropped the client.
+				return nil, Err(ErrExpired)
+			}
+			return a.reply, nil
+		}
+
+		failures.Attempts++
+		switch {
+		case !a.delivered:
+			failures.Unreachable++
+		case wrongGroup:
+			failures.WrongGroup++
+		case a.reply.wrongLeader():
+			failures.WrongLeader++
+		case a.reply.err() == ErrThrottled:
+			failures.Throttled++
+		default:
+			failures.Busy++
+		}
+		if ck.cfg.MaxRetries > 0 && failures.Attempts > ck.cfg.MaxRetries {
+			return nil, &failures
+		}
+		if wrongGroup {
+			// the map may not know of a reconfiguration yet; give it time before asking again.
+			if !ck.reroute(args) {
+				time.Sleep(busyBackoff)
+			}
+			followedHint = false
+			continue
+		}
+		if a.accepted() {
+			ck.setLeader(a.server)
+			time.Sleep(busyBackoff)
+			continue
+		}
+
+		// follow a hint only once in a row, so two servers with stale hints
+		// can't bounce the request between them.
+		if next, ok := ck.hinted(a); ok && !followedHint {
+			ck.setLeader(next)
+			followedHint = true
+			continue
+		}
+		ck.setLeader((a.server + 1) % len(ck.group()))
+		followedHint = false
+	}
+}
+
+// Load returns the load the leader reported in its latest reply: its uncommitted backlog as a
+// fraction of Raft.MaxUncommittedEntries, from 0 to 1. It stays 0 if the backlog is unbounded.
+func (ck *Clerk) Load() float64 {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.load
+}
+
+// observeLoad remembers the load a leader reported, and passes it to cfg.OnLoad.
+func (ck *Clerk) observeLoad(load float64) {
+	ck.mu.Lock()
+	ck.load = load
+	ck.mu.Unlock()
+	if ck.cfg.OnLoad != nil {
+		ck.cfg.OnLoad(load)
+	}
+}
+
+// currentLeader returns the position in ck.servers of the server believed to be the leader.
+func (ck *Clerk) currentLeader() int {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.leader
+}
+
+// setLeader records the position in ck.servers of the server believed to be the leader.
+func (ck *Clerk) setLeader(server int) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.leader = server
+}
+
+// send sends the request to a single server.
+func (ck *Clerk) send(svcMeth string, args interface{}, newReply func() reply, server int) answer {
+	// server may be a position in a group the Clerk has since moved away from.
+	servers := ck.group()
+	server %= len(servers)
+	reply := newReply()
+	ok := servers[server].Call(svcMeth, args, reply)
+	return answer{server, reply, ok}
+}
+
+// learn remembers which Raft peer answered from a given position in ck.servers,
+// so that leader hints, which name Raft peers, can be followed.
+func (ck *Clerk) learn(a answer) {
+	peer, _ := a.reply.redirect()
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	ck.positions[peer] = a.server
+}
+
+// hinted returns the position in ck.servers of the leader a rejecting server pointed to,
+// if there was a hint and the Clerk knows where that peer is.
+func (ck *Clerk) hinted(a answer) (int, bool) {
+	if !a.delivered {
+		return 0, false
+	}
+	_, hint := a.reply.redirect()
+	if hint < 0 {
+		return 0, false
+	}
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	server, ok := ck.positions[hint]
+	return server, ok && server != a.server
+}
+
+// callHedged sends the request to server first and, if no answer has come back within
+// cfg.HedgeDelay, also to the next server. It returns the first answer from a server that
+// accepted the request as leader, and ignores the other request; since servers deduplicate
+// by request id, the operation is applied once either way. If neither accepts, it returns
+// the last answer received.
+func (ck *Clerk) callHedged(svcMeth string, args interface{}, newReply func() reply, first int) answer {
+	answers := make(chan answer, 2)
+	send := func(server int) {
+		go func() {
+			answers <- ck.send(svcMeth, args, newReply, server)
+		}()
+	}
+
+	send(first)
+	hedge := time.After(ck.cfg.HedgeDelay)
+	var last answer
+	for pending := 1; pending > 0; {
+		select {
+		case a := <-answers:
+			pending--
+			if a.accepted() {
+				return a
+			}
+			last = a
+			if hedge != nil {
+				// the first server answered, just not as leader; no need to hedge
+				return a
+			}
+		case <-hedge:
+			hedge = nil
+			send(first + 1)
+			pending++
+		}
+	}
+	return last
+}
+
+/*
+ * FindLeader returns the index, in the Clerk's list of servers, of a server that believes it is
+ * the leader, preferring the highest term if several do. It keeps polling until it finds one.
+ */
+func (ck *Clerk) FindLeader() int {
+	for {
+		leader, leaderTerm := -1, -1
+		for i, server := range ck.group() {
+			reply := StatusReply{}
+			if !server.Call("KVServer.Status", &StatusArgs{}, &reply) {
+				continue
+			}
+			ck.mu.Lock()
+			ck.positions[reply.Me] = i
+			ck.mu.Unlock()
+			if reply.IsLeader && reply.Term > leaderTerm {
+				leader, leaderTerm = i, reply.Term
+			}
+		}
+		if leader != -1 {
+			ck.setLeader(leader)
+			return leader
+		}
+		time.Sleep(busyBackoff)
+	}
+}
+
 /*
  * Get fetches the current value for a key from the key-value store.
  * It returns an empty string if the key does not exist.
- * The function retries indefinitely in case of errors, trying to find the correct leader.
+ * The function retries indefinitely in case of errors, trying to find the correct leader,
+ * unless ClerkConfig.MaxRetries limits it.
  */
 func (ck *Clerk) Get(key string) string {
+	value, _ := ck.TryGet(key)
+	return value
+}
+
+// TryGet is like Get, but returns a *RetryError if ClerkConfig.MaxRetries runs out.
+func (ck *Clerk) TryGet(key string) (string, error) {
+	return ck.GetWithConsistency(key, Linearizable)
+}
+
+/*
+ * GetWithConsistency is like TryGet, but reads at the given consistency level. A stale read
+ * goes to any server that can be reached, starting from a random one, and a leader read to
+ * the server believed to be the leader. Only linearizable reads are recorded in the history,
+ * since the others need not be linearizable.
+ */
+func (ck *Clerk) GetWithConsistency(key string, level Consistency) (string, error) {
 	args := GetArgs{}
 	args.Key = key
-	args.ClientId = ck.clientId
+	args.ClientId = ck.id()
+	args.Consistency = level
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(key)
+	defer end()
 
-	// Locking to ensure that requestId is incremented atomically.
-	ck.mu.Lock()
-	args.RequestId = ck.requestId
-	ck.requestId++
-	ck.mu.Unlock()
+	start := time.Now().UnixNano()
+	call := ck.call
+	if level == Stale {
+		call = ck.callAny
+	}
+	r, err := call("KVServer.Get", &args, func() reply { return &GetReply{} })
+	if err != nil {
+		return "", err
+	}
+	value := r.(*GetReply).Value
+	if level == Linearizable {
+		ck.record(linearizability.KvInput{Op: 0, Key: key}, linearizability.KvOutput{Value: value}, start)
+	}
+	return value, nil
+}
 
-	// Keep trying different servers until a valid response is received.
+// callAny sends an RPC that any server may answer, starting from a random server and moving
+// on to the next while the RPC is lost or the server is not ready or throttling, pausing after each round of
+// all the servers. With cfg.ShardMap set, it follows the map to another group when a server
+// reports ErrWrongGroup. With cfg.MaxRetries set, it returns a *RetryError once the retries run out.
+func (ck *Clerk) callAny(svcMeth string, args interface{}, newReply func() reply) (reply, error) {
+	server := int(nrand() % int64(len(ck.group())))
+	failures := RetryError{}
 	for {
-		server := ck.servers[ck.leader]
-		reply := GetReply{}
-		ok := server.Call("KVServer.Get", &args, &reply)
-		if ok && !reply.WrongLeader {
-			return reply.Value
+		a := ck.send(svcMeth, args, newReply, server)
+		rerouted := false
+		if a.delivered {
+			ck.learn(a)
+			switch err := a.reply.err(); {
+			case err == ErrNotReady:
+				failures.NotReady++
+			case err == ErrThrottled:
+				failures.Throttled++
+			case err == ErrWrongGroup && ck.cfg.ShardMap != nil:
+				failures.WrongGroup++
+				rerouted = ck.reroute(args)
+			default:
+				return a.reply, nil
+			}
+		} else {
+			failures.Unreachable++
+		}
+		failures.Attempts++
+		if ck.cfg.MaxRetries > 0 && failures.Attempts > ck.cfg.MaxRetries {
+			return nil, &failures
 		}
-		ck.leader = (ck.leader + 1) % len(ck.servers)
+		servers := len(ck.group())
+		if rerouted {
+			server = int(nrand() % int64(servers))
+			continue
+		}
+		server = (a.server + 1) % servers
+		if failures.Attempts%servers == 0 {
+			time.Sleep(busyBackoff)
+		}
+	}
+}
+
+/*
+ * CheckAndAct reads key and, if its value equals expected, writes newValue, all at one point in
+ * the log. A missing key has the empty value. It returns the value key had, whether or not it
+ * was written, and whether it was. The Clerk's history, like the servers' export with
+ * ServerConfig.ExportOperations, records one that acted as a put of newValue, and one that did
+ * not as a get of the value it saw.
+ */
+func (ck *Clerk) CheckAndAct(key string, expected string, newValue string) (string, bool, error) {
+	args := CheckAndActArgs{}
+	args.Key = key
+	args.Expected = expected
+	args.Value = newValue
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(key)
+	defer end()
+
+	start := time.Now().UnixNano()
+	r, err := ck.call("KVServer.CheckAndAct", &args, func() reply { return &CheckAndActReply{} })
+	if err != nil {
+		// it either wrote newValue or left the key alone, as a put that may never have happened.
+		ck.recordAbandoned(linearizability.KvInput{Op: 1, Key: key, Value: newValue}, start)
+		return "", false, err
+	}
+	reply := r.(*CheckAndActReply)
+	switch reply.Err {
+	case OK:
+		ck.record(linearizability.KvInput{Op: 1, Key: key, Value: newValue}, linearizability.KvOutput{}, start)
+	case ErrMismatch:
+		ck.record(linearizability.KvInput{Op: 0, Key: key}, linearizability.KvOutput{Value: reply.Value}, start)
 	}
+	return reply.Value, reply.Err == OK, nil
+}
+
+/*
+ * MultiGet reads several keys at a single linearization point, so the values returned
+ * are a consistent snapshot even while other clients update the keys concurrently.
+ * Keys that do not exist are left out of the result.
+ */
+func (ck *Clerk) MultiGet(keys []string) (map[string]string, error) {
+	args := MultiGetArgs{}
+	args.Keys = keys
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(keys...)
+	defer end()
+
+	start := time.Now().UnixNano()
+	r, err := ck.call("KVServer.MultiGet", &args, func() reply { return &MultiGetReply{} })
+	if err != nil {
+		return nil, err
+	}
+	reply := r.(*MultiGetReply)
+	if reply.Err != OK {
+		return nil, reply.Err
+	}
+	// KvModel checks keys independently, so a multi-key read is recorded as one get per key,
+	// all spanning the same interval.
+	for _, key := range keys {
+		ck.record(linearizability.KvInput{Op: 0, Key: key}, linearizability.KvOutput{Value: reply.Values[key]}, start)
+	}
+	return reply.Values, nil
+}
+
+/*
+ * FindByValue returns the keys that hold value, in key order, read at a single linearization
+ * point like MultiGet. It needs the servers to index keys by value, with
+ * ServerConfig.IndexValues, and fails with ErrNoIndex otherwise. Lookups are not recorded in
+ * the Clerk's history, since KvModel cannot express them.
+ */
+func (ck *Clerk) FindByValue(value string) ([]string, error) {
+	args := FindByValueArgs{}
+	args.Value = value
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin()
+	defer end()
+
+	r, err := ck.call("KVServer.FindByValue", &args, func() reply { return &FindByValueReply{} })
+	if err != nil {
+		return nil, err
+	}
+	reply := r.(*FindByValueReply)
+	if reply.Err != OK {
+		return nil, reply.Err
+	}
+	return reply.Keys, nil
+}
+
+/*
+ * FlushAll deletes every key as a single, atomic operation, which every replica applies at the
+ * same point in its log. Like any other write it is applied at most once even if retried, so a
+ * retry never wipes out what was written after the flush took effect. The servers refuse it
+ * with ErrRejected unless they were started with ServerConfig.AllowFlushAll. With
+ * ClerkConfig.Pipeline set, it is ordered after the Clerk's completed operations only. The
+ * Clerk's history records a flush as a delete of every key it holds operations on; the keys the
+ * Clerk never used already read as missing in KvModel.
+ */
+func (ck *Clerk) FlushAll() error {
+	args := FlushAllArgs{}
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin()
+	defer end()
+
+	start := time.Now().UnixNano()
+	r, err := ck.call("KVServer.FlushAll", &args, func() reply { return &FlushAllReply{} })
+	if err == nil {
+		if reply := r.(*FlushAllReply); reply.Err != OK {
+			return reply.Err
+		}
+	}
+	// KvModel checks keys independently, so a flush is recorded as one delete per key,
+	// all spanning the same interval.
+	for _, key := range ck.historyKeys() {
+		input := linearizability.KvInput{Op: 1, Key: key, Value: ""}
+		if err != nil {
+			ck.recordAbandoned(input, start)
+		} else {
+			ck.record(input, linearizability.KvOutput{}, start)
+		}
+	}
+	return err
 }
 
 /*
@@ -68,28 +782,45 @@ func (ck *Clerk) Get(key string) string {
  * This is a helper function used by both Put and Append.
  */
 func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.TryPutAppend(key, value, op)
+}
+
+/*
+ * TryPutAppend is like PutAppend, but returns a *RetryError if ClerkConfig.MaxRetries runs out.
+ * The operation may still have been applied if its request reached the leader but the reply was lost.
+ */
+func (ck *Clerk) TryPutAppend(key string, value string, op string) error {
+	return ck.PutAppendIdempotent(key, value, op, "")
+}
+
+/*
+ * PutAppendIdempotent is like TryPutAppend, but the write is applied at most once under
+ * idempotencyKey, even if other clients, such as a restarted process, send it again with
+ * the same key. An empty idempotencyKey leaves deduplication to the request id alone.
+ */
+func (ck *Clerk) PutAppendIdempotent(key string, value string, op string, idempotencyKey string) error {
 	args := PutAppendArgs{}
 	args.Key = key
 	args.Value = value
 	args.Command = op
-	args.ClientId = ck.clientId
+	args.IdempotencyKey = idempotencyKey
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(key)
+	defer end()
 
-	// Locking to ensure that requestId is incremented atomically.
-	ck.mu.Lock()
-	args.RequestId = ck.requestId
-	ck.requestId++
-	ck.mu.Unlock()
-
-	// Keep trying different servers until a valid response is received.
-	for {
-		server := ck.servers[ck.leader]
-		reply := PutAppendReply{}
-		ok := server.Call("KVServer.PutAppend", &args, &reply)
-		if ok && !reply.WrongLeader {
-			return
-		}
-		ck.leader = (ck.leader + 1) % len(ck.servers)
+	start := time.Now().UnixNano()
+	_, err := ck.call("KVServer.PutAppend", &args, func() reply { return &PutAppendReply{} })
+	input := linearizability.KvInput{Op: 1, Key: key, Value: value}
+	if op == "append" {
+		input.Op = 2
+	}
+	if err != nil {
+		ck.recordAbandoned(input, start)
+		return err
 	}
+	ck.record(input, linearizability.KvOutput{}, start)
+	return nil
 }
 
 // Put inserts or updates the value for a given key in the key-value store.
@@ -97,7 +828,166 @@ func (ck *Clerk) Put(key string, value string) {
 	ck.PutAppend(key, value, "put")
 }
 
+// Delete removes a key, and its value, from the key-value store.
+func (ck *Clerk) Delete(key string) {
+	// recorded as a put of the empty string, which is how KvModel sees a missing key.
+	ck.PutAppend(key, "", "delete")
+}
+
 // Append appends the given value to the existing value for a given key in the key-value store.
 func (ck *Clerk) Append(key string, value string) {
 	ck.PutAppend(key, value, "append")
 }
+
+/*
+ * BulkLoad puts every key/value pair in pairs as a single, atomic operation.
+ * It is much cheaper than one Put per pair when importing a large dataset,
+ * and like any other operation it is applied at most once even if retried.
+ */
+func (ck *Clerk) BulkLoad(pairs map[string]string) {
+	ck.TryBulkLoad(pairs)
+}
+
+// TryBulkLoad is like BulkLoad, but returns a *RetryError if ClerkConfig.MaxRetries runs out,
+// in which case the pairs may or may not have been loaded.
+func (ck *Clerk) TryBulkLoad(pairs map[string]string) error {
+	args := BulkLoadArgs{}
+	args.Pairs = pairs
+	args.ClientId = ck.id()
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(keys...)
+	defer end()
+
+	start := time.Now().UnixNano()
+	_, err := ck.call("KVServer.BulkLoad", &args, func() reply { return &BulkLoadReply{} })
+	// KvModel checks keys independently, so a bulk load is recorded as one put per key,
+	// all spanning the same interval.
+	for key, value := range pairs {
+		input := linearizability.KvInput{Op: 1, Key: key, Value: value}
+		if err != nil {
+			ck.recordAbandoned(input, start)
+		} else {
+			ck.record(input, linearizability.KvOutput{}, start)
+		}
+	}
+	return err
+}
+
+/*
+ * Rename atomically moves the value of oldKey to newKey, through a single log entry.
+ * It fails with ErrNoKey if oldKey does not exist, and with ErrKeyExists if newKey does.
+ * The Clerk's history records a rename as a put of the empty string to oldKey, which is how
+ * KvModel sees a missing key, and a put of the value moved to newKey. One the Clerk gave up on
+ * may have moved a value it never learnt, so both keys are left out of the history from then on.
+ */
+func (ck *Clerk) Rename(oldKey string, newKey string) (bool, error) {
+	return ck.rename(oldKey, newKey, false)
+}
+
+// RenameOverwrite is like Rename, but replaces the value of newKey if it already exists.
+func (ck *Clerk) RenameOverwrite(oldKey string, newKey string) (bool, error) {
+	return ck.rename(oldKey, newKey, true)
+}
+
+// rename is the helper behind Rename and RenameOverwrite.
+func (ck *Clerk) rename(oldKey string, newKey string, overwrite bool) (bool, error) {
+	args := RenameArgs{}
+	args.OldKey = oldKey
+	args.NewKey = newKey
+	args.Overwrite = overwrite
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(oldKey, newKey)
+	defer end()
+
+	start := time.Now().UnixNano()
+	r, err := ck.call("KVServer.Rename", &args, func() reply { return &RenameReply{} })
+	if err != nil {
+		ck.unmodel(oldKey, newKey)
+		return false, err
+	}
+	reply := r.(*RenameReply)
+	if reply.Err != OK {
+		return false, reply.Err
+	}
+	ck.record(linearizability.KvInput{Op: 1, Key: oldKey, Value: ""}, linearizability.KvOutput{}, start)
+	ck.record(linearizability.KvInput{Op: 1, Key: newKey, Value: reply.Value}, linearizability.KvOutput{}, start)
+	return true, nil
+}
+
+/*
+ * Transform atomically replaces the value of key with the result of the named server-side
+ * transform applied to it and arg, saving the round trip of a read-modify-write. The built-in
+ * transforms are "incr" (add an integer), "max" and "min" (keep the larger or smaller integer),
+ * and "append-unique" (add a member to a comma-separated set). It fails with ErrUnknownTransform
+ * or, leaving the value alone, with ErrBadValue. The Clerk's history, like the servers' export
+ * with ServerConfig.ExportOperations, records a transform as a put of its result. One the Clerk
+ * gave up on left a value it never learnt, so its key is left out of the history from then on.
+ */
+func (ck *Clerk) Transform(key string, transform string, arg string) error {
+	return ck.TransformIdempotent(key, transform, arg, "")
+}
+
+// NextID returns an id from the counter of namespace, unique among all the ids the cluster
+// issues in it and greater than every id issued before it was called. A retry gets the id first
+// reserved for it, so retries neither skip nor reuse ids.
+func (ck *Clerk) NextID(namespace string) (int64, error) {
+	return ck.NextIDBlock(namespace, 1)
+}
+
+// NextIDBlock reserves n consecutive ids from the counter of namespace in a single log entry,
+// and returns the first of them, to amortize the commit over many ids. It fails with
+// ErrBadValue if n is less than one.
+func (ck *Clerk) NextIDBlock(namespace string, n int) (int64, error) {
+	args := NextIDArgs{}
+	args.Namespace = namespace
+	args.Count = int64(n)
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(namespace)
+	defer end()
+
+	reply, err := ck.call("KVServer.NextID", &args, func() reply { return &NextIDReply{} })
+	if err != nil {
+		return 0, err
+	}
+	if err := reply.(*NextIDReply).Err; err != OK {
+		return 0, err
+	}
+	return reply.(*NextIDReply).First, nil
+}
+
+// TransformIdempotent is like Transform, but the transform is applied at most once under
+// idempotencyKey, whichever client sends it, as with PutAppendIdempotent. Its key is left out of
+// the Clerk's history, since the transform that took effect may have been another client's.
+func (ck *Clerk) TransformIdempotent(key string, transform string, arg string, idempotencyKey string) error {
+	args := TransformArgs{}
+	args.Key = key
+	args.Transform = transform
+	args.Arg = arg
+	args.IdempotencyKey = idempotencyKey
+	args.ClientId = ck.id()
+	var end func()
+	args.RequestId, args.Floor, end = ck.begin(key)
+	defer end()
+
+	if idempotencyKey != "" {
+		ck.unmodel(key)
+	}
+	start := time.Now().UnixNano()
+	r, err := ck.call("KVServer.Transform", &args, func() reply { return &TransformReply{} })
+	if err != nil {
+		ck.unmodel(key)
+		return err
+	}
+	reply := r.(*TransformReply)
+	if reply.Err != OK {
+		return reply.Err
+	}
+	ck.record(linearizability.KvInput{Op: 1, Key: key, Value: reply.Value}, linearizability.KvOutput{}, start)
+	return nil
+}
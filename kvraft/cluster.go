@@ -0,0 +1,111 @@
+package raftkv
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ReshiAdavan/Sentinel/raft"
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// A Cluster is a replica group run in process, for applications and tests that embed Sentinel
+// rather than deploy it. Its servers and Clerks talk over the rpc package's simulated network,
+// which delivers every call reliably and at once, and its servers keep their state in memory.
+
+// ClusterConfig configures NewClusterWithConfig. The zero value starts servers with the default
+// ServerConfig that never snapshot.
+type ClusterConfig struct {
+	// Server configures every server of the cluster.
+	Server ServerConfig
+
+	// MaxRaftState, if positive, is the size in bytes of the Raft state at which servers
+	// snapshot. Zero never snapshots.
+	MaxRaftState int
+}
+
+// Cluster is a replica group of KVServers started by NewCluster.
+type Cluster struct {
+	Servers []*KVServer // Servers of the group, by index
+
+	mu       sync.Mutex
+	net      *rpc.Network
+	clerks   int // Number of Clerks made, which names their ends
+	shutdown sync.Once
+}
+
+// NewCluster starts a cluster of n servers with the default configuration.
+func NewCluster(n int) (*Cluster, error) {
+	return NewClusterWithConfig(n, ClusterConfig{})
+}
+
+// NewClusterWithConfig is like NewCluster, but starts every server as cfg describes. If a server
+// fails to start, the ones already started are shut down and the error is returned.
+func NewClusterWithConfig(n int, cfg ClusterConfig) (*Cluster, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("raftkv: a cluster needs at least one server, got %d", n)
+	}
+	maxraftstate := cfg.MaxRaftState
+	if maxraftstate <= 0 {
+		maxraftstate = -1
+	}
+	c := &Cluster{Servers: make([]*KVServer, n), net: rpc.MakeNetwork()}
+	for i := 0; i < n; i++ {
+		ends := make([]*rpc.ClientEnd, n)
+		for j := range ends {
+			ends[j] = c.connect(fmt.Sprintf("server-%d-%d", i, j), j)
+		}
+		kv, err := StartKVServerWithConfig(ends, i, raft.MakePersister(), maxraftstate, cfg.Server)
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+		c.Servers[i] = kv
+
+		srv := rpc.MakeServer()
+		srv.AddService(rpc.MakeService(kv))
+		srv.AddService(rpc.MakeService(kv.rf))
+		c.net.AddServer(i, srv)
+	}
+	return c, nil
+}
+
+// connect makes an end called name and connects it to server i.
+func (c *Cluster) connect(name string, i int) *rpc.ClientEnd {
+	end := c.net.MakeEnd(name)
+	c.net.Connect(name, i)
+	c.net.Enable(name, true)
+	return end
+}
+
+// MakeClerk returns a new Clerk for the cluster, with the default configuration.
+func (c *Cluster) MakeClerk() *Clerk {
+	return c.MakeClerkWithConfig(ClerkConfig{})
+}
+
+// MakeClerkWithConfig is like MakeClerk, but tunes the Clerk through ckcfg.
+func (c *Cluster) MakeClerkWithConfig(ckcfg ClerkConfig) *Clerk {
+	c.mu.Lock()
+	id := c.clerks
+	c.clerks++
+	c.mu.Unlock()
+	ends := make([]*rpc.ClientEnd, len(c.Servers))
+	for i := range ends {
+		ends[i] = c.connect(fmt.Sprintf("clerk-%d-%d", id, i), i)
+	}
+	return MakeClerkWithConfig(ends, ckcfg)
+}
+
+// Shutdown stops every server and then the network; the servers' goroutines exit within an
+// election timeout. The cluster's Clerks must not be used afterwards: their calls fail at once,
+// so an operation retries until ClerkConfig.MaxRetries runs out, or forever without it.
+func (c *Cluster) Shutdown() {
+	c.shutdown.Do(func() {
+		for i, kv := range c.Servers {
+			c.net.DeleteServer(i)
+			if kv != nil {
+				kv.Kill()
+			}
+		}
+		c.net.Cleanup()
+	})
+}
@@ -0,0 +1,101 @@
+package raftkv
+
+import "sort"
+
+// With cfg.CoalesceAppends set, appends from one client to one key that arrive while an earlier
+// such append is still being replicated are queued, and the queue is proposed as a single log
+// entry once that append completes. Under a steady stream of appends the log then grows by one
+// entry per commit rather than one per append.
+
+// appendKey identifies a stream of appends that may be coalesced.
+type appendKey struct {
+	clientId int64
+	key      string
+}
+
+// pendingAppend is an append waiting for the entry it was coalesced into.
+type pendingAppend struct {
+	op   Op
+	done chan Result
+}
+
+// appendQueue holds the appends of one stream waiting behind the entry being replicated.
+type appendQueue struct {
+	pending []pendingAppend
+}
+
+// coalesceAppend queues an append behind any earlier append of its stream still in flight,
+// and returns the result of the entry it ends up in.
+func (kv *KVServer) coalesceAppend(op Op) Result {
+	k := appendKey{op.ClientId, op.Key}
+	p := pendingAppend{op, make(chan Result, 1)}
+
+	kv.mu.Lock()
+	q, inflight := kv.appendQueues[k]
+	if !inflight {
+		q = &appendQueue{}
+		kv.appendQueues[k] = q
+	}
+	q.pending = append(q.pending, p)
+	kv.mu.Unlock()
+
+	if !inflight {
+		// nothing is in flight for this stream, so this caller proposes the queue itself.
+		go kv.drainAppends(k)
+	}
+	return <-p.done
+}
+
+// drainAppends proposes the queued appends of a stream, one entry per batch, until none are left.
+func (kv *KVServer) drainAppends(k appendKey) {
+	for {
+		kv.mu.Lock()
+		q := kv.appendQueues[k]
+		batch := q.pending
+		q.pending = nil
+		if len(batch) == 0 {
+			delete(kv.appendQueues, k)
+			kv.mu.Unlock()
+			return
+		}
+		kv.mu.Unlock()
+
+		result := kv.propose(mergeAppends(batch))
+		for _, p := range batch {
+			p.done <- result
+		}
+	}
+}
+
+// mergeAppends returns the entry for a batch of appends, ordered by request id so that the
+// client's acknowledged request id only grows as they are applied.
+func mergeAppends(batch []pendingAppend) Op {
+	if len(batch) == 1 {
+		return batch[0].op
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].op.RequestId < batch[j].op.RequestId })
+	entry := batch[len(batch)-1].op
+	entry.Value = ""
+	for _, p := range batch {
+		entry.Values = append(entry.Values, p.op.Value)
+		entry.RequestIds = append(entry.RequestIds, p.op.RequestId)
+	}
+	return entry
+}
+
+// splitAppends returns the operations an entry holds: the appends coalesced into it,
+// each deduplicated on its own when applied, or else the entry itself.
+func splitAppends(entry Op) []Op {
+	if len(entry.RequestIds) == 0 {
+		return []Op{entry}
+	}
+	ops := make([]Op, len(entry.RequestIds))
+	for i, requestId := range entry.RequestIds {
+		op := entry
+		op.RequestId = requestId
+		op.Value = entry.Values[i]
+		op.Values, op.RequestIds = nil, nil
+		ops[i] = op
+	}
+	return ops
+}
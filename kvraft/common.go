@@ -1,27 +1,127 @@
 package raftkv
 
+import (
+	"fmt"
+
+	"github.com/ReshiAdavan/Sentinel/linearizability"
+)
+
 // Constants defining possible error states.
 const (
-	OK       = "OK"       // Indicates successful operation.
-	ErrNoKey = "ErrNoKey" // Indicates that the requested key does not exist in the key-value store.
+	OK           = "OK"           // Indicates successful operation.
+	ErrNoKey     = "ErrNoKey"     // Indicates that the requested key does not exist in the key-value store.
+	ErrRejected  = "ErrRejected"  // Indicates that the server refused to propose the operation.
+	ErrKeyExists = "ErrKeyExists" // Indicates that the target key of a rename already exists.
+	ErrBusy      = "ErrBusy"      // Indicates that the leader's backlog is full; the request may be retried.
+	ErrNotReady  = "ErrNotReady"  // Indicates that a restarted server has not caught up enough to serve stale reads.
+	ErrThrottled = "ErrThrottled" // Indicates that the leader turned the client away for exceeding its rate; the request may be retried.
+	ErrExpired   = "ErrExpired"   // Indicates that the servers dropped the client's state as dormant; the request may or may not have been applied.
+
+	ErrUnknownTransform = "ErrUnknownTransform" // Indicates that no transform has the requested name.
+	ErrBadValue         = "ErrBadValue"         // Indicates that a transform could not use the key's value or its argument.
+	ErrMismatch         = "ErrMismatch"         // Indicates that a check-and-act found a value other than the expected one.
+	ErrLocked           = "ErrLocked"           // Indicates that another owner holds the lock, see lock.go.
+	ErrNotLockOwner     = "ErrNotLockOwner"     // Indicates that the lock being released is not held by the caller.
+	ErrWrongGroup       = "ErrWrongGroup"       // Indicates that the server's replica group does not serve the key, see shard.go.
+	ErrNoIndex          = "ErrNoIndex"          // Indicates that the server does not index keys by value, see index.go.
 )
 
 // Err is a custom type representing an error string.
 type Err string
 
+// Error makes Err usable as an error.
+func (e Err) Error() string {
+	return string(e)
+}
+
+// Consistency is the guarantee a request asks for. The zero value is Linearizable.
+type Consistency int
+
+const (
+	// Linearizable reads reflect every write that completed before they were sent. With
+	// ServerConfig.LinearizableReads the leader serves them from its local state once it has
+	// applied up to a Raft ReadIndex, or to the commit index under its lease with
+	// ServerConfig.LeaseReads; otherwise, or while it has not yet committed an entry in its
+	// term, they go through the log.
+	Linearizable Consistency = iota
+	// Leader reads are served from the local state of a server that believes it is the leader,
+	// without confirming it with a quorum, so a deposed leader may return a stale value.
+	Leader
+	// Stale reads are served from the local state of any server, which may lag behind.
+	Stale
+)
+
+// ViolationError is returned by Clerk.Violation once a check of the Clerk's history, with
+// ClerkConfig.VerifyEvery set and no ClerkConfig.OnViolation, has found it is not linearizable.
+type ViolationError struct {
+	History []linearizability.Operation // History as it was when the check failed.
+}
+
+// Error reports how many operations the history that failed the check held.
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("raftkv: history of %d operations observed by the clerk is not linearizable", len(e.History))
+}
+
+// RetryError is returned by a Clerk operation that gave up after ClerkConfig.MaxRetries retries.
+// It counts how each of the failed attempts went, so the caller can tell a cluster that cannot
+// be reached from one that has no leader.
+type RetryError struct {
+	Attempts    int // Requests sent, counting the first one.
+	Unreachable int // Attempts whose RPC was lost or whose server could not be reached.
+	WrongLeader int // Attempts turned away by a server that is not the leader.
+	Busy        int // Attempts the leader refused with ErrBusy.
+	NotReady    int // Stale reads refused with ErrNotReady by a server still catching up.
+	Throttled   int // Attempts the leader refused with ErrThrottled.
+	WrongGroup  int // Attempts turned away by a server whose group does not serve the key.
+}
+
+// Error describes the failures that led the Clerk to give up.
+func (e *RetryError) Error() string {
+	var cause string
+	switch e.Attempts {
+	case e.Unreachable:
+		cause = "no server could be reached"
+	case e.WrongLeader:
+		cause = "no server accepted the request as leader"
+	case e.Busy:
+		cause = "the leader stayed busy"
+	case e.NotReady:
+		cause = "no server was ready to serve the read"
+	case e.Throttled:
+		cause = "the leader kept throttling the client"
+	case e.WrongGroup:
+		cause = "no group the shard map named served the key"
+	default:
+		cause = fmt.Sprintf("%d unreachable, %d wrong leader, %d busy, %d not ready, %d throttled, %d wrong group",
+			e.Unreachable, e.WrongLeader, e.Busy, e.NotReady, e.Throttled, e.WrongGroup)
+	}
+	return fmt.Sprintf("raftkv: gave up after %d attempts: %s", e.Attempts, cause)
+}
+
 // PutAppendArgs defines the arguments structure for Put and Append operations.
 type PutAppendArgs struct {
 	Key       string // Key in the key-value store.
 	Value     string // Value to be associated with the key.
-	Command   string // Operation type: "Put" or "Append".
+	Command   string // Operation type: "put", "append", or "delete".
 	ClientId  int64  // Unique client identifier to differentiate requests.
 	RequestId int64  // Unique request identifier for idempotency.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+	Known     bool   // The client has had a write applied before, so the servers dropped its state if they have none.
+
+	IdempotencyKey string // If set, the write is applied at most once under this key, whichever client sends it.
+
+	// Consistency is accepted for symmetry with GetArgs: a write is only acknowledged once it
+	// has been committed and applied through the log, so it is linearizable at every level.
+	Consistency Consistency
 }
 
 // PutAppendReply defines the reply structure for Put and Append operations.
 type PutAppendReply struct {
-	WrongLeader bool // Flag to indicate if the operation reached a non-leader server.
-	Err         Err  // Error status of the operation.
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
 }
 
 // GetArgs defines the arguments structure for Get operation.
@@ -29,11 +129,195 @@ type GetArgs struct {
 	Key       string // Key to retrieve from the key-value store.
 	ClientId  int64  // Unique client identifier.
 	RequestId int64  // Unique request identifier.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+
+	Consistency Consistency // Guarantee the read asks for.
 }
 
 // GetReply defines the reply structure for Get operation.
 type GetReply struct {
-	WrongLeader bool   // Flag to indicate if the operation reached a non-leader server.
-	Err         Err    // Error status of the operation.
-	Value       string // The value retrieved for the key, if any.
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
+	Value       string  // The value retrieved for the key, if any.
+}
+
+// BulkLoadArgs defines the arguments structure for a BulkLoad operation.
+type BulkLoadArgs struct {
+	Pairs     map[string]string // Key/value pairs to put, applied as a single operation.
+	ClientId  int64             // Unique client identifier.
+	RequestId int64             // Unique request identifier for idempotency.
+	Floor     int64             // If positive, every request below Floor has completed at the Clerk.
+	Known     bool              // The client has had a write applied before, so the servers dropped its state if they have none.
+}
+
+// BulkLoadReply defines the reply structure for a BulkLoad operation.
+type BulkLoadReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
+}
+
+// RenameArgs defines the arguments structure for a Rename operation.
+type RenameArgs struct {
+	OldKey    string // Key whose value is moved.
+	NewKey    string // Key the value is moved to.
+	Overwrite bool   // Replace the value of NewKey if it already exists.
+	ClientId  int64  // Unique client identifier.
+	RequestId int64  // Unique request identifier for idempotency.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+	Known     bool   // The client has had a write applied before, so the servers dropped its state if they have none.
+}
+
+// RenameReply defines the reply structure for a Rename operation.
+type RenameReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
+	Value       string  // Value moved to NewKey, if Err is OK.
+}
+
+// TransformArgs defines the arguments structure for a Transform operation.
+type TransformArgs struct {
+	Key       string // Key whose value is transformed.
+	Transform string // Name of the transform, e.g. "incr" or "max".
+	Arg       string // Argument passed to the transform.
+	ClientId  int64  // Unique client identifier.
+	RequestId int64  // Unique request identifier for idempotency.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+	Known     bool   // The client has had a write applied before, so the servers dropped its state if they have none.
+
+	IdempotencyKey string // If set, the transform is applied at most once under this key, whichever client sends it.
+}
+
+// TransformReply defines the reply structure for a Transform operation.
+type TransformReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
+	Value       string  // Value the transform left Key holding, if Err is OK.
+}
+
+// CheckAndActArgs defines the arguments structure for a CheckAndAct operation.
+type CheckAndActArgs struct {
+	Key       string // Key that is read and conditionally written.
+	Expected  string // Value Key must have for the write to happen; empty matches a missing key.
+	Value     string // Value written if Key has the expected value.
+	ClientId  int64  // Unique client identifier.
+	RequestId int64  // Unique request identifier for idempotency.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+	Known     bool   // The client has had a write applied before, so the servers dropped its state if they have none.
+}
+
+// CheckAndActReply defines the reply structure for a CheckAndAct operation.
+type CheckAndActReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // OK if the value was written, ErrMismatch if not.
+	Value       string  // Value Key had when the operation was applied, whether or not it was written.
+}
+
+// NextIDArgs defines the arguments structure for a NextID operation.
+type NextIDArgs struct {
+	Namespace string // Namespace whose counter the ids are taken from.
+	Count     int64  // Number of consecutive ids to reserve; at least one.
+	ClientId  int64  // Unique client identifier.
+	RequestId int64  // Unique request identifier for idempotency.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+	Known     bool   // The client has had a write applied before, so the servers dropped its state if they have none.
+}
+
+// NextIDReply defines the reply structure for a NextID operation.
+type NextIDReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // Error status of the operation.
+	First       int64   // First of the Count ids reserved; ids start at 1 in every namespace.
+}
+
+// MultiGetArgs defines the arguments structure for a MultiGet operation.
+type MultiGetArgs struct {
+	Keys      []string // Keys to read at a single point in time.
+	ClientId  int64    // Unique client identifier.
+	RequestId int64    // Unique request identifier.
+	Floor     int64    // If positive, every request below Floor has completed at the Clerk.
+}
+
+// MultiGetReply defines the reply structure for a MultiGet operation.
+type MultiGetReply struct {
+	WrongLeader bool              // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int               // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int               // Index, among the Raft peers, of the server that replied.
+	Load        float64           // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err               // Error status of the operation.
+	Values      map[string]string // Values of the keys that exist; missing keys are left out.
+}
+
+// FindByValueArgs defines the arguments structure for a FindByValue operation.
+type FindByValueArgs struct {
+	Value     string // Value whose keys are looked up.
+	ClientId  int64  // Unique client identifier.
+	RequestId int64  // Unique request identifier.
+	Floor     int64  // If positive, every request below Floor has completed at the Clerk.
+}
+
+// FindByValueReply defines the reply structure for a FindByValue operation.
+type FindByValueReply struct {
+	WrongLeader bool     // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int      // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int      // Index, among the Raft peers, of the server that replied.
+	Load        float64  // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err      // Error status of the operation.
+	Keys        []string // Keys holding the value, in key order.
+}
+
+// FlushAllArgs defines the arguments structure for a FlushAll operation.
+type FlushAllArgs struct {
+	ClientId  int64 // Unique client identifier.
+	RequestId int64 // Unique request identifier for idempotency.
+	Floor     int64 // If positive, every request below Floor has completed at the Clerk.
+	Known     bool  // The client has had a write applied before, so the servers dropped its state if they have none.
+}
+
+// FlushAllReply defines the reply structure for a FlushAll operation.
+type FlushAllReply struct {
+	WrongLeader bool    // Flag to indicate if the operation reached a non-leader server.
+	LeaderHint  int     // With WrongLeader, the server's guess at the leader's index among the Raft peers, or -1.
+	Server      int     // Index, among the Raft peers, of the server that replied.
+	Load        float64 // Leader's uncommitted backlog as a fraction of its limit, from 0 to 1; 0 if unbounded.
+	Err         Err     // ErrRejected if the servers do not allow flushes.
+}
+
+// StatusArgs defines the arguments structure for a Status request.
+type StatusArgs struct{}
+
+// StatusReply defines the reply structure for a Status request.
+type StatusReply struct {
+	Me       int  // Index of the server among its Raft peers.
+	Term     int  // Current Raft term of the server.
+	IsLeader bool // True if the server believes it is the leader.
+	Paused   bool // True if the server's Raft peer is paused, see raft.Raft.Pause.
+}
+
+// TransferLeadershipArgs defines the arguments structure for a TransferLeadership request.
+type TransferLeadershipArgs struct {
+	Target int // Index, among the Raft peers, of the server to hand leadership to.
+}
+
+// TransferLeadershipReply defines the reply structure for a TransferLeadership request.
+type TransferLeadershipReply struct {
+	WrongLeader bool // Flag to indicate if the request reached a non-leader server.
+	Err         Err  // ErrRejected if the leader could not hand over leadership.
 }
@@ -1,6 +1,7 @@
 package raftkv
 
 import (
+	"bytes"
 	"os"
 	"testing"
 
@@ -9,13 +10,21 @@ import (
 	// import "log"
 	crand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+	"github.com/ReshiAdavan/Sentinel/linearizability"
 	"github.com/ReshiAdavan/Sentinel/raft"
 )
 
@@ -50,7 +59,8 @@ type config struct {
 	clerks       map[*Clerk][]string
 	nextClientId int
 	maxraftstate int
-	testNum      int32 // for two-minute timeout
+	servercfg    ServerConfig // passed to every server started by StartServer
+	testNum      int32        // for two-minute timeout
 	// begin()/end() statistics
 	t0    time.Time
 	rpcs0 int       // rpcTotal() at start of test
@@ -177,6 +187,11 @@ func (cfg *config) partition(p1 []int, p2 []int) {
 
 // makeClient creates a clerk with specific server names and connections.
 func (cfg *config) makeClient(to []int) *Clerk {
+	return cfg.makeClientWithConfig(to, ClerkConfig{})
+}
+
+// makeClientWithConfig is like makeClient, but creates the clerk with ckcfg.
+func (cfg *config) makeClientWithConfig(to []int, ckcfg ClerkConfig) *Clerk {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
@@ -189,7 +204,7 @@ func (cfg *config) makeClient(to []int) *Clerk {
 		cfg.net.Connect(endnames[j], j)
 	}
 
-	ck := MakeClerk(random_handles(ends))
+	ck := MakeClerkWithConfig(random_handles(ends), ckcfg)
 	cfg.clerks[ck] = endnames
 	cfg.nextClientId++
 	cfg.ConnectClientUnlocked(ck, to)
@@ -302,7 +317,11 @@ func (cfg *config) StartServer(i int) {
 	}
 	cfg.mu.Unlock()
 
-	cfg.kvservers[i] = StartKVServer(ends, i, cfg.saved[i], cfg.maxraftstate)
+	kv, err := StartKVServerWithConfig(ends, i, cfg.saved[i], cfg.maxraftstate, cfg.servercfg)
+	if err != nil {
+		cfg.t.Fatalf("starting server %d: %v", i, err)
+	}
+	cfg.kvservers[i] = kv
 
 	kvsvc := rpc.MakeService(cfg.kvservers[i])
 	rfsvc := rpc.MakeService(cfg.kvservers[i].rf)
@@ -317,7 +336,7 @@ func (cfg *config) Leader() (bool, int) {
 	defer cfg.mu.Unlock()
 
 	for i := 0; i < cfg.n; i++ {
-		_, is_leader := cfg.kvservers[i].rf.GetState()
+		_, is_leader, _ := cfg.kvservers[i].rf.GetState()
 		if is_leader {
 			return true, i
 		}
@@ -348,6 +367,11 @@ func (cfg *config) make_partition() ([]int, []int) {
 var ncpu_once sync.Once
 
 func make_config(t *testing.T, n int, unreliable bool, maxraftstate int) *config {
+	return make_config_with(t, n, unreliable, maxraftstate, ServerConfig{})
+}
+
+// make_config_with is like make_config, but starts every server with servercfg.
+func make_config_with(t *testing.T, n int, unreliable bool, maxraftstate int, servercfg ServerConfig) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -364,6 +388,7 @@ func make_config(t *testing.T, n int, unreliable bool, maxraftstate int) *config
 	cfg.clerks = make(map[*Clerk][]string)
 	cfg.nextClientId = cfg.n + 1000 // client ids start 1000 above the highest serverid
 	cfg.maxraftstate = maxraftstate
+	cfg.servercfg = servercfg
 
 	// create a full set of KV servers.
 	for i := 0; i < cfg.n; i++ {
@@ -418,3 +443,3054 @@ func (cfg *config) end() {
 		fmt.Printf("  %4.1f  %d %5d %4d\n", t, npeers, nrpc, ops)
 	}
 }
+
+// checkIdleSnapshot writes nops values, then leaves the cluster idle and checks that every
+// server compacts its log into a snapshot within a few multiples of idle, though the Raft state
+// never reached maxraftstate. The cluster must have been made with IdleSnapshotAfter set to idle.
+func (cfg *config) checkIdleSnapshot(nops int, idle time.Duration) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	values := make([]string, nops)
+	for i := range values {
+		values[i] = randstring(20)
+		ck.Put(strconv.Itoa(i), values[i])
+	}
+	busy := cfg.LogSize()
+
+	deadline := time.Now().Add(4 * idle)
+	for cfg.LogSize() > busy/4 {
+		if time.Now().After(deadline) {
+			cfg.t.Fatalf("log still %d bytes after %v idle, was %d", cfg.LogSize(), 4*idle, busy)
+		}
+		time.Sleep(idle / 4)
+	}
+	for i := 0; i < cfg.n; i++ {
+		if cfg.saved[i].SnapshotSize() == 0 {
+			cfg.t.Fatalf("server %d has not snapshotted after %v idle", i, 4*idle)
+		}
+	}
+	for i, value := range values {
+		if v := ck.Get(strconv.Itoa(i)); v != value {
+			cfg.t.Fatalf("get %d after idle snapshot: got %q, want %q", i, v, value)
+		}
+	}
+}
+
+// checkSnapshotVerification checks VerifySnapshot on real snapshots and a misindexed one. It
+// writes nops values and waits for every server to take an idle snapshot, which must verify.
+// Then it has one server hand Raft its state labeled with the index after it, as a server
+// that captured the state at the wrong index would, and that snapshot must be refused. It
+// leaves that server's persisted state misindexed, so the server must not be restarted
+// afterwards. Expects cfg.servercfg.IdleSnapshotAfter to be set, and a maxraftstate large
+// enough that no snapshot is taken for size.
+func (cfg *config) checkSnapshotVerification(nops int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	for i := 0; i < nops; i++ {
+		ck.Put(strconv.Itoa(i), randstring(20))
+	}
+
+	idle := cfg.servercfg.IdleSnapshotAfter
+	for i := 0; i < cfg.n; i++ {
+		for deadline := time.Now().Add(4 * idle); cfg.saved[i].SnapshotSize() == 0; time.Sleep(idle / 4) {
+			if time.Now().After(deadline) {
+				cfg.t.Fatalf("server %d has not snapshotted after %v idle", i, 4*idle)
+			}
+		}
+		if err := VerifySnapshot(cfg.saved[i], cfg.servercfg); err != nil {
+			cfg.t.Fatalf("server %d: %v", i, err)
+		}
+	}
+
+	cfg.mu.Lock()
+	kv := cfg.kvservers[0]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	data, index := kv.encodeSnapshot(), kv.lastApplied
+	kv.mu.Unlock()
+	ck.Put("misindexed", "x")
+	kv.mu.Lock()
+	for kv.lastApplied <= index {
+		kv.applyCond.Wait()
+	}
+	kv.mu.Unlock()
+	kv.rf.CreateSnapshot(data, index+1)
+	if err := VerifySnapshot(cfg.saved[0], cfg.servercfg); err == nil {
+		cfg.t.Fatalf("a snapshot of the state at index %d labeled %d verified", index, index+1)
+	}
+}
+
+// encodeSnapshotV1 encodes the server's state in the layout of version 1, from before
+// snapshots carried a version: encodeSnapshot's fields, without the version in front.
+// Must be called with kv.mu held.
+func (kv *KVServer) encodeSnapshotV1() []byte {
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(kv.sm.Snapshot())
+	e.Encode(kv.encodeAck())
+	e.Encode(kv.lastErr)
+	e.Encode(kv.window)
+	e.Encode(kv.floor)
+	e.Encode(kv.idempotent)
+	e.Encode(kv.remembered)
+	e.Encode(kv.sequences)
+	e.Encode(kv.issued)
+	e.Encode(kv.results)
+	e.Encode(kv.lastApplied)
+	return w.Bytes()
+}
+
+// checkSnapshotV1 checks that a server restarts from a snapshot written in version 1 of both
+// layouts, Raft's container and the server's state, as a server upgraded from that version
+// would find on disk. It writes nkeys values, replaces server 0's snapshot with its state in
+// the old layouts, which VerifySnapshot must accept, and restarts it: the server must serve
+// every value from the snapshot, and the cluster must go on taking writes.
+func (cfg *config) checkSnapshotV1(nkeys int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	values := make(map[string]string)
+	for i := 0; i < nkeys; i++ {
+		key := strconv.Itoa(i)
+		values[key] = randstring(20)
+		ck.Put(key, values[key])
+	}
+
+	cfg.mu.Lock()
+	kv := cfg.kvservers[0]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	data, index := kv.encodeSnapshotV1(), kv.lastApplied
+	kv.mu.Unlock()
+	entry, ok := kv.rf.GetAtIndex(index)
+	if !ok {
+		cfg.t.Fatalf("server 0 no longer holds index %d", index)
+	}
+	// Raft's version 1 container: the index and term, gob-encoded, directly followed by the data
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(index)
+	e.Encode(entry.Term)
+	snapshot := append(w.Bytes(), data...)
+	if parsed, err := raft.ParseSnapshot(snapshot); err != nil || parsed.Version != 1 {
+		cfg.t.Fatalf("the old container parsed as version %d: %v", parsed.Version, err)
+	}
+	decoded, err := kv.decodeSnapshot(data, index)
+	if err != nil {
+		cfg.t.Fatalf("decoding a version 1 snapshot: %v", err)
+	}
+	if decoded.recorded != index {
+		cfg.t.Fatalf("a version 1 snapshot at index %d decoded as the state at %d", index, decoded.recorded)
+	}
+
+	cfg.ShutdownServer(0)
+	cfg.saved[0].SaveStateAndSnapshot(cfg.saved[0].ReadRaftState(), snapshot)
+	if err := VerifySnapshot(cfg.saved[0], cfg.servercfg); err != nil {
+		cfg.t.Fatalf("a version 1 snapshot failed verification: %v", err)
+	}
+	cfg.StartServer(0)
+	cfg.ConnectAll()
+
+	cfg.mu.Lock()
+	kv = cfg.kvservers[0]
+	cfg.mu.Unlock()
+	for key, value := range values {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			args, reply := GetArgs{Key: key, Consistency: Stale}, GetReply{}
+			kv.Get(&args, &reply)
+			if reply.Err == OK {
+				if reply.Value != value {
+					cfg.t.Fatalf("server 0 restarted from a version 1 snapshot: get %s got %q, want %q", key, reply.Value, value)
+				}
+				break
+			}
+			if time.Since(start) > 2*time.Second {
+				cfg.t.Fatalf("server 0 did not serve %s after restarting from a version 1 snapshot: %v", key, reply.Err)
+			}
+		}
+	}
+	ck.Put("after", "x")
+	if v := ck.Get("after"); v != "x" {
+		cfg.t.Fatalf("get after restart: got %q, want %q", v, "x")
+	}
+}
+
+// checkBulkLoad loads nkeys keys with a single BulkLoad and checks that it took exactly one log
+// entry: every server's applied index advances by one, and the client's entry in every
+// server's duplicate table by one request. Every server must then hold every key with its
+// value, and the keys must read back through the Clerk.
+func (cfg *config) checkBulkLoad(nkeys int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("before", "x")
+
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	applied, acked := kv.lastApplied, kv.ack[ck.id()]
+	kv.mu.Unlock()
+
+	pairs := make(map[string]string, nkeys)
+	for i := 0; i < nkeys; i++ {
+		pairs["bulk"+strconv.Itoa(i)] = randstring(8)
+	}
+	ck.BulkLoad(pairs)
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !server.waitApplied(applied+1, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied the bulk load at index %d", i, applied+1)
+		}
+		server.mu.Lock()
+		index, ack := server.lastApplied, server.ack[ck.id()]
+		data := server.sm.(*kvStore).data
+		missing := 0
+		for key, value := range pairs {
+			if data[key] != value {
+				missing++
+			}
+		}
+		server.mu.Unlock()
+		if index != applied+1 || ack != acked+1 {
+			cfg.t.Fatalf("server %d applied up to %d with request %d acknowledged after the bulk load; want %d and %d",
+				i, index, ack, applied+1, acked+1)
+		}
+		if missing > 0 {
+			cfg.t.Fatalf("server %d is missing %d of the %d bulk-loaded keys", i, missing, nkeys)
+		}
+	}
+	for i := 0; i < nkeys; i += nkeys / 10 {
+		key := "bulk" + strconv.Itoa(i)
+		if value := ck.Get(key); value != pairs[key] {
+			cfg.t.Fatalf("get %s returned %q after the bulk load; want %q", key, value, pairs[key])
+		}
+	}
+}
+
+// checkMultiGetPairs has one clerk write keys "x" and "y" together with BulkLoad, a new value
+// each time, for d, while nreaders other clerks read both with MultiGet. Every read must return
+// the two keys with the same value, or neither, never one write's x with another's y, and the
+// readers together must see several different values, so that reads overlapped the writes.
+func (cfg *config) checkMultiGetPairs(nreaders int, d time.Duration) {
+	var done int32
+	written := make(chan struct{})
+	go func() {
+		writer := cfg.makeClient(cfg.All())
+		defer cfg.deleteClient(writer)
+		for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+			v := strconv.Itoa(i)
+			writer.BulkLoad(map[string]string{"x": v, "y": v})
+			cfg.op()
+		}
+		close(written)
+	}()
+
+	type outcome struct {
+		seen map[string]bool
+		torn map[string]string
+	}
+	outcomes := make(chan outcome, nreaders)
+	for r := 0; r < nreaders; r++ {
+		go func() {
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			o := outcome{seen: make(map[string]bool)}
+			for atomic.LoadInt32(&done) == 0 {
+				values, err := ck.MultiGet([]string{"x", "y"})
+				cfg.op()
+				if err != nil {
+					continue
+				}
+				if values["x"] != values["y"] || len(values) == 1 {
+					o.torn = values
+					break
+				}
+				o.seen[values["x"]] = true
+			}
+			outcomes <- o
+		}()
+	}
+	time.Sleep(d)
+	atomic.StoreInt32(&done, 1)
+	<-written
+
+	seen := make(map[string]bool)
+	for r := 0; r < nreaders; r++ {
+		o := <-outcomes
+		if o.torn != nil {
+			cfg.t.Fatalf("MultiGet returned a half-updated pair: %v", o.torn)
+		}
+		for v := range o.seen {
+			seen[v] = true
+		}
+	}
+	if len(seen) < 3 {
+		cfg.t.Fatalf("readers saw only %d values of the pair in %v, too few to overlap the writes", len(seen), d)
+	}
+}
+
+// checkApplyLatency measures the mean apply latency the leader reports over nops puts, first
+// as they are, and then with replication delayed: both followers are paused for delay while
+// each put is under way, so that it cannot commit until they resume. The delayed mean must
+// exceed the first by at least half the delay, and every delayed put must land in a bucket
+// past half the delay.
+func (cfg *config) checkApplyLatency(nops int, delay time.Duration) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("k", "warm")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	var followers []*raft.Raft
+	for i := 0; i < cfg.n; i++ {
+		if i != leader {
+			followers = append(followers, cfg.kvservers[i].rf)
+		}
+	}
+	cfg.mu.Unlock()
+
+	// measure returns the mean latency of nops puts, each made by put, and how
+	// many of them were observed in a bucket past half the delay.
+	measure := func(put func(i int)) (time.Duration, int64) {
+		before := kv.Stats().ApplyLatency
+		for i := 0; i < nops; i++ {
+			put(i)
+			cfg.op()
+		}
+		after := kv.Stats().ApplyLatency
+		if after.Count-before.Count < int64(nops) {
+			cfg.t.Fatalf("leader %d observed %d apply latencies for %d puts", leader, after.Count-before.Count, nops)
+		}
+		var slow int64
+		for i := 1; i < len(after.Counts); i++ {
+			if after.Bounds[i-1] >= delay/2 {
+				slow += after.Counts[i] - before.Counts[i]
+			}
+		}
+		return (after.Sum - before.Sum) / time.Duration(after.Count-before.Count), slow
+	}
+
+	quiet, _ := measure(func(i int) { ck.Put("k", strconv.Itoa(i)) })
+	delayed, slow := measure(func(i int) {
+		for _, rf := range followers {
+			rf.Pause()
+		}
+		done := make(chan struct{})
+		go func() {
+			ck.Put("k", strconv.Itoa(i))
+			close(done)
+		}()
+		time.Sleep(delay)
+		for _, rf := range followers {
+			rf.Resume()
+		}
+		<-done
+	})
+	if delayed < quiet+delay/2 {
+		cfg.t.Fatalf("mean apply latency went from %v to %v with replication delayed by %v", quiet, delayed, delay)
+	}
+	if slow < int64(nops) {
+		cfg.t.Fatalf("only %d of %d delayed puts were observed slower than %v", slow, nops, delay/2)
+	}
+}
+
+// checkTombstoneCompaction writes nkeys keys and then, over several rounds, deletes a share of
+// them and writes one more. After each round it waits for the leader to propose and apply a
+// compaction, and checks that every replica has applied it at the same point: each holds
+// exactly the keys left, has no deletes pending, and has moved its data into a new map.
+// Expects cfg.servercfg.CompactionInterval to be set.
+func (cfg *config) checkTombstoneCompaction(nkeys int, rounds int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	want := make(map[string]string)
+	for i := 0; i < nkeys; i++ {
+		key := strconv.Itoa(i)
+		want[key] = randstring(20)
+		ck.Put(key, want[key])
+		cfg.op()
+	}
+
+	// dataOf returns server i's data and whether it has deletes pending.
+	dataOf := func(i int) (map[string]string, bool) {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		store := server.sm.(*kvStore)
+		return store.data, store.deletes > 0
+	}
+	maps := make([]uintptr, cfg.n)
+	for i := 0; i < cfg.n; i++ {
+		data, _ := dataOf(i)
+		maps[i] = reflect.ValueOf(data).Pointer()
+	}
+
+	for r := 0; r < rounds; r++ {
+		for i := r; i < nkeys; i += rounds + 1 {
+			key := strconv.Itoa(i)
+			ck.Delete(key)
+			delete(want, key)
+			cfg.op()
+		}
+		key := "round" + strconv.Itoa(r)
+		want[key] = strconv.Itoa(r)
+		ck.Put(key, want[key])
+
+		// the leader has compacted once it has no deletes pending, and every replica that has
+		// applied as far as it has compacted at the same point.
+		_, leader := cfg.Leader()
+		cfg.mu.Lock()
+		kv := cfg.kvservers[leader]
+		cfg.mu.Unlock()
+		var applied int
+		for start := time.Now(); ; time.Sleep(cfg.servercfg.CompactionInterval) {
+			_, pending := dataOf(leader)
+			kv.mu.Lock()
+			applied = kv.lastApplied
+			kv.mu.Unlock()
+			if !pending {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				cfg.t.Fatalf("round %d: leader %d has not compacted its deleted keys", r, leader)
+			}
+		}
+		for i := 0; i < cfg.n; i++ {
+			cfg.mu.Lock()
+			server := cfg.kvservers[i]
+			cfg.mu.Unlock()
+			if !server.waitApplied(applied, 5*time.Second) {
+				cfg.t.Fatalf("round %d: server %d has not applied index %d", r, i, applied)
+			}
+			data, pending := dataOf(i)
+			server.mu.Lock()
+			same := reflect.DeepEqual(data, want)
+			server.mu.Unlock()
+			if !same {
+				cfg.t.Fatalf("round %d: server %d holds %d keys; want %d", r, i, len(data), len(want))
+			}
+			if pending {
+				cfg.t.Fatalf("round %d: server %d still has deletes pending at index %d", r, i, applied)
+			}
+			if m := reflect.ValueOf(data).Pointer(); m == maps[i] {
+				cfg.t.Fatalf("round %d: server %d kept its data in the same map", r, i)
+			} else {
+				maps[i] = m
+			}
+		}
+	}
+}
+
+// checkHedgedRequests has a Clerk with HedgeDelay set to hedge make nops appends, each time
+// believing the leader to be the server just before it in its list. That server is cut off from
+// the Clerk on a network with long delays, so a request sent to it only fails after up to
+// seconds. Every append must still complete within bound, which only the hedge to the leader
+// makes possible, and must leave the Clerk pointing at the leader. Last, the key must hold every
+// append once.
+func (cfg *config) checkHedgedRequests(nops int, hedge time.Duration, bound time.Duration) {
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{HedgeDelay: hedge})
+	defer cfg.deleteClient(ck)
+	ck.Put("k", "")
+
+	leader := ck.FindLeader()
+	slowAt := (leader + cfg.n - 1) % cfg.n
+	slow := -1
+	ck.mu.Lock()
+	for peer, at := range ck.positions {
+		if at == slowAt {
+			slow = peer
+		}
+	}
+	ck.mu.Unlock()
+	if slow < 0 {
+		cfg.t.Fatalf("the Clerk does not know which server is at position %d", slowAt)
+	}
+	cfg.net.LongDelays(true)
+	cfg.DisconnectClient(ck, []int{slow})
+
+	want := ""
+	for i := 0; i < nops; i++ {
+		ck.setLeader(slowAt)
+		value := "x " + strconv.Itoa(i) + " y"
+		start := time.Now()
+		ck.Append("k", value)
+		if took := time.Since(start); took > bound {
+			cfg.t.Fatalf("append %d with server %d slow took %v; want at most %v", i, slow, took, bound)
+		}
+		if at := ck.currentLeader(); at != leader {
+			cfg.t.Fatalf("append %d left the Clerk at position %d; want the leader's, %d", i, at, leader)
+		}
+		want += value
+		cfg.op()
+	}
+
+	cfg.ConnectClient(ck, cfg.All())
+	if got := ck.Get("k"); got != want {
+		cfg.t.Fatalf("key holds %q; want %q", got, want)
+	}
+}
+
+// checkLeaderHints records the RPCs a Clerk sends, lets it learn where every server is in its
+// list, and then, for each follower in turn, points it at that follower before a put. Each put
+// must reach the leader within two calls, the follower's and the one its hint leads to, where
+// round-robin could take up to cfg.n-1. Over rounds, the leader is restarted in between, so
+// the hints must follow the new one.
+func (cfg *config) checkLeaderHints(rounds int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	trace := rpc.NewTrace()
+	for _, end := range ck.servers {
+		end.Record(trace)
+	}
+
+	for r := 0; r < rounds; r++ {
+		ck.Put("k", "warm")
+		leader := ck.FindLeader()
+		// a put commits on a majority, so wait for the rest to hear from the leader too.
+		_, server := cfg.Leader()
+		for start := time.Now(); !cfg.knowLeader(server); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				cfg.t.Fatalf("round %d: not every server learned that server %d leads", r, server)
+			}
+		}
+		for at := 0; at < cfg.n; at++ {
+			if at == leader {
+				continue
+			}
+			ck.setLeader(at)
+			before := len(trace.Entries())
+			ck.Put("k", strconv.Itoa(at))
+			calls := 0
+			for _, entry := range trace.Entries()[before:] {
+				if entry.SvcMeth == "KVServer.PutAppend" {
+					calls++
+				}
+			}
+			if calls > 2 {
+				cfg.t.Fatalf("round %d: a put sent first to position %d took %d calls to reach the leader at %d", r, at, calls, leader)
+			}
+			if got := ck.currentLeader(); got != leader {
+				cfg.t.Fatalf("round %d: a put sent first to position %d left the Clerk at %d; want %d", r, at, got, leader)
+			}
+			cfg.op()
+		}
+
+		_, old := cfg.Leader()
+		cfg.ShutdownServer(old)
+		cfg.StartServer(old)
+		cfg.ConnectAll()
+	}
+}
+
+// knowLeader reports whether every follower's hint names leader.
+func (cfg *config) knowLeader(leader int) bool {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	for i, kv := range cfg.kvservers {
+		if i != leader && kv.rf.GetLeaderHint() != leader {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRetriesExhausted cuts a Clerk with MaxRetries set to retries off from every server, and
+// checks that a put and a get each give up with a *RetryError counting retries+1 attempts, all
+// of them unreachable, and saying so. Once the Clerk is reconnected, the put must be found not
+// to have been applied, and the Clerk must work as before.
+func (cfg *config) checkRetriesExhausted(retries int) {
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{MaxRetries: retries})
+	defer cfg.deleteClient(ck)
+	// the retries could run out while the cluster is still electing its first leader.
+	ck.FindLeader()
+	if err := ck.TryPutAppend("k", "before", "put"); err != nil {
+		cfg.t.Fatalf("a put to a connected cluster returned %v", err)
+	}
+	cfg.DisconnectClient(ck, cfg.All())
+
+	// check checks that err is a *RetryError for retries+1 unreachable attempts.
+	check := func(what string, err error) {
+		var retryErr *RetryError
+		if !errors.As(err, &retryErr) {
+			cfg.t.Fatalf("%s to unreachable servers returned %v; want a *RetryError", what, err)
+		}
+		if retryErr.Attempts != retries+1 || retryErr.Unreachable != retryErr.Attempts {
+			cfg.t.Fatalf("%s gave up after %+v; want %d attempts, all unreachable", what, *retryErr, retries+1)
+		}
+		if !strings.Contains(err.Error(), "no server could be reached") {
+			cfg.t.Fatalf("%s returned %q, which does not say no server could be reached", what, err)
+		}
+	}
+	check("a put", ck.TryPutAppend("k", "after", "put"))
+	_, err := ck.TryGet("k")
+	check("a get", err)
+
+	cfg.ConnectClient(ck, cfg.All())
+	if value, err := ck.TryGet("k"); err != nil || value != "before" {
+		cfg.t.Fatalf("after reconnecting, k holds %q (%v); want %q", value, err, "before")
+	}
+	if err := ck.TryPutAppend("k", "after", "put"); err != nil {
+		cfg.t.Fatalf("after reconnecting, a put returned %v", err)
+	}
+	if value := ck.Get("k"); value != "after" {
+		cfg.t.Fatalf("after reconnecting, k holds %q; want %q", value, "after")
+	}
+}
+
+// checkCoalescedAppends sends the leader nbursts bursts of size concurrent appends to one key,
+// all from one client, each burst with a floor at its first request id as a pipelining Clerk
+// would send them. Every append must succeed, each burst must take fewer log entries than it
+// has appends, and every replica must end up holding each appended value exactly once.
+// Expects cfg.servercfg.CoalesceAppends to be set.
+func (cfg *config) checkCoalescedAppends(nbursts int, size int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("k", "")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+
+	clientId := nrand()
+	requestId := int64(1)
+	var values []string
+	for b := 0; b < nbursts; b++ {
+		kv.mu.Lock()
+		before := kv.lastApplied
+		kv.mu.Unlock()
+		floor := requestId
+		var wg sync.WaitGroup
+		replies := make([]PutAppendReply, size)
+		for i := 0; i < size; i++ {
+			value := "x " + strconv.Itoa(b) + " " + strconv.Itoa(i) + " y"
+			values = append(values, value)
+			args := PutAppendArgs{Key: "k", Value: value, Command: "append", ClientId: clientId, RequestId: requestId, Floor: floor}
+			requestId++
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				kv.PutAppend(&args, &replies[i])
+			}(i)
+		}
+		wg.Wait()
+		for i, reply := range replies {
+			if reply.WrongLeader || reply.Err != OK {
+				cfg.t.Fatalf("burst %d: append %d returned %+v", b, i, reply)
+			}
+		}
+		kv.mu.Lock()
+		entries := kv.lastApplied - before
+		kv.mu.Unlock()
+		if entries >= size {
+			cfg.t.Fatalf("burst %d: %d appends took %d log entries; want fewer", b, size, entries)
+		}
+		cfg.op()
+	}
+
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	var want string
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !server.waitApplied(applied, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+		server.mu.Lock()
+		value := server.sm.(*kvStore).data["k"]
+		server.mu.Unlock()
+		if i == 0 {
+			want = value
+		} else if value != want {
+			cfg.t.Fatalf("server %d holds %q and server 0 %q", i, value, want)
+		}
+	}
+	for _, value := range values {
+		if n := strings.Count(want, value); n != 1 {
+			cfg.t.Fatalf("%q was appended %d times; want once", value, n)
+		}
+	}
+	if len(want) != len(strings.Join(values, "")) {
+		cfg.t.Fatalf("key holds %d bytes; want %d", len(want), len(strings.Join(values, "")))
+	}
+}
+
+// counterMachine is a StateMachine of named counters: a put sets a counter, an append adds its
+// value to one, and a get reads one, all in decimal.
+type counterMachine struct {
+	counters map[string]int64
+}
+
+// newCounterMachine returns an empty counterMachine, for ServerConfig.NewStateMachine.
+func newCounterMachine() StateMachine {
+	return &counterMachine{counters: make(map[string]int64)}
+}
+
+func (m *counterMachine) Apply(op Op) Result {
+	result := Result{Err: OK}
+	n, _ := strconv.ParseInt(op.Value, 10, 64)
+	switch op.Command {
+	case "put":
+		m.counters[op.Key] = n
+	case "append":
+		m.counters[op.Key] += n
+	case "get":
+		result.Value = strconv.FormatInt(m.counters[op.Key], 10)
+	default:
+		result.Err = ErrRejected
+	}
+	return result
+}
+
+func (m *counterMachine) Snapshot() []byte {
+	w := new(bytes.Buffer)
+	gobWrapper.NewEncoder(w).Encode(m.counters)
+	return w.Bytes()
+}
+
+func (m *counterMachine) Restore(snapshot []byte) {
+	m.counters = make(map[string]int64)
+	gobWrapper.NewDecoder(bytes.NewBuffer(snapshot)).Decode(&m.counters)
+}
+
+// checkCounterStateMachine has nclients clients each add 1 to a shared counter nops times, and
+// add their own total to a counter of their own, through servers running counterMachine. The
+// shared counter must read nclients*nops, with no retry counted twice. A server is then
+// restarted from its snapshot, and every replica must hold the same counters, all as expected.
+// Expects cfg.servercfg.NewStateMachine to return a counterMachine, and a maxraftstate small
+// enough that snapshots are taken.
+func (cfg *config) checkCounterStateMachine(nclients int, nops int) {
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			key := "c" + strconv.Itoa(c)
+			ck.Put(key, "0")
+			for i := 1; i <= nops; i++ {
+				ck.Append("shared", "1")
+				ck.Append(key, strconv.Itoa(i))
+				cfg.op()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	want := map[string]int64{"shared": int64(nclients * nops)}
+	for c := 0; c < nclients; c++ {
+		want["c"+strconv.Itoa(c)] = int64(nops * (nops + 1) / 2)
+	}
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	for key, n := range want {
+		if value := ck.Get(key); value != strconv.FormatInt(n, 10) {
+			cfg.t.Fatalf("counter %s reads %s; want %d", key, value, n)
+		}
+	}
+
+	_, leader := cfg.Leader()
+	restarted := (leader + 1) % cfg.n
+	if cfg.saved[restarted].SnapshotSize() == 0 {
+		cfg.t.Fatalf("server %d has not snapshotted", restarted)
+	}
+	cfg.ShutdownServer(restarted)
+	cfg.StartServer(restarted)
+	cfg.ConnectAll()
+	ck.Put("after", "1")
+	want["after"] = 1
+
+	_, leader = cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !server.waitApplied(applied, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+		server.mu.Lock()
+		counters := server.sm.(*counterMachine).counters
+		same := reflect.DeepEqual(counters, want)
+		server.mu.Unlock()
+		if !same {
+			cfg.t.Fatalf("server %d holds %v; want %v", i, counters, want)
+		}
+	}
+}
+
+// checkSnapshotWatermarks has nclients clients each put nops values at once, keeping the Raft
+// state of every server hovering about the high watermark, and samples each server's Raft state
+// size meanwhile. Every server must snapshot, but no more than once every few operations, and
+// its Raft state must never grow past twice maxraftstate. Expects cfg.servercfg to set
+// SnapshotLowWatermark, and a maxraftstate a few entries large.
+func (cfg *config) checkSnapshotWatermarks(nclients int, nops int) {
+	before := make([]Stats, cfg.n)
+	applied := make([]int, cfg.n)
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		before[i] = server.Stats()
+		server.mu.Lock()
+		applied[i] = server.lastApplied
+		server.mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	largest := make(chan int)
+	go func() {
+		most := 0
+		for {
+			for i := 0; i < cfg.n; i++ {
+				cfg.mu.Lock()
+				persister := cfg.saved[i]
+				cfg.mu.Unlock()
+				if size := persister.RaftStateSize(); size > most {
+					most = size
+				}
+			}
+			select {
+			case <-done:
+				largest <- most
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; i < nops; i++ {
+				ck.Put(strconv.Itoa(c), randstring(50))
+				cfg.op()
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(done)
+	if most := <-largest; most > 2*cfg.maxraftstate {
+		cfg.t.Fatalf("a server's Raft state reached %d bytes; want at most %d", most, 2*cfg.maxraftstate)
+	}
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		server.mu.Lock()
+		entries := server.lastApplied - applied[i]
+		server.mu.Unlock()
+		snapshots := server.Stats().Snapshots - before[i].Snapshots
+		if snapshots == 0 || snapshots*4 > int64(entries) {
+			cfg.t.Fatalf("server %d took %d snapshots over %d entries; want at least one, and at most one per 4", i, snapshots, entries)
+		}
+	}
+}
+
+// checkPipelinedDedup has nworkers goroutines share one pipelining Clerk, each appending nops
+// values to a key of its own and to a key all of them share, so that many requests are in
+// flight at once and, on an unreliable network, retried. Every replica must hold each worker's
+// appends exactly once and in order, and each shared value exactly once. Last, the outcomes
+// every replica keeps for the Clerk must have shrunk back to the requests still in flight when
+// the last were applied, at most nworkers. Expects an unreliable network.
+func (cfg *config) checkPipelinedDedup(nworkers int, nops int) {
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Pipeline: true})
+	defer cfg.deleteClient(ck)
+
+	var wg sync.WaitGroup
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nops; i++ {
+				value := "x " + strconv.Itoa(w) + " " + strconv.Itoa(i) + " y"
+				ck.Append(strconv.Itoa(w), value)
+				ck.Append("shared", value)
+				cfg.op()
+			}
+		}(w)
+	}
+	wg.Wait()
+	// a put after every worker has finished carries a floor above all their requests.
+	ck.Put("last", "")
+
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !server.waitApplied(applied, 10*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+		server.mu.Lock()
+		data := server.sm.(*kvStore).data
+		var own []string
+		for w := 0; w < nworkers; w++ {
+			own = append(own, data[strconv.Itoa(w)])
+		}
+		shared := data["shared"]
+		window := len(server.window[ck.id()])
+		server.mu.Unlock()
+
+		for w := 0; w < nworkers; w++ {
+			want := ""
+			for j := 0; j < nops; j++ {
+				value := "x " + strconv.Itoa(w) + " " + strconv.Itoa(j) + " y"
+				want += value
+				if n := strings.Count(shared, value); n != 1 {
+					cfg.t.Fatalf("server %d holds %q %d times in the shared key; want once", i, value, n)
+				}
+			}
+			if own[w] != want {
+				cfg.t.Fatalf("server %d holds %q for worker %d; want %q", i, own[w], w, want)
+			}
+		}
+		if window > nworkers {
+			cfg.t.Fatalf("server %d keeps %d outcomes for the Clerk; want at most %d", i, window, nworkers)
+		}
+	}
+}
+
+// checkLoadBackoff has a Clerk with LoadDelay set to delay make a few puts on an idle cluster,
+// which must report no load and take no time to speak of. It then pauses both followers, so
+// that nothing commits, and has nloaders other clients each start a put, filling the leader's
+// backlog, before the Clerk sends a put of its own and the followers are resumed. The load that
+// put reports must reflect the backlog, and the Clerk must hold its next put back for that
+// share of delay; the put after it, with the backlog drained, must go at once again.
+// Expects Raft.MaxUncommittedEntries above nloaders.
+func (cfg *config) checkLoadBackoff(nloaders int, delay time.Duration) {
+	var mu sync.Mutex
+	var most float64
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{LoadDelay: delay, OnLoad: func(load float64) {
+		mu.Lock()
+		most = math.Max(most, load)
+		mu.Unlock()
+	}})
+	defer cfg.deleteClient(ck)
+	// timedPut returns how long a put of value takes.
+	timedPut := func(value string) time.Duration {
+		start := time.Now()
+		ck.Put("k", value)
+		cfg.op()
+		return time.Since(start)
+	}
+	ck.Put("k", "warm")
+	for i := 0; i < 5; i++ {
+		if took := timedPut("idle"); took > delay/4 {
+			cfg.t.Fatalf("put %d on an idle cluster took %v", i, took)
+		}
+	}
+	if most != 0 {
+		cfg.t.Fatalf("an idle leader reported a load of %v", most)
+	}
+
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	var followers []*raft.Raft
+	for i := 0; i < cfg.n; i++ {
+		if i != leader {
+			followers = append(followers, cfg.kvservers[i].rf)
+		}
+	}
+	cfg.mu.Unlock()
+	for _, rf := range followers {
+		rf.Pause()
+	}
+	var wg sync.WaitGroup
+	for l := 0; l < nloaders; l++ {
+		wg.Add(1)
+		go func(l int) {
+			defer wg.Done()
+			loader := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(loader)
+			loader.Put("loader"+strconv.Itoa(l), "x")
+		}(l)
+	}
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if backlog, _ := kv.rf.Backlog(); backlog >= nloaders {
+			break
+		}
+		if time.Since(start) > time.Second {
+			cfg.t.Fatalf("leader %d's backlog did not reach %d", leader, nloaders)
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ck.Put("k", "loaded")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for _, rf := range followers {
+		rf.Resume()
+	}
+	wg.Wait()
+
+	_, limit := kv.rf.Backlog()
+	load := ck.Load()
+	if want := float64(nloaders) / float64(limit); load < want {
+		cfg.t.Fatalf("a put sent with %d entries uncommitted reported a load of %v; want at least %v", nloaders, load, want)
+	}
+	if took, want := timedPut("slowed"), time.Duration(load*float64(delay)); took < want {
+		cfg.t.Fatalf("with a load of %v the next put took %v; want at least %v", load, took, want)
+	}
+	if took := timedPut("drained"); took > delay/4 {
+		cfg.t.Fatalf("with the backlog drained a put took %v", took)
+	}
+}
+
+// checkEviction fills the store to cfg.servercfg.MaxKeys keys, reads the first key through the
+// log, and writes one key more: the second key, now the least recently used, must be the one
+// evicted. Then nclients clients write and read keys at random, well past the limit, and a
+// server is restarted from its snapshot. Every replica must end up holding the same keys, no
+// more than the limit, in the same recency order. Expects a maxraftstate small enough that
+// snapshots are taken.
+func (cfg *config) checkEviction(nclients int, nops int) {
+	maxKeys := cfg.servercfg.MaxKeys
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	for i := 0; i < maxKeys; i++ {
+		ck.Put(strconv.Itoa(i), strconv.Itoa(i))
+		cfg.op()
+	}
+	ck.Get("0")
+	ck.Put("new", "x")
+
+	// checkReplicas waits for every server to apply as far as the leader has, checks that they
+	// agree, and returns the leader's data.
+	checkReplicas := func() map[string]string {
+		_, leader := cfg.Leader()
+		cfg.mu.Lock()
+		kv := cfg.kvservers[leader]
+		cfg.mu.Unlock()
+		kv.mu.Lock()
+		applied := kv.lastApplied
+		kv.mu.Unlock()
+		var data map[string]string
+		var order []string
+		for i := 0; i < cfg.n; i++ {
+			cfg.mu.Lock()
+			server := cfg.kvservers[i]
+			cfg.mu.Unlock()
+			if !server.waitApplied(applied, 5*time.Second) {
+				cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+			}
+			server.mu.Lock()
+			store := server.sm.(*kvStore)
+			if len(store.data) > maxKeys {
+				cfg.t.Fatalf("server %d holds %d keys; want at most %d", i, len(store.data), maxKeys)
+			}
+			if i == 0 {
+				data, order = store.data, store.recencyOrder()
+			} else if !reflect.DeepEqual(store.data, data) || !reflect.DeepEqual(store.recencyOrder(), order) {
+				cfg.t.Fatalf("server %d holds %v in order %v; server 0 %v in order %v", i, store.data, store.recencyOrder(), data, order)
+			}
+			server.mu.Unlock()
+		}
+		return data
+	}
+	data := checkReplicas()
+	if _, ok := data["1"]; ok {
+		cfg.t.Fatalf("key 1, the least recently used, was not evicted")
+	}
+	if _, ok := data["0"]; !ok {
+		cfg.t.Fatalf("key 0, read through the log, was evicted")
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; i < nops; i++ {
+				key := strconv.Itoa(rand.Intn(4 * maxKeys))
+				if rand.Intn(3) == 0 {
+					ck.Get(key)
+				} else {
+					ck.Put(key, strconv.Itoa(c))
+				}
+				cfg.op()
+			}
+		}(c)
+	}
+	wg.Wait()
+	checkReplicas()
+	// the count is not part of the snapshot, so a follower that caught up by installing one
+	// missed the evictions it covers; none can have counted more than the leader, though.
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	evictions := cfg.kvservers[leader].Stats().Evictions
+	cfg.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if n := server.Stats().Evictions; n == 0 || n > evictions {
+			cfg.t.Fatalf("server %d evicted %d keys and the leader %d", i, n, evictions)
+		}
+	}
+
+	restarted := (leader + 1) % cfg.n
+	if cfg.saved[restarted].SnapshotSize() == 0 {
+		cfg.t.Fatalf("server %d has not snapshotted", restarted)
+	}
+	cfg.ShutdownServer(restarted)
+	cfg.StartServer(restarted)
+	cfg.ConnectAll()
+	ck.Put("restarted", "x")
+	checkReplicas()
+}
+
+// checkConsistencyLevels sends a get at each consistency level straight to every server. A
+// linearizable or leader read must be turned away by a follower and answered by the leader, and
+// a stale read answered by any server; leader and stale reads must add nothing to the log. The
+// leader is then cut off while the rest of the cluster overwrites the key. The deposed leader
+// must still answer a leader read and a stale read, with the old value, but refuse a
+// linearizable one, while the Clerk reads the new value at every level from the majority.
+// Expects cfg.servercfg.LinearizableReads, so that the deposed leader refuses rather than waits.
+func (cfg *config) checkConsistencyLevels() {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("k", "old")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	servers := append([]*KVServer(nil), cfg.kvservers...)
+	cfg.mu.Unlock()
+	servers[leader].mu.Lock()
+	applied := servers[leader].lastApplied
+	servers[leader].mu.Unlock()
+	for i, server := range servers {
+		if !server.waitApplied(applied, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+	}
+
+	// get reads k from server i at level, and returns the value, or false if it was turned away.
+	get := func(i int, level Consistency) (string, bool) {
+		reply := GetReply{}
+		servers[i].Get(&GetArgs{Key: "k", ClientId: nrand(), RequestId: 1, Consistency: level}, &reply)
+		if reply.WrongLeader || reply.Err != OK {
+			return "", false
+		}
+		return reply.Value, true
+	}
+	names := map[Consistency]string{Linearizable: "linearizable", Leader: "leader", Stale: "stale"}
+	for i := range servers {
+		for _, level := range []Consistency{Linearizable, Leader, Stale} {
+			value, ok := get(i, level)
+			if answers := i == leader || level == Stale; ok != answers || ok && value != "old" {
+				cfg.t.Fatalf("server %d (leader %d) answered a %s read with %q, %v", i, leader, names[level], value, ok)
+			}
+		}
+		servers[i].mu.Lock()
+		index := servers[i].lastApplied
+		servers[i].mu.Unlock()
+		if index != applied {
+			cfg.t.Fatalf("reads on server %d took it from index %d to %d", i, applied, index)
+		}
+	}
+
+	var rest []int
+	for i := range servers {
+		if i != leader {
+			rest = append(rest, i)
+		}
+	}
+	cfg.partition(rest, []int{leader})
+	cfg.ConnectClient(ck, rest)
+	ck.Put("k", "new")
+	if value, ok := get(leader, Leader); !ok || value != "old" {
+		cfg.t.Fatalf("deposed leader %d answered a leader read with %q, %v; want %q", leader, value, ok, "old")
+	}
+	if value, ok := get(leader, Stale); !ok || value != "old" {
+		cfg.t.Fatalf("deposed leader %d answered a stale read with %q, %v; want %q", leader, value, ok, "old")
+	}
+	if value, ok := get(leader, Linearizable); ok {
+		cfg.t.Fatalf("deposed leader %d answered a linearizable read with %q", leader, value)
+	}
+	for _, level := range []Consistency{Linearizable, Leader} {
+		if value, err := ck.GetWithConsistency("k", level); err != nil || value != "new" {
+			cfg.t.Fatalf("a %s read from the majority returned %q, %v; want %q", names[level], value, err, "new")
+		}
+	}
+	// a stale read may go to a follower that has yet to apply the write.
+	if value, err := ck.GetWithConsistency("k", Stale); err != nil || value != "new" && value != "old" {
+		cfg.t.Fatalf("a stale read from the majority returned %q, %v", value, err)
+	}
+	cfg.ConnectAll()
+	cfg.ConnectClient(ck, cfg.All())
+}
+
+// checkIdempotencyKeys has nclients clients, each with its own client id, append the same value
+// under the same idempotency key, first all at once and then one after another, and then once
+// more after every server has been restarted from its snapshot. The key must hold the value
+// once, and every client must be told the append succeeded. Appends under a different key, or
+// with none, must each be applied. Expects a maxraftstate small enough that snapshots are taken.
+func (cfg *config) checkIdempotencyKeys(nclients int) {
+	clerks := make([]*Clerk, nclients)
+	for c := range clerks {
+		clerks[c] = cfg.makeClient(cfg.All())
+		defer cfg.deleteClient(clerks[c])
+	}
+	// appendOnce has every clerk append value to k under key, at once if concurrent is set.
+	appendOnce := func(value string, key string, concurrent bool) {
+		var wg sync.WaitGroup
+		for _, ck := range clerks {
+			wg.Add(1)
+			run := func(ck *Clerk) {
+				defer wg.Done()
+				if err := ck.PutAppendIdempotent("k", value, "append", key); err != nil {
+					cfg.t.Errorf("append of %q under %q returned %v", value, key, err)
+				}
+				cfg.op()
+			}
+			if concurrent {
+				go run(ck)
+			} else {
+				run(ck)
+			}
+		}
+		wg.Wait()
+		if cfg.t.Failed() {
+			cfg.t.FailNow()
+		}
+	}
+	appendOnce("a", "op-a", true)
+	appendOnce("a", "op-a", false)
+	appendOnce("b", "op-b", false)
+	want := "ab"
+	for i := 0; i < 20; i++ {
+		// enough writes for every server to snapshot the remembered keys.
+		clerks[0].Append("k", "c")
+		want += "c"
+	}
+	if value := clerks[0].Get("k"); value != want {
+		cfg.t.Fatalf("k holds %q; want %q", value, want)
+	}
+
+	for i := 0; i < cfg.n; i++ {
+		if cfg.saved[i].SnapshotSize() == 0 {
+			cfg.t.Fatalf("server %d has not snapshotted", i)
+		}
+		cfg.ShutdownServer(i)
+	}
+	for i := 0; i < cfg.n; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	appendOnce("a", "op-a", true)
+	appendOnce("b", "op-b", false)
+	if value := clerks[nclients-1].Get("k"); value != want {
+		cfg.t.Fatalf("after a restart k holds %q; want %q", value, want)
+	}
+}
+
+// checkStaleReadsAfterRestart writes a key until a follower has snapshotted it, restarts the
+// follower cut off from the cluster, and sends it stale reads. It must refuse them with
+// ErrNotReady, rather than answer from the empty state it starts with or from a state no leader
+// has confirmed, and a Clerk that can reach only it must give up with NotReady failures. Once
+// reconnected, it must start answering within a few seconds, and never from an empty state.
+// Expects a maxraftstate small enough that snapshots are taken.
+func (cfg *config) checkStaleReadsAfterRestart() {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	_, leader := cfg.Leader()
+	follower := (leader + 1) % cfg.n
+	for i := 0; cfg.saved[follower].SnapshotSize() == 0; i++ {
+		if i == 200 {
+			cfg.t.Fatalf("server %d has not snapshotted after %d writes", follower, i)
+		}
+		ck.Put("k", strconv.Itoa(i))
+		cfg.op()
+	}
+	cfg.ShutdownServer(follower)
+	cfg.StartServer(follower)
+	cfg.mu.Lock()
+	kv := cfg.kvservers[follower]
+	cfg.mu.Unlock()
+
+	// read sends server follower a stale read of k.
+	read := func() GetReply {
+		reply := GetReply{}
+		kv.Get(&GetArgs{Key: "k", ClientId: nrand(), RequestId: 1, Consistency: Stale}, &reply)
+		return reply
+	}
+	for i := 0; i < 10; i++ {
+		if reply := read(); reply.Err != ErrNotReady {
+			cfg.t.Fatalf("cut-off server %d answered a stale read with %+v; want %v", follower, reply, ErrNotReady)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	only := cfg.makeClientWithConfig([]int{follower}, ClerkConfig{MaxRetries: 3})
+	defer cfg.deleteClient(only)
+	var retryErr *RetryError
+	if _, err := only.GetWithConsistency("k", Stale); !errors.As(err, &retryErr) || retryErr.NotReady == 0 {
+		cfg.t.Fatalf("a stale read from cut-off server %d returned %v; want a *RetryError with NotReady failures", follower, err)
+	}
+
+	cfg.ConnectAll()
+	ck.Put("k", "after")
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		reply := read()
+		if reply.Err == OK {
+			if reply.Value == "" {
+				cfg.t.Fatalf("restarted server %d answered a stale read from an empty state", follower)
+			}
+			break
+		}
+		if reply.Err != ErrNotReady {
+			cfg.t.Fatalf("restarted server %d answered a stale read with %+v", follower, reply)
+		}
+		if time.Since(start) > 5*time.Second {
+			cfg.t.Fatalf("restarted server %d still refuses stale reads", follower)
+		}
+	}
+}
+
+// checkThrottling has a pipelining Clerk flood the leader with puts from nflooders goroutines
+// for d, while another client sends the leader a put every interval, well within the rate. The
+// flooder must be throttled, completing no more puts than its bucket allows over d, while every
+// one of the other client's puts is admitted. Expects cfg.servercfg.ClientRate to be set well
+// above one put every interval.
+func (cfg *config) checkThrottling(nflooders int, d time.Duration, interval time.Duration) {
+	flooder := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Pipeline: true})
+	defer cfg.deleteClient(flooder)
+	flooder.Put("warm", "")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	before := kv.Stats()
+
+	var flooded int64
+	stop := time.Now().Add(d)
+	var wg sync.WaitGroup
+	for f := 0; f < nflooders; f++ {
+		wg.Add(1)
+		go func(f int) {
+			defer wg.Done()
+			for time.Now().Before(stop) {
+				flooder.Put("flood"+strconv.Itoa(f), "x")
+				atomic.AddInt64(&flooded, 1)
+				cfg.op()
+			}
+		}(f)
+	}
+
+	clientId := nrand()
+	polite := 0
+	for requestId := int64(1); time.Now().Before(stop); requestId++ {
+		args := PutAppendArgs{Key: "polite", Value: strconv.FormatInt(requestId, 10), Command: "put", ClientId: clientId, RequestId: requestId}
+		reply := PutAppendReply{}
+		kv.PutAppend(&args, &reply)
+		if reply.WrongLeader || reply.Err != OK {
+			cfg.t.Fatalf("put %d from the client within its rate returned %+v", requestId, reply)
+		}
+		polite++
+		cfg.op()
+		time.Sleep(interval)
+	}
+	wg.Wait()
+
+	if kv.Stats().Throttled == before.Throttled {
+		cfg.t.Fatalf("leader %d throttled no request from the flooder", leader)
+	}
+	// the bucket starts full, and the last puts may have been admitted just before stop.
+	allowed := int64(cfg.servercfg.ClientRate*d.Seconds()) + int64(cfg.servercfg.clientBurst()) + int64(nflooders)
+	if flooded > allowed {
+		cfg.t.Fatalf("the flooder completed %d puts in %v; want at most %d", flooded, d, allowed)
+	}
+	if polite == 0 {
+		cfg.t.Fatalf("the client within its rate sent no puts")
+	}
+}
+
+// checkSnapshotInstallLatency checks that installing a large snapshot does not hold up requests
+// for as long as decoding it takes. It loads nkeys keys, waits for server 0 to take an idle
+// snapshot of them, and then feeds that snapshot back to server 0's apply loop several times,
+// as Raft does when a leader sends one, while timing stale reads served by server 0. The state
+// doesn't change, since the snapshot holds exactly the state the server is in. No read may
+// take half as long as a decode. Expects cfg.servercfg.IdleSnapshotAfter to be set, and a
+// maxraftstate large enough that no snapshot is taken for size.
+func (cfg *config) checkSnapshotInstallLatency(nkeys int) {
+	const installs = 5
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	for i := 0; i < nkeys; {
+		pairs := make(map[string]string)
+		for ; len(pairs) < 1000 && i < nkeys; i++ {
+			pairs[strconv.Itoa(i)] = randstring(100)
+		}
+		ck.BulkLoad(pairs)
+	}
+	value := ck.Get("0")
+
+	cfg.mu.Lock()
+	kv := cfg.kvservers[0]
+	cfg.mu.Unlock()
+	idle := cfg.servercfg.IdleSnapshotAfter
+	var snapshot raft.Snapshot
+	for deadline := time.Now().Add(4 * idle); ; time.Sleep(idle / 4) {
+		var err error
+		snapshot, err = raft.ParseSnapshot(cfg.saved[0].ReadSnapshot())
+		kv.mu.Lock()
+		current := err == nil && snapshot.LastIncludedIndex == kv.lastApplied
+		kv.mu.Unlock()
+		if current {
+			break
+		}
+		if time.Now().After(deadline) {
+			cfg.t.Fatalf("server 0 has not snapshotted its state after %v idle", 4*idle)
+		}
+	}
+	start := time.Now()
+	if _, err := kv.decodeSnapshot(snapshot.Data, snapshot.LastIncludedIndex); err != nil {
+		cfg.t.Fatalf("%v", err)
+	}
+	decode := time.Since(start)
+
+	msg := raft.ApplyMsg{UseSnapshot: true, Snapshot: cfg.saved[0].ReadSnapshot(), SnapshotIndex: snapshot.LastIncludedIndex}
+	for i := 0; i < installs; i++ {
+		kv.applyCh <- msg
+	}
+	// the apply channel is buffered, so the installs are under way until it has drained,
+	// and the last one for about one more decode.
+	var slowest time.Duration
+	var drained time.Time
+	for {
+		if drained.IsZero() && len(kv.applyCh) == 0 {
+			drained = time.Now()
+		}
+		if !drained.IsZero() && time.Since(drained) > 2*decode {
+			break
+		}
+		args, reply := GetArgs{Key: "0", Consistency: Stale}, GetReply{}
+		start := time.Now()
+		kv.Get(&args, &reply)
+		if d := time.Since(start); d > slowest {
+			slowest = d
+		}
+		if reply.Err != OK || reply.Value != value {
+			cfg.t.Fatalf("stale read during snapshot installs: %v %q, want %q", reply.Err, reply.Value, value)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if slowest >= decode/2 {
+		cfg.t.Fatalf("a read took %v while snapshots decoding in %v were installed", slowest, decode)
+	}
+}
+
+// checkSnapshotWaiters checks that no proposer waiting for an entry's result is left without
+// one by a snapshot. First, in rounds, nwaiters operations are proposed to the leader at once
+// while it snapshots as they apply, and each must get its own result. Then a follower is cut
+// off with waiters registered at the next few indexes, as a deposed leader would have, and is
+// brought back once the leader's snapshot covers them: installing the snapshot must release
+// every waiter at once. Expects a maxraftstate small enough that snapshots are taken every few
+// operations.
+func (cfg *config) checkSnapshotWaiters(nwaiters int) {
+	const rounds = 5
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("trim", "")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	snapshots := kv.Stats().Snapshots
+	for r := 0; r < rounds; r++ {
+		results := make(chan string, nwaiters)
+		for i := 0; i < nwaiters; i++ {
+			go func(i int) {
+				op := Op{Command: "put", Key: strconv.Itoa(i), Value: randstring(100), ClientId: int64(1000 + i), RequestId: int64(r)}
+				result := kv.propose(op)
+				if !result.OK || result.Err != OK {
+					results <- fmt.Sprintf("round %d: waiter %d got %+v", r, i, result)
+					return
+				}
+				results <- ""
+			}(i)
+		}
+		for i := 0; i < nwaiters; i++ {
+			if failure := <-results; failure != "" {
+				cfg.t.Fatal(failure)
+			}
+		}
+		cfg.op()
+	}
+	if kv.Stats().Snapshots == snapshots {
+		cfg.t.Fatalf("the leader took no snapshot during %d rounds of %d waiters", rounds, nwaiters)
+	}
+
+	follower := (leader + 1) % cfg.n
+	cfg.mu.Lock()
+	straggler := cfg.kvservers[follower]
+	cfg.mu.Unlock()
+	// let the follower apply everything first, so it has no entries left to apply itself.
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	straggler.mu.Lock()
+	for straggler.lastApplied < applied {
+		straggler.applyCond.Wait()
+	}
+	straggler.mu.Unlock()
+	var others []int
+	for i := 0; i < cfg.n; i++ {
+		if i != follower {
+			others = append(others, i)
+		}
+	}
+	cfg.partition(others, []int{follower})
+
+	const waiting = 3
+	straggler.mu.Lock()
+	applied = straggler.lastApplied
+	waiters := make([]chan Result, waiting)
+	for i := range waiters {
+		waiters[i] = make(chan Result, 1)
+		straggler.resultCh[applied+1+i] = waiters[i]
+	}
+	straggler.mu.Unlock()
+
+	// whichever of the others leads once the network heals, it must have no entry left for the
+	// follower to apply before the snapshot, so wait for all of them to trim past the waiters.
+	trimmed := func() bool {
+		for _, i := range others {
+			snapshot, err := raft.ParseSnapshot(cfg.saved[i].ReadSnapshot())
+			if err != nil || snapshot.LastIncludedIndex <= applied+waiting {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; !trimmed(); i++ {
+		ck.Put("trim", strconv.Itoa(i))
+	}
+	cfg.ConnectAll()
+
+	for i, waiter := range waiters {
+		select {
+		case result := <-waiter:
+			if !result.WrongLeader {
+				cfg.t.Fatalf("waiter at index %d released with %+v", applied+1+i, result)
+			}
+		case <-time.After(5 * time.Second):
+			cfg.t.Fatalf("waiter at index %d was not released by the snapshot", applied+1+i)
+		}
+	}
+}
+
+// checkPartitionedLeaderRead checks that the leader serves a get through a ReadIndex rather
+// than the log. It then cuts the leader off in the minority while the majority elects a new
+// leader and overwrites a key, and checks that the old leader, which may still believe it
+// leads, cannot confirm a ReadIndex and refuses a linearizable Get rather than serve the value
+// it holds. Once the partition heals, the new value must be read. Expects
+// cfg.servercfg.LinearizableReads.
+func (cfg *config) checkPartitionedLeaderRead() {
+	ck := cfg.makeClient(cfg.All())
+	ck.Put("k", "old")
+	_, leader := cfg.Leader()
+	before := cfg.kvservers[leader].Stats()
+	if v := ck.Get("k"); v != "old" {
+		cfg.t.Fatalf("read %q, want %q", v, "old")
+	}
+	if after := cfg.kvservers[leader].Stats(); after.ReadIndexReads == before.ReadIndexReads {
+		cfg.t.Fatalf("leader %d served no get through a ReadIndex", leader)
+	}
+	p1, p2 := cfg.make_partition()
+	cfg.partition(p1, p2)
+	majority := cfg.makeClient(p1)
+	majority.Put("k", "new")
+
+	old := cfg.kvservers[leader]
+	if index, err := old.rf.ReadIndex(); err == nil {
+		cfg.t.Fatalf("deposed leader %d confirmed a ReadIndex at %d", leader, index)
+	}
+	args := GetArgs{Key: "k", ClientId: nrand(), RequestId: 1}
+	reply := GetReply{}
+	old.Get(&args, &reply)
+	if !reply.WrongLeader {
+		cfg.t.Fatalf("deposed leader %d served a linearizable read: %v %q", leader, reply.Err, reply.Value)
+	}
+
+	cfg.ConnectAll()
+	if v := ck.Get("k"); v != "new" {
+		cfg.t.Fatalf("read %q after the partition healed, want %q", v, "new")
+	}
+}
+
+// checkLeaseReads checks that the leader serves gets under its lease, and that once the lease
+// has lapsed it falls back to a ReadIndex round rather than refuse the read. It cuts the leader
+// off for longer than the lease but less than an election timeout, so it is still leader when
+// it returns, and then reads through it at once, before a heartbeat can renew the lease.
+// Expects cfg.servercfg.LeaseReads, with a Raft.LeaseDuration well below 100ms.
+func (cfg *config) checkLeaseReads() {
+	ck := cfg.makeClient(cfg.All())
+	ck.Put("k", "v")
+	_, leader := cfg.Leader()
+	kv := cfg.kvservers[leader]
+	before := kv.Stats()
+	for i := 0; i < 10; i++ {
+		if v := ck.Get("k"); v != "v" {
+			cfg.t.Fatalf("read %q, want %q", v, "v")
+		}
+	}
+	if after := kv.Stats(); after.LeaseReads == before.LeaseReads {
+		cfg.t.Fatalf("leader %d served no read under its lease", leader)
+	}
+
+	term, _, _ := kv.rf.GetState()
+	cfg.disconnect(leader, cfg.All())
+	time.Sleep(100 * time.Millisecond)
+	cfg.connect(leader, cfg.All())
+	before = kv.Stats()
+	reply := GetReply{}
+	kv.Get(&GetArgs{Key: "k", ClientId: nrand(), RequestId: 1}, &reply)
+	after := kv.Stats()
+	if t, isLeader, _ := kv.rf.GetState(); t != term || !isLeader {
+		cfg.t.Fatalf("leader %d lost its leadership while cut off for less than an election timeout", leader)
+	}
+	if reply.WrongLeader || reply.Value != "v" {
+		cfg.t.Fatalf("leader %d refused a read once its lease lapsed: %+v", leader, reply)
+	}
+	if after.LeaseReads != before.LeaseReads || after.ReadIndexReads != before.ReadIndexReads+1 {
+		cfg.t.Fatalf("read with a lapsed lease took %d lease and %d ReadIndex reads, want 0 and 1",
+			after.LeaseReads-before.LeaseReads, after.ReadIndexReads-before.ReadIndexReads)
+	}
+}
+
+// checkReadCache reads a key once through the log, which caches it, and then has the leader
+// read it again with both followers paused, so that no heartbeat round could complete: the read
+// must still be answered, from the cache. Then, for d, one clerk keeps writing the key while
+// another keeps reading it, and every read must return the latest acknowledged write or a later
+// one. Both hits and misses must rise meanwhile, the misses showing that the writes dropped the
+// cached value. Expects cfg.servercfg.ReadCacheSize and Raft.LeaseDuration to be set.
+func (cfg *config) checkReadCache(d time.Duration) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("k", "0")
+	if value := ck.Get("k"); value != "0" {
+		cfg.t.Fatalf("read %q; want %q", value, "0")
+	}
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	var followers []*raft.Raft
+	for i := 0; i < cfg.n; i++ {
+		if i != leader {
+			followers = append(followers, cfg.kvservers[i].rf)
+		}
+	}
+	cfg.mu.Unlock()
+
+	before := kv.Stats()
+	for _, rf := range followers {
+		rf.Pause()
+	}
+	reply := GetReply{}
+	kv.Get(&GetArgs{Key: "k", ClientId: ck.id(), RequestId: ck.nextRequestId()}, &reply)
+	for _, rf := range followers {
+		rf.Resume()
+	}
+	if reply.WrongLeader || reply.Err != OK || reply.Value != "0" {
+		cfg.t.Fatalf("leader %d did not answer a cached read with its followers paused: %+v", leader, reply)
+	}
+	if after := kv.Stats(); after.ReadCacheHits != before.ReadCacheHits+1 {
+		cfg.t.Fatalf("the read took %d cache hits; want 1", after.ReadCacheHits-before.ReadCacheHits)
+	}
+
+	writer := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(writer)
+	var acked int64
+	done := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := int64(1); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			writer.Put("k", strconv.FormatInt(i, 10))
+			atomic.StoreInt64(&acked, i)
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	before = kv.Stats()
+	for start := time.Now(); time.Since(start) < d; {
+		least := atomic.LoadInt64(&acked)
+		value := ck.Get("k")
+		if got, err := strconv.ParseInt(value, 10, 64); err != nil || got < least {
+			close(done)
+			<-written
+			cfg.t.Fatalf("read %q after write %d was acknowledged", value, least)
+		}
+		cfg.op()
+	}
+	close(done)
+	<-written
+	after := kv.Stats()
+	if after.ReadCacheHits == before.ReadCacheHits || after.ReadCacheMisses == before.ReadCacheMisses {
+		cfg.t.Fatalf("reads under a concurrent writer took %d cache hits and %d misses; want some of each",
+			after.ReadCacheHits-before.ReadCacheHits, after.ReadCacheMisses-before.ReadCacheMisses)
+	}
+}
+
+// checkResultCache checks that a retried request is answered from the result cache: a get the
+// leader read from its own state, a get that went through the log and an append, each retried
+// after the data has changed, return the result they first had, with no new log entry. Every
+// server must cache the result of an operation applied from the log, the cache must survive a
+// snapshot, and it must hold no more than cfg.servercfg.ResultCacheSize clients after nclients
+// more have read. Expects ResultCacheSize and LinearizableReads to be set.
+func (cfg *config) checkResultCache(nclients int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("cached", "1")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	lastIndex := func() int {
+		log := kv.rf.LogSnapshot()
+		return log[len(log)-1].Index
+	}
+	get := func(clientId int64, requestId int64) string {
+		for {
+			args := GetArgs{Key: "cached", ClientId: clientId, RequestId: requestId}
+			reply := GetReply{}
+			kv.Get(&args, &reply)
+			if !reply.WrongLeader && reply.Err == OK {
+				return reply.Value
+			}
+			if _, isLeader, _ := kv.rf.GetState(); !isLeader {
+				cfg.t.Fatalf("server %d lost its leadership", leader)
+			}
+		}
+	}
+
+	if value := get(1, 1); value != "1" {
+		cfg.t.Fatalf("get returned %q; want %q", value, "1")
+	}
+	read := Op{Command: "get", Key: "cached", ClientId: 2, RequestId: 1}
+	if result := kv.appendEntryToLog(read); !result.OK || result.Value != "1" {
+		cfg.t.Fatalf("get through the log returned %+v", result)
+	}
+	appended := PutAppendArgs{Key: "appended", Value: "x", Command: "append", ClientId: 3, RequestId: 1}
+	appendReply := PutAppendReply{}
+	if kv.PutAppend(&appended, &appendReply); appendReply.WrongLeader || appendReply.Err != OK {
+		cfg.t.Fatalf("append returned %+v", appendReply)
+	}
+	ck.Put("cached", "2")
+	cfg.op()
+
+	index := lastIndex()
+	if value := get(1, 1); value != "1" {
+		cfg.t.Fatalf("retried read returned %q; want the cached %q", value, "1")
+	}
+	if value := get(2, 1); value != "1" {
+		cfg.t.Fatalf("retried get through the log returned %q; want the cached %q", value, "1")
+	}
+	appendReply = PutAppendReply{}
+	if kv.PutAppend(&appended, &appendReply); appendReply.WrongLeader || appendReply.Err != OK {
+		cfg.t.Fatalf("retried append returned %+v", appendReply)
+	}
+	if lastIndex() != index {
+		cfg.t.Fatalf("retries added log entries %d to %d", index+1, lastIndex())
+	}
+	if value := ck.Get("appended"); value != "x" {
+		cfg.t.Fatalf("appended key holds %q; want %q", value, "x")
+	}
+
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !server.waitApplied(applied, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+		server.mu.Lock()
+		cached, ok := server.results[2]
+		server.mu.Unlock()
+		if !ok || cached.RequestId != 1 || cached.Result.Value != "1" {
+			cfg.t.Fatalf("server %d caches %+v, %v for the get through the log", i, cached, ok)
+		}
+	}
+
+	kv.mu.Lock()
+	decoded, err := kv.decodeSnapshot(kv.encodeSnapshot(), kv.lastApplied)
+	if err != nil {
+		kv.mu.Unlock()
+		cfg.t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(decoded.results, kv.results) {
+		kv.mu.Unlock()
+		cfg.t.Fatalf("snapshot restored cached results %+v; want %+v", decoded.results, kv.results)
+	}
+	kv.mu.Unlock()
+
+	for i := 0; i < nclients; i++ {
+		get(int64(100+i), 1)
+		cfg.op()
+	}
+	kv.mu.Lock()
+	cached := len(kv.results)
+	kv.mu.Unlock()
+	if cached > cfg.servercfg.ResultCacheSize {
+		cfg.t.Fatalf("server caches %d results; want at most %d", cached, cfg.servercfg.ResultCacheSize)
+	}
+}
+
+// checkFlushAll writes nkeys keys and flushes them, and checks that every replica is then
+// empty, that a retried flush does not wipe a key written after the flush, and that a server
+// restarted from its snapshot agrees. It then races a put against a flush, round after round:
+// every replica must end up holding the put's value, or none, as the leader does. Last, a
+// cluster without AllowFlushAll must refuse a flush with ErrRejected. Expects
+// cfg.servercfg.AllowFlushAll to be set, and a maxraftstate small enough that snapshots are taken.
+func (cfg *config) checkFlushAll(nkeys int, rounds int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	for i := 0; i < nkeys; i++ {
+		ck.Put(strconv.Itoa(i), randstring(20))
+		cfg.op()
+	}
+
+	// checkReplicas waits for every server to apply as far as the leader has, then checks
+	// that each holds exactly want.
+	checkReplicas := func(want map[string]string) {
+		_, leader := cfg.Leader()
+		cfg.mu.Lock()
+		kv := cfg.kvservers[leader]
+		cfg.mu.Unlock()
+		kv.mu.Lock()
+		applied := kv.lastApplied
+		kv.mu.Unlock()
+		for i := 0; i < cfg.n; i++ {
+			cfg.mu.Lock()
+			server := cfg.kvservers[i]
+			cfg.mu.Unlock()
+			if !server.waitApplied(applied, 5*time.Second) {
+				cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+			}
+			server.mu.Lock()
+			data := server.sm.(*kvStore).data
+			same := len(data) == len(want) && (len(data) == 0 || reflect.DeepEqual(data, want))
+			server.mu.Unlock()
+			if !same {
+				cfg.t.Fatalf("server %d holds %v; want %v", i, data, want)
+			}
+		}
+	}
+
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	args := FlushAllArgs{ClientId: ck.clientId, RequestId: ck.nextRequestId()}
+	flush := func() {
+		for {
+			reply := FlushAllReply{}
+			kv.FlushAll(&args, &reply)
+			if !reply.WrongLeader && reply.Err == OK {
+				return
+			}
+			if _, isLeader, _ := kv.rf.GetState(); !isLeader {
+				cfg.t.Fatalf("server %d lost its leadership", leader)
+			}
+		}
+	}
+	flush()
+	checkReplicas(map[string]string{})
+	ck.Put("after", "kept")
+	flush()
+	checkReplicas(map[string]string{"after": "kept"})
+
+	restarted := (leader + 1) % cfg.n
+	if cfg.saved[restarted].SnapshotSize() == 0 {
+		cfg.t.Fatalf("server %d has not snapshotted", restarted)
+	}
+	cfg.ShutdownServer(restarted)
+	cfg.StartServer(restarted)
+	cfg.ConnectAll()
+	ck.Put("restarted", strconv.Itoa(restarted))
+	checkReplicas(map[string]string{"after": "kept", "restarted": strconv.Itoa(restarted)})
+
+	writer := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(writer)
+	for r := 0; r < rounds; r++ {
+		value := strconv.Itoa(r)
+		done := make(chan struct{})
+		go func() {
+			writer.Put("race", value)
+			close(done)
+		}()
+		if err := ck.FlushAll(); err != nil {
+			cfg.t.Fatalf("round %d: FlushAll: %v", r, err)
+		}
+		<-done
+		want := map[string]string{}
+		if got := ck.Get("race"); got == value {
+			want["race"] = value
+		} else if got != "" {
+			cfg.t.Fatalf("round %d: race holds %q; want %q or nothing", r, got, value)
+		}
+		checkReplicas(want)
+		cfg.op()
+	}
+
+	refusing := make_config(cfg.t, cfg.n, false, -1)
+	defer refusing.cleanup()
+	other := refusing.makeClient(refusing.All())
+	defer refusing.deleteClient(other)
+	other.Put("kept", "1")
+	if err := other.FlushAll(); err != Err(ErrRejected) {
+		cfg.t.Fatalf("FlushAll without AllowFlushAll returned %v; want %v", err, ErrRejected)
+	}
+	if value := other.Get("kept"); value != "1" {
+		cfg.t.Fatalf("refused flush left %q; want %q", value, "1")
+	}
+}
+
+// checkChunkedValues puts a value of size bytes with PutChunked, split into parts of at most
+// chunkSize, and checks that GetChunked reads it back whole while the key itself holds a
+// manifest of the parts. A reader then keeps reading the key while it is overwritten with
+// another large value and then a small one, and must only ever see one of the three values
+// whole. Last, the parts of the replaced values must all be deleted, and no entry in any
+// server's log may carry a value longer than chunkSize. Expects maxraftstate -1, so the logs
+// keep every entry.
+func (cfg *config) checkChunkedValues(size int, chunkSize int) {
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{ChunkSize: chunkSize})
+	defer cfg.deleteClient(ck)
+	first, second, small := randstring(size), randstring(size), "small"
+	if err := ck.PutChunked("large", first); err != nil {
+		cfg.t.Fatalf("PutChunked: %v", err)
+	}
+	if value, err := ck.GetChunked("large"); err != nil || value != first {
+		cfg.t.Fatalf("GetChunked returned %d bytes (error %v); want the %d bytes put", len(value), err, len(first))
+	}
+	if keys, ok := parseManifest("large", ck.Get("large")); !ok || len(keys) != (size+chunkSize-1)/chunkSize {
+		cfg.t.Fatalf("key holds no manifest of %d parts", (size+chunkSize-1)/chunkSize)
+	}
+	cfg.op()
+
+	reader := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{ChunkSize: chunkSize})
+	defer cfg.deleteClient(reader)
+	done := make(chan struct{})
+	reads := make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-done:
+				reads <- n
+				return
+			default:
+			}
+			value, err := reader.GetChunked("large")
+			if err != nil || value != first && value != second && value != small {
+				cfg.t.Errorf("GetChunked during overwrites returned %d bytes (error %v); want one of the values put", len(value), err)
+			}
+			n++
+		}
+	}()
+	for _, value := range []string{second, small} {
+		if err := ck.PutChunked("large", value); err != nil {
+			cfg.t.Fatalf("PutChunked: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		cfg.op()
+	}
+	close(done)
+	if n := <-reads; n == 0 {
+		cfg.t.Fatalf("no read completed during the overwrites")
+	}
+	if value, err := ck.GetChunked("large"); err != nil || value != small {
+		cfg.t.Fatalf("GetChunked returned %q (error %v); want %q", value, err, small)
+	}
+
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	for key := range kv.sm.(*kvStore).data {
+		if strings.HasPrefix(key, "large_part_") {
+			cfg.t.Errorf("part %s of a replaced value was not deleted", key)
+		}
+	}
+	kv.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		server := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		for _, entry := range server.rf.LogSnapshot()[1:] {
+			op, ok := entry.Command.(Op)
+			if !ok {
+				continue
+			}
+			carried := len(op.Value)
+			if len(op.Expected) > carried {
+				carried = len(op.Expected)
+			}
+			if carried > chunkSize {
+				cfg.t.Fatalf("server %d's log entry %d carries a %d-byte value; want at most %d", i, entry.Index, carried, chunkSize)
+			}
+		}
+	}
+}
+
+// checkFindByValue writes nkeys keys over a handful of values, then appends to, deletes and
+// renames some of them, and checks that FindByValue returns exactly the keys holding each value.
+// Every server must then hold the same index once it has applied as far as the leader, and so
+// must a server restarted from its snapshot. Expects cfg.servercfg.IndexValues to be set, and a
+// maxraftstate small enough that snapshots are taken.
+func (cfg *config) checkFindByValue(nkeys int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	values := []string{"red", "green", "blue", "redder", "absent"}
+	want := make(map[string]string)
+	for i := 0; i < nkeys; i++ {
+		key := strconv.Itoa(i)
+		want[key] = values[i%3]
+		ck.Put(key, want[key])
+		cfg.op()
+	}
+	for i := 0; i < nkeys; i += 5 {
+		key := strconv.Itoa(i)
+		switch want[key] {
+		case "red":
+			ck.Append(key, "der")
+			want[key] = "redder"
+		case "green":
+			ck.Delete(key)
+			delete(want, key)
+		case "blue":
+			if _, err := ck.RenameOverwrite(key, "renamed"+key); err != nil {
+				cfg.t.Fatalf("rename %s: %v", key, err)
+			}
+			want["renamed"+key] = "blue"
+			delete(want, key)
+		}
+	}
+	holding := func(value string) []string {
+		keys := []string{}
+		for key, v := range want {
+			if v == value {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	same := func(a []string, b []string) bool {
+		return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+	}
+	for _, value := range values {
+		keys, err := ck.FindByValue(value)
+		if err != nil || !same(keys, holding(value)) {
+			cfg.t.Fatalf("FindByValue(%q) returned %v, %v; want %v", value, keys, err, holding(value))
+		}
+	}
+
+	// checkReplica waits for server i to apply everything the leader had, then checks its index.
+	checkReplica := func(i int, applied int) {
+		cfg.mu.Lock()
+		kv := cfg.kvservers[i]
+		cfg.mu.Unlock()
+		if !kv.waitApplied(applied, 5*time.Second) {
+			cfg.t.Fatalf("server %d has not applied index %d", i, applied)
+		}
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		for _, value := range values {
+			if keys := kv.sm.Apply(Op{Command: "findbyvalue", Value: value}).Keys; !same(keys, holding(value)) {
+				cfg.t.Fatalf("server %d indexes %q under %v; want %v", i, value, keys, holding(value))
+			}
+		}
+	}
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	applied := kv.lastApplied
+	kv.mu.Unlock()
+	for i := 0; i < cfg.n; i++ {
+		checkReplica(i, applied)
+	}
+
+	restarted := (leader + 1) % cfg.n
+	if cfg.saved[restarted].SnapshotSize() == 0 {
+		cfg.t.Fatalf("server %d has not snapshotted", restarted)
+	}
+	cfg.ShutdownServer(restarted)
+	cfg.StartServer(restarted)
+	cfg.ConnectAll()
+	checkReplica(restarted, applied)
+}
+
+// checkNextID has nclients clients each take nops ids from one namespace, alternating single
+// ids and blocks of three, all at once. Each client must see its ids strictly increase, and no
+// id may be handed out twice. Clerks retry until they get an answer, so no allocation is
+// abandoned and the ids handed out must be exactly 1 to the number reserved, with no gaps, even
+// on an unreliable network where requests are retried.
+func (cfg *config) checkNextID(nclients int, nops int) {
+	ids := make(chan []int64, nclients)
+	for c := 0; c < nclients; c++ {
+		go func() {
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			var mine []int64
+			for i := 0; i < nops; i++ {
+				n := 1 + 2*(i%2)
+				first, err := ck.NextIDBlock("checkNextID", n)
+				if err != nil {
+					cfg.t.Errorf("NextIDBlock: %v", err)
+					break
+				}
+				for id := first; id < first+int64(n); id++ {
+					mine = append(mine, id)
+				}
+				cfg.op()
+			}
+			ids <- mine
+		}()
+	}
+
+	seen := make(map[int64]bool)
+	for c := 0; c < nclients; c++ {
+		mine := <-ids
+		for i, id := range mine {
+			if i > 0 && id <= mine[i-1] {
+				cfg.t.Fatalf("a client got id %d after %d", id, mine[i-1])
+			}
+			if seen[id] {
+				cfg.t.Fatalf("id %d was handed out twice", id)
+			}
+			seen[id] = true
+		}
+	}
+	for id := int64(1); id <= int64(len(seen)); id++ {
+		if !seen[id] {
+			cfg.t.Fatalf("id %d was skipped; %d ids handed out", id, len(seen))
+		}
+	}
+}
+
+// checkLockContention has two owners race for a lock for rounds rounds, checking that exactly
+// one of them takes it each time, that fencing tokens increase across acquisitions, and that
+// only the holder can release it. Finally a holder with a short TTL "crashes" without
+// unlocking, and the other owner must take the lock once the hold expires.
+func (cfg *config) checkLockContention(rounds int) {
+	owners := []string{"a", "b"}
+	clerks := []*Clerk{cfg.makeClient(cfg.All()), cfg.makeClient(cfg.All())}
+	defer cfg.deleteClient(clerks[0])
+	defer cfg.deleteClient(clerks[1])
+
+	type attempt struct {
+		token int64
+		err   error
+	}
+	var last int64
+	for r := 0; r < rounds; r++ {
+		results := make([]chan attempt, len(owners))
+		for i := range owners {
+			results[i] = make(chan attempt, 1)
+			go func(i int) {
+				token, err := clerks[i].Lock("checkLock", owners[i], 10*time.Second)
+				results[i] <- attempt{token, err}
+			}(i)
+		}
+		holder := -1
+		for i := range owners {
+			a := <-results[i]
+			switch {
+			case a.err == nil && holder != -1:
+				cfg.t.Fatalf("round %d: both owners took the lock", r)
+			case a.err == nil:
+				holder = i
+				if a.token <= last {
+					cfg.t.Fatalf("round %d: token %d after %d", r, a.token, last)
+				}
+				last = a.token
+			case a.err != Err(ErrLocked):
+				cfg.t.Fatalf("round %d: Lock: %v", r, a.err)
+			}
+		}
+		if holder == -1 {
+			cfg.t.Fatalf("round %d: neither owner took the lock", r)
+		}
+		other := 1 - holder
+		if err := clerks[other].Unlock("checkLock", owners[other]); err != Err(ErrNotLockOwner) {
+			cfg.t.Fatalf("round %d: the owner not holding the lock released it: %v", r, err)
+		}
+		if err := clerks[holder].Unlock("checkLock", owners[holder]); err != nil {
+			cfg.t.Fatalf("round %d: Unlock: %v", r, err)
+		}
+		cfg.op()
+	}
+
+	const ttl = 500 * time.Millisecond
+	crashed, err := clerks[0].Lock("checkLock", owners[0], ttl)
+	if err != nil {
+		cfg.t.Fatalf("Lock: %v", err)
+	}
+	if _, err := clerks[1].Lock("checkLock", owners[1], ttl); err != Err(ErrLocked) {
+		cfg.t.Fatalf("took a lock held by another owner: %v", err)
+	}
+	time.Sleep(ttl)
+	token, err := clerks[1].Lock("checkLock", owners[1], ttl)
+	if err != nil {
+		cfg.t.Fatalf("could not take an expired lock: %v", err)
+	}
+	if token <= crashed {
+		cfg.t.Fatalf("token %d after the expired hold's %d", token, crashed)
+	}
+	if err := clerks[0].Unlock("checkLock", owners[0]); err != Err(ErrNotLockOwner) {
+		cfg.t.Fatalf("the expired holder released the lock taken over from it: %v", err)
+	}
+}
+
+// checkShardRouting starts two replica groups of cfg.n servers beside cfg's, each of which
+// turns away, with ErrWrongGroup, writes to the keys the other group serves. A Clerk given a
+// ShardMap, starting on the first group, writes nkeys keys alternating between the groups: it
+// must follow the map to the right group each time it is turned away, consulting it once per
+// switch, and every key must end up in its own group only. A Clerk without the map must get
+// ErrWrongGroup back.
+func (cfg *config) checkShardRouting(nkeys int) {
+	owner := func(key string) int {
+		i, _ := strconv.Atoi(key[len("shard"):])
+		return i % 2
+	}
+	groups := make([]*config, 2)
+	ends := make([][]*rpc.ClientEnd, 2)
+	for gid := range groups {
+		gid := gid
+		servercfg := ServerConfig{PreProposeHook: func(op Op) (Op, Err) {
+			if owner(op.Key) != gid {
+				return op, ErrWrongGroup
+			}
+			return op, ""
+		}}
+		groups[gid] = make_config_with(cfg.t, cfg.n, false, -1, servercfg)
+		defer groups[gid].cleanup()
+		ck := groups[gid].makeClient(groups[gid].All())
+		ends[gid] = ck.servers
+	}
+
+	var lookups int32
+	shardMap := func(key string) (int, []*rpc.ClientEnd) {
+		atomic.AddInt32(&lookups, 1)
+		return owner(key), ends[owner(key)]
+	}
+	ck := MakeClerkWithConfig(ends[0], ClerkConfig{ShardMap: shardMap})
+	for i := 0; i < nkeys; i++ {
+		ck.Put("shard"+strconv.Itoa(i), strconv.Itoa(i))
+		cfg.op()
+	}
+	// the Clerk starts on group 0, so it moves once for every key after the first.
+	if n := atomic.LoadInt32(&lookups); int(n) != nkeys-1 {
+		cfg.t.Fatalf("consulted the shard map %d times for %d keys", n, nkeys)
+	}
+
+	for gid, group := range groups {
+		plain := group.makeClient(group.All())
+		for i := 0; i < nkeys; i++ {
+			key := "shard" + strconv.Itoa(i)
+			value := plain.Get(key)
+			if owner(key) == gid && value != strconv.Itoa(i) {
+				cfg.t.Fatalf("group %d has %q for its key %s", gid, value, key)
+			}
+			if owner(key) != gid && value != "" {
+				cfg.t.Fatalf("group %d has %q for group %d's key %s", gid, value, owner(key), key)
+			}
+		}
+		other := strconv.Itoa(1 - gid)
+		if err := plain.Transform("shard"+other, "incr", "1"); err != Err(ErrWrongGroup) {
+			cfg.t.Fatalf("a Clerk without a shard map got %v from the wrong group", err)
+		}
+	}
+}
+
+// checkCompetingCheckAndActs has nclients recording Clerks race, rounds times each, to extend a
+// key through CheckAndAct, each expecting the value it last observed. The final value must hold
+// exactly the extensions of the check-and-acts that acted, and the clients' combined history,
+// in which each check-and-act is a put or a get, must be linearizable.
+func (cfg *config) checkCompetingCheckAndActs(nclients int, rounds int) {
+	var acted int32
+	histories := make(chan []linearizability.Operation, nclients)
+	for c := 0; c < nclients; c++ {
+		go func(c int) {
+			ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Record: true})
+			defer cfg.deleteClient(ck)
+			seen := ""
+			for r := 0; r < rounds; r++ {
+				next := seen + strconv.Itoa(c) + ","
+				observed, ok, _ := ck.CheckAndAct("race", seen, next)
+				cfg.op()
+				if ok {
+					atomic.AddInt32(&acted, 1)
+					seen = next
+				} else {
+					seen = observed
+				}
+			}
+			histories <- ck.History()
+		}(c)
+	}
+
+	var history []linearizability.Operation
+	for c := 0; c < nclients; c++ {
+		history = append(history, <-histories...)
+	}
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	if final := ck.Get("race"); strings.Count(final, ",") != int(atomic.LoadInt32(&acted)) {
+		cfg.t.Fatalf("final value %q does not hold the %d check-and-acts that acted", final, acted)
+	}
+	if !linearizability.CheckOperationsTimeout(linearizability.KvModel(), history, 10*time.Second) {
+		cfg.t.Fatalf("history of %d check-and-acts is not linearizable", len(history))
+	}
+}
+
+// checkConcurrentTransforms has nclients recording Clerks each keep the larger of a key's value
+// and a random number, rounds times, reading the key in between. The final value must be the
+// largest number sent, and the clients' combined history, in which each transform is a put of
+// the value it left, must be linearizable.
+func (cfg *config) checkConcurrentTransforms(nclients int, rounds int) {
+	histories := make(chan []linearizability.Operation, nclients)
+	tops := make(chan int64, nclients)
+	for c := 0; c < nclients; c++ {
+		go func() {
+			ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Record: true})
+			defer cfg.deleteClient(ck)
+			top := int64(-1)
+			for r := 0; r < rounds; r++ {
+				n := rand.Int63n(1000)
+				if err := ck.Transform("top", "max", strconv.FormatInt(n, 10)); err != nil {
+					cfg.t.Errorf("max transform failed: %v", err)
+				}
+				if n > top {
+					top = n
+				}
+				ck.Get("top")
+				cfg.op()
+			}
+			histories <- ck.History()
+			tops <- top
+		}()
+	}
+
+	var history []linearizability.Operation
+	top := int64(-1)
+	for c := 0; c < nclients; c++ {
+		history = append(history, <-histories...)
+		if n := <-tops; n > top {
+			top = n
+		}
+	}
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	if final := ck.Get("top"); final != strconv.FormatInt(top, 10) {
+		cfg.t.Fatalf("final value %q is not the largest number sent, %d", final, top)
+	}
+	if !linearizability.CheckOperationsTimeout(linearizability.KvModel(), history, 10*time.Second) {
+		cfg.t.Fatalf("history of %d transforms and gets is not linearizable", len(history))
+	}
+}
+
+// checkCompetingRenames has nclients recording Clerks race, rounds times, to rename the same
+// key to keys of their own. Exactly one rename must succeed each round, its key must hold the
+// value moved, and the clients' combined history, in which each rename is a put of the empty
+// string to the old key and a put of the value to the new one, must be linearizable.
+func (cfg *config) checkCompetingRenames(nclients int, rounds int) {
+	setup := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Record: true})
+	defer cfg.deleteClient(setup)
+	clients := make([]*Clerk, nclients)
+	for c := range clients {
+		clients[c] = cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Record: true})
+		defer cfg.deleteClient(clients[c])
+	}
+
+	for r := 0; r < rounds; r++ {
+		src := "src" + strconv.Itoa(r)
+		value := randstring(8)
+		setup.Put(src, value)
+		var renamed int32
+		var wg sync.WaitGroup
+		for c, ck := range clients {
+			wg.Add(1)
+			go func(c int, ck *Clerk) {
+				defer wg.Done()
+				dst := src + "-" + strconv.Itoa(c)
+				ok, err := ck.Rename(src, dst)
+				if ok {
+					atomic.AddInt32(&renamed, 1)
+					if v := ck.Get(dst); v != value {
+						cfg.t.Errorf("%s holds %q after the rename, expected %q", dst, v, value)
+					}
+				} else if err != Err(ErrNoKey) {
+					cfg.t.Errorf("a losing rename failed with %v, expected %v", err, ErrNoKey)
+				}
+				ck.Get(src)
+				cfg.op()
+			}(c, ck)
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&renamed); n != 1 {
+			cfg.t.Fatalf("%d renames of %s succeeded, expected exactly one", n, src)
+		}
+	}
+
+	history := setup.History()
+	for _, ck := range clients {
+		history = append(history, ck.History()...)
+	}
+	if !linearizability.CheckOperationsTimeout(linearizability.KvModel(), history, 10*time.Second) {
+		cfg.t.Fatalf("history of %d renames, puts and gets is not linearizable", len(history))
+	}
+}
+
+// checkVerifiedHistory has a Clerk that verifies its own history every few operations do nops
+// random puts, gets, renames, transforms and flushes on nkeys keys. Every check must pass, so
+// each of those writes must be recorded as the value it left. Expects
+// cfg.servercfg.AllowFlushAll to be set.
+func (cfg *config) checkVerifiedHistory(nkeys int, nops int) {
+	violated := false
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{
+		VerifyEvery: 5,
+		OnViolation: func(history []linearizability.Operation) { violated = true },
+	})
+	defer cfg.deleteClient(ck)
+	for i := 0; i < nops && !violated; i++ {
+		key := strconv.Itoa(rand.Intn(nkeys))
+		switch rand.Intn(6) {
+		case 0:
+			ck.Put(key, strconv.Itoa(rand.Intn(100)))
+		case 1:
+			ck.Rename(key, strconv.Itoa(rand.Intn(nkeys)))
+		case 2:
+			ck.Transform(key, "max", strconv.Itoa(rand.Intn(100)))
+		case 3:
+			if rand.Intn(4) == 0 {
+				if err := ck.FlushAll(); err != nil {
+					cfg.t.Fatalf("flush failed: %v", err)
+				}
+			}
+		default:
+			ck.Get(key)
+		}
+		cfg.op()
+	}
+	if violated {
+		cfg.t.Fatalf("the Clerk found its history of puts, renames, transforms and flushes not linearizable")
+	}
+}
+
+// checkViolationReported has a Clerk that verifies its own history, with no OnViolation, work
+// against the cluster, and checks that it reports no violation. It then slips a read that no
+// write explains into the history, and the Clerk must report the violation rather than panic.
+func (cfg *config) checkViolationReported() {
+	ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{VerifyEvery: 4})
+	defer cfg.deleteClient(ck)
+	for i := 0; i < 20; i++ {
+		ck.Put("v", strconv.Itoa(i))
+		ck.Get("v")
+		cfg.op()
+	}
+	if err := ck.Violation(); err != nil {
+		cfg.t.Fatalf("the Clerk found a violation in a correct run: %v", err)
+	}
+
+	start := time.Now().UnixNano()
+	for i := 0; i < 4; i++ {
+		ck.record(linearizability.KvInput{Op: 0, Key: "v"}, linearizability.KvOutput{Value: "never written"}, start)
+	}
+	violation, ok := ck.Violation().(*ViolationError)
+	if !ok {
+		cfg.t.Fatalf("the Clerk did not report a read of a value never written")
+	}
+	if len(violation.History) != len(ck.History()) {
+		cfg.t.Fatalf("the violation holds %d operations; want the %d recorded", len(violation.History), len(ck.History()))
+	}
+}
+
+// checkDormantClients checks that the dedup state of clients that have come and gone does not
+// pile up: once ten times as many clients have each written once and outlasted
+// cfg.servercfg.AckRetention, the leader's snapshot must have grown by less than half. A client
+// that writes again after its state was dropped must be turned away with ErrExpired, leaving
+// the key alone, and get through when it retries under the new client id the Clerk picks.
+// Expects AckRetention to be set.
+func (cfg *config) checkDormantClients(nclients int) {
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+	ck.Put("dormant", "")
+	_, leader := cfg.Leader()
+	cfg.mu.Lock()
+	kv := cfg.kvservers[leader]
+	cfg.mu.Unlock()
+
+	// come has n fresh clients write once, outlasts their retention, and returns the size of
+	// the leader's snapshot once it has dropped them. The first client is kept for later.
+	var first *Clerk
+	come := func(n int) int {
+		for i := 0; i < n; i++ {
+			visitor := cfg.makeClient(cfg.All())
+			visitor.Put("dormant", strconv.Itoa(i))
+			if first == nil {
+				first = visitor
+			} else {
+				cfg.deleteClient(visitor)
+			}
+			cfg.op()
+		}
+		for i := 0; i <= cfg.servercfg.AckRetention; i++ {
+			ck.Put("ticker", strconv.Itoa(i))
+			cfg.op()
+		}
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		kv.pruneDormantClients()
+		return len(kv.encodeSnapshot())
+	}
+	few := come(nclients)
+	many := come(9 * nclients)
+	if many-few > few/2 {
+		cfg.t.Fatalf("snapshot grew from %d to %d bytes as %d more clients came and went", few, many, 9*nclients)
+	}
+
+	defer cfg.deleteClient(first)
+	expired := first.id()
+	if err := first.TryPutAppend("dormant", "stale", "put"); err != Err(ErrExpired) {
+		cfg.t.Fatalf("a write from a client whose state was dropped returned %v; want %v", err, ErrExpired)
+	}
+	want := strconv.Itoa(9*nclients - 1)
+	if value := ck.Get("dormant"); value != want {
+		cfg.t.Fatalf("get returned %q after an expired write; want %q", value, want)
+	}
+	if first.id() == expired {
+		cfg.t.Fatalf("the Clerk kept its client id after ErrExpired")
+	}
+	if err := first.TryPutAppend("dormant", "again", "put"); err != nil {
+		cfg.t.Fatalf("a write under the new client id failed: %v", err)
+	}
+	if value := ck.Get("dormant"); value != "again" {
+		cfg.t.Fatalf("get returned %q; want %q", value, "again")
+	}
+}
+
+// simStep is one step of a scripted fault scenario run by runSimulation.
+type simStep struct {
+	name  string            // short description, for failure messages
+	apply func(cfg *config) // injects the fault (or the repair)
+}
+
+// runSimulation drives nclients recording clerks, each doing random puts, appends, and gets
+// on nkeys keys, while the steps are applied one after another, stepTime apart. Once the
+// script has finished and the network has healed, it checks that the combined history of
+// all clerks is linearizable and fails the test if it is not.
+// The fault schedule is fixed by the script, and each clerk's sequence of operations by seed,
+// so that with Raft.ElectionSeed set as well a failing run can be replayed with the same
+// workload and election timeouts. Timing still comes from the real clock and the network's
+// own randomness, so runs explore different interleavings.
+func (cfg *config) runSimulation(nclients int, nkeys int, steps []simStep, stepTime time.Duration, seed int64) {
+	var done int32
+	histories := make(chan []linearizability.Operation, nclients)
+	for c := 0; c < nclients; c++ {
+		go func(c int) {
+			ck := cfg.makeClientWithConfig(cfg.All(), ClerkConfig{Record: true})
+			defer cfg.deleteClient(ck)
+			r := rand.New(rand.NewSource(seed + int64(c)))
+			for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+				key := strconv.Itoa(r.Intn(nkeys))
+				switch r.Intn(3) {
+				case 0:
+					ck.Put(key, strconv.Itoa(r.Int()))
+				case 1:
+					ck.Append(key, fmt.Sprintf("x %d %d y", c, i))
+				default:
+					ck.Get(key)
+				}
+				cfg.op()
+			}
+			histories <- ck.History()
+		}(c)
+	}
+
+	var script []string
+	for _, step := range steps {
+		step.apply(cfg)
+		script = append(script, step.name)
+		time.Sleep(stepTime)
+	}
+	cfg.ConnectAll()
+	atomic.StoreInt32(&done, 1)
+
+	var history []linearizability.Operation
+	for c := 0; c < nclients; c++ {
+		history = append(history, <-histories...)
+	}
+	if !linearizability.CheckOperationsTimeout(linearizability.KvModel(), history, 10*time.Second) {
+		cfg.t.Fatalf("history of %d operations is not linearizable after %v with seed %d", len(history), script, seed)
+	}
+}
+
+// partitionHealCrashRecover scripts a partition that isolates the leader in the minority,
+// a heal, a crash of the leader, and its recovery from its persisted state.
+func partitionHealCrashRecover() []simStep {
+	var crashed int
+	return []simStep{
+		{"partition", func(cfg *config) {
+			p1, p2 := cfg.make_partition()
+			cfg.partition(p1, p2)
+		}},
+		{"heal", func(cfg *config) {
+			cfg.ConnectAll()
+		}},
+		{"crash", func(cfg *config) {
+			_, crashed = cfg.Leader()
+			cfg.ShutdownServer(crashed)
+		}},
+		{"recover", func(cfg *config) {
+			cfg.StartServer(crashed)
+			cfg.ConnectAll()
+		}},
+	}
+}
+
+// checkPreProposeReads starts n servers whose PreProposeHook counts the operations it sees,
+// rejects every read of one key and sends gets of an alias to another. A Clerk then reads through
+// the log, the read cache, ReadIndex, MultiGet, FindByValue and stale reads, and checks that the
+// hook saw each read, that the rejected key's value never came back, and that the alias was
+// followed on every read path.
+func checkPreProposeReads(t *testing.T, n int) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	hook := func(op Op) (Op, Err) {
+		mu.Lock()
+		seen[op.Command]++
+		mu.Unlock()
+		if isRead(op) && (op.Key == "secret" || op.Value == "s" || len(op.Keys) > 0 && op.Keys[0] == "secret") {
+			return op, ErrRejected
+		}
+		if op.Command == "get" && op.Key == "alias" {
+			op.Key = "open"
+		}
+		return op, ""
+	}
+	servercfg := ServerConfig{PreProposeHook: hook, LinearizableReads: true, ReadCacheSize: 10, IndexValues: true}
+	servercfg.Raft.LeaseDuration = 50 * time.Millisecond
+	cfg := make_config_with(t, n, false, -1, servercfg)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+
+	ck.Put("secret", "s")
+	ck.Put("open", "o")
+	for i := 0; i < 3; i++ {
+		// the first get of a key goes through ReadIndex or the log, and the next from the read cache.
+		if value := ck.Get("secret"); value != "" {
+			t.Fatalf("Get returned %q for a key the hook rejects", value)
+		}
+		if value := ck.Get("alias"); value != "o" {
+			t.Fatalf("Get of the alias returned %q; want %q", value, "o")
+		}
+		if value, _ := ck.GetWithConsistency("secret", Stale); value != "" {
+			t.Fatalf("stale Get returned %q for a key the hook rejects", value)
+		}
+		if values, err := ck.MultiGet([]string{"secret", "open"}); err != Err(ErrRejected) {
+			t.Fatalf("MultiGet of a rejected key returned %v, %v", values, err)
+		}
+		if keys, err := ck.FindByValue("s"); err != Err(ErrRejected) {
+			t.Fatalf("FindByValue of a rejected value returned %v, %v", keys, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for command, want := range map[string]int{"get": 9, "multiget": 3, "findbyvalue": 3} {
+		if seen[command] < want {
+			t.Fatalf("the hook saw %d %s requests; want at least %d", seen[command], command, want)
+		}
+	}
+}
+
+// unregisteredCommand is a command type that is never registered with gobWrapper.
+type unregisteredCommand struct {
+	Key string
+}
+
+// registeredCommand is a command type that checkCommandTypes registers before starting a server.
+type registeredCommand struct {
+	Key string
+}
+
+// checkCommandTypes starts a server whose CommandTypes include a type that was never
+// registered. StartKVServerWithConfig must refuse to start it, with an error naming the type,
+// rather than let the first command of that type fail during replication. With the type
+// replaced by a registered one, the server must start.
+func checkCommandTypes(t *testing.T) {
+	servercfg := ServerConfig{CommandTypes: []interface{}{unregisteredCommand{}}}
+	kv, err := StartKVServerWithConfig(make([]*rpc.ClientEnd, 1), 0, raft.MakePersister(), -1, servercfg)
+	if err == nil {
+		kv.Kill()
+		t.Fatalf("server started with unregistered command type %T", unregisteredCommand{})
+	}
+	if !strings.Contains(err.Error(), "unregisteredCommand") {
+		t.Fatalf("starting with an unregistered command type returned %q, which does not name the type", err)
+	}
+
+	gobWrapper.Register(registeredCommand{})
+	servercfg.CommandTypes = []interface{}{registeredCommand{}}
+	kv, err = StartKVServerWithConfig(make([]*rpc.ClientEnd, 1), 0, raft.MakePersister(), -1, servercfg)
+	if err != nil {
+		t.Fatalf("server with registered command type %T refused to start: %v", registeredCommand{}, err)
+	}
+	kv.Kill()
+}
+
+// checkPostApplyHook starts n servers whose PostApplyHook checks an invariant the clients keep,
+// that keys "a" and "b", always written together by BulkLoad, hold the same value, and records
+// every violation with the index and the replica's data. No violation may be seen while the
+// clients keep the invariant. It then corrupts "b" on one follower's state directly, as a
+// divergent replica would, and puts an unrelated key: the hook must report exactly one
+// violation, at that put's index, on the corrupted replica alone.
+func checkPostApplyHook(t *testing.T, n int) {
+	type violation struct {
+		index int
+		data  map[string]string
+	}
+	var mu sync.Mutex
+	var violations []violation
+	hook := func(index int, op Op, result Result, data map[string]string) {
+		if data["a"] != data["b"] {
+			mu.Lock()
+			violations = append(violations, violation{index, data})
+			mu.Unlock()
+		}
+	}
+	cfg := make_config_with(t, n, false, -1, ServerConfig{PostApplyHook: hook})
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+	defer cfg.deleteClient(ck)
+
+	// caught waits for every server to apply what the leader has, and returns its index.
+	caught := func() int {
+		_, leader := cfg.Leader()
+		cfg.mu.Lock()
+		kv := cfg.kvservers[leader]
+		cfg.mu.Unlock()
+		kv.mu.Lock()
+		index := kv.lastApplied
+		kv.mu.Unlock()
+		for i := 0; i < n; i++ {
+			cfg.mu.Lock()
+			server := cfg.kvservers[i]
+			cfg.mu.Unlock()
+			if !server.waitApplied(index, 5*time.Second) {
+				t.Fatalf("server %d has not applied index %d", i, index)
+			}
+		}
+		return index
+	}
+
+	for i := 0; i < 5; i++ {
+		v := strconv.Itoa(i)
+		ck.BulkLoad(map[string]string{"a": v, "b": v})
+		ck.Put("other", v)
+	}
+	caught()
+	mu.Lock()
+	if len(violations) > 0 {
+		mu.Unlock()
+		t.Fatalf("the hook saw %d violations while the clients kept the invariant", len(violations))
+	}
+	mu.Unlock()
+
+	_, leader := cfg.Leader()
+	corrupt := (leader + 1) % n
+	cfg.mu.Lock()
+	kv := cfg.kvservers[corrupt]
+	cfg.mu.Unlock()
+	kv.mu.Lock()
+	kv.sm.(*kvStore).data["b"] = "corrupt"
+	data := kv.sm.(*kvStore).data
+	kv.mu.Unlock()
+
+	ck.Put("other", "after")
+	index := caught()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(violations) != 1 {
+		t.Fatalf("the hook saw %d violations after one replica was corrupted; want 1", len(violations))
+	}
+	if v := violations[0]; v.index != index || reflect.ValueOf(v.data).Pointer() != reflect.ValueOf(data).Pointer() {
+		t.Fatalf("the hook reported the violation at index %d on another replica's data; want index %d on server %d", v.index, index, corrupt)
+	}
+}
+
+// checkSnapshotContents runs nclients clients putting, appending to and reading a few shared
+// keys for d on a cluster that snapshots often, while recording every operation the servers
+// apply, by log index, through PostApplyHook, and every snapshot each server persists. Each
+// snapshot is then checked against the log: it must be labelled with its own index, and its
+// data and each client's latest request must be exactly those of replaying the operations up
+// to that index.
+func checkSnapshotContents(t *testing.T, nclients int, d time.Duration) {
+	// an entry may hold several coalesced appends, and every replica reports each of them, so
+	// an operation is recorded the first time it is reported at its index.
+	var mu sync.Mutex
+	applied := make(map[int][]Op)
+	hook := func(index int, op Op, result Result, data map[string]string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, seen := range applied[index] {
+			if seen.ClientId == op.ClientId && seen.RequestId == op.RequestId {
+				return
+			}
+		}
+		applied[index] = append(applied[index], op)
+	}
+	cfg := make_config_with(t, 3, false, 1000, ServerConfig{PostApplyHook: hook})
+	defer cfg.cleanup()
+	cfg.begin("Test: snapshots taken under load hold the state at their index")
+
+	type persisted struct {
+		server   int
+		snapshot raft.Snapshot
+	}
+	var snapshots []persisted
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		last := make([]int, cfg.n)
+		for {
+			for i := 0; i < cfg.n; i++ {
+				cfg.mu.Lock()
+				persister := cfg.saved[i]
+				cfg.mu.Unlock()
+				snapshot, err := raft.ParseSnapshot(persister.ReadSnapshot())
+				if err == nil && snapshot.LastIncludedIndex > last[i] {
+					last[i] = snapshot.LastIncludedIndex
+					snapshots = append(snapshots, persisted{i, snapshot})
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	stop := time.Now().Add(d)
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; time.Now().Before(stop); i++ {
+				key := strconv.Itoa(rand.Intn(3))
+				switch rand.Intn(3) {
+				case 0:
+					ck.Put(key, strconv.Itoa(c))
+				case 1:
+					ck.Append(key, strconv.Itoa(i))
+				default:
+					ck.Get(key)
+				}
+				cfg.op()
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(done)
+	<-watched
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(snapshots) < 2*cfg.n {
+		t.Fatalf("the servers persisted only %d snapshots", len(snapshots))
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].snapshot.LastIncludedIndex < snapshots[j].snapshot.LastIncludedIndex })
+
+	// replay the log, checking each snapshot as its index is reached.
+	data := make(map[string]string)
+	ack := make(map[int64]int64)
+	index := 0
+	for _, p := range snapshots {
+		for ; index < p.snapshot.LastIncludedIndex; index++ {
+			for _, op := range applied[index+1] {
+				if op.ClientId == 0 {
+					continue
+				}
+				last, known := ack[op.ClientId]
+				fresh := !known || op.RequestId > last
+				if fresh {
+					ack[op.ClientId] = op.RequestId
+				}
+				switch {
+				case fresh && op.Command == "put":
+					data[op.Key] = op.Value
+				case fresh && op.Command == "append":
+					data[op.Key] += op.Value
+				}
+			}
+		}
+		cfg.mu.Lock()
+		kv := cfg.kvservers[p.server]
+		cfg.mu.Unlock()
+		decoded, err := kv.decodeSnapshot(p.snapshot.Data, p.snapshot.LastIncludedIndex)
+		if err != nil {
+			t.Fatalf("server %d's snapshot at index %d: %v", p.server, index, err)
+		}
+		if decoded.recorded != index {
+			t.Fatalf("server %d's snapshot at index %d holds the state at index %d", p.server, index, decoded.recorded)
+		}
+		if got := decoded.sm.(*kvStore).data; !reflect.DeepEqual(got, data) {
+			t.Fatalf("server %d's snapshot at index %d holds %v; the log up to it gives %v", p.server, index, got, data)
+		}
+		for clientId, requestId := range ack {
+			if decoded.ack[clientId] != requestId {
+				t.Fatalf("server %d's snapshot at index %d has client %d at request %d; the log up to it gives %d",
+					p.server, index, clientId, decoded.ack[clientId], requestId)
+			}
+		}
+	}
+	cfg.end()
+}
+
+// checkExportedHistory runs nclients clients putting, appending to and reading a few shared
+// keys for d on servers with ExportOperations set, partitioning the cluster at random a few
+// times along the way. The history the servers export must be linearizable under KvModel, and
+// must stop being so once a read of a value nobody wrote is added to it.
+func checkExportedHistory(t *testing.T, nclients int, d time.Duration) {
+	exports := make(chan linearizability.Operation, 100)
+	var history []linearizability.Operation
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for op := range exports {
+			history = append(history, op)
+		}
+	}()
+	cfg := make_config_with(t, 5, false, -1, ServerConfig{ExportOperations: exports})
+	defer cfg.cleanup()
+	cfg.begin("Test: the history the servers export is linearizable")
+
+	var done int32
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+				key := strconv.Itoa(rand.Intn(3))
+				switch rand.Intn(3) {
+				case 0:
+					ck.Put(key, strconv.Itoa(rand.Int()))
+				case 1:
+					ck.Append(key, fmt.Sprintf("x %d %d y", c, i))
+				default:
+					ck.Get(key)
+				}
+				cfg.op()
+			}
+		}(c)
+	}
+	for start := time.Now(); time.Since(start) < d; {
+		time.Sleep(d / 4)
+		p1, p2 := cfg.make_partition()
+		cfg.partition(p1, p2)
+	}
+	cfg.ConnectAll()
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+
+	// the servers send an operation once they have replied to it, so wait for the last ones,
+	// then shut them down before closing the channel they send on.
+	time.Sleep(time.Second)
+	for i := 0; i < cfg.n; i++ {
+		cfg.ShutdownServer(i)
+	}
+	close(exports)
+	<-drained
+
+	if len(history) == 0 {
+		t.Fatalf("the servers exported no operations")
+	}
+	if !linearizability.CheckOperationsTimeout(linearizability.KvModel(), history, 10*time.Second) {
+		t.Fatalf("the exported history of %d operations is not linearizable", len(history))
+	}
+	last := history[len(history)-1].Return
+	forged := linearizability.Operation{
+		Input:  linearizability.KvInput{Op: 0, Key: "0"},
+		Call:   last + 1,
+		Output: linearizability.KvOutput{Value: "never written"},
+		Return: last + 2,
+	}
+	if linearizability.CheckOperationsTimeout(linearizability.KvModel(), append(history, forged), 10*time.Second) {
+		t.Fatalf("the exported history stayed linearizable with a read of a value nobody wrote")
+	}
+	cfg.end()
+}
+
+// checkEmbeddedCluster starts a Cluster of n servers, checks that values put through one of its
+// Clerks read back through another, and that Shutdown stops every goroutine the cluster started.
+func checkEmbeddedCluster(t *testing.T, n int) {
+	before := runtime.NumGoroutine()
+	c, err := NewCluster(n)
+	if err != nil {
+		t.Fatalf("NewCluster(%d): %v", n, err)
+	}
+	writer, reader := c.MakeClerk(), c.MakeClerk()
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		writer.Put(key, "v"+key)
+		if value := reader.Get(key); value != "v"+key {
+			c.Shutdown()
+			t.Fatalf("Get(%q) returned %q after Put(%q, %q)", key, value, key, "v"+key)
+		}
+	}
+
+	c.Shutdown()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running after Shutdown, against %d before the cluster started", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
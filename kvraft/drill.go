@@ -0,0 +1,52 @@
+package raftkv
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// drillTimeout bounds how long FailoverDrill waits for the new leader to take over.
+const drillTimeout = 5 * time.Second
+
+// FailoverDrill performs a planned failover of the cluster reached through servers, handing
+// leadership from the current leader to servers[target], and measures the unavailability
+// window: the time from the start of the transfer until another server is leader in a later
+// term and can accept writes again. It returns the index of the new leader in servers, which
+// may differ from target if another server won the election.
+func FailoverDrill(servers []*rpc.ClientEnd, target int) (int, time.Duration, error) {
+	if target < 0 || target >= len(servers) {
+		return -1, 0, fmt.Errorf("raftkv: drill target %d out of range", target)
+	}
+	ck := MakeClerk(servers)
+	old := ck.FindLeader()
+	if old == target {
+		return -1, 0, fmt.Errorf("raftkv: drill target %d is already the leader", target)
+	}
+
+	var oldStatus, targetStatus StatusReply
+	if !servers[old].Call("KVServer.Status", &StatusArgs{}, &oldStatus) || !oldStatus.IsLeader {
+		return -1, 0, fmt.Errorf("raftkv: leader %d stepped down before the drill started", old)
+	}
+	if !servers[target].Call("KVServer.Status", &StatusArgs{}, &targetStatus) {
+		return -1, 0, fmt.Errorf("raftkv: drill target %d is unreachable", target)
+	}
+
+	start := time.Now()
+	reply := TransferLeadershipReply{}
+	if !servers[old].Call("KVServer.TransferLeadership", &TransferLeadershipArgs{Target: targetStatus.Me}, &reply) || reply.WrongLeader || reply.Err != OK {
+		return -1, 0, fmt.Errorf("raftkv: leader %d refused to transfer leadership", old)
+	}
+
+	for time.Since(start) < drillTimeout {
+		for i, server := range servers {
+			status := StatusReply{}
+			if i != old && server.Call("KVServer.Status", &StatusArgs{}, &status) && status.IsLeader && status.Term > oldStatus.Term {
+				return i, time.Since(start), nil
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return -1, 0, fmt.Errorf("raftkv: no new leader within %v", drillTimeout)
+}
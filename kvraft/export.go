@@ -0,0 +1,110 @@
+package raftkv
+
+import (
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/linearizability"
+)
+
+// With cfg.ExportOperations set, every client operation is stamped with the server that proposed
+// it and the time that server received it. Only the proposer exports an operation, once it has
+// applied it: the operation took effect when it committed, which is after it was proposed and
+// before the proposer applied it, so that interval is a valid call and return for the checker.
+// Retries that were deduplicated are not exported, since they never took effect themselves.
+// The proposer is identified by incarnation, so a restarted server replaying its log does not
+// export operations a second time; the flip side is that operations its previous run proposed
+// but never applied are not exported at all.
+
+// exportApplied returns the operations to export for op, just applied with result by this
+// server, in the KvModel form; fresh is false if op was a deduplicated retry.
+// Must be called with the lock held.
+func (kv *KVServer) exportApplied(op Op, result Result, fresh bool) []linearizability.Operation {
+	if kv.cfg.ExportOperations == nil || op.ProposedAt == 0 || op.Proposer != kv.incarnation {
+		return nil
+	}
+	var inputs []linearizability.KvInput
+	var outputs []linearizability.KvOutput
+	switch op.Command {
+	case "get":
+		inputs = append(inputs, linearizability.KvInput{Op: 0, Key: op.Key})
+		outputs = append(outputs, linearizability.KvOutput{Value: result.Value})
+	case "multiget":
+		for _, key := range op.Keys {
+			inputs = append(inputs, linearizability.KvInput{Op: 0, Key: key})
+			outputs = append(outputs, linearizability.KvOutput{Value: result.Values[key]})
+		}
+	case "put", "delete":
+		// a delete is a put of the empty string, which is how KvModel sees a missing key.
+		if fresh {
+			inputs = append(inputs, linearizability.KvInput{Op: 1, Key: op.Key, Value: op.Value})
+			outputs = append(outputs, linearizability.KvOutput{})
+		}
+	case "append":
+		if fresh {
+			inputs = append(inputs, linearizability.KvInput{Op: 2, Key: op.Key, Value: op.Value})
+			outputs = append(outputs, linearizability.KvOutput{})
+		}
+	case "bulk":
+		if fresh {
+			for key, value := range op.Pairs {
+				inputs = append(inputs, linearizability.KvInput{Op: 1, Key: key, Value: value})
+				outputs = append(outputs, linearizability.KvOutput{})
+			}
+		}
+	case "transform":
+		// a transform took the key to the value it returned, which KvModel sees as a put.
+		if fresh && result.Err == OK {
+			inputs = append(inputs, linearizability.KvInput{Op: 1, Key: op.Key, Value: result.Value})
+			outputs = append(outputs, linearizability.KvOutput{})
+		}
+	case "rename":
+		// a rename is a delete of the old key and a put of its value to the new one.
+		if fresh && result.Err == OK {
+			inputs = append(inputs, linearizability.KvInput{Op: 1, Key: op.Key, Value: ""})
+			inputs = append(inputs, linearizability.KvInput{Op: 1, Key: op.NewKey, Value: result.Value})
+			outputs = append(outputs, linearizability.KvOutput{}, linearizability.KvOutput{})
+		}
+	case "flushall":
+		// a flush is a delete of every key it found.
+		if fresh && result.Err == OK {
+			for _, key := range result.Keys {
+				inputs = append(inputs, linearizability.KvInput{Op: 1, Key: key, Value: ""})
+				outputs = append(outputs, linearizability.KvOutput{})
+			}
+		}
+	case "checkandact":
+		// one that acted is a put of the new value, and one that did not a get of the value it saw.
+		if fresh && result.Err == OK {
+			inputs = append(inputs, linearizability.KvInput{Op: 1, Key: op.Key, Value: op.Value})
+			outputs = append(outputs, linearizability.KvOutput{})
+		} else if fresh {
+			inputs = append(inputs, linearizability.KvInput{Op: 0, Key: op.Key})
+			outputs = append(outputs, linearizability.KvOutput{Value: result.Value})
+		}
+	}
+	// id allocations are not exported, since they leave the data alone.
+
+	end := time.Now().UnixNano()
+	exported := make([]linearizability.Operation, len(inputs))
+	for i := range inputs {
+		exported[i] = linearizability.Operation{Input: inputs[i], Call: op.ProposedAt, Output: outputs[i], Return: end}
+	}
+	return exported
+}
+
+// exportReads exports gets the leader answered from its local state, without the log,
+// as reads of keys spanning from start to now.
+func (kv *KVServer) exportReads(keys []string, values map[string]string, start int64) {
+	if kv.cfg.ExportOperations == nil {
+		return
+	}
+	end := time.Now().UnixNano()
+	for _, key := range keys {
+		kv.cfg.ExportOperations <- linearizability.Operation{
+			Input:  linearizability.KvInput{Op: 0, Key: key},
+			Call:   start,
+			Output: linearizability.KvOutput{Value: values[key]},
+			Return: end,
+		}
+	}
+}
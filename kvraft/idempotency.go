@@ -0,0 +1,62 @@
+package raftkv
+
+// A write may carry an idempotency key, chosen by the caller rather than by the Clerk, so that
+// the same logical request sent by different clients (a retry from a restarted process, say) is
+// applied at most once. The server remembers the outcome of each key it applied, and a later
+// write with the same key, from whichever client and under whichever request id, gets that
+// outcome instead of being applied again. Two writes are the same if cfg.IdempotencyKey maps
+// them to the same non-empty key; by default that is the key they carry. Like the state of
+// dormant clients, a key is forgotten once AckRetention log entries have been applied after it.
+
+// idempotentOutcome is the remembered outcome of a write applied under an idempotency key.
+type idempotentOutcome struct {
+	Err   Err // Outcome returned to every write with the key
+	Index int // Log index at which the write was applied, for retention
+}
+
+// idempotencyKey returns the key op is deduplicated under, or "" if it has none.
+func (kv *KVServer) idempotencyKey(op Op) string {
+	if op.Command == "compact" || op.Command == "snapshot" || op.Command == "nextid" || isRead(op) {
+		return ""
+	}
+	if kv.cfg.IdempotencyKey != nil {
+		return kv.cfg.IdempotencyKey(op)
+	}
+	return op.IdempotencyKey
+}
+
+// idempotentErr returns the outcome of the write already applied under op's idempotency key,
+// and whether there is one still retained.
+func (kv *KVServer) idempotentErr(op Op) (Err, bool) {
+	key := kv.idempotencyKey(op)
+	if key == "" {
+		return "", false
+	}
+	outcome, ok := kv.idempotent[key]
+	if !ok || kv.idempotencyExpired(outcome) {
+		return "", false
+	}
+	return outcome.Err, true
+}
+
+// recordIdempotent remembers the outcome of a write applied under an idempotency key.
+func (kv *KVServer) recordIdempotent(op Op, err Err) {
+	if key := kv.idempotencyKey(op); key != "" {
+		kv.idempotent[key] = idempotentOutcome{err, kv.lastApplied}
+	}
+}
+
+// idempotencyExpired reports whether an outcome is past AckRetention. Like isDormant, it
+// depends only on log indexes, so every replica agrees on it.
+func (kv *KVServer) idempotencyExpired(outcome idempotentOutcome) bool {
+	return kv.cfg.AckRetention > 0 && kv.lastApplied-outcome.Index > kv.cfg.AckRetention
+}
+
+// pruneIdempotencyKeys drops the outcomes past AckRetention.
+func (kv *KVServer) pruneIdempotencyKeys() {
+	for key, outcome := range kv.idempotent {
+		if kv.idempotencyExpired(outcome) {
+			delete(kv.idempotent, key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package raftkv
+
+import "sort"
+
+// With cfg.IndexValues set, the default store keeps a reverse index from each value to the keys
+// holding it, so that Clerk.FindByValue needn't scan the data. The index is updated wherever an
+// applied operation changes a key, alongside the read cache, so every replica keeps the same
+// index in step with its own data. It is part of the store's snapshot.
+
+// reindex moves keys an applied operation wrote or deleted to the entry of the value they now
+// hold, if any.
+func (s *kvStore) reindex(keys ...string) {
+	if s.byValue == nil {
+		return
+	}
+	for _, key := range keys {
+		if old, ok := s.indexed[key]; ok {
+			delete(s.byValue[old], key)
+			if len(s.byValue[old]) == 0 {
+				delete(s.byValue, old)
+			}
+			delete(s.indexed, key)
+		}
+		value, ok := s.data[key]
+		if !ok {
+			continue
+		}
+		if s.byValue[value] == nil {
+			s.byValue[value] = make(map[string]bool)
+		}
+		s.byValue[value][key] = true
+		s.indexed[key] = value
+	}
+}
+
+// findByValue returns the keys holding value, in key order.
+func (s *kvStore) findByValue(value string) ([]string, Err) {
+	if s.byValue == nil {
+		return nil, ErrNoIndex
+	}
+	keys := make([]string, 0, len(s.byValue[value]))
+	for key := range s.byValue[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, OK
+}
+
+// restoreIndex rebuilds the index after a snapshot is restored, from the snapshot's own index
+// if it has one, and otherwise, for a snapshot taken without cfg.IndexValues, from the data.
+func (s *kvStore) restoreIndex(byValue map[string]map[string]bool) {
+	if s.byValue == nil {
+		return
+	}
+	if byValue == nil {
+		s.byValue = make(map[string]map[string]bool)
+		s.indexed = make(map[string]string)
+		keys := make([]string, 0, len(s.data))
+		for key := range s.data {
+			keys = append(keys, key)
+		}
+		s.reindex(keys...)
+		return
+	}
+	s.byValue = byValue
+	s.indexed = make(map[string]string, len(s.data))
+	for value, keys := range byValue {
+		for key := range keys {
+			s.indexed[key] = value
+		}
+	}
+}
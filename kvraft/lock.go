@@ -0,0 +1,115 @@
+package raftkv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locks are built on the Clerk's own operations, so the servers know nothing of them. A lock
+// is held in the key "lock:" followed by its name, whose value records the holder, when its
+// hold expires and its fencing token; an empty value means the lock is free. It is taken and
+// released with check-and-acts against the value last read, so of two clients racing for it
+// at most one succeeds. The fencing token is drawn with NextID after the free lock was read,
+// and so after the previous holder's token was drawn, which makes tokens increase across
+// acquisitions: a resource that remembers the highest token it has seen can refuse a holder
+// whose lock has since expired and been taken by someone else. A hold expires by the clock
+// of the clients contending for the lock, so locks assume their clocks roughly agree; the
+// TTL should be long against the drift between them.
+
+// lockHold is the holder of a lock, as stored in its key.
+type lockHold struct {
+	Token     int64
+	ExpiresAt int64 // Time, in nanoseconds, at which the hold expires
+	Owner     string
+}
+
+// lockKey returns the key that holds the lock called name.
+func lockKey(name string) string {
+	return "lock:" + name
+}
+
+// encodeHold formats a hold as the value of its lock's key.
+func encodeHold(hold lockHold) string {
+	return fmt.Sprintf("%d %d %s", hold.Token, hold.ExpiresAt, hold.Owner)
+}
+
+// decodeHold parses the value of a lock's key; ok is false if the value is not a hold.
+func decodeHold(value string) (hold lockHold, ok bool) {
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) != 3 {
+		return lockHold{}, false
+	}
+	token, err1 := strconv.ParseInt(fields[0], 10, 64)
+	expiresAt, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return lockHold{}, false
+	}
+	return lockHold{token, expiresAt, fields[2]}, true
+}
+
+/*
+ * Lock takes the lock called name for owner, for ttl, and returns its fencing token, which is
+ * greater than that of every earlier hold of the lock. It does not wait: it fails with
+ * ErrLocked if another owner holds the lock and its hold has not expired, or if another owner
+ * took it first. An owner that already holds the lock takes it again, renewing the hold under
+ * a new token. It fails with ErrBadValue if owner is empty or ttl is not positive, and with
+ * ErrMismatch if the lock's key holds something other than a lock.
+ */
+func (ck *Clerk) Lock(name string, owner string, ttl time.Duration) (int64, error) {
+	if owner == "" || ttl <= 0 {
+		return 0, Err(ErrBadValue)
+	}
+	key := lockKey(name)
+	current, err := ck.TryGet(key)
+	if err != nil {
+		return 0, err
+	}
+	if current != "" {
+		hold, ok := decodeHold(current)
+		if !ok {
+			return 0, Err(ErrMismatch)
+		}
+		if hold.Owner != owner && time.Now().UnixNano() < hold.ExpiresAt {
+			return 0, Err(ErrLocked)
+		}
+	}
+
+	token, err := ck.NextID(key)
+	if err != nil {
+		return 0, err
+	}
+	hold := lockHold{Token: token, ExpiresAt: time.Now().Add(ttl).UnixNano(), Owner: owner}
+	_, acted, err := ck.CheckAndAct(key, current, encodeHold(hold))
+	if err != nil {
+		return 0, err
+	}
+	if !acted {
+		return 0, Err(ErrLocked)
+	}
+	return token, nil
+}
+
+/*
+ * Unlock releases the lock called name if owner holds it, even if the hold has expired, as long
+ * as no one has taken the lock since. It fails with ErrNotLockOwner otherwise.
+ */
+func (ck *Clerk) Unlock(name string, owner string) error {
+	key := lockKey(name)
+	current, err := ck.TryGet(key)
+	if err != nil {
+		return err
+	}
+	if hold, ok := decodeHold(current); !ok || hold.Owner != owner {
+		return Err(ErrNotLockOwner)
+	}
+	_, acted, err := ck.CheckAndAct(key, current, "")
+	if err != nil {
+		return err
+	}
+	if !acted {
+		return Err(ErrNotLockOwner)
+	}
+	return nil
+}
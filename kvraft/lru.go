@@ -0,0 +1,85 @@
+package raftkv
+
+import (
+	"container/list"
+	"sort"
+)
+
+// With cfg.MaxKeys set, the default store holds at most that many keys, evicting the least
+// recently used key when a write adds one too many. Recency is the order in which operations
+// were applied from the log: writes, and the gets that go through the log, refresh the keys they
+// touch, so every replica, applying the same log, evicts the same keys. Reads served without the
+// log (cached, ReadIndex, leader and stale reads) leave no trace in it, so they never refresh a
+// key, and for the same reason a multiget never does. The recency order is part of the store's
+// snapshot.
+
+// touch marks keys as the most recently used, in the order given.
+func (s *kvStore) touch(keys ...string) {
+	if s.maxKeys <= 0 {
+		return
+	}
+	for _, key := range keys {
+		if e, ok := s.used[key]; ok {
+			s.recency.MoveToBack(e)
+		} else {
+			s.used[key] = s.recency.PushBack(key)
+		}
+	}
+}
+
+// forget drops a deleted key from the recency order.
+func (s *kvStore) forget(key string) {
+	if e, ok := s.used[key]; ok {
+		s.recency.Remove(e)
+		delete(s.used, key)
+	}
+}
+
+// evict deletes the least recently used keys until the store is within cfg.MaxKeys.
+func (s *kvStore) evict() {
+	for s.maxKeys > 0 && len(s.data) > s.maxKeys {
+		key := s.recency.Remove(s.recency.Front()).(string)
+		delete(s.used, key)
+		delete(s.data, key)
+		s.deletes++
+		s.evictions++
+		s.invalidate(key)
+		s.reindex(key)
+	}
+}
+
+// recencyOrder returns the keys from least to most recently used, for the snapshot.
+func (s *kvStore) recencyOrder() []string {
+	order := make([]string, 0, s.recency.Len())
+	for e := s.recency.Front(); e != nil; e = e.Next() {
+		order = append(order, e.Value.(string))
+	}
+	return order
+}
+
+// restoreRecency rebuilds the recency order from a snapshot's. Keys the snapshot has no order
+// for, because it was taken without MaxKeys, count as least recently used, in key order.
+func (s *kvStore) restoreRecency(order []string) {
+	s.recency = list.New()
+	s.used = make(map[string]*list.Element)
+	if s.maxKeys <= 0 {
+		return
+	}
+	var unordered []string
+	known := make(map[string]bool, len(order))
+	for _, key := range order {
+		known[key] = true
+	}
+	for key := range s.data {
+		if !known[key] {
+			unordered = append(unordered, key)
+		}
+	}
+	sort.Strings(unordered)
+	s.touch(unordered...)
+	for _, key := range order {
+		if _, ok := s.data[key]; ok {
+			s.touch(key)
+		}
+	}
+}
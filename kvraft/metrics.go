@@ -0,0 +1,60 @@
+package raftkv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// WriteMetrics writes the server's Raft metrics (see raft.Raft.WriteMetrics), followed by its
+// own statistics, to w in the Prometheus text exposition format. Apply latency is rendered as a
+// histogram in seconds; every sample is labelled with the server's index.
+func (kv *KVServer) WriteMetrics(w io.Writer) error {
+	if err := kv.rf.WriteMetrics(w); err != nil {
+		return err
+	}
+	stats := kv.Stats()
+	buf := new(bytes.Buffer)
+	peer := fmt.Sprintf(`peer="%d"`, kv.me)
+
+	h := stats.ApplyLatency
+	fmt.Fprintf(buf, "# HELP sentinel_kv_apply_latency_seconds Time on the leader from proposing an operation to applying it.\n")
+	fmt.Fprintf(buf, "# TYPE sentinel_kv_apply_latency_seconds histogram\n")
+	cumulative := int64(0)
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		fmt.Fprintf(buf, "sentinel_kv_apply_latency_seconds_bucket{%s,le=\"%s\"} %d\n", peer, le, cumulative)
+	}
+	fmt.Fprintf(buf, "sentinel_kv_apply_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", peer, h.Count)
+	fmt.Fprintf(buf, "sentinel_kv_apply_latency_seconds_sum{%s} %g\n", peer, h.Sum.Seconds())
+	fmt.Fprintf(buf, "sentinel_kv_apply_latency_seconds_count{%s} %d\n", peer, h.Count)
+
+	writeMetric(buf, "sentinel_kv_apply_queue_depth", "gauge", "Committed operations waiting to be applied.", peer, int64(stats.ApplyQueueDepth))
+	writeMetric(buf, "sentinel_kv_apply_queue_capacity", "gauge", "Buffer size of the apply channel.", peer, int64(stats.ApplyQueueCapacity))
+	writeMetric(buf, "sentinel_kv_read_cache_hits_total", "counter", "Gets answered from the read cache under a lease.", peer, stats.ReadCacheHits)
+	writeMetric(buf, "sentinel_kv_read_cache_misses_total", "counter", "Gets sent through the log despite a lease.", peer, stats.ReadCacheMisses)
+	writeMetric(buf, "sentinel_kv_lease_reads_total", "counter", "Reads served under the leader's lease.", peer, stats.LeaseReads)
+	writeMetric(buf, "sentinel_kv_read_index_reads_total", "counter", "Reads served after a ReadIndex round.", peer, stats.ReadIndexReads)
+	writeMetric(buf, "sentinel_kv_snapshots_total", "counter", "Snapshots handed to Raft.", peer, stats.Snapshots)
+	writeMetric(buf, "sentinel_kv_evictions_total", "counter", "Keys evicted to stay within MaxKeys.", peer, stats.Evictions)
+	writeMetric(buf, "sentinel_kv_throttled_total", "counter", "Requests refused for exceeding ClientRate.", peer, stats.Throttled)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// MetricsHandler returns an http.Handler that serves WriteMetrics, for Prometheus to scrape.
+func (kv *KVServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		kv.WriteMetrics(w)
+	})
+}
+
+// writeMetric writes a metric with a single sample in the Prometheus text exposition format.
+func writeMetric(buf *bytes.Buffer, name string, kind string, help string, labels string, value int64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %d\n", name, help, name, kind, name, labels, value)
+}
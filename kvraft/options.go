@@ -0,0 +1,211 @@
+package raftkv
+
+import (
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/linearizability"
+	"github.com/ReshiAdavan/Sentinel/raft"
+)
+
+// ServerConfig holds the optional behaviour of a KVServer.
+// The zero value gives the behaviour of StartKVServer.
+type ServerConfig struct {
+	// Raft is passed to the server's Raft peer. With Raft.MaxUncommittedEntries set, the leader
+	// answers ErrBusy while its backlog is full, and the Clerk backs off and retries.
+	Raft raft.Config
+
+	// ApplyBuffer is the buffer size of the channel on which Raft delivers committed
+	// operations to the server. Zero means the default of 100.
+	ApplyBuffer int
+
+	// CommandTypes lists the concrete types, besides Op and Result, that the service will place in
+	// interface{} fields of replicated commands. Each must already be registered with
+	// gobWrapper.Register; StartKVServerWithConfig refuses to start if one is not, or if it fails
+	// the capitalization check, rather than failing later during replication.
+	CommandTypes []interface{}
+
+	// AckRetention, if positive, is the number of log entries after which a client with no newly
+	// applied request is considered dormant and its duplicate-detection state is discarded, keeping
+	// snapshots small when many clients have come and gone. A dormant client's next write fails
+	// with ErrExpired, since it may retry a request applied before, and its Clerk carries on under
+	// a new client id; the retention should comfortably exceed the time clients go between writes.
+	// Zero keeps every client's state forever.
+	AckRetention int
+
+	// IdempotencyKey, if set, derives the idempotency key a write is deduplicated under, in
+	// place of the one it carries, e.g. from a hash of its content; writes that map to the same
+	// non-empty key are applied at most once, see idempotency.go. It runs in the apply loop of
+	// every replica, so it must be deterministic.
+	IdempotencyKey func(op Op) string
+
+	// CompactionInterval, if positive, is how often the leader checks whether keys have been
+	// deleted since the last compaction and, if so, proposes a compaction through the log.
+	// Applying it shrinks the data map, which otherwise keeps the space of every deleted key,
+	// and drops the dedup state of dormant clients. Zero disables compaction.
+	CompactionInterval time.Duration
+
+	// IdleSnapshotAfter, if positive, has the leader propose a snapshot through the log once no
+	// write has been applied for that long and entries have been applied since the last snapshot,
+	// even though the Raft state is below maxraftstate. Every replica snapshots as it applies the
+	// proposal, so an idle cluster is left with a short log, and a later restart or a follower
+	// catching up has little to replay. Ignored if maxraftstate is -1.
+	IdleSnapshotAfter time.Duration
+
+	// SnapshotHighWatermark and SnapshotLowWatermark, in bytes of Raft state, give snapshotting a
+	// hysteresis band. The server snapshots once the state exceeds the high watermark, and then not
+	// again until the state has dropped below the low watermark or Raft has taken the snapshot,
+	// rather than on every operation applied while Raft is still trimming its log. If the state is
+	// still above the high watermark once Raft has taken the snapshot, the server snapshots again.
+	// The low watermark must be below the high one. Zero SnapshotHighWatermark means
+	// maxraftstate; zero SnapshotLowWatermark disables the band. Ignored if maxraftstate is -1.
+	SnapshotHighWatermark int
+	SnapshotLowWatermark  int
+
+	// MaxKeys, if positive, bounds the number of keys the store holds. A write that adds a key
+	// beyond the bound evicts the least recently used key, with recency taken from the order of
+	// the log, so that every replica evicts the same keys; see lru.go for which reads count.
+	MaxKeys int
+
+	// IndexValues has the default store keep a reverse index from each value to the keys holding
+	// it, updated as operations are applied and saved in snapshots, so that Clerk.FindByValue
+	// can answer without scanning the data; see index.go. The index costs a map entry per key.
+	// Without it, FindByValue fails with ErrNoIndex.
+	IndexValues bool
+
+	// ReadCacheSize, if positive, is how many recently read keys the server caches so that the
+	// leader can answer gets on them under its lease, without a trip through the log. A cached
+	// value is dropped as soon as a write to its key is applied, so cached reads stay
+	// linearizable. It needs Raft.LeaseDuration, and with it the lease's clock assumptions.
+	ReadCacheSize int
+
+	// LinearizableReads has the leader answer linearizable gets from its local state once it has
+	// applied up to a Raft ReadIndex, which confirms its leadership with one quorum round, rather
+	// than proposing each get through the log. A leader that learns during the round that it was
+	// deposed refuses the read. Until the leader has committed an entry in its term, gets still go
+	// through the log. Multigets and value lookups always take the ReadIndex path.
+	LinearizableReads bool
+
+	// LeaseReads has the leader answer gets, multigets and value lookups from its local state
+	// under its lease (see raft.Raft.LeaseRead), without the quorum round of a ReadIndex. Once
+	// the lease has lapsed, or was given up to a leadership transfer, reads fall back to
+	// ReadIndex. It needs Raft.LeaseDuration, and with it the lease's clock assumption: no
+	// server's clock may run fast enough, relative to the leader's, to cut an election timeout
+	// short by the margin between it and LeaseDuration. With unreliable clocks, leave it off.
+	LeaseReads bool
+
+	// ResultCacheSize, if positive, is how many clients' latest results the server caches, so
+	// that a client retrying a request after a timeout gets the result back without the request
+	// going through Raft again; see results.go. Zero caches none.
+	ResultCacheSize int
+
+	// AllowFlushAll lets clients delete every key with Clerk.FlushAll, e.g. to reset test
+	// fixtures. Without it, the server refuses flushes with ErrRejected, so that a stray call
+	// cannot wipe a production store.
+	AllowFlushAll bool
+
+	// CoalesceAppends makes the leader merge appends from one client to one key that arrive while
+	// an earlier one is still being replicated into a single log entry, proposed once that append
+	// completes. Each append keeps its own request id and is deduplicated on its own, so retries
+	// behave as before; a client only benefits if it issues appends concurrently.
+	CoalesceAppends bool
+
+	// ExportOperations, if set, receives every client operation the server proposed, once it has
+	// taken effect, as a linearizability.Operation in KvModel form, for checking the history as
+	// the servers saw it. Reads answered without the log are exported by the leader that answered
+	// them, renames as a delete of the old key and a put of the new one, and flushes as a delete
+	// of every key they found. Retries that were deduplicated are left out. Sends block, so the
+	// consumer must keep up or the server stalls. Meant for tests and debugging.
+	ExportOperations chan<- linearizability.Operation
+
+	// PreProposeHook, if set, is called on the leader with every client operation, reads included,
+	// at the top of its RPC handler, before the server answers it from the log, from local state or
+	// from a cache; stale reads are screened by whichever server answers them. It never runs on
+	// the apply path, and runs again for each retry. It may return a rewritten operation, or a
+	// non-empty Err to reject the operation, in which case the Err is returned to the client and
+	// nothing enters the log. It must not rewrite ClientId or RequestId: the server matches applied
+	// entries and cached results to requests by them, so every attempt of a request whose ids were
+	// rewritten would fail, retries included.
+	PreProposeHook func(op Op) (Op, Err)
+
+	// PostApplyHook, if set, is called on every replica after each committed operation has been
+	// applied, in log order, with the operation's log index, its result, and the resulting data.
+	// Since every replica applies the same log, the hook sees the same sequence everywhere, which
+	// makes it a place to record metrics or to check invariants (e.g. panic on a violation).
+	// It runs with the server's lock held and must neither modify data nor call back into the server.
+	// With a custom state machine, data is nil.
+	PostApplyHook func(index int, op Op, result Result, data map[string]string)
+
+	// ClientRate, if positive, limits each client to that many requests a second on the leader,
+	// with bursts of up to ClientBurst requests, or one second's worth if ClientBurst is zero.
+	// Requests beyond the limit are refused with ErrThrottled before they are proposed, and the
+	// Clerk backs off and retries them, so one client flooding the leader cannot starve the
+	// others. See throttle.go.
+	ClientRate  float64
+	ClientBurst int
+
+	// NewStateMachine, if set, creates the state machine committed operations are applied to,
+	// in place of the key-value map; it is called each time the server starts, and each time it
+	// installs a snapshot, which it restores into a fresh state machine without holding its lock
+	// and then swaps in. The server still handles the log, duplicate detection and snapshots.
+	// See StateMachine.
+	NewStateMachine func() StateMachine
+}
+
+// ClerkConfig holds the optional behaviour of a Clerk.
+// The zero value gives the behaviour of MakeClerk.
+type ClerkConfig struct {
+	// Record makes the Clerk keep the history of its completed operations, with their
+	// invocation and response times, for linearizability checks. See Clerk.History.
+	Record bool
+
+	// VerifyEvery, if positive, implies Record and makes the Clerk check its recorded history
+	// against linearizability.KvModel after every VerifyEvery operations. Meant for tests only:
+	// each check covers the whole history so far, so its cost grows with the run.
+	VerifyEvery int
+
+	// HedgeDelay, if positive, makes the Clerk send a second copy of a request to the next
+	// server when the first has not answered within the delay, and use whichever answer comes
+	// back first from a leader. This trims the tail latency of a stalled leader. Servers
+	// deduplicate requests by id, so hedging never applies an operation twice.
+	HedgeDelay time.Duration
+
+	// MaxRetries, if positive, is how many times the Clerk retries an operation that no server
+	// has accepted before giving up with a *RetryError. TryGet, TryPutAppend, TryBulkLoad, MultiGet
+	// and Rename return that error; Get, Put, Append, Delete and BulkLoad discard it, so a Get that
+	// gives up returns the empty string. Zero retries forever.
+	MaxRetries int
+
+	// Pipeline lets goroutines sharing the Clerk keep several operations in flight at once.
+	// Each request tells the servers which of the Clerk's requests have completed, so they
+	// deduplicate correctly even when requests are applied out of order. Operations on a key
+	// still take effect in the order they were issued: an operation waits for the Clerk's
+	// earlier operations on any of its keys to complete before it is sent. Without Pipeline,
+	// operations from one Clerk must not overlap.
+	Pipeline bool
+
+	// LoadDelay, if positive, makes the Clerk slow down as the leader fills its uncommitted
+	// backlog (see ServerConfig.Raft.MaxUncommittedEntries). Every reply from the leader reports
+	// its load, from 0 to 1, and the Clerk waits that fraction of LoadDelay before sending each
+	// operation, backing off voluntarily before the leader has to refuse it with ErrBusy.
+	LoadDelay time.Duration
+
+	// OnLoad, if set, is called with the load the leader reports in each reply, so the caller can
+	// apply flow control of its own. It runs on the goroutine of the operation that got the reply.
+	OnLoad func(load float64)
+
+	// ShardMap, if set, tells the Clerk which replica group serves a key. When a server answers
+	// ErrWrongGroup, the Clerk moves to the servers of the group the map names for the request's
+	// key and retries there, instead of trying the other servers of its group as it does for a
+	// server that is not the leader; see shard.go. Without it, ErrWrongGroup is returned to the
+	// caller like any other error the servers report.
+	ShardMap ShardMap
+
+	// ChunkSize is the largest part, in bytes, Clerk.PutChunked splits a value into, and so
+	// about the largest log entry it makes; see chunk.go. Zero means 64 KiB.
+	ChunkSize int
+
+	// OnViolation is called with the recorded history when a check finds it is not
+	// linearizable. If nil, the Clerk keeps the first violation for Clerk.Violation to
+	// return, and stops checking.
+	OnViolation func(history []linearizability.Operation)
+}
@@ -0,0 +1,56 @@
+package raftkv
+
+// A Clerk with cfg.Pipeline set sends requests concurrently, so the server may apply its request
+// ids out of order, and the latest applied id no longer tells which requests were applied. Such
+// a request carries a floor instead: the client has completed every request below it and will
+// never send those again. The server remembers the outcome of each request the client applied
+// at or above its floor, and forgets them as the floor rises, so a request is a duplicate if it
+// is below the floor or in that window.
+
+// isPipelinedDuplicate is isDuplicated for a request from a pipelining client.
+func (kv *KVServer) isPipelinedDuplicate(op Op) bool {
+	if kv.isDormant(op.ClientId) {
+		return false
+	}
+	if op.RequestId < kv.floor[op.ClientId] {
+		return true
+	}
+	_, ok := kv.window[op.ClientId][op.RequestId]
+	return ok
+}
+
+// pipelinedErr returns the outcome a retry of a pipelined request gets. A request below the
+// floor has already completed at the client, which will ignore the answer.
+func (kv *KVServer) pipelinedErr(op Op) Err {
+	if err, ok := kv.window[op.ClientId][op.RequestId]; ok {
+		return err
+	}
+	return OK
+}
+
+// recordPipelined remembers the outcome of a write applied for a pipelining client,
+// starting the client's window afresh if it was dormant.
+func (kv *KVServer) recordPipelined(op Op, err Err) {
+	window, ok := kv.window[op.ClientId]
+	if !ok || kv.isDormant(op.ClientId) {
+		window = make(map[int64]Err)
+		kv.window[op.ClientId] = window
+		delete(kv.floor, op.ClientId)
+	}
+	window[op.RequestId] = err
+}
+
+// advanceFloor raises a pipelining client's floor to op's, dropping the outcomes below it.
+func (kv *KVServer) advanceFloor(op Op) {
+	if op.Floor <= kv.floor[op.ClientId] {
+		return
+	}
+	kv.floor[op.ClientId] = op.Floor
+	for requestId := range kv.window[op.ClientId] {
+		if requestId < op.Floor {
+			delete(kv.window[op.ClientId], requestId)
+		}
+	}
+	kv.dropRemembered(op.ClientId, op.Floor)
+	kv.dropIssued(op.ClientId, op.Floor)
+}
@@ -0,0 +1,76 @@
+package raftkv
+
+// With cfg.ResultCacheSize set, the server remembers the result of each client's latest
+// request, so that a retry of it, as a client sends after a timeout, is answered from the cache
+// rather than proposed to Raft again. A result is cached when its request is applied from the
+// log, on every replica alike, and when the server answers a linearizable read from its own
+// state, on that server only. Either way the retry gets the result the request first had,
+// which was taken within the request's lifetime and so is still linearizable. Only a request's
+// first result is kept: a duplicate applied later, such as a get proposed again, does not
+// replace it. The cache holds at most cfg.ResultCacheSize clients, evicting the client whose
+// result is oldest, and is part of the snapshot.
+
+// cachedResult is the result of a client's latest request.
+type cachedResult struct {
+	RequestId int64
+	Result    Result
+	Index     int // Index of the latest log entry applied when the result was cached
+}
+
+// lookupResult returns the cached result of a client's request, if the request is the latest
+// the cache holds for the client.
+func (kv *KVServer) lookupResult(clientId int64, requestId int64) (Result, bool) {
+	if kv.cfg.ResultCacheSize <= 0 {
+		return Result{}, false
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	cached, ok := kv.results[clientId]
+	if !ok || cached.RequestId != requestId {
+		return Result{}, false
+	}
+	return cached.Result, true
+}
+
+// cacheResult caches the result of a client's request, unless the cache already holds a result
+// for that request or a later one, and evicts the oldest result if the cache is then too large.
+// Eviction depends only on log indexes, so replicas applying the same log evict alike.
+// Must be called with kv.mu held.
+func (kv *KVServer) cacheResult(clientId int64, requestId int64, result Result) {
+	if kv.cfg.ResultCacheSize <= 0 {
+		return
+	}
+	if cached, ok := kv.results[clientId]; ok && cached.RequestId >= requestId {
+		return
+	}
+	kv.results[clientId] = cachedResult{RequestId: requestId, Result: result, Index: kv.lastApplied}
+	for len(kv.results) > kv.cfg.ResultCacheSize {
+		oldest, found := int64(0), false
+		for id, cached := range kv.results {
+			if id == clientId {
+				continue
+			}
+			if !found || cached.Index < kv.results[oldest].Index || cached.Index == kv.results[oldest].Index && id < oldest {
+				oldest, found = id, true
+			}
+		}
+		delete(kv.results, oldest)
+	}
+}
+
+// rememberRead caches the result of a linearizable read the server answered from its own state.
+func (kv *KVServer) rememberRead(op Op, result Result) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.cacheResult(op.ClientId, op.RequestId, kv.stamp(op, result))
+}
+
+// pruneResults drops the results cached more than cfg.AckRetention log entries ago, along with
+// the dedup state of dormant clients. Must be called with kv.mu held.
+func (kv *KVServer) pruneResults() {
+	for clientId, cached := range kv.results {
+		if kv.cfg.AckRetention > 0 && kv.lastApplied-cached.Index > kv.cfg.AckRetention {
+			delete(kv.results, clientId)
+		}
+	}
+}
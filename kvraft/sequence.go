@@ -0,0 +1,41 @@
+package raftkv
+
+// The servers keep a counter per namespace, apart from the key-value data, from which NextID
+// reserves blocks of ids. An allocation takes the ids following the last one issued in its
+// namespace, at its log position, so ids are unique and increase in log order across all
+// clients. A retry must get the ids first reserved for it rather than new ones, so the server
+// remembers the first id of each allocation by client and request id, as it remembers the
+// values check-and-acts observed: a client that does not pipeline keeps only its latest, and a
+// pipelining client's are dropped as its floor rises. An allocation whose caller gave up before
+// hearing back is still made, which leaves a gap in the ids the clients see.
+
+// allocate reserves op.Count ids in namespace op.Key and returns the first of them.
+func (kv *KVServer) allocate(op Op) Result {
+	first := kv.sequences[op.Key] + 1
+	kv.sequences[op.Key] += op.Count
+	return Result{Err: OK, First: first}
+}
+
+// recordIssued remembers the first id an allocation reserved, and forgets a non-pipelining
+// client's earlier ones.
+func (kv *KVServer) recordIssued(op Op, result Result) {
+	if op.Command != "nextid" {
+		return
+	}
+	if op.Floor == 0 {
+		delete(kv.issued, op.ClientId)
+	}
+	if kv.issued[op.ClientId] == nil {
+		kv.issued[op.ClientId] = make(map[int64]int64)
+	}
+	kv.issued[op.ClientId][op.RequestId] = result.First
+}
+
+// dropIssued forgets the allocations of a pipelining client's requests below its floor.
+func (kv *KVServer) dropIssued(clientId int64, floor int64) {
+	for requestId := range kv.issued[clientId] {
+		if requestId < floor {
+			delete(kv.issued[clientId], requestId)
+		}
+	}
+}
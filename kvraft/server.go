@@ -1,12 +1,14 @@
 package raftkv
 
 import (
-	"bytes"
+	"errors"
 	"log"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+	"github.com/ReshiAdavan/Sentinel/linearizability"
 	"github.com/ReshiAdavan/Sentinel/raft"
 	"github.com/ReshiAdavan/Sentinel/rpc"
 )
@@ -24,22 +26,45 @@ func DPrintf(format string, a ...interface{}) (n int, err error) {
 
 // Op represents an operation in the key-value store.
 type Op struct {
-	Command   string // "get", "put", or "append"
-	ClientId  int64  // Client identifier
-	RequestId int64  // Request identifier
-	Key       string // Key in the key-value store
-	Value     string // Value to be put or appended
+	Command   string            // "get", "put", "append", "delete", "bulk", "rename", "transform", "checkandact", "nextid", "multiget", "compact", or "snapshot"
+	ClientId  int64             // Client identifier
+	RequestId int64             // Request identifier
+	Floor     int64             // If positive, the client pipelines requests and has completed every one below Floor
+	Known     bool              // The client has had a write applied before, see isExpired
+	Key       string            // Key in the key-value store
+	Value     string            // Value to be put or appended
+	Pairs     map[string]string // Key/value pairs of a bulk load
+	NewKey    string            // Key a rename moves Key's value to
+	Overwrite bool              // True if a rename may replace an existing NewKey
+	Keys      []string          // Keys read by a multiget
+	Transform string            // Name of the transform applied to Key, with Value as its argument
+
+	IdempotencyKey string // If set, the write is applied at most once under this key, see idempotency.go
+	Expected       string // Value a check-and-act expects Key to have before writing Value
+	Count          int64  // Number of ids a nextid reserves in namespace Key
+
+	// Appends from one client to Key coalesced into this entry, in request order;
+	// RequestId is then that of the last of them.
+	Values     []string
+	RequestIds []int64
+
+	Proposer   int64 // Incarnation of the server that proposed the operation, if cfg.ExportOperations is set
+	ProposedAt int64 // Time, in nanoseconds, at which the proposer received the operation
 }
 
 // Result represents the result of an operation.
 type Result struct {
-	Command     string // Operation command
-	OK          bool   // True if operation was successful
-	ClientId    int64  // Client identifier
-	RequestId   int64  // Request identifier
-	WrongLeader bool   // True if the operation was sent to a non-leader server
-	Err         Err    // Error state
-	Value       string // Value retrieved in a get operation
+	Command     string            // Operation command
+	OK          bool              // True if operation was successful
+	ClientId    int64             // Client identifier
+	RequestId   int64             // Request identifier
+	WrongLeader bool              // True if the operation was sent to a non-leader server
+	Err         Err               // Error state
+	Value       string            // Value retrieved in a get operation
+	Values      map[string]string // Values retrieved in a multiget operation
+
+	First int64    // First id reserved by a nextid operation
+	Keys  []string // Keys found by a findbyvalue operation, or deleted by a flushall one
 }
 
 // KVServer is the main key-value server structure.
@@ -49,53 +74,252 @@ type KVServer struct {
 	rf           *raft.Raft        // Raft instance
 	applyCh      chan raft.ApplyMsg // Channel for apply messages from Raft
 
-	maxraftstate int // Maximum raft state size before snapshotting
+	maxraftstate int          // Maximum raft state size before snapshotting
+	cfg          ServerConfig // Optional behaviour supplied at startup
 
-	data     map[string]string   // Key-value data store
+	sm       StateMachine        // Replicated state the log is applied to
 	ack      map[int64]int64     // Map of client's latest request id for deduplication
+	ackIndex map[int64]int       // Map of client's latest applied log index, for dormancy
+	lastErr  map[int64]Err       // Map of client's latest write outcome other than OK, returned again to retries
 	resultCh map[int]chan Result // Map of log index to result channel
+
+	window map[int64]map[int64]Err // Map of pipelining client's write outcomes at or above its floor, see pipeline.go
+	floor  map[int64]int64         // Map of pipelining client's highest floor
+
+	idempotent map[string]idempotentOutcome // Map of idempotency key to the outcome of the write applied under it
+
+	remembered map[int64]map[int64]string // Map of client's values a retry must get back, see checkandact.go
+
+	sequences map[string]int64          // Map of namespace to the last id issued in it, see sequence.go
+	issued    map[int64]map[int64]int64 // Map of client's first ids reserved by its nextid requests
+
+	results map[int64]cachedResult // Map of client's latest result, if cfg.ResultCacheSize is set, see results.go
+
+	appendQueues map[appendKey]*appendQueue // Appends waiting to be coalesced, if cfg.CoalesceAppends is set
+
+	lastApplied int        // Index of the latest log entry applied to sm
+	applyCond   *sync.Cond // Broadcast whenever lastApplied advances
+
+	stats Stats // Statistics reported by Stats()
+
+	snapshotted bool                 // True if a snapshot was taken since the Raft state was last below cfg.SnapshotLowWatermark
+	snapshots   chan pendingSnapshot // Snapshot encoded by the apply loop and not yet taken by snapshotLoop
+
+	snapshotIndex int       // Index of the latest snapshot encoded or installed
+	lastWrite     time.Time // When a write was last applied, for cfg.IdleSnapshotAfter
+
+	buckets      map[int64]*tokenBucket // Map of client's admission state, if cfg.ClientRate is set, see throttle.go
+	bucketsSwept time.Time              // When idle clients' buckets were last dropped
+
+	readyIndex int  // Index of the snapshot the server started from, which it must apply before serving stale reads
+	ready      bool // True once the server may serve stale reads, see readyForStale
+
+	incarnation int64 // Random id of this run of the server, which stamps the operations it proposes
+
+	done     chan struct{} // Closed by Kill, to stop the server's goroutines
+	killOnce sync.Once
 }
 
 // appendEntryToLog tries to append an entry to the Raft log and returns the result.
 func (kv *KVServer) appendEntryToLog(entry Op) Result {
-	index, _, isLeader := kv.rf.Start(entry)
+	if kv.cfg.ExportOperations != nil {
+		entry.Proposer = kv.incarnation
+		entry.ProposedAt = time.Now().UnixNano()
+	}
+	if result, ok := kv.lookupResult(entry.ClientId, entry.RequestId); ok {
+		return result
+	}
+	if kv.cfg.CoalesceAppends && entry.Command == "append" && entry.IdempotencyKey == "" {
+		return kv.coalesceAppend(entry)
+	}
+	return kv.propose(entry)
+}
+
+// screen runs cfg.PreProposeHook on the operation a client request asks for, at the top of its
+// handler, so the hook sees every request whichever path then answers it. A server that is not
+// the leader turns the request away first, unless any server may answer it, so the hook only
+// runs on the leader but for stale reads. It returns the operation to carry out, or, with ok
+// false, the result to reply with.
+func (kv *KVServer) screen(entry Op, anyServer bool) (op Op, result Result, ok bool) {
+	if kv.cfg.PreProposeHook == nil {
+		return entry, Result{}, true
+	}
+	if _, isLeader, _ := kv.rf.GetState(); !isLeader && !anyServer {
+		return entry, Result{OK: false}, false
+	}
+	op, err := kv.cfg.PreProposeHook(entry)
+	if err != "" {
+		return entry, Result{OK: true, Err: err}, false
+	}
+	return op, Result{}, true
+}
+
+// propose appends an entry to the Raft log and waits for its result.
+func (kv *KVServer) propose(entry Op) Result {
+	start := time.Now()
+	index, _, isLeader, err := kv.rf.TryStart(entry)
 	if !isLeader {
 		return Result{OK: false}
 	}
+	if err != nil {
+		// a full backlog and a pending configuration change both clear up on their own.
+		return Result{OK: true, Err: ErrBusy}
+	}
 
 	kv.mu.Lock()
-	if _, ok := kv.resultCh[index]; !ok {
-		kv.resultCh[index] = make(chan Result, 1)
+	ch, ok := kv.resultCh[index]
+	if !ok {
+		if index <= kv.lastApplied {
+			// a snapshot installed since TryStart covered the index, so no result will come.
+			kv.mu.Unlock()
+			return Result{OK: false}
+		}
+		ch = make(chan Result, 1)
+		kv.resultCh[index] = ch
 	}
 	kv.mu.Unlock()
 
+	var result Result
+	matched := false
 	select {
-	case result := <-kv.resultCh[index]:
-		if isMatch(entry, result) {
-			return result
-		}
-		return Result{OK: false}
+	case result = <-ch:
+		matched = isMatch(entry, result)
 	case <-time.After(240 * time.Millisecond):
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	// the proposer is done with the index either way, so the entry must not outlive it.
+	if kv.resultCh[index] == ch {
+		delete(kv.resultCh, index)
+	}
+	if !matched {
 		return Result{OK: false}
 	}
+	kv.stats.ApplyLatency.observe(time.Since(start))
+	return result
 }
 
 // isMatch checks if a log entry matches a result.
 func isMatch(entry Op, result Result) bool {
-	return entry.ClientId == result.ClientId && entry.RequestId == result.RequestId
+	return entry.ClientId == result.ClientId && entry.RequestId == result.RequestId && !result.WrongLeader
+}
+
+// notifyWaiter hands the result of the entry applied at index to the proposer waiting for it,
+// or keeps it for a proposer that has yet to register. Must be called with kv.mu held.
+func (kv *KVServer) notifyWaiter(index int, result Result) {
+	if ch, ok := kv.resultCh[index]; ok {
+		select {
+		case <-ch: // drain bad data
+		default:
+		}
+	} else {
+		kv.resultCh[index] = make(chan Result, 1)
+	}
+	kv.resultCh[index] <- result
 }
 
-// Get handles a get request from a client.
+// releaseWaiters is called when a snapshot from the leader takes the server from index from to
+// index to. The entries in between are never applied here, so the proposers waiting for them,
+// whose entries were likely overwritten when the server lost its leadership, are told at once
+// that their outcome is unknown here, and their clients retry, rather than waiting out the
+// timeout. Must be called with kv.mu held.
+func (kv *KVServer) releaseWaiters(from int, to int) {
+	for index := from + 1; index <= to; index++ {
+		if _, ok := kv.resultCh[index]; ok {
+			kv.notifyWaiter(index, Result{WrongLeader: true})
+		}
+	}
+}
+
+// load returns the leader's uncommitted backlog as a fraction of Raft.MaxUncommittedEntries,
+// reported in replies so that clients can slow down before the leader starts refusing them.
+func (kv *KVServer) load() float64 {
+	backlog, limit := kv.rf.Backlog()
+	if limit <= 0 {
+		return 0
+	}
+	return math.Min(float64(backlog)/float64(limit), 1)
+}
+
+// Get handles a get request from a client, at the consistency level it asks for.
+// A stale read is answered by any server, a leader read by a server that believes it is
+// the leader, and a linearizable read, after trying the cached result of a retried request and
+// then the read cache, by readLocally with cfg.LinearizableReads or cfg.LeaseReads, or
+// otherwise through the log.
 func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
 	entry := Op{}
 	entry.Command = "get"
 	entry.ClientId = args.ClientId
 	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
 	entry.Key = args.Key
 
-	result := kv.appendEntryToLog(entry)
+	entry, result, ok := kv.screen(entry, args.Consistency == Stale)
+	if !ok && !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	if !ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		return
+	}
+	switch args.Consistency {
+	case Stale:
+		reply.WrongLeader = false
+		if !kv.readyForStale() {
+			reply.Err = ErrNotReady
+			return
+		}
+		reply.Value, reply.Err = kv.localGet(entry.Key)
+		return
+	case Leader:
+		if _, isLeader, _ := kv.rf.GetState(); !isLeader {
+			reply.WrongLeader = true
+			reply.LeaderHint = kv.rf.GetLeaderHint()
+			return
+		}
+		reply.WrongLeader = false
+		reply.Value, reply.Err = kv.localGet(entry.Key)
+		return
+	}
+
+	if result, ok := kv.lookupResult(args.ClientId, args.RequestId); ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		reply.Value = result.Value
+		return
+	}
+	read := Op{Command: "get", ClientId: entry.ClientId, RequestId: entry.RequestId, Key: entry.Key}
+
+	if kv.cfg.ReadCacheSize > 0 {
+		start := time.Now().UnixNano()
+		if value, ok := kv.cacheRead(entry.Key); ok {
+			reply.WrongLeader = false
+			reply.Err = OK
+			reply.Value = value
+			kv.rememberRead(read, Result{Err: reply.Err, Value: reply.Value})
+			kv.exportReads([]string{entry.Key}, map[string]string{entry.Key: value}, start)
+			return
+		}
+	}
+
+	if (kv.cfg.LinearizableReads || kv.cfg.LeaseReads) && kv.readLocally(read, reply) {
+		return
+	}
+
+	result = kv.appendEntryToLog(entry)
 	if !result.OK {
 		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
 		return
 	}
 	reply.WrongLeader = false
@@ -105,106 +329,689 @@ func (kv *KVServer) Get(args *GetArgs, reply *GetReply) {
 
 // PutAppend handles put or append requests from a client.
 func (kv *KVServer) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
 	entry := Op{}
 	entry.Command = args.Command
 	entry.ClientId = args.ClientId
 	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
 	entry.Key = args.Key
 	entry.Value = args.Value
+	entry.IdempotencyKey = args.IdempotencyKey
 
-	result := kv.appendEntryToLog(entry)
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
 	if !result.OK {
 		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
 		return
 	}
 	reply.WrongLeader = false
 	reply.Err = result.Err
 }
 
-// applyOp applies an operation to the key-value store and returns the result.
-func (kv *KVServer) applyOp(op Op) Result {
-	result := Result{}
-	result.Command = op.Command
-	result.OK = true
-	result.WrongLeader = false
-	result.ClientId = op.ClientId
-	result.RequestId = op.RequestId
+// BulkLoad handles a bulk-load request from a client, committing all pairs as a single log entry.
+func (kv *KVServer) BulkLoad(args *BulkLoadArgs, reply *BulkLoadReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	entry := Op{}
+	entry.Command = "bulk"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+	entry.Pairs = args.Pairs
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+}
+
+// Rename handles a rename request from a client, moving a value between keys in a single log entry.
+func (kv *KVServer) Rename(args *RenameArgs, reply *RenameReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	entry := Op{}
+	entry.Command = "rename"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+	entry.Key = args.OldKey
+	entry.NewKey = args.NewKey
+	entry.Overwrite = args.Overwrite
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+	reply.Value = result.Value
+}
+
+// Transform handles a request to apply a named transform to the value of a key in a single log entry.
+// Transforms that don't exist are refused without going through the log.
+func (kv *KVServer) Transform(args *TransformArgs, reply *TransformReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	if _, ok := transforms[args.Transform]; !ok {
+		reply.WrongLeader = false
+		reply.Err = ErrUnknownTransform
+		return
+	}
+	entry := Op{}
+	entry.Command = "transform"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+	entry.Key = args.Key
+	entry.Transform = args.Transform
+	entry.Value = args.Arg
+	entry.IdempotencyKey = args.IdempotencyKey
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+	reply.Value = result.Value
+}
+
+// CheckAndAct handles a request to read a key and write it if it has the expected value,
+// in a single log entry. The reply carries the value read whether or not it was written.
+func (kv *KVServer) CheckAndAct(args *CheckAndActArgs, reply *CheckAndActReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	entry := Op{}
+	entry.Command = "checkandact"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+	entry.Key = args.Key
+	entry.Expected = args.Expected
+	entry.Value = args.Value
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+	reply.Value = result.Value
+}
+
+// MultiGet handles a request to read several keys at a single linearization point.
+// The leader serves it from its local state once it has applied up to a Raft ReadIndex, or
+// with cfg.LeaseReads up to its commit index while it holds its lease, so the read never
+// enters the log; until the leader has committed an entry in its term,
+// it falls back to reading through the log.
+func (kv *KVServer) MultiGet(args *MultiGetArgs, reply *MultiGetReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	entry := Op{}
+	entry.Command = "multiget"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Keys = args.Keys
 
-	switch op.Command {
-	case "put":
-		if !kv.isDuplicated(op) {
-			kv.data[op.Key] = op.Value
+	entry, result, ok := kv.screen(entry, false)
+	if !ok && !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	if !ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		return
+	}
+	if result, ok := kv.lookupResult(args.ClientId, args.RequestId); ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		reply.Values = result.Values
+		return
+	}
+	start := time.Now().UnixNano()
+	index, ok := kv.readIndex()
+	if !ok {
+		result = kv.appendEntryToLog(entry)
+		if !result.OK {
+			reply.WrongLeader = true
+			reply.LeaderHint = kv.rf.GetLeaderHint()
+			return
 		}
-		result.Err = OK
-	case "append":
-		if !kv.isDuplicated(op) {
-			kv.data[op.Key] += op.Value
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		reply.Values = result.Values
+		return
+	}
+
+	if !kv.waitApplied(index, 240*time.Millisecond) {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	kv.mu.Lock()
+	reply.WrongLeader = false
+	reply.Err = OK
+	reply.Values = kv.sm.Apply(Op{Command: "multiget", Keys: entry.Keys}).Values
+	kv.mu.Unlock()
+	kv.rememberRead(Op{Command: "multiget", ClientId: entry.ClientId, RequestId: entry.RequestId}, Result{Err: reply.Err, Values: reply.Values})
+	kv.exportReads(entry.Keys, reply.Values, start)
+}
+
+// FlushAll handles a request to delete every key, committed as a single log entry. Unless
+// cfg.AllowFlushAll is set, it is refused before reaching the log.
+func (kv *KVServer) FlushAll(args *FlushAllArgs, reply *FlushAllReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	if !kv.cfg.AllowFlushAll {
+		reply.WrongLeader = false
+		reply.Err = ErrRejected
+		return
+	}
+	entry := Op{}
+	entry.Command = "flushall"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+}
+
+// FindByValue handles a request for the keys holding a value, read at a single point in time,
+// from the value index; see index.go. Like MultiGet, the leader confirms its leadership through
+// ReadIndex and answers from local state, going through the log only if it cannot.
+func (kv *KVServer) FindByValue(args *FindByValueArgs, reply *FindByValueReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	entry := Op{}
+	entry.Command = "findbyvalue"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Value = args.Value
+
+	entry, result, ok := kv.screen(entry, false)
+	if !ok && !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	if !ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		return
+	}
+	if result, ok := kv.lookupResult(args.ClientId, args.RequestId); ok {
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		reply.Keys = result.Keys
+		return
+	}
+	index, ok := kv.readIndex()
+	if !ok {
+		result = kv.appendEntryToLog(entry)
+		if !result.OK {
+			reply.WrongLeader = true
+			reply.LeaderHint = kv.rf.GetLeaderHint()
+			return
+		}
+		reply.WrongLeader = false
+		reply.Err = result.Err
+		reply.Keys = result.Keys
+		return
+	}
+
+	if !kv.waitApplied(index, 240*time.Millisecond) {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	kv.mu.Lock()
+	result = kv.sm.Apply(Op{Command: "findbyvalue", Value: entry.Value})
+	kv.mu.Unlock()
+	kv.rememberRead(entry, result)
+	reply.WrongLeader = false
+	reply.Err = result.Err
+	reply.Keys = result.Keys
+}
+
+// readLocally answers a linearizable get from the leader's local state, without the log, once
+// it has applied up to the index readIndex confirms. It reports false, leaving reply untouched,
+// if the index cannot be confirmed, e.g. before the leader has committed an entry in its term,
+// so the read should go through the log; a leader that could not apply up to the index in time
+// answers WrongLeader.
+func (kv *KVServer) readLocally(read Op, reply *GetReply) bool {
+	start := time.Now().UnixNano()
+	index, ok := kv.readIndex()
+	if !ok {
+		return false
+	}
+	if !kv.waitApplied(index, 240*time.Millisecond) {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return true
+	}
+	reply.WrongLeader = false
+	reply.Value, reply.Err = kv.localGet(read.Key)
+	kv.rememberRead(read, Result{Err: reply.Err, Value: reply.Value})
+	kv.exportReads([]string{read.Key}, map[string]string{read.Key: reply.Value}, start)
+	return true
+}
+
+// localGet reads key from this server's state as it stands, without the log. It reads
+// through a multiget, which unlike a get leaves the state machine untouched.
+func (kv *KVServer) localGet(key string) (string, Err) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	value, ok := kv.sm.Apply(Op{Command: "multiget", Keys: []string{key}}).Values[key]
+	if !ok {
+		return "", ErrNoKey
+	}
+	return value, OK
+}
+
+// readyForStale reports whether the server may serve stale reads. A restarted server refuses
+// them until it has applied the snapshot it started from and has heard from a leader (or is
+// one), so it never answers from the empty state it starts with, nor from a state it recovered
+// while cut off from the cluster. Once ready, it stays ready.
+func (kv *KVServer) readyForStale() bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if !kv.ready {
+		kv.ready = kv.lastApplied >= kv.readyIndex && kv.rf.GetLeaderHint() >= 0
+	}
+	return kv.ready
+}
+
+// readIndex returns the index a local read must wait for: the lease's, with cfg.LeaseReads while
+// the leader holds its lease, and otherwise a Raft ReadIndex. ok is false if neither confirms
+// this server as the leader.
+func (kv *KVServer) readIndex() (int, bool) {
+	if kv.cfg.LeaseReads {
+		if index, ok := kv.rf.LeaseRead(); ok {
+			kv.mu.Lock()
+			kv.stats.LeaseReads++
+			kv.mu.Unlock()
+			return index, true
 		}
+	}
+	index, err := kv.rf.ReadIndex()
+	if err != nil {
+		return -1, false
+	}
+	kv.mu.Lock()
+	kv.stats.ReadIndexReads++
+	kv.mu.Unlock()
+	return index, true
+}
+
+// waitApplied blocks until sm reflects the log up to index, or timeout passes.
+// It reports whether index was reached.
+func (kv *KVServer) waitApplied(index int, timeout time.Duration) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		kv.mu.Lock()
+		expired = true
+		kv.applyCond.Broadcast()
+		kv.mu.Unlock()
+	})
+	defer timer.Stop()
+	for kv.lastApplied < index && !expired {
+		kv.applyCond.Wait()
+	}
+	return kv.lastApplied >= index
+}
+
+// NextID handles a request to reserve a block of ids from the counter of a namespace, in a
+// single log entry. Blocks that are empty are refused without going through the log.
+func (kv *KVServer) NextID(args *NextIDArgs, reply *NextIDReply) {
+	reply.Server = kv.me
+	reply.Load = kv.load()
+	if !kv.admit(args.ClientId) {
+		reply.Err = ErrThrottled
+		return
+	}
+	if args.Count < 1 {
+		reply.WrongLeader = false
+		reply.Err = ErrBadValue
+		return
+	}
+	entry := Op{}
+	entry.Command = "nextid"
+	entry.ClientId = args.ClientId
+	entry.RequestId = args.RequestId
+	entry.Floor = args.Floor
+	entry.Known = args.Known
+	entry.Key = args.Namespace
+	entry.Count = args.Count
+
+	entry, result, ok := kv.screen(entry, false)
+	if ok {
+		result = kv.appendEntryToLog(entry)
+	}
+	if !result.OK {
+		reply.WrongLeader = true
+		reply.LeaderHint = kv.rf.GetLeaderHint()
+		return
+	}
+	reply.WrongLeader = false
+	reply.Err = result.Err
+	reply.First = result.First
+}
+
+// Status reports this server's index, term, and whether it believes it is the leader.
+func (kv *KVServer) Status(args *StatusArgs, reply *StatusReply) {
+	reply.Me = kv.me
+	reply.Term, reply.IsLeader, reply.Paused = kv.rf.GetState()
+}
+
+// TransferLeadership asks the leader to hand leadership over to another server, and replies
+// once this server has stepped down. The new leader shows up through Status.
+func (kv *KVServer) TransferLeadership(args *TransferLeadershipArgs, reply *TransferLeadershipReply) {
+	err := kv.rf.TransferLeadership(args.Target)
+	reply.WrongLeader = err == raft.ErrNotLeader
+	reply.Err = OK
+	if err != nil && !reply.WrongLeader {
+		reply.Err = ErrRejected
+	}
+}
+
+// applyOp applies an operation to the state machine and returns the result.
+func (kv *KVServer) applyOp(op Op) Result {
+	var result Result
+	switch {
+	case op.Command == "compact":
+		// proposed by the leader itself, so there is no client to deduplicate or acknowledge.
+		kv.sm.Apply(op)
+		kv.pruneDormantClients()
+		result.Err = OK
+		return kv.stamp(op, result)
+	case op.Command == "snapshot":
+		// proposed by the leader once idle, see idleSnapshotLoop; Run snapshots right after it.
 		result.Err = OK
-	case "get":
-		if value, ok := kv.data[op.Key]; ok {
-			result.Err = OK
-			result.Value = value
+		return kv.stamp(op, result)
+	case isRead(op):
+		result = kv.sm.Apply(op)
+	case kv.isDuplicated(op):
+		// a write's outcome may depend on the state it was first applied to (e.g. a rename),
+		// so a retry gets the remembered outcome rather than a fresh one.
+		result.Err = OK
+		if err, ok := kv.idempotentErr(op); ok {
+			result.Err = err
+		} else if op.Floor > 0 {
+			result.Err = kv.pipelinedErr(op)
+		} else if err, ok := kv.lastErr[op.ClientId]; ok {
+			result.Err = err
+		}
+		if op.Command == "checkandact" || op.Command == "transform" || op.Command == "rename" {
+			result.Value = kv.rememberedValue(op, result.Err)
+		}
+		if op.Command == "nextid" {
+			result.First = kv.issued[op.ClientId][op.RequestId]
+		}
+	case kv.isExpired(op):
+		// the request may be a retry of one applied before the client's state was dropped, so
+		// it is turned away rather than applied again, and the client is left unknown.
+		result.Err = ErrExpired
+		return kv.stamp(op, result)
+	case op.Command == "nextid":
+		// the counters are the server's, so they work with any state machine.
+		result = kv.allocate(op)
+		kv.recordIssued(op, result)
+		if op.Floor > 0 {
+			kv.recordPipelined(op, result.Err)
+		} else {
+			delete(kv.lastErr, op.ClientId)
+		}
+	default:
+		result = kv.sm.Apply(op)
+		kv.recordIdempotent(op, result.Err)
+		kv.rememberValue(op, result)
+		if op.Floor > 0 {
+			kv.recordPipelined(op, result.Err)
+		} else if result.Err != OK {
+			kv.lastErr[op.ClientId] = result.Err
 		} else {
-			result.Err = ErrNoKey
+			delete(kv.lastErr, op.ClientId)
 		}
 	}
-	kv.ack[op.ClientId] = op.RequestId
+	kv.recordAck(op)
+	result = kv.stamp(op, result)
+	kv.cacheResult(op.ClientId, op.RequestId, result)
 	return result
 }
 
-// isDuplicated checks if a request is a duplicate based on the request id.
+// stamp fills in the fields of a state machine's result that identify the request.
+func (kv *KVServer) stamp(op Op, result Result) Result {
+	result.Command = op.Command
+	result.OK = true
+	result.WrongLeader = false
+	result.ClientId = op.ClientId
+	result.RequestId = op.RequestId
+	return result
+}
+
+// hookData returns the data PostApplyHook sees: the key-value map of the default
+// state machine, or nil for a custom one.
+func (kv *KVServer) hookData() map[string]string {
+	if store, ok := kv.sm.(*kvStore); ok {
+		return store.data
+	}
+	return nil
+}
+
+// recordAck remembers op as its client's latest applied request.
+func (kv *KVServer) recordAck(op Op) {
+	if lastRequestId, ok := kv.ack[op.ClientId]; !ok || kv.isDormant(op.ClientId) || op.RequestId > lastRequestId {
+		kv.ack[op.ClientId] = op.RequestId
+	}
+	if op.Floor > 0 {
+		kv.advanceFloor(op)
+	}
+	kv.ackIndex[op.ClientId] = kv.lastApplied
+}
+
+// isDuplicated checks if a request is a duplicate based on the request id,
+// or on its idempotency key if it has one.
 func (kv *KVServer) isDuplicated(op Op) bool {
+	if _, ok := kv.idempotentErr(op); ok {
+		return true
+	}
+	if op.Floor > 0 {
+		return kv.isPipelinedDuplicate(op)
+	}
 	lastRequestId, ok := kv.ack[op.ClientId]
-	if ok {
+	if ok && !kv.isDormant(op.ClientId) {
 		return lastRequestId >= op.RequestId
 	}
 	return false
 }
 
-// Kill stops the KVServer.
+// compactLoop has the leader propose a compaction every cfg.CompactionInterval, as long as
+// keys have been deleted since the last one. Compaction goes through the log like any other
+// operation, so every replica compacts at the same point. A custom state machine that wants
+// compaction proposes it itself; the server then still prunes dormant clients.
+func (kv *KVServer) compactLoop() {
+	for !kv.killed() {
+		time.Sleep(kv.cfg.CompactionInterval)
+		kv.mu.Lock()
+		store, ok := kv.sm.(*kvStore)
+		pending := ok && store.deletes > 0
+		kv.mu.Unlock()
+		if _, isLeader, _ := kv.rf.GetState(); pending && isLeader {
+			kv.rf.Start(Op{Command: "compact"})
+		}
+	}
+}
+
+// Kill stops the KVServer and its Raft peer. The apply loop and the snapshotter stop at once,
+// the periodic loops when they next wake.
 func (kv *KVServer) Kill() {
 	kv.rf.Kill()
+	kv.killOnce.Do(func() { close(kv.done) })
+}
+
+// killed reports whether Kill has been called.
+func (kv *KVServer) killed() bool {
+	select {
+	case <-kv.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // Run is the main loop of the KVServer, applying committed Raft entries.
 func (kv *KVServer) Run() {
+	// the apply loop is the only source of snapshots, so the snapshotter stops with it.
+	defer close(kv.snapshots)
 	for {
-		msg := <-kv.applyCh
+		var msg raft.ApplyMsg
+		select {
+		case msg = <-kv.applyCh:
+		case <-kv.done:
+			return
+		}
+		var exported []linearizability.Operation
+		var decoded decodedSnapshot
+		if msg.UseSnapshot {
+			// decode before taking the lock; only this loop applies, so nothing else does meanwhile.
+			snapshot, err := raft.ParseSnapshot(msg.Snapshot)
+			if err != nil {
+				log.Fatalf("kvserver %d: %v", kv.me, err)
+			}
+			if decoded, err = kv.decodeSnapshot(snapshot.Data, snapshot.LastIncludedIndex); err != nil {
+				log.Fatalf("kvserver %d: %v", kv.me, err)
+			}
+		}
 		kv.mu.Lock()
 		if msg.UseSnapshot {
-			r := bytes.NewBuffer(msg.Snapshot)
-			d := gobWrapper.NewDecoder(r)
-
-			var lastIncludedIndex, lastIncludedTerm int
-			d.Decode(&lastIncludedIndex)
-			d.Decode(&lastIncludedTerm)
-			d.Decode(&kv.data)
-			d.Decode(&kv.ack)
+			applied := kv.lastApplied
+			kv.installSnapshot(decoded)
+			kv.releaseWaiters(applied, kv.lastApplied)
+			kv.applyCond.Broadcast()
+		} else if _, ok := msg.Command.(raft.Membership); ok {
+			// a membership change has nothing to apply, and any proposer waiting on its index
+			// lost its entry to it
+			kv.lastApplied = msg.CommandIndex
+			if _, ok := kv.resultCh[msg.CommandIndex]; ok {
+				kv.notifyWaiter(msg.CommandIndex, Result{WrongLeader: true})
+			}
+			kv.applyCond.Broadcast()
 		} else {
 			// apply operation and send result
-			op := msg.Command.(Op)
-			result := kv.applyOp(op)
-			if ch, ok := kv.resultCh[msg.CommandIndex]; ok {
-				select {
-				case <-ch: // drain bad data
-				default:
+			kv.lastApplied = msg.CommandIndex
+			var result Result
+			entry := msg.Command.(Op)
+			if !isRead(entry) && entry.Command != "snapshot" {
+				kv.lastWrite = time.Now()
+			}
+			for _, op := range splitAppends(entry) {
+				fresh := !kv.isDuplicated(op) && !kv.isExpired(op)
+				result = kv.applyOp(op)
+				exported = append(exported, kv.exportApplied(op, result, fresh)...)
+				if kv.cfg.PostApplyHook != nil {
+					kv.cfg.PostApplyHook(msg.CommandIndex, op, result, kv.hookData())
 				}
-			} else {
-				kv.resultCh[msg.CommandIndex] = make(chan Result, 1)
 			}
-			kv.resultCh[msg.CommandIndex] <- result
-
-			// create snapshot if raft state exceeds allowed size
-			if kv.maxraftstate != -1 && kv.rf.GetRaftStateSize() > kv.maxraftstate {
-				w := new(bytes.Buffer)
-				e := gobWrapper.NewEncoder(w)
-				e.Encode(kv.data)
-				e.Encode(kv.ack)
-				go kv.rf.CreateSnapshot(w.Bytes(), msg.CommandIndex)
+			kv.applyCond.Broadcast()
+			kv.notifyWaiter(msg.CommandIndex, result)
+
+			// create snapshot if raft state exceeds allowed size, or if the leader proposed one;
+			// it is encoded here, before the next entry is applied, so it holds exactly the state
+			// at msg.CommandIndex. Every entry it covers has had its result handed to its waiter
+			// above, so Raft trimming them from its log can't leave a proposer without one.
+			if kv.shouldSnapshot() || entry.Command == "snapshot" && kv.maxraftstate != -1 {
+				kv.pruneDormantClients()
+				kv.handOff(pendingSnapshot{kv.encodeSnapshot(), msg.CommandIndex})
+				kv.snapshotIndex = msg.CommandIndex
 			}
 		}
 		kv.mu.Unlock()
+
+		// in apply order, but outside the lock, since the consumer may be slow.
+		for _, op := range exported {
+			kv.cfg.ExportOperations <- op
+		}
 	}
 }
 
@@ -220,22 +1027,88 @@ func (kv *KVServer) Run() {
  */
 
 func StartKVServer(servers []*rpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int) *KVServer {
+	kv, _ := StartKVServerWithConfig(servers, me, persister, maxraftstate, ServerConfig{})
+	return kv
+}
+
+/*
+ * StartKVServerWithConfig is like StartKVServer, but enables the optional behaviour in cfg.
+ * Returns an error, without starting the server, if cfg is invalid.
+ */
+
+func StartKVServerWithConfig(servers []*rpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, cfg ServerConfig) (*KVServer, error) {
 	// call gobWrapper.Register on structures you want
 	// Go's RPC library to marshall/unmarshall.
 	gobWrapper.Register(Op{})
 	gobWrapper.Register(Result{})
+	if err := gobWrapper.CheckRegistered(append([]interface{}{Op{}, Result{}}, cfg.CommandTypes...)...); err != nil {
+		return nil, err
+	}
+	if cfg.ReadCacheSize > 0 && cfg.Raft.LeaseDuration <= 0 {
+		return nil, errors.New("raftkv: ReadCacheSize needs Raft.LeaseDuration to be set")
+	}
+	if cfg.LeaseReads && cfg.Raft.LeaseDuration <= 0 {
+		return nil, errors.New("raftkv: LeaseReads needs Raft.LeaseDuration to be set")
+	}
+	if err := cfg.validateRates(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateWatermarks(maxraftstate); err != nil {
+		return nil, err
+	}
+	if cfg.ReadCacheSize > 0 && cfg.NewStateMachine != nil {
+		return nil, errors.New("raftkv: ReadCacheSize only works with the default state machine")
+	}
+	if cfg.MaxKeys > 0 && cfg.NewStateMachine != nil {
+		return nil, errors.New("raftkv: MaxKeys only works with the default state machine")
+	}
 
 	kv := new(KVServer)
 	kv.me = me
 	kv.maxraftstate = maxraftstate
+	kv.cfg = cfg
+	kv.incarnation = nrand()
 
-	kv.applyCh = make(chan raft.ApplyMsg, 100)
-	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+	applyBuffer := cfg.ApplyBuffer
+	if applyBuffer <= 0 {
+		applyBuffer = 100
+	}
+	kv.applyCh = make(chan raft.ApplyMsg, applyBuffer)
+	if snapshot, err := raft.ParseSnapshot(persister.ReadSnapshot()); err == nil {
+		kv.readyIndex = snapshot.LastIncludedIndex
+	}
+	rf, err := raft.MakeWithConfig(servers, me, persister, kv.applyCh, cfg.Raft)
+	if err != nil {
+		return nil, err
+	}
+	kv.rf = rf
 
-	kv.data = make(map[string]string)
+	kv.sm = cfg.newStateMachine()
 	kv.ack = make(map[int64]int64)
+	kv.ackIndex = make(map[int64]int)
+	kv.lastErr = make(map[int64]Err)
+	kv.window = make(map[int64]map[int64]Err)
+	kv.floor = make(map[int64]int64)
+	kv.idempotent = make(map[string]idempotentOutcome)
+	kv.remembered = make(map[int64]map[int64]string)
+	kv.sequences = make(map[string]int64)
+	kv.issued = make(map[int64]map[int64]int64)
+	kv.results = make(map[int64]cachedResult)
+	kv.buckets = make(map[int64]*tokenBucket)
+	kv.appendQueues = make(map[appendKey]*appendQueue)
 	kv.resultCh = make(map[int]chan Result)
+	kv.applyCond = sync.NewCond(&kv.mu)
+	kv.stats.ApplyLatency = newLatencyHistogram()
 
+	kv.snapshots = make(chan pendingSnapshot, 1)
+	kv.done = make(chan struct{})
 	go kv.Run()
-	return kv
+	go kv.snapshotLoop()
+	if cfg.CompactionInterval > 0 {
+		go kv.compactLoop()
+	}
+	if cfg.IdleSnapshotAfter > 0 && maxraftstate != -1 {
+		go kv.idleSnapshotLoop()
+	}
+	return kv, nil
 }
@@ -0,0 +1,73 @@
+package raftkv
+
+import (
+	"sort"
+
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// The routing contract for sharding: a server whose replica group does not serve a key
+// answers ErrWrongGroup, and the Clerk asks its ShardMap which group does and moves over to
+// that group's servers. A Clerk talks to one group at a time; the request that was turned
+// away, and later ones, go to the new group until another ErrWrongGroup moves it on.
+
+// ShardMap returns the id of the replica group that serves key, and the group's servers.
+type ShardMap func(key string) (gid int, servers []*rpc.ClientEnd)
+
+// routingKey returns the key that decides which group a request goes to: its only key, or
+// for a request naming several, the first of them (the smallest, for a bulk load).
+func routingKey(args interface{}) string {
+	switch args := args.(type) {
+	case *GetArgs:
+		return args.Key
+	case *PutAppendArgs:
+		return args.Key
+	case *TransformArgs:
+		return args.Key
+	case *CheckAndActArgs:
+		return args.Key
+	case *RenameArgs:
+		return args.OldKey
+	case *NextIDArgs:
+		return args.Namespace
+	case *MultiGetArgs:
+		if len(args.Keys) > 0 {
+			return args.Keys[0]
+		}
+	case *BulkLoadArgs:
+		keys := make([]string, 0, len(args.Pairs))
+		for key := range args.Pairs {
+			keys = append(keys, key)
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			return keys[0]
+		}
+	}
+	return ""
+}
+
+// reroute consults cfg.ShardMap for the group serving the key of a request a server turned
+// away with ErrWrongGroup, and moves the Clerk to that group's servers. It reports false if
+// the map names the group the Clerk already talks to, as it may while it catches up with a
+// reconfiguration, or a group without servers.
+func (ck *Clerk) reroute(args interface{}) bool {
+	gid, servers := ck.cfg.ShardMap(routingKey(args))
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if gid == ck.gid || len(servers) == 0 {
+		return false
+	}
+	ck.gid = gid
+	ck.servers = servers
+	ck.leader = 0
+	ck.positions = make(map[int]int)
+	return true
+}
+
+// group returns the servers of the group the Clerk talks to.
+func (ck *Clerk) group() []*rpc.ClientEnd {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	return ck.servers
+}
@@ -0,0 +1,312 @@
+package raftkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+)
+
+// shouldSnapshot reports whether the Raft state has grown enough to take a snapshot. Without a
+// low watermark, that is whenever the state is above the high watermark. With one, a snapshot
+// disarms the check until the state has dropped below the low watermark or Raft has taken the
+// snapshot, so the operations applied while Raft is still trimming its log don't each trigger
+// another snapshot.
+func (kv *KVServer) shouldSnapshot() bool {
+	if kv.maxraftstate == -1 {
+		return false
+	}
+	size := kv.rf.GetRaftStateSize()
+	if size < kv.cfg.SnapshotLowWatermark {
+		kv.snapshotted = false
+	}
+	if size <= kv.cfg.highWatermark(kv.maxraftstate) || kv.snapshotted {
+		return false
+	}
+	kv.snapshotted = kv.cfg.SnapshotLowWatermark > 0
+	return true
+}
+
+// pendingSnapshot is a snapshot the apply loop has encoded, waiting to be handed to Raft.
+type pendingSnapshot struct {
+	data  []byte // Encoded server state, exactly as of index
+	index int    // Log index of the last entry the state reflects
+}
+
+// handOff passes a snapshot from the apply loop to snapshotLoop without blocking. The apply loop
+// must never block on Raft: CreateSnapshot waits for Raft's lock and then trims and persists the
+// log, and while the apply loop waited, nothing would drain applyCh and committed entries would
+// back up behind it. A snapshot still waiting when a newer one arrives is dropped, since the
+// newer one covers it, so snapshots reach Raft one at a time, in index order.
+// Must be called from the apply loop, the only sender.
+func (kv *KVServer) handOff(snapshot pendingSnapshot) {
+	select {
+	case kv.snapshots <- snapshot:
+	default:
+		select {
+		case <-kv.snapshots:
+		default:
+		}
+		kv.snapshots <- snapshot
+	}
+}
+
+// snapshotLoop hands the snapshots the apply loop encodes to Raft, one at a time.
+func (kv *KVServer) snapshotLoop() {
+	for snapshot := range kv.snapshots {
+		kv.createSnapshot(snapshot.data, snapshot.index)
+	}
+}
+
+// createSnapshot hands a snapshot to Raft, and re-arms the check once Raft has trimmed its log.
+// Operations that kept arriving during the trim can leave the state above the low watermark,
+// and waiting for it to drop below would then never end while the log grows; the next snapshot
+// is taken once the state is above the high watermark again, or at once if it still is.
+func (kv *KVServer) createSnapshot(snapshot []byte, index int) {
+	kv.rf.CreateSnapshot(snapshot, index)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.stats.Snapshots++
+	kv.snapshotted = false
+}
+
+// idleSnapshotLoop has the leader propose a snapshot once no write has been applied for
+// cfg.IdleSnapshotAfter and the log holds entries past the last snapshot. Like a compaction,
+// the proposal goes through the log, so every replica snapshots at the same index, through the
+// same handoff as a snapshot taken for size. The snapshot covers the proposal itself, so the
+// loop stays quiet until something else is applied.
+func (kv *KVServer) idleSnapshotLoop() {
+	for !kv.killed() {
+		time.Sleep(kv.cfg.IdleSnapshotAfter / 2)
+		kv.mu.Lock()
+		idle := time.Since(kv.lastWrite) >= kv.cfg.IdleSnapshotAfter && kv.lastApplied > kv.snapshotIndex
+		kv.mu.Unlock()
+		if _, isLeader, _ := kv.rf.GetState(); idle && isLeader {
+			kv.rf.Start(Op{Command: "snapshot"})
+		}
+	}
+}
+
+// snapshotVersion identifies the layout encodeSnapshot writes. It goes up with every change to
+// the layout, so a server refuses a snapshot it would misread instead of restoring the wrong
+// state from it. Version 1 is the layout from before snapshots carried a version: the same
+// fields in the same order, with no version in front, which decodeSnapshot still reads.
+const snapshotVersion = 2
+
+// encodeSnapshot encodes the server's state as of lastApplied, the index it is to be handed to
+// Raft with. The layout version comes first; the index is recorded last, so the state can be
+// checked against the snapshot's.
+func (kv *KVServer) encodeSnapshot() []byte {
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(snapshotVersion)
+	e.Encode(kv.sm.Snapshot())
+	e.Encode(kv.encodeAck())
+	e.Encode(kv.lastErr)
+	e.Encode(kv.window)
+	e.Encode(kv.floor)
+	e.Encode(kv.idempotent)
+	e.Encode(kv.remembered)
+	e.Encode(kv.sequences)
+	e.Encode(kv.issued)
+	e.Encode(kv.results)
+	e.Encode(kv.lastApplied)
+	return w.Bytes()
+}
+
+// decodedSnapshot is a server's state decoded from a snapshot, waiting to be installed.
+type decodedSnapshot struct {
+	sm         StateMachine
+	ack        map[int64]int64
+	ackIndex   map[int64]int
+	lastErr    map[int64]Err
+	window     map[int64]map[int64]Err
+	floor      map[int64]int64
+	idempotent map[string]idempotentOutcome
+	remembered map[int64]map[int64]string
+	sequences  map[string]int64
+	issued     map[int64]map[int64]int64
+	results    map[int64]cachedResult
+
+	index    int // Log index Raft delivered the snapshot at
+	recorded int // Index the state was recorded at
+}
+
+// decodeSnapshot decodes a state encodeSnapshot encoded, which Raft delivered as the state at
+// lastIncludedIndex, into a fresh state machine and fresh maps. It touches none of the
+// server's state, so the apply loop runs it without the lock, and requests are not held up
+// for the time it takes to decode a large state; installSnapshot then swaps it in. It reads
+// snapshots of the current layout version and of version 1, and fails on any other.
+func (kv *KVServer) decodeSnapshot(data []byte, lastIncludedIndex int) (decodedSnapshot, error) {
+	snapshot := decodedSnapshot{
+		sm:         kv.cfg.newStateMachine(),
+		lastErr:    make(map[int64]Err),
+		window:     make(map[int64]map[int64]Err),
+		floor:      make(map[int64]int64),
+		idempotent: make(map[string]idempotentOutcome),
+		remembered: make(map[int64]map[int64]string),
+		sequences:  make(map[string]int64),
+		issued:     make(map[int64]map[int64]int64),
+		results:    make(map[int64]cachedResult),
+		index:      lastIncludedIndex,
+	}
+	d := gobWrapper.NewDecoder(bytes.NewBuffer(data))
+	var version int
+	if err := d.Decode(&version); err != nil {
+		// a snapshot from before versioning starts with the state machine's bytes, which don't
+		// decode as a version; it is read again from the start, as version 1.
+		version = 1
+		d = gobWrapper.NewDecoder(bytes.NewBuffer(data))
+	}
+	if version != 1 && version != snapshotVersion {
+		return snapshot, fmt.Errorf("raftkv: snapshot at index %d has layout version %d, want at most %d", lastIncludedIndex, version, snapshotVersion)
+	}
+	var state, ack []byte
+	d.Decode(&state)
+	d.Decode(&ack)
+	d.Decode(&snapshot.lastErr)
+	d.Decode(&snapshot.window)
+	d.Decode(&snapshot.floor)
+	d.Decode(&snapshot.idempotent)
+	d.Decode(&snapshot.remembered)
+	d.Decode(&snapshot.sequences)
+	d.Decode(&snapshot.issued)
+	d.Decode(&snapshot.results)
+	d.Decode(&snapshot.recorded)
+	snapshot.sm.Restore(state)
+	snapshot.ack, snapshot.ackIndex = decodeAck(ack, lastIncludedIndex)
+	return snapshot, nil
+}
+
+// installSnapshot replaces the server's state with a decoded snapshot. The apply loop decodes
+// and installs snapshots itself, so no entry is applied in between.
+// Must be called with kv.mu held.
+func (kv *KVServer) installSnapshot(snapshot decodedSnapshot) {
+	if old, ok := kv.sm.(*kvStore); ok {
+		if store, ok := snapshot.sm.(*kvStore); ok {
+			store.evictions = old.evictions
+		}
+	}
+	kv.sm = snapshot.sm
+	kv.ack, kv.ackIndex = snapshot.ack, snapshot.ackIndex
+	kv.lastErr = snapshot.lastErr
+	kv.window = snapshot.window
+	kv.floor = snapshot.floor
+	kv.idempotent = snapshot.idempotent
+	kv.remembered = snapshot.remembered
+	kv.sequences = snapshot.sequences
+	kv.issued = snapshot.issued
+	kv.results = snapshot.results
+	kv.lastApplied = snapshot.index
+	kv.snapshotIndex = snapshot.index
+}
+
+// highWatermark returns the Raft state size above which the server snapshots.
+func (cfg ServerConfig) highWatermark(maxraftstate int) int {
+	if cfg.SnapshotHighWatermark > 0 {
+		return cfg.SnapshotHighWatermark
+	}
+	return maxraftstate
+}
+
+// validateWatermarks reports whether the snapshot watermarks form a valid band.
+func (cfg ServerConfig) validateWatermarks(maxraftstate int) error {
+	if cfg.SnapshotHighWatermark < 0 || cfg.SnapshotLowWatermark < 0 {
+		return fmt.Errorf("raftkv: snapshot watermarks must not be negative, got %d and %d", cfg.SnapshotHighWatermark, cfg.SnapshotLowWatermark)
+	}
+	if high := cfg.highWatermark(maxraftstate); maxraftstate != -1 && cfg.SnapshotLowWatermark >= high {
+		return fmt.Errorf("raftkv: SnapshotLowWatermark %d must be below the high watermark %d", cfg.SnapshotLowWatermark, high)
+	}
+	return nil
+}
+
+// isDormant reports whether a client has had no request applied within the last
+// AckRetention log entries. Dormancy depends only on log indexes, so every replica
+// agrees on it no matter when it takes its snapshots.
+func (kv *KVServer) isDormant(clientId int64) bool {
+	return kv.cfg.AckRetention > 0 && kv.lastApplied-kv.ackIndex[clientId] > kv.cfg.AckRetention
+}
+
+// isExpired reports whether op is a write from a client the servers have no state for, though
+// it says it has had a write applied: its state was dropped as dormant, so op may repeat a
+// request that was applied before, and duplicate detection can no longer tell.
+func (kv *KVServer) isExpired(op Op) bool {
+	if !op.Known || isRead(op) {
+		return false
+	}
+	_, ok := kv.ack[op.ClientId]
+	return !ok || kv.isDormant(op.ClientId)
+}
+
+// pruneDormantClients drops the dedup state of dormant clients.
+func (kv *KVServer) pruneDormantClients() {
+	for clientId := range kv.ack {
+		if kv.isDormant(clientId) {
+			delete(kv.ack, clientId)
+			delete(kv.ackIndex, clientId)
+			delete(kv.lastErr, clientId)
+			delete(kv.window, clientId)
+			delete(kv.floor, clientId)
+			delete(kv.remembered, clientId)
+			delete(kv.issued, clientId)
+		}
+	}
+	kv.pruneIdempotencyKeys()
+	kv.pruneResults()
+}
+
+// encodeAck packs the dedup state into a compact byte string for the snapshot.
+// Entries are sorted by client id; ids are delta-encoded, and request ids and the
+// distance of each client's last applied index from lastApplied are written as varints.
+func (kv *KVServer) encodeAck() []byte {
+	clientIds := make([]int64, 0, len(kv.ack))
+	for clientId := range kv.ack {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Slice(clientIds, func(i, j int) bool { return clientIds[i] < clientIds[j] })
+
+	buf := make([]byte, 0, len(clientIds)*3*binary.MaxVarintLen64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	put := func(x uint64) {
+		n := binary.PutUvarint(tmp, x)
+		buf = append(buf, tmp[:n]...)
+	}
+	prev := int64(0)
+	for _, clientId := range clientIds {
+		put(uint64(clientId - prev))
+		put(uint64(kv.ack[clientId]))
+		put(uint64(kv.lastApplied - kv.ackIndex[clientId]))
+		prev = clientId
+	}
+	return buf
+}
+
+// decodeAck restores the dedup state written by encodeAck at log index lastApplied.
+func decodeAck(buf []byte, lastApplied int) (map[int64]int64, map[int64]int) {
+	ack := make(map[int64]int64)
+	ackIndex := make(map[int64]int)
+	next := func() (uint64, bool) {
+		x, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return 0, false
+		}
+		buf = buf[n:]
+		return x, true
+	}
+	clientId := int64(0)
+	for len(buf) > 0 {
+		delta, ok1 := next()
+		requestId, ok2 := next()
+		age, ok3 := next()
+		if !ok1 || !ok2 || !ok3 {
+			break
+		}
+		clientId += int64(delta)
+		ack[clientId] = int64(requestId)
+		ackIndex[clientId] = lastApplied - int(age)
+	}
+	return ack, ackIndex
+}
@@ -0,0 +1,229 @@
+package raftkv
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+)
+
+// StateMachine is the replicated state a KVServer applies committed operations to. The server
+// owns everything else: the Raft log, duplicate detection, snapshots and the RPC handlers. The
+// default, used when ServerConfig.NewStateMachine is nil, is the key-value map; a replacement
+// interprets the same Op commands as it sees fit (e.g. "append" as adding to a set).
+type StateMachine interface {
+	// Apply applies an operation and returns its result; the server fills in the fields that
+	// identify the request, and the state machine sets Err, Value, Values and Keys. Every
+	// replica applies the same operations in the same order, so Apply must be deterministic. A
+	// retry of an operation that was already applied never reaches Apply, and its client gets the
+	// Err of the first application again. Reads ("get", "multiget" and "findbyvalue") are the
+	// exception: they are applied every time, and the leader also applies them outside the log
+	// to serve reads from local state, so they must not change the state.
+	Apply(op Op) Result
+
+	// Snapshot returns an encoding of the whole state, and Restore replaces the state with one
+	// returned by Snapshot, possibly on another replica.
+	Snapshot() []byte
+	Restore(snapshot []byte)
+}
+
+// isRead reports whether op only reads the state machine.
+func isRead(op Op) bool {
+	return op.Command == "get" || op.Command == "multiget" || op.Command == "findbyvalue"
+}
+
+// kvStore is the default StateMachine: a map from keys to string values.
+type kvStore struct {
+	data      map[string]string // Key-value data store
+	deletes   int               // Number of keys deleted since the last compaction
+	cache     map[string]string // Values of recently read keys, see cache.go
+	cacheSize int               // Capacity of the cache; zero disables it
+
+	maxKeys   int                      // Most keys the store holds, see lru.go; zero is unbounded
+	recency   *list.List               // Keys from least to most recently used, if maxKeys is set
+	used      map[string]*list.Element // Element of each key in recency
+	evictions int64                    // Number of keys evicted to stay within maxKeys
+
+	byValue map[string]map[string]bool // Keys holding each value, if indexing; see index.go
+	indexed map[string]string          // Value each key is indexed under
+}
+
+// newKVStore returns an empty store whose read cache holds up to cacheSize keys, which holds
+// up to maxKeys keys if maxKeys is positive, and which indexes keys by value if indexValues is set.
+func newKVStore(cacheSize int, maxKeys int, indexValues bool) *kvStore {
+	s := &kvStore{
+		data:      make(map[string]string),
+		cache:     make(map[string]string),
+		cacheSize: cacheSize,
+		maxKeys:   maxKeys,
+		recency:   list.New(),
+		used:      make(map[string]*list.Element),
+	}
+	if indexValues {
+		s.byValue = make(map[string]map[string]bool)
+		s.indexed = make(map[string]string)
+	}
+	return s
+}
+
+// newStateMachine returns a fresh state machine of the kind the server is configured with.
+func (cfg ServerConfig) newStateMachine() StateMachine {
+	if cfg.NewStateMachine != nil {
+		return cfg.NewStateMachine()
+	}
+	return newKVStore(cfg.ReadCacheSize, cfg.MaxKeys, cfg.IndexValues)
+}
+
+// Apply applies an operation to the key-value store and returns the result.
+func (s *kvStore) Apply(op Op) Result {
+	result := Result{Err: OK}
+	switch op.Command {
+	case "put":
+		s.data[op.Key] = op.Value
+		s.invalidate(op.Key)
+		s.reindex(op.Key)
+		s.touch(op.Key)
+	case "append":
+		s.data[op.Key] += op.Value
+		s.invalidate(op.Key)
+		s.reindex(op.Key)
+		s.touch(op.Key)
+	case "delete":
+		if _, ok := s.data[op.Key]; ok {
+			delete(s.data, op.Key)
+			s.deletes++
+			s.invalidate(op.Key)
+			s.reindex(op.Key)
+			s.forget(op.Key)
+		}
+	case "compact":
+		s.compact()
+	case "flushall":
+		result.Keys = s.flush()
+	case "bulk":
+		// the whole batch shares a single dedup entry, so a retry never re-applies part of it.
+		keys := make([]string, 0, len(op.Pairs))
+		for key, value := range op.Pairs {
+			s.data[key] = value
+			s.invalidate(key)
+			keys = append(keys, key)
+		}
+		// map order differs between replicas, so the batch is used in key order.
+		sort.Strings(keys)
+		s.reindex(keys...)
+		s.touch(keys...)
+	case "rename":
+		result.Value, result.Err = s.rename(op)
+	case "transform":
+		result.Value, result.Err = s.transform(op)
+	case "checkandact":
+		result.Value, result.Err = s.checkAndAct(op)
+	case "multiget":
+		result.Values = s.readKeys(op.Keys)
+	case "findbyvalue":
+		result.Keys, result.Err = s.findByValue(op.Value)
+	case "get":
+		if value, ok := s.data[op.Key]; ok {
+			result.Value = value
+			s.fill(op.Key, value)
+			// gets are only ever applied from the log, so this is the same on every replica.
+			s.touch(op.Key)
+		} else {
+			result.Err = ErrNoKey
+		}
+	}
+	s.evict()
+	return result
+}
+
+// rename moves the value of op.Key to op.NewKey, as a delete and a put that take effect together,
+// and returns the value moved.
+func (s *kvStore) rename(op Op) (string, Err) {
+	value, ok := s.data[op.Key]
+	if !ok {
+		return "", ErrNoKey
+	}
+	if _, exists := s.data[op.NewKey]; exists && !op.Overwrite {
+		return "", ErrKeyExists
+	}
+	delete(s.data, op.Key)
+	s.deletes++
+	s.data[op.NewKey] = value
+	s.invalidate(op.Key, op.NewKey)
+	s.reindex(op.Key, op.NewKey)
+	s.forget(op.Key)
+	s.touch(op.NewKey)
+	return value, OK
+}
+
+// readKeys returns the values of those keys that exist.
+func (s *kvStore) readKeys(keys []string) map[string]string {
+	values := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := s.data[key]; ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// compact reclaims the memory held by deleted keys. Go maps never give back the space of
+// deleted entries, so the data is copied into a map sized for what is left.
+func (s *kvStore) compact() {
+	data := make(map[string]string, len(s.data))
+	for key, value := range s.data {
+		data[key] = value
+	}
+	s.data = data
+	s.deletes = 0
+}
+
+// flush deletes every key, and returns the keys deleted in order. The data starts over in a fresh
+// map, so there is nothing left for a compaction to reclaim.
+func (s *kvStore) flush() []string {
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s.data = make(map[string]string)
+	s.deletes = 0
+	s.cache = make(map[string]string)
+	s.recency.Init()
+	s.used = make(map[string]*list.Element)
+	if s.byValue != nil {
+		s.byValue = make(map[string]map[string]bool)
+		s.indexed = make(map[string]string)
+	}
+	return keys
+}
+
+// Snapshot encodes the data, the recency order and the value index; the read cache is not part
+// of the replicated state.
+func (s *kvStore) Snapshot() []byte {
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(s.data)
+	e.Encode(s.recencyOrder())
+	if s.byValue != nil {
+		e.Encode(s.byValue)
+	}
+	return w.Bytes()
+}
+
+// Restore replaces the data, recency order and value index with a snapshot's, and empties the
+// read cache.
+func (s *kvStore) Restore(snapshot []byte) {
+	s.data = make(map[string]string)
+	var order []string
+	var byValue map[string]map[string]bool
+	d := gobWrapper.NewDecoder(bytes.NewBuffer(snapshot))
+	d.Decode(&s.data)
+	d.Decode(&order)
+	d.Decode(&byValue)
+	s.restoreRecency(order)
+	s.restoreIndex(byValue)
+	s.deletes = 0
+	s.cache = make(map[string]string)
+}
@@ -0,0 +1,95 @@
+package raftkv
+
+import "time"
+
+// latencyBounds are the upper bounds of the buckets of a LatencyHistogram, doubling from 1ms.
+var latencyBounds = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	4 * time.Millisecond,
+	8 * time.Millisecond,
+	16 * time.Millisecond,
+	32 * time.Millisecond,
+	64 * time.Millisecond,
+	128 * time.Millisecond,
+	256 * time.Millisecond,
+}
+
+// LatencyHistogram counts latency observations in buckets. Counts[i] is the number of
+// observations no greater than Bounds[i] (and greater than the previous bound), and the
+// final entry of Counts, one past the last bound, counts everything slower.
+type LatencyHistogram struct {
+	Bounds []time.Duration // Upper bound of each bucket but the last.
+	Counts []int64         // Number of observations in each bucket.
+	Count  int64           // Total number of observations.
+	Sum    time.Duration   // Sum of all observations.
+}
+
+// newLatencyHistogram returns an empty histogram with the default buckets.
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{Bounds: latencyBounds, Counts: make([]int64, len(latencyBounds)+1)}
+}
+
+// observe adds one observation to the histogram.
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Mean returns the average observation, or zero if there are none.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Stats is a point-in-time copy of a KVServer's statistics, as returned by KVServer.Stats.
+type Stats struct {
+	// ApplyLatency is the time, on the leader, from proposing a client operation to Raft to
+	// its result coming back from the apply loop. It covers replication, commit, and
+	// application, but not time spent waiting for the leader's lock or in the client.
+	ApplyLatency LatencyHistogram
+
+	// ApplyQueueDepth is the number of committed operations waiting for the server to apply
+	// them, out of ApplyQueueCapacity. A full queue blocks Raft, so alert before it fills.
+	ApplyQueueDepth    int
+	ApplyQueueCapacity int
+
+	// ReadCacheHits counts gets the leader answered from its read cache under its lease, and
+	// ReadCacheMisses those it had to send through the log although it held the lease.
+	ReadCacheHits   int64
+	ReadCacheMisses int64
+
+	// LeaseReads counts reads the leader served under its lease, with ServerConfig.LeaseReads,
+	// and ReadIndexReads those it served after confirming its leadership with a ReadIndex round.
+	LeaseReads     int64
+	ReadIndexReads int64
+
+	// Snapshots counts the snapshots the server has handed to Raft.
+	Snapshots int64
+
+	// Evictions counts the keys the store has evicted to stay within ServerConfig.MaxKeys.
+	Evictions int64
+
+	// Throttled counts the requests refused with ErrThrottled for exceeding ServerConfig.ClientRate.
+	Throttled int64
+}
+
+// Stats returns a copy of the server's current statistics.
+func (kv *KVServer) Stats() Stats {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	stats := kv.stats
+	stats.ApplyLatency.Counts = append([]int64(nil), kv.stats.ApplyLatency.Counts...)
+	stats.ApplyQueueDepth, stats.ApplyQueueCapacity = kv.rf.ApplyQueue()
+	if store, ok := kv.sm.(*kvStore); ok {
+		stats.Evictions = store.evictions
+	}
+	return stats
+}
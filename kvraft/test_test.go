@@ -0,0 +1,384 @@
+package raftkv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/raft"
+)
+
+func TestPartitionedLeaderRead(t *testing.T) {
+	cfg := make_config_with(t, 5, false, -1, ServerConfig{LinearizableReads: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a partitioned leader refuses ReadIndex reads")
+	cfg.checkPartitionedLeaderRead()
+	cfg.end()
+}
+
+func TestCompetingCheckAndActs(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: competing check-and-acts observe a single serialization")
+	cfg.checkCompetingCheckAndActs(5, 10)
+	cfg.end()
+}
+
+func TestConcurrentTransforms(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: concurrent transforms are linearizable")
+	cfg.checkConcurrentTransforms(5, 10)
+	cfg.end()
+}
+
+func TestCompetingRenames(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: competing renames are linearizable")
+	cfg.checkCompetingRenames(5, 10)
+	cfg.end()
+}
+
+func TestFlushAll(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 1000, ServerConfig{AllowFlushAll: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: flushes are atomic and applied at most once")
+	cfg.checkFlushAll(20, 10)
+	cfg.end()
+}
+
+func TestVerifiedHistory(t *testing.T) {
+	cfg := make_config_with(t, 3, true, -1, ServerConfig{AllowFlushAll: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a verifying Clerk accepts renames, transforms and flushes")
+	cfg.checkVerifiedHistory(5, 120)
+	cfg.end()
+}
+
+func TestViolationReported(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a verifying Clerk reports a violation without panicking")
+	cfg.checkViolationReported()
+	cfg.end()
+}
+
+func TestDormantClients(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{AckRetention: 20})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: dormant clients are dropped and then turned away")
+	cfg.checkDormantClients(10)
+	cfg.end()
+}
+
+func TestPreProposeReads(t *testing.T) {
+	checkPreProposeReads(t, 3)
+}
+
+func TestIdleSnapshot(t *testing.T) {
+	idle := 200 * time.Millisecond
+	cfg := make_config_with(t, 3, false, 100000, ServerConfig{IdleSnapshotAfter: idle})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: an idle cluster snapshots below maxraftstate")
+	cfg.checkIdleSnapshot(20, idle)
+	cfg.end()
+}
+
+func TestNextID(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: NextID hands out every id once, with no gaps")
+	cfg.checkNextID(5, 20)
+	cfg.end()
+}
+
+func TestLockContention(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: one owner holds a lock at a time, with rising fencing tokens")
+	cfg.checkLockContention(10)
+	cfg.end()
+}
+
+func TestSnapshotVerification(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 100000, ServerConfig{IdleSnapshotAfter: 200 * time.Millisecond})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: VerifySnapshot accepts real snapshots and refuses a misindexed one")
+	cfg.checkSnapshotVerification(20)
+	cfg.end()
+}
+
+func TestSnapshotV1(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a server restarts from a version 1 snapshot")
+	cfg.checkSnapshotV1(20)
+	cfg.end()
+}
+
+func TestBulkLoad(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a bulk load of 10000 keys is a single log entry")
+	cfg.checkBulkLoad(10000)
+	cfg.end()
+}
+
+func TestMultiGetPairs(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: MultiGet never sees a half-updated pair")
+	cfg.checkMultiGetPairs(3, 2*time.Second)
+	cfg.end()
+}
+
+func TestApplyLatency(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: delayed replication shows up in the apply latency")
+	cfg.checkApplyLatency(20, 100*time.Millisecond)
+	cfg.end()
+}
+
+func TestTombstoneCompaction(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{CompactionInterval: 50 * time.Millisecond})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: compaction reclaims deleted keys on every replica alike")
+	cfg.checkTombstoneCompaction(60, 3)
+	cfg.end()
+}
+
+func TestHedgedRequests(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a hedged request completes past a slow server")
+	cfg.checkHedgedRequests(10, 5*time.Millisecond, 500*time.Millisecond)
+	cfg.end()
+}
+
+func TestLeaderHints(t *testing.T) {
+	cfg := make_config(t, 5, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a follower's hint takes the Clerk to the leader in two hops")
+	cfg.checkLeaderHints(3)
+	cfg.end()
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a Clerk that reaches no server gives up after its retries")
+	cfg.checkRetriesExhausted(5)
+	cfg.end()
+}
+
+func TestReadCache(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{ReadCacheSize: 10, Raft: raft.Config{LeaseDuration: 150 * time.Millisecond}})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: cached reads skip the quorum round and see concurrent writes")
+	cfg.checkReadCache(2 * time.Second)
+	cfg.end()
+}
+
+func TestCoalescedAppends(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{CoalesceAppends: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: bursts of appends to one key coalesce into fewer entries")
+	cfg.checkCoalescedAppends(5, 20)
+	cfg.end()
+}
+
+func TestCounterStateMachine(t *testing.T) {
+	cfg := make_config_with(t, 3, true, 1000, ServerConfig{NewStateMachine: newCounterMachine})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a counter state machine runs through the server and Raft")
+	cfg.checkCounterStateMachine(3, 30)
+	cfg.end()
+}
+
+func TestSnapshotWatermarks(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 2000, ServerConfig{SnapshotLowWatermark: 1000})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: state hovering near maxraftstate does not snapshot on every op")
+	cfg.checkSnapshotWatermarks(5, 60)
+	cfg.end()
+}
+
+func TestPipelinedDedup(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a pipelining Clerk's retried requests apply once")
+	cfg.checkPipelinedDedup(5, 20)
+	cfg.end()
+}
+
+func TestLoadBackoff(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{Raft: raft.Config{MaxUncommittedEntries: 10}})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: the load rises under overload and the Clerk slows down")
+	cfg.checkLoadBackoff(6, 400*time.Millisecond)
+	cfg.end()
+}
+
+func TestEviction(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 1000, ServerConfig{MaxKeys: 10})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: every replica evicts the same keys past the limit")
+	cfg.checkEviction(3, 50)
+	cfg.end()
+}
+
+func TestConsistencyLevels(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{LinearizableReads: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: each consistency level is served where and as it promises")
+	cfg.checkConsistencyLevels()
+	cfg.end()
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	cfg := make_config(t, 3, false, 1000)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a write under one idempotency key applies once across clients")
+	cfg.checkIdempotencyKeys(3)
+	cfg.end()
+}
+
+func TestStaleReadsAfterRestart(t *testing.T) {
+	cfg := make_config(t, 3, false, 1000)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a restarted follower refuses stale reads until it has caught up")
+	cfg.checkStaleReadsAfterRestart()
+	cfg.end()
+}
+
+func TestThrottling(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{ClientRate: 20, ClientBurst: 5})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: an over-rate client is throttled while another proceeds")
+	cfg.checkThrottling(5, 2*time.Second, 100*time.Millisecond)
+	cfg.end()
+}
+
+func TestSnapshotInstallLatency(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 1<<24, ServerConfig{IdleSnapshotAfter: 200 * time.Millisecond})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: installing a large snapshot does not hold up reads")
+	cfg.checkSnapshotInstallLatency(20000)
+	cfg.end()
+}
+
+func TestShardRouting(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a Clerk follows its shard map on ErrWrongGroup")
+	cfg.checkShardRouting(10)
+	cfg.end()
+}
+
+func TestSnapshotWaiters(t *testing.T) {
+	cfg := make_config(t, 3, false, 1000)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: snapshots leave no proposer without a result")
+	cfg.checkSnapshotWaiters(10)
+	cfg.end()
+}
+
+func TestFindByValue(t *testing.T) {
+	cfg := make_config_with(t, 3, false, 1000, ServerConfig{IndexValues: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: FindByValue returns exactly the keys holding a value")
+	cfg.checkFindByValue(30)
+	cfg.end()
+}
+
+func TestResultCache(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{ResultCacheSize: 5, LinearizableReads: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: retries are answered from the result cache")
+	cfg.checkResultCache(10)
+	cfg.end()
+}
+
+func TestPostApplyHook(t *testing.T) {
+	checkPostApplyHook(t, 3)
+}
+
+func TestCommandTypes(t *testing.T) {
+	checkCommandTypes(t)
+}
+
+func TestSimulation(t *testing.T) {
+	cfg := make_config_with(t, 5, false, -1, ServerConfig{Raft: raft.Config{ElectionSeed: 1}})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a scripted partition, heal, crash and recovery stay linearizable")
+	cfg.runSimulation(3, 3, partitionHealCrashRecover(), time.Second, 1)
+	cfg.end()
+}
+
+func TestSnapshotContents(t *testing.T) {
+	checkSnapshotContents(t, 5, 3*time.Second)
+}
+
+func TestExportedHistory(t *testing.T) {
+	checkExportedHistory(t, 5, 4*time.Second)
+}
+
+func TestEmbeddedCluster(t *testing.T) {
+	checkEmbeddedCluster(t, 3)
+}
+
+func TestChunkedValues(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: large values are split into chunks")
+	cfg.checkChunkedValues(100000, 8192)
+	cfg.end()
+}
+
+func TestLeaseReads(t *testing.T) {
+	cfg := make_config_with(t, 3, false, -1, ServerConfig{LeaseReads: true, Raft: raft.Config{LeaseDuration: 50 * time.Millisecond}})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: reads under a lease, and ReadIndex once it lapses")
+	cfg.checkLeaseReads()
+	cfg.end()
+}
@@ -0,0 +1,93 @@
+package raftkv
+
+import (
+	"fmt"
+	"time"
+)
+
+// With cfg.ClientRate set, the leader admits each client's requests through a token bucket:
+// the bucket holds up to cfg.ClientBurst tokens, refills at cfg.ClientRate tokens a second, and
+// every request takes one. A request that finds the bucket empty is answered with ErrThrottled
+// before anything is proposed, and the Clerk backs off and retries it like ErrBusy. Only the
+// leader throttles, since it is the one a flood of writes can overload; a follower turns the
+// requests away as before. A bucket that has refilled says nothing the absence of one doesn't,
+// so idle clients' buckets are swept away.
+
+// bucketSweepInterval is how often the leader drops the buckets of clients that have gone idle.
+const bucketSweepInterval = time.Second
+
+// tokenBucket is the admission state of one client.
+type tokenBucket struct {
+	tokens float64   // Tokens left as of last
+	last   time.Time // When tokens was last brought up to date
+}
+
+// admit reports whether a request from clientId may proceed, taking a token from its bucket if so.
+func (kv *KVServer) admit(clientId int64) bool {
+	if kv.cfg.ClientRate <= 0 {
+		return true
+	}
+	if _, isLeader, _ := kv.rf.GetState(); !isLeader {
+		return true
+	}
+	now := time.Now()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if now.Sub(kv.bucketsSwept) >= bucketSweepInterval {
+		kv.sweepBuckets(now)
+	}
+	b, ok := kv.buckets[clientId]
+	if !ok {
+		b = &tokenBucket{tokens: kv.cfg.clientBurst(), last: now}
+		kv.buckets[clientId] = b
+	}
+	b.refill(now, kv.cfg.ClientRate, kv.cfg.clientBurst())
+	if b.tokens < 1 {
+		kv.stats.Throttled++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since b was last brought up to date, up to burst.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// sweepBuckets drops the buckets that have refilled completely.
+// Must be called with the lock held.
+func (kv *KVServer) sweepBuckets(now time.Time) {
+	burst := kv.cfg.clientBurst()
+	for clientId, b := range kv.buckets {
+		if b.refill(now, kv.cfg.ClientRate, burst); b.tokens >= burst {
+			delete(kv.buckets, clientId)
+		}
+	}
+	kv.bucketsSwept = now
+}
+
+// validateRates reports whether the admission limits are valid.
+func (cfg ServerConfig) validateRates() error {
+	if cfg.ClientRate < 0 || cfg.ClientBurst < 0 {
+		return fmt.Errorf("raftkv: ClientRate and ClientBurst must not be negative, got %v and %d", cfg.ClientRate, cfg.ClientBurst)
+	}
+	return nil
+}
+
+// clientBurst returns the capacity of each client's bucket: cfg.ClientBurst, or one second's
+// worth of cfg.ClientRate, and never less than a single request.
+func (cfg ServerConfig) clientBurst() float64 {
+	burst := float64(cfg.ClientBurst)
+	if burst <= 0 {
+		burst = cfg.ClientRate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
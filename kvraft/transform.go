@@ -0,0 +1,100 @@
+package raftkv
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Transform computes the new value of a key from its current value, if it exists, and the
+// argument a client sent along with the transform's name. Transforms run in the apply loop
+// of every replica, so they must be deterministic.
+type Transform func(value string, exists bool, arg string) (string, Err)
+
+// transforms are the transforms a client may name in Clerk.Transform.
+var transforms = map[string]Transform{
+	"incr":          incrTransform,
+	"max":           maxTransform,
+	"min":           minTransform,
+	"append-unique": appendUniqueTransform,
+}
+
+// incrTransform adds the integer arg to the integer value; a missing key counts as zero.
+func incrTransform(value string, exists bool, arg string) (string, Err) {
+	delta, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return "", ErrBadValue
+	}
+	if !exists {
+		return strconv.FormatInt(delta, 10), OK
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", ErrBadValue
+	}
+	return strconv.FormatInt(n+delta, 10), OK
+}
+
+// maxTransform keeps the larger of the integers value and arg; a missing key takes arg.
+func maxTransform(value string, exists bool, arg string) (string, Err) {
+	return compareTransform(value, exists, arg, func(n, m int64) bool { return m > n })
+}
+
+// minTransform keeps the smaller of the integers value and arg; a missing key takes arg.
+func minTransform(value string, exists bool, arg string) (string, Err) {
+	return compareTransform(value, exists, arg, func(n, m int64) bool { return m < n })
+}
+
+// compareTransform replaces the integer value with the integer arg if replace says so.
+func compareTransform(value string, exists bool, arg string, replace func(n, m int64) bool) (string, Err) {
+	m, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return "", ErrBadValue
+	}
+	if !exists {
+		return arg, OK
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", ErrBadValue
+	}
+	if replace(n, m) {
+		return arg, OK
+	}
+	return value, OK
+}
+
+// appendUniqueTransform treats the value as a comma-separated set and adds arg to it,
+// unless it is already a member.
+func appendUniqueTransform(value string, exists bool, arg string) (string, Err) {
+	if arg == "" || strings.Contains(arg, ",") {
+		return "", ErrBadValue
+	}
+	if !exists || value == "" {
+		return arg, OK
+	}
+	for _, member := range strings.Split(value, ",") {
+		if member == arg {
+			return value, OK
+		}
+	}
+	return value + "," + arg, OK
+}
+
+// transform applies the transform op.Transform to the value of op.Key, with op.Value as its
+// argument, and returns the new value. The value is left alone if the transform fails.
+func (s *kvStore) transform(op Op) (string, Err) {
+	fn, ok := transforms[op.Transform]
+	if !ok {
+		return "", ErrUnknownTransform
+	}
+	value, exists := s.data[op.Key]
+	value, err := fn(value, exists, op.Value)
+	if err != OK {
+		return "", err
+	}
+	s.data[op.Key] = value
+	s.invalidate(op.Key)
+	s.reindex(op.Key)
+	s.touch(op.Key)
+	return value, OK
+}
@@ -0,0 +1,73 @@
+package raftkv
+
+import (
+	"fmt"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+	"github.com/ReshiAdavan/Sentinel/raft"
+)
+
+// VerifySnapshot checks, end to end, the snapshot a server saved in persister against the log
+// Raft saved alongside it. The snapshot's state must be the state at the index it is labeled
+// with, which catches a snapshot handed to Raft with the wrong index; the log must pick up
+// where the snapshot leaves off, with the term it records; and replaying the log onto the
+// snapshot's state, as a restarted server would, must apply every entry in order. cfg must be
+// the configuration the server ran with, for its state machine and dedup settings. A snapshot
+// of a layout version decodeSnapshot cannot read, see snapshotVersion, fails the check. It
+// returns nil if the persister holds no snapshot.
+func VerifySnapshot(persister *raft.Persister, cfg ServerConfig) error {
+	if persister.SnapshotSize() == 0 {
+		return nil
+	}
+	snapshot, err := raft.ParseSnapshot(persister.ReadSnapshot())
+	if err != nil {
+		return err
+	}
+	_, _, log, err := raft.ParseRaftState(persister.ReadRaftState())
+	if err != nil {
+		return err
+	}
+
+	// the log may begin before the snapshot, if it was saved after a snapshot that Raft has
+	// not trimmed it to yet, but never after it.
+	index := snapshot.LastIncludedIndex
+	if log[0].Index > index || log[len(log)-1].Index < index {
+		return fmt.Errorf("raftkv: log spans %d to %d, missing the snapshot's index %d", log[0].Index, log[len(log)-1].Index, index)
+	}
+	if term := log[index-log[0].Index].Term; term != snapshot.LastIncludedTerm {
+		return fmt.Errorf("raftkv: snapshot at index %d has term %d, the log %d", index, snapshot.LastIncludedTerm, term)
+	}
+
+	gobWrapper.Register(Op{})
+	kv := &KVServer{cfg: cfg}
+	decoded, err := kv.decodeSnapshot(snapshot.Data, index)
+	if err != nil {
+		return err
+	}
+	if decoded.recorded != index {
+		return fmt.Errorf("raftkv: snapshot labeled index %d holds the state at index %d", index, decoded.recorded)
+	}
+	kv.installSnapshot(decoded)
+
+	prev := log[index-log[0].Index]
+	for _, entry := range log[index-log[0].Index+1:] {
+		if entry.Index != prev.Index+1 || entry.Term < prev.Term {
+			return fmt.Errorf("raftkv: log entry %d (term %d) follows entry %d (term %d)", entry.Index, entry.Term, prev.Index, prev.Term)
+		}
+		if _, ok := entry.Command.(raft.Membership); ok {
+			kv.lastApplied = entry.Index
+			prev = entry
+			continue
+		}
+		op, ok := entry.Command.(Op)
+		if !ok {
+			return fmt.Errorf("raftkv: log entry %d holds %T, not an operation", entry.Index, entry.Command)
+		}
+		kv.lastApplied = entry.Index
+		for _, op := range splitAppends(op) {
+			kv.applyOp(op)
+		}
+		prev = entry
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package linearizability
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ValidateEvents checks that an event history is well formed: every id has exactly one call
+// event followed, later in the history, by exactly one return event. The event checker assumes
+// this pairing, so a history captured from real logs should be validated before it is checked.
+// The error describes the first problem found.
+func ValidateEvents(history []Event) error {
+	called := make(map[uint]int) // id => position of its call event
+	returned := make(map[uint]bool)
+	for i, e := range history {
+		switch e.Kind {
+		case CallEvent:
+			if j, ok := called[e.Id]; ok {
+				return fmt.Errorf("linearizability: event %d: id %d is called again (first called at event %d)", i, e.Id, j)
+			}
+			called[e.Id] = i
+		case ReturnEvent:
+			if _, ok := called[e.Id]; !ok {
+				return fmt.Errorf("linearizability: event %d: return for id %d has no earlier call", i, e.Id)
+			}
+			if returned[e.Id] {
+				return fmt.Errorf("linearizability: event %d: id %d returns more than once", i, e.Id)
+			}
+			returned[e.Id] = true
+		}
+	}
+	// report the earliest unmatched call, so the error is deterministic.
+	missing, at := uint(0), -1
+	for id, i := range called {
+		if !returned[id] && (at == -1 || i < at) {
+			missing, at = id, i
+		}
+	}
+	if at != -1 {
+		return fmt.Errorf("linearizability: event %d: call for id %d has no return", at, missing)
+	}
+	return nil
+}
+
+// CheckEventsStrict is like CheckEvents, but first validates the history with ValidateEvents
+// and returns its error, without checking, if the history is malformed.
+func CheckEventsStrict(model Model, history []Event) (bool, error) {
+	if err := ValidateEvents(history); err != nil {
+		return false, err
+	}
+	return CheckEvents(model, history), nil
+}
+
+// jsonEvent is the JSON encoding of an Event read by LoadEvents.
+type jsonEvent struct {
+	Kind  string          `json:"kind"` // "call" or "return"
+	Id    uint            `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// LoadEvents reads an event history from a JSON array of objects of the form
+//
+//	{"kind": "call" or "return", "id": <unsigned integer>, "value": <any JSON>}
+//
+// decodeValue turns each raw value into the input (for calls) or output (for returns)
+// the model expects. Ids may be arbitrary, as captured from logs; the history is
+// validated with ValidateEvents before it is returned.
+func LoadEvents(r io.Reader, decodeValue func(kind EventKind, raw json.RawMessage) (interface{}, error)) ([]Event, error) {
+	var raw []jsonEvent
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("linearizability: decoding events: %v", err)
+	}
+	history := make([]Event, 0, len(raw))
+	for i, je := range raw {
+		var kind EventKind
+		switch je.Kind {
+		case "call":
+			kind = CallEvent
+		case "return":
+			kind = ReturnEvent
+		default:
+			return nil, fmt.Errorf("linearizability: event %d: unknown kind %q", i, je.Kind)
+		}
+		value, err := decodeValue(kind, je.Value)
+		if err != nil {
+			return nil, fmt.Errorf("linearizability: event %d: %v", i, err)
+		}
+		history = append(history, Event{Kind: kind, Value: value, Id: je.Id})
+	}
+	if err := ValidateEvents(history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// DecodeKvEventValue is a decodeValue function for LoadEvents that decodes the values of
+// KvModel histories: a KvInput for each call and a KvOutput for each return.
+func DecodeKvEventValue(kind EventKind, raw json.RawMessage) (interface{}, error) {
+	if kind == CallEvent {
+		var input KvInput
+		err := json.Unmarshal(raw, &input)
+		return input, err
+	}
+	var output KvOutput
+	err := json.Unmarshal(raw, &output)
+	return output, err
+}
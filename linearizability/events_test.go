@@ -0,0 +1,47 @@
+package linearizability
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMissingReturn checks that an event history in which one call never returns is rejected,
+// by ValidateEvents, CheckEventsStrict and LoadEvents, with an error naming the event and id
+// of that call, while the same history with the return in place is checked as usual.
+func TestMissingReturn(t *testing.T) {
+	complete := []Event{
+		{Kind: CallEvent, Value: KvInput{Op: 1, Key: "x", Value: "1"}, Id: 7},
+		{Kind: CallEvent, Value: KvInput{Op: 0, Key: "x"}, Id: 9},
+		{Kind: ReturnEvent, Value: KvOutput{}, Id: 7},
+		{Kind: ReturnEvent, Value: KvOutput{Value: "1"}, Id: 9},
+	}
+	if ok, err := CheckEventsStrict(KvModel(), complete); err != nil || !ok {
+		t.Fatalf("complete history: got %v, %v, want true, nil", ok, err)
+	}
+
+	// id 9 is called between two operations that complete, and never returns.
+	missing := []Event{
+		{Kind: CallEvent, Value: KvInput{Op: 1, Key: "x", Value: "1"}, Id: 7},
+		{Kind: ReturnEvent, Value: KvOutput{}, Id: 7},
+		{Kind: CallEvent, Value: KvInput{Op: 0, Key: "x"}, Id: 9},
+		{Kind: CallEvent, Value: KvInput{Op: 0, Key: "x"}, Id: 11},
+		{Kind: ReturnEvent, Value: KvOutput{Value: "1"}, Id: 11},
+	}
+	want := "linearizability: event 2: call for id 9 has no return"
+
+	err := ValidateEvents(missing)
+	if err == nil || err.Error() != want {
+		t.Fatalf("ValidateEvents returned %v, want %q", err, want)
+	}
+	if ok, err := CheckEventsStrict(KvModel(), missing); ok || err == nil || err.Error() != want {
+		t.Fatalf("CheckEventsStrict returned %v, %v, want false, %q", ok, err, want)
+	}
+	json := `[
+		{"kind": "call", "id": 7, "value": {"Op": 1, "Key": "x", "Value": "1"}},
+		{"kind": "call", "id": 9, "value": {"Op": 0, "Key": "x"}},
+		{"kind": "return", "id": 7, "value": {}}
+	]`
+	if _, err := LoadEvents(strings.NewReader(json), DecodeKvEventValue); err == nil || !strings.Contains(err.Error(), "call for id 9 has no return") {
+		t.Fatalf("LoadEvents returned %v, want an error about id 9's missing return", err)
+	}
+}
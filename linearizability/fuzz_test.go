@@ -0,0 +1,71 @@
+package linearizability
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// corruptValue is never written by generateKvHistory, so a get that returns it can't be linearized.
+const corruptValue = "!"
+
+// FuzzKvModel is a fuzz target for the checker itself. Each input seeds the generation of a
+// random concurrent KvModel history whose labelling is known: a valid history is built around
+// a sequential execution, and a corrupted one has a get that returns a value no execution
+// could produce. The checker must accept the former and reject the latter, which exercises
+// checkSingle's lift/unlift and cache logic against a reference it can't share bugs with.
+// Run it with go test -fuzz FuzzKvModel; plain go test runs the seed corpus.
+func FuzzKvModel(f *testing.F) {
+	// seed corpus: small and medium histories over one or several keys, valid and corrupted.
+	f.Add(int64(1), uint8(4), uint8(1), false)
+	f.Add(int64(2), uint8(12), uint8(1), false)
+	f.Add(int64(3), uint8(20), uint8(3), false)
+	f.Add(int64(4), uint8(4), uint8(1), true)
+	f.Add(int64(5), uint8(12), uint8(2), true)
+	f.Add(int64(6), uint8(30), uint8(3), true)
+
+	f.Fuzz(func(t *testing.T, seed int64, nops uint8, nkeys uint8, corrupt bool) {
+		r := rand.New(rand.NewSource(seed))
+		// keep histories small enough that the exponential search stays fast.
+		history := generateKvHistory(r, int(nops)%32+1, int(nkeys)%3+1, corrupt)
+		if ok := CheckOperations(KvModel(), history); ok == corrupt {
+			t.Fatalf("checker returned %v for a history with corrupt=%v: %+v", ok, corrupt, history)
+		}
+	})
+}
+
+// generateKvHistory returns a random history of nops KvModel operations over nkeys keys.
+// The operations are executed one after another by a reference sequential store, and each
+// one's call and return times are then spread out around its point in that sequence, so
+// neighbouring operations overlap but the history is linearizable by construction.
+// If corrupt is set, one get is made to return corruptValue, so the history is not.
+func generateKvHistory(r *rand.Rand, nops, nkeys int, corrupt bool) []Operation {
+	store := make(map[string]string)
+	history := make([]Operation, 0, nops)
+	for i := 0; i < nops; i++ {
+		point := int64(i+1) * 100
+		call := point - 1 - r.Int63n(150)
+		ret := point + 1 + r.Int63n(150)
+
+		input := KvInput{Op: uint8(r.Intn(3)), Key: "k" + strconv.Itoa(r.Intn(nkeys))}
+		output := KvOutput{}
+		switch input.Op {
+		case 0:
+			output.Value = store[input.Key]
+		case 1:
+			input.Value = strconv.Itoa(r.Intn(100))
+			store[input.Key] = input.Value
+		case 2:
+			input.Value = strconv.Itoa(r.Intn(100))
+			store[input.Key] += input.Value
+		}
+		history = append(history, Operation{Input: input, Call: call, Output: output, Return: ret})
+	}
+
+	if corrupt {
+		i := r.Intn(len(history))
+		history[i].Input = KvInput{Op: 0, Key: history[i].Input.(KvInput).Key}
+		history[i].Output = KvOutput{Value: corruptValue}
+	}
+	return history
+}
@@ -171,7 +171,8 @@ func unlift(entry *node) {
 }
 
 // checkSingle checks if a single partition of the history is linearizable.
-func checkSingle(model Model, subhistory *node, kill *int32) bool {
+// If it is, it also returns the ids of the operations in the order they were linearized.
+func checkSingle(model Model, subhistory *node, kill *int32) (bool, []uint) {
 	n := length(subhistory) / 2
 	linearized := newBitset(n)
 	cache := make(map[uint64][]cacheEntry) // map from hash to cache entry
@@ -182,7 +183,7 @@ func checkSingle(model Model, subhistory *node, kill *int32) bool {
 	entry := subhistory
 	for headEntry.next != nil {
 		if atomic.LoadInt32(kill) != 0 {
-			return false
+			return false, nil
 		}
 		if entry.match != nil {
 			matching := entry.match // the return entry
@@ -206,7 +207,7 @@ func checkSingle(model Model, subhistory *node, kill *int32) bool {
 			}
 		} else {
 			if len(calls) == 0 {
-				return false
+				return false, nil
 			}
 			callsTop := calls[len(calls)-1]
 			entry = callsTop.entry
@@ -217,7 +218,12 @@ func checkSingle(model Model, subhistory *node, kill *int32) bool {
 			entry = entry.next
 		}
 	}
-	return true
+	// every operation has been lifted, so calls holds the full linearization in order.
+	order := make([]uint, len(calls))
+	for i, call := range calls {
+		order[i] = call.entry.id
+	}
+	return true, order
 }
 
 // fillDefault fills in default implementations for missing methods in the model.
@@ -249,7 +255,8 @@ func CheckOperationsTimeout(model Model, history []Operation, timeout time.Durat
 	for _, subhistory := range partitions {
 		l := makeLinkedEntries(makeEntries(subhistory))
 		go func() {
-			results <- checkSingle(model, l, &kill)
+			ok, _ := checkSingle(model, l, &kill)
+			results <- ok
 		}()
 	}
 	var timeoutChan <-chan time.Time
@@ -277,6 +284,39 @@ loop:
 	return ok
 }
 
+// CheckOperationsWithOrder checks if the operations in the history are linearizable and, if so,
+// also returns the linearization found for each partition. orders[i] lists the ids of the
+// operations of partition i (as returned by model.Partition) in linearized order, where an id
+// is the index of the operation within its partition.
+func CheckOperationsWithOrder(model Model, history []Operation) (bool, [][]uint) {
+	model = fillDefault(model)
+	partitions := model.Partition(history)
+	orders := make([][]uint, len(partitions))
+	type result struct {
+		partition int
+		ok        bool
+		order     []uint
+	}
+	results := make(chan result, len(partitions))
+	kill := int32(0)
+	for i, subhistory := range partitions {
+		i, l := i, makeLinkedEntries(makeEntries(subhistory))
+		go func() {
+			ok, order := checkSingle(model, l, &kill)
+			results <- result{i, ok, order}
+		}()
+	}
+	for range partitions {
+		r := <-results
+		if !r.ok {
+			atomic.StoreInt32(&kill, 1)
+			return false, nil
+		}
+		orders[r.partition] = r.order
+	}
+	return true, orders
+}
+
 // CheckEvents checks if the events in the history are linearizable.
 func CheckEvents(model Model, history []Event) bool {
 	return CheckEventsTimeout(model, history, 0)
@@ -292,7 +332,8 @@ func CheckEventsTimeout(model Model, history []Event, timeout time.Duration) boo
 	for _, subhistory := range partitions {
 		l := makeLinkedEntries(convertEntries(renumber(subhistory)))
 		go func() {
-			results <- checkSingle(model, l, &kill)
+			ok, _ := checkSingle(model, l, &kill)
+			results <- ok
 		}()
 	}
 	var timeoutChan <-chan time.Time
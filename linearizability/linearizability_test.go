@@ -0,0 +1,49 @@
+package linearizability
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestLinearizationOrder checks the orders CheckOperationsWithOrder returns for random valid
+// KvModel histories over several keys. Each partition's order must name every one of its
+// operations exactly once, respect real time, and replay through the model from its initial
+// state with every step valid.
+func TestLinearizationOrder(t *testing.T) {
+	model := KvModel()
+	for seed := int64(1); seed <= 20; seed++ {
+		history := generateKvHistory(rand.New(rand.NewSource(seed)), 24, 3, false)
+		ok, orders := CheckOperationsWithOrder(model, history)
+		if !ok {
+			t.Fatalf("seed %d: valid history reported not linearizable: %+v", seed, history)
+		}
+		partitions := model.Partition(history)
+		if len(orders) != len(partitions) {
+			t.Fatalf("seed %d: %d orders for %d partitions", seed, len(orders), len(partitions))
+		}
+		for i, order := range orders {
+			ops := partitions[i]
+			if len(order) != len(ops) {
+				t.Fatalf("seed %d: partition %d: order %v has %d ids for %d operations", seed, i, order, len(order), len(ops))
+			}
+			seen := make(map[uint]bool)
+			state := model.Init()
+			for k, id := range order {
+				if id >= uint(len(ops)) || seen[id] {
+					t.Fatalf("seed %d: partition %d: order %v repeats or exceeds id %d", seed, i, order, id)
+				}
+				seen[id] = true
+				for _, later := range order[k+1:] {
+					if ops[later].Return < ops[id].Call {
+						t.Fatalf("seed %d: partition %d: operation %d is ordered before %d, which returned before it was called", seed, i, id, later)
+					}
+				}
+				var valid bool
+				valid, state = model.Step(state, ops[id].Input, ops[id].Output)
+				if !valid {
+					t.Fatalf("seed %d: partition %d: operation %+v is invalid at position %d of order %v", seed, i, ops[id], k, order)
+				}
+			}
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package linearizability
 
+import "sort"
+
 // Operation represents an operation in the history of a linearizability check.
 // It includes both the input to and output from the operation along with their respective timestamps.
 type Operation struct {
@@ -38,7 +40,9 @@ type Model struct {
 
 	// Step function takes a state and an operation's input and output,
 	// and returns whether the operation is valid in the current state and the new state.
-	// It should not mutate the existing state.
+	// It should not mutate the existing state. The output is checked against the state before
+	// the operation and the new state may depend on the input, so an operation that both reads
+	// and writes (e.g. get-and-set) is a single step; RMWModel builds such a Step.
 	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
 
 	// Equal function defines equality for states.
@@ -50,6 +54,39 @@ func NoPartition(history []Operation) [][]Operation {
 	return [][]Operation{history}
 }
 
+// PartitionBy returns a partitioning function built from a per-operation predicate.
+// Operations the predicate marks as splittable are grouped by the key it returns, one
+// partition per key; all other operations are kept together in a single partition.
+// NoPartition and key partitioning are the cases where nothing, or everything, is splittable.
+// Partitions are returned in a deterministic order: the coupled operations first, then by key.
+func PartitionBy(split func(op Operation) (key string, splittable bool)) func(history []Operation) [][]Operation {
+	return func(history []Operation) [][]Operation {
+		var coupled []Operation
+		m := make(map[string][]Operation)
+		for _, op := range history {
+			key, ok := split(op)
+			if !ok {
+				coupled = append(coupled, op)
+				continue
+			}
+			m[key] = append(m[key], op)
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var ret [][]Operation
+		if len(coupled) > 0 {
+			ret = append(ret, coupled)
+		}
+		for _, k := range keys {
+			ret = append(ret, m[k])
+		}
+		return ret
+	}
+}
+
 // NoPartitionEvent is a default partitioning function for event histories, treating the entire history as a single partition.
 func NoPartitionEvent(history []Event) [][]Event {
 	return [][]Event{history}
@@ -0,0 +1,79 @@
+package linearizability
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// TestPartitionBy checks a custom partition that keeps the operations on keys k0 and k1
+// together and splits the rest by key. On random histories it must put every operation in
+// exactly one partition, coupled ones first and then one per key in order, each in history
+// order, and a model over the whole store must reach the same verdict through it as through
+// NoPartition, for valid and corrupted histories alike.
+func TestPartitionBy(t *testing.T) {
+	partition := PartitionBy(func(op Operation) (string, bool) {
+		key := op.Input.(KvInput).Key
+		return key, key != "k0" && key != "k1"
+	})
+	// store is a model of the whole key-value store, so it is valid under any partition.
+	store := Model{
+		Init: func() interface{} { return map[string]string{} },
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			inp := input.(KvInput)
+			st := state.(map[string]string)
+			if inp.Op == 0 {
+				return output.(KvOutput).Value == st[inp.Key], state
+			}
+			next := make(map[string]string, len(st)+1)
+			for k, v := range st {
+				next[k] = v
+			}
+			if inp.Op == 1 {
+				next[inp.Key] = inp.Value
+			} else {
+				next[inp.Key] += inp.Value
+			}
+			return true, next
+		},
+		Equal: func(state1, state2 interface{}) bool { return reflect.DeepEqual(state1, state2) },
+	}
+
+	for seed := int64(1); seed <= 20; seed++ {
+		corrupt := seed%2 == 0
+		history := generateKvHistory(rand.New(rand.NewSource(seed)), 16, 4, corrupt)
+		partitions := partition(history)
+
+		var want [][]Operation
+		var coupled, k2, k3 []Operation
+		for _, op := range history {
+			switch op.Input.(KvInput).Key {
+			case "k2":
+				k2 = append(k2, op)
+			case "k3":
+				k3 = append(k3, op)
+			default:
+				coupled = append(coupled, op)
+			}
+		}
+		for _, p := range [][]Operation{coupled, k2, k3} {
+			if len(p) > 0 {
+				want = append(want, p)
+			}
+		}
+		if !reflect.DeepEqual(partitions, want) {
+			t.Fatalf("seed %d: partitioned %+v into %+v, want %+v", seed, history, partitions, want)
+		}
+
+		whole := CheckOperations(store, history)
+		store.Partition = partition
+		parted := CheckOperations(store, history)
+		store.Partition = nil
+		if whole != parted {
+			t.Fatalf("seed %d: checker returned %v through the partition and %v without", seed, parted, whole)
+		}
+		if whole == corrupt {
+			t.Fatalf("seed %d: checker returned %v for a history with corrupt=%v", seed, whole, corrupt)
+		}
+	}
+}
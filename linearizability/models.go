@@ -1,9 +1,11 @@
 package linearizability
 
+import "reflect"
+
 // KvInput represents the input for a key-value store operation.
 // It includes the operation type (get, put, append), key, and value.
 type KvInput struct {
-	Op    uint8  // Operation type: 0 => get, 1 => put, 2 => append
+	Op    uint8  // Operation type: 0 => get, 1 => put, 2 => append, 3 => delete (KvNoKeyModel only)
 	Key   string // Key in the key-value store
 	Value string // Value to be used in the operation
 }
@@ -11,26 +13,22 @@ type KvInput struct {
 // KvOutput represents the output of a get operation in the key-value store.
 type KvOutput struct {
 	Value string // Value retrieved from the key-value store
+	NoKey bool   // True if the get reported ErrNoKey (only checked by KvNoKeyModel)
 }
 
+// partitionByKvKey partitions KvInput operations by key. Each key's operations
+// are considered a separate history for linearizability checks.
+var partitionByKvKey = PartitionBy(func(op Operation) (string, bool) {
+	return op.Input.(KvInput).Key, true
+})
+
 // KvModel returns a Model specific to a key-value store. This model can be used
 // to check linearizability of operations on a key-value store.
 func KvModel() Model {
 	return Model{
 		// Partition partitions the operations by key. Each key's operations
 		// are considered a separate history for linearizability checks.
-		Partition: func(history []Operation) [][]Operation {
-			m := make(map[string][]Operation)
-			for _, v := range history {
-				key := v.Input.(KvInput).Key
-				m[key] = append(m[key], v)
-			}
-			var ret [][]Operation
-			for _, v := range m {
-				ret = append(ret, v)
-			}
-			return ret
-		},
+		Partition: partitionByKvKey,
 		// Init initializes the model state. For a key-value store model,
 		// the state is represented as a string (value of a key).
 		Init: func() interface{} {
@@ -58,3 +56,210 @@ func KvModel() Model {
 		Equal: ShallowEqual,
 	}
 }
+
+// kvNoKeyState is the state of a single key in KvNoKeyModel.
+type kvNoKeyState struct {
+	Present bool   // Whether the key currently exists
+	Value   string // Value of the key, meaningful only if Present
+}
+
+// KvNoKeyModel returns a key-value Model that, unlike KvModel, tells a missing key apart
+// from a key holding the empty string. A get returning ErrNoKey (KvOutput.NoKey) is only
+// valid while the key has never been written or has since been deleted, which matches
+// the behaviour of kvraft's Get.
+func KvNoKeyModel() Model {
+	return Model{
+		// Partition partitions the operations by key, as in KvModel.
+		Partition: partitionByKvKey,
+		// Init initializes the model state: every key starts out missing.
+		Init: func() interface{} {
+			return kvNoKeyState{}
+		},
+		// Step validates gets against both the presence and the value of the key.
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			inp := input.(KvInput)
+			out := output.(KvOutput)
+			st := state.(kvNoKeyState)
+			switch inp.Op {
+			case 0: // get operation
+				if out.NoKey {
+					return !st.Present, state
+				}
+				return st.Present && out.Value == st.Value, state
+			case 1: // put operation
+				return true, kvNoKeyState{Present: true, Value: inp.Value}
+			case 2: // append operation (creates the key if missing)
+				return true, kvNoKeyState{Present: true, Value: st.Value + inp.Value}
+			case 3: // delete operation
+				return true, kvNoKeyState{}
+			}
+			// Default case: should not happen in correct usage
+			return false, state
+		},
+		// Equal can compare states directly since kvNoKeyState is a comparable struct.
+		Equal: ShallowEqual,
+	}
+}
+
+// QueueInput represents the input for a queue operation.
+type QueueInput struct {
+	Op    uint8  // Operation type: 0 => enqueue, 1 => dequeue
+	Value string // Value to enqueue
+}
+
+// QueueOutput represents the output of a queue operation.
+type QueueOutput struct {
+	Ok    bool   // False if an enqueue found the queue full or a dequeue found it empty
+	Value string // Value dequeued
+}
+
+// BoundedQueueModel returns a Model of a FIFO queue holding at most capacity values,
+// where an enqueue fails when the queue is full and a dequeue fails when it is empty.
+// A queue's operations all interact, so the history is checked as a single partition.
+func BoundedQueueModel(capacity int) Model {
+	return Model{
+		// Init initializes the model state: the queue contents, oldest first.
+		Init: func() interface{} {
+			return []string{}
+		},
+		// Step validates the outcome of each operation against the queue's fill level.
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			inp := input.(QueueInput)
+			out := output.(QueueOutput)
+			st := state.([]string)
+			switch inp.Op {
+			case 0: // enqueue operation
+				if len(st) >= capacity {
+					return !out.Ok, state
+				}
+				// copy, since the existing state must not be mutated.
+				next := make([]string, len(st), len(st)+1)
+				copy(next, st)
+				return out.Ok, append(next, inp.Value)
+			case 1: // dequeue operation
+				if len(st) == 0 {
+					return !out.Ok, state
+				}
+				return out.Ok && out.Value == st[0], st[1:]
+			}
+			// Default case: should not happen in correct usage
+			return false, state
+		},
+		// Equal compares queue contents element by element, since slices aren't comparable.
+		Equal: func(state1, state2 interface{}) bool {
+			st1, st2 := state1.([]string), state2.([]string)
+			if len(st1) != len(st2) {
+				return false
+			}
+			for i := range st1 {
+				if st1[i] != st2[i] {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
+
+// CounterInput represents the input for an operation on a counter.
+type CounterInput struct {
+	Op    uint8  // Operation type: 0 => increment, 1 => read
+	Key   string // Key of the counter
+	Delta int64  // Amount to add in an increment
+}
+
+// CounterOutput represents the output of a read of a counter.
+type CounterOutput struct {
+	Value int64 // Value of the counter
+}
+
+// CounterModel returns a Model of independent counters, one per key, each starting at zero.
+// An increment always succeeds and advances the counter by its delta, and a read returns the
+// current value, so a history is only linearizable if no increment was lost or applied twice.
+func CounterModel() Model {
+	return Model{
+		// Partition partitions the operations by the key of the counter.
+		Partition: PartitionBy(func(op Operation) (string, bool) {
+			return op.Input.(CounterInput).Key, true
+		}),
+		// Init initializes the model state: a single counter's value.
+		Init: func() interface{} {
+			return int64(0)
+		},
+		// Step applies an increment or validates a read against the counter's value.
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			inp := input.(CounterInput)
+			st := state.(int64)
+			switch inp.Op {
+			case 0: // increment operation
+				return true, st + inp.Delta
+			case 1: // read operation
+				return output.(CounterOutput).Value == st, state
+			}
+			// Default case: should not happen in correct usage
+			return false, state
+		},
+		// Equal compares counter values, which are plain integers.
+		Equal: ShallowEqual,
+	}
+}
+
+// RMWModel returns a Model for objects whose operations may read and modify the state in one step,
+// such as get-and-set, increment-and-get or compare-and-swap. apply runs an operation sequentially:
+// given the state before it and its input, it returns the state after it and the output it must
+// have produced. An operation is valid in a state if its recorded output equals, by
+// reflect.DeepEqual, the one apply derives from that state. apply must not mutate state. equal
+// compares states; nil means ShallowEqual. The history is not partitioned; set Partition on the
+// returned Model to check independent objects separately.
+func RMWModel(init func() interface{}, apply func(state, input interface{}) (interface{}, interface{}), equal func(state1, state2 interface{}) bool) Model {
+	if equal == nil {
+		equal = ShallowEqual
+	}
+	return Model{
+		Init: init,
+		// Step derives the output from the pre-state and accepts the operation if it matches.
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+			next, want := apply(state, input)
+			if !reflect.DeepEqual(want, output) {
+				return false, state
+			}
+			return true, next
+		},
+		Equal: equal,
+	}
+}
+
+// GetSetInput represents the input for an operation on a register.
+type GetSetInput struct {
+	Op    uint8  // Operation type: 0 => get, 1 => get-and-set
+	Key   string // Key of the register
+	Value string // Value stored by a get-and-set
+}
+
+// GetSetOutput represents the output of an operation on a register.
+type GetSetOutput struct {
+	Value string // Value of the register before the operation
+}
+
+// GetSetModel returns a Model of independent string registers, one per key, each starting empty.
+// A get returns the current value, and a get-and-set stores a new value and returns the old one.
+// It is built on RMWModel.
+func GetSetModel() Model {
+	model := RMWModel(
+		func() interface{} { return "" },
+		func(state, input interface{}) (interface{}, interface{}) {
+			inp := input.(GetSetInput)
+			st := state.(string)
+			if inp.Op == 1 {
+				return inp.Value, GetSetOutput{Value: st}
+			}
+			return st, GetSetOutput{Value: st}
+		},
+		nil,
+	)
+	// Partition partitions the operations by the key of the register.
+	model.Partition = PartitionBy(func(op Operation) (string, bool) {
+		return op.Input.(GetSetInput).Key, true
+	})
+	return model
+}
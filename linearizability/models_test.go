@@ -0,0 +1,146 @@
+package linearizability
+
+import "testing"
+
+// TestKvNoKeyModel checks that KvNoKeyModel accepts a get reporting ErrNoKey only while the
+// key is missing: before it is first written, or after it is deleted, and tells a missing key
+// from one holding the empty string.
+func TestKvNoKeyModel(t *testing.T) {
+	put := func(value string, call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 1, Key: "x", Value: value}, Call: call, Output: KvOutput{}, Return: ret}
+	}
+	del := func(call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 3, Key: "x"}, Call: call, Output: KvOutput{}, Return: ret}
+	}
+	get := func(value string, call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 0, Key: "x"}, Call: call, Output: KvOutput{Value: value}, Return: ret}
+	}
+	noKey := func(call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 0, Key: "x"}, Call: call, Output: KvOutput{NoKey: true}, Return: ret}
+	}
+	cases := []struct {
+		name    string
+		history []Operation
+		want    bool
+	}{
+		{"no key before the first put", []Operation{noKey(0, 10), put("1", 20, 30), get("1", 40, 50)}, true},
+		{"no key after a delete", []Operation{put("1", 0, 10), del(20, 30), noKey(40, 50)}, true},
+		{"no key concurrent with the first put", []Operation{put("1", 0, 30), noKey(10, 20), get("1", 40, 50)}, true},
+		{"no key after a put", []Operation{put("1", 0, 10), noKey(20, 30)}, false},
+		{"no key after a put of the empty string", []Operation{put("", 0, 10), noKey(20, 30)}, false},
+		{"empty value before the first put", []Operation{get("", 0, 10), put("1", 20, 30)}, false},
+		{"no key after a delete was undone by a put", []Operation{del(0, 10), put("2", 20, 30), noKey(40, 50)}, false},
+	}
+	for _, c := range cases {
+		if ok := CheckOperations(KvNoKeyModel(), c.history); ok != c.want {
+			t.Fatalf("%s: checker returned %v, want %v", c.name, ok, c.want)
+		}
+	}
+}
+
+// TestBoundedQueueModel checks BoundedQueueModel on a queue of capacity 2. An enqueue must
+// fail exactly when the queue is full and a dequeue exactly when it is empty, and values must
+// come out in the order they went in, allowing for whichever order concurrent operations take.
+func TestBoundedQueueModel(t *testing.T) {
+	enq := func(value string, ok bool, call, ret int64) Operation {
+		return Operation{Input: QueueInput{Op: 0, Value: value}, Call: call, Output: QueueOutput{Ok: ok}, Return: ret}
+	}
+	deq := func(value string, ok bool, call, ret int64) Operation {
+		return Operation{Input: QueueInput{Op: 1}, Call: call, Output: QueueOutput{Ok: ok, Value: value}, Return: ret}
+	}
+	cases := []struct {
+		name    string
+		history []Operation
+		want    bool
+	}{
+		{"fill, reject, drain", []Operation{enq("a", true, 0, 10), enq("b", true, 20, 30), enq("c", false, 40, 50), deq("a", true, 60, 70), deq("b", true, 80, 90), deq("", false, 100, 110)}, true},
+		{"room again after a dequeue", []Operation{enq("a", true, 0, 10), enq("b", true, 20, 30), deq("a", true, 40, 50), enq("c", true, 60, 70), deq("b", true, 80, 90), deq("c", true, 100, 110)}, true},
+		{"concurrent enqueues in either order", []Operation{enq("a", true, 0, 30), enq("b", true, 10, 20), deq("b", true, 40, 50), deq("a", true, 60, 70)}, true},
+		{"rejected enqueue concurrent with a dequeue", []Operation{enq("a", true, 0, 10), enq("b", true, 20, 30), enq("c", false, 40, 70), deq("a", true, 50, 60)}, true},
+		{"over capacity", []Operation{enq("a", true, 0, 10), enq("b", true, 20, 30), enq("c", true, 40, 50)}, false},
+		{"rejected with room", []Operation{enq("a", true, 0, 10), enq("b", false, 20, 30)}, false},
+		{"dequeued out of order", []Operation{enq("a", true, 0, 10), enq("b", true, 20, 30), deq("b", true, 40, 50)}, false},
+		{"dequeued from an empty queue", []Operation{deq("a", true, 0, 10)}, false},
+	}
+	for _, c := range cases {
+		if ok := CheckOperations(BoundedQueueModel(2), c.history); ok != c.want {
+			t.Fatalf("%s: checker returned %v, want %v", c.name, ok, c.want)
+		}
+	}
+}
+
+// TestCounterModel checks CounterModel on two histories of concurrent increments to two
+// counters, read during and after them. It must accept the reads that count every increment,
+// and reject them once one increment is dropped from the total of a read after them.
+func TestCounterModel(t *testing.T) {
+	inc := func(key string, delta, call, ret int64) Operation {
+		return Operation{Input: CounterInput{Op: 0, Key: key, Delta: delta}, Call: call, Output: CounterOutput{}, Return: ret}
+	}
+	read := func(key string, value, call, ret int64) Operation {
+		return Operation{Input: CounterInput{Op: 1, Key: key}, Call: call, Output: CounterOutput{Value: value}, Return: ret}
+	}
+	increments := []Operation{inc("a", 1, 0, 40), inc("a", 2, 10, 30), inc("a", 4, 20, 50), inc("b", 10, 0, 20), inc("b", 20, 5, 25)}
+	cases := []struct {
+		name  string
+		reads []Operation
+		want  bool
+	}{
+		// a read concurrent with the increments may see any subset of them.
+		{"every increment counted", []Operation{read("a", 3, 15, 35), read("a", 7, 60, 70), read("b", 30, 60, 70)}, true},
+		{"an increment dropped", []Operation{read("a", 3, 15, 35), read("a", 5, 60, 70), read("b", 30, 60, 70)}, false},
+	}
+	for _, c := range cases {
+		history := append(append([]Operation{}, increments...), c.reads...)
+		if ok := CheckOperations(CounterModel(), history); ok != c.want {
+			t.Fatalf("%s: checker returned %v, want %v", c.name, ok, c.want)
+		}
+	}
+}
+
+// TestGetSetModel checks GetSetModel on concurrent get-and-sets of two registers. For a valid
+// history, walking the linearization CheckOperationsWithOrder finds must show every operation
+// returning the value the one before it left. Two get-and-sets that both claim the initial
+// value, or one that returns a value nobody set, must be rejected.
+func TestGetSetModel(t *testing.T) {
+	set := func(key, value, old string, call, ret int64) Operation {
+		return Operation{Input: GetSetInput{Op: 1, Key: key, Value: value}, Call: call, Output: GetSetOutput{Value: old}, Return: ret}
+	}
+	get := func(key, value string, call, ret int64) Operation {
+		return Operation{Input: GetSetInput{Op: 0, Key: key}, Call: call, Output: GetSetOutput{Value: value}, Return: ret}
+	}
+	// on x, b is called before c but takes effect after it, so b returns c and c returns a.
+	valid := []Operation{
+		set("x", "a", "", 0, 50), set("x", "b", "c", 10, 60), set("x", "c", "a", 20, 40), get("x", "b", 70, 80),
+		set("y", "p", "", 0, 10), set("y", "q", "p", 20, 30),
+	}
+	ok, orders := CheckOperationsWithOrder(GetSetModel(), valid)
+	if !ok {
+		t.Fatalf("valid history reported not linearizable")
+	}
+	for i, partition := range GetSetModel().Partition(valid) {
+		value := ""
+		for _, id := range orders[i] {
+			op := partition[id]
+			if old := op.Output.(GetSetOutput).Value; old != value {
+				t.Fatalf("%+v returned %q at its point in order %v, where the register held %q", op, old, orders[i], value)
+			}
+			if in := op.Input.(GetSetInput); in.Op == 1 {
+				value = in.Value
+			}
+		}
+	}
+
+	cases := []struct {
+		name    string
+		history []Operation
+	}{
+		{"both saw the initial value", []Operation{set("x", "a", "", 0, 20), set("x", "b", "", 10, 30)}},
+		{"old value nobody set", []Operation{set("x", "a", "", 0, 10), set("x", "b", "z", 20, 30)}},
+		{"old value already replaced", []Operation{set("x", "a", "", 0, 10), set("x", "b", "a", 20, 30), set("x", "c", "a", 40, 50)}},
+	}
+	for _, c := range cases {
+		if CheckOperations(GetSetModel(), c.history) {
+			t.Fatalf("%s: checker accepted the history", c.name)
+		}
+	}
+}
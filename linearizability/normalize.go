@@ -0,0 +1,43 @@
+package linearizability
+
+import "math"
+
+// PendingPolicy chooses what Normalize does with operations that never returned.
+type PendingPolicy int
+
+const (
+	// CompletePending keeps each pending operation, returning after every other operation.
+	// It may then be linearized anywhere after its call, including after everything else,
+	// which is the same as never having taken effect, so the verdict covers both outcomes.
+	// The model's Step must accept the operation's recorded Output in any state, as
+	// KvModel does for a put or an append with a KvOutput.
+	CompletePending PendingPolicy = iota
+	// DropPending leaves pending operations out, as if none of them had taken effect. A
+	// history whose other operations observed one of them is then not linearizable.
+	DropPending
+)
+
+// IsPending reports whether an operation was invoked but never returned, which a captured
+// history marks with a Return earlier than the Call (e.g. -1, or zero for calls stamped after
+// time zero).
+func IsPending(op Operation) bool {
+	return op.Return < op.Call
+}
+
+// Normalize returns a copy of a captured history that the checker can take, with its pending
+// operations (see IsPending) completed or dropped as the policy says. The checker assumes every
+// operation returned, so a history truncated while operations were still in flight, or whose
+// clients crashed mid-call, should be normalized before it is checked.
+func Normalize(history []Operation, policy PendingPolicy) []Operation {
+	normalized := make([]Operation, 0, len(history))
+	for _, op := range history {
+		if IsPending(op) {
+			if policy == DropPending {
+				continue
+			}
+			op.Return = math.MaxInt64
+		}
+		normalized = append(normalized, op)
+	}
+	return normalized
+}
@@ -0,0 +1,40 @@
+package linearizability
+
+import "testing"
+
+// TestPendingPolicies checks Normalize's verdicts on a history with a put that never returned.
+// A later get that saw the put is linearizable only if the put is kept; one that didn't see it
+// is linearizable either way.
+func TestPendingPolicies(t *testing.T) {
+	put := func(value string, call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 1, Key: "x", Value: value}, Call: call, Output: KvOutput{}, Return: ret}
+	}
+	get := func(value string, call, ret int64) Operation {
+		return Operation{Input: KvInput{Op: 0, Key: "x"}, Call: call, Output: KvOutput{Value: value}, Return: ret}
+	}
+	cases := []struct {
+		name     string
+		history  []Operation
+		complete bool // verdict under CompletePending
+		drop     bool // verdict under DropPending
+	}{
+		{"get sees the pending put", []Operation{put("1", 0, 10), put("2", 5, -1), get("2", 20, 30)}, true, false},
+		{"get misses the pending put", []Operation{put("1", 0, 10), put("2", 5, -1), get("1", 20, 30)}, true, true},
+	}
+	for _, c := range cases {
+		for _, p := range []struct {
+			policy PendingPolicy
+			want   bool
+		}{{CompletePending, c.complete}, {DropPending, c.drop}} {
+			history := Normalize(c.history, p.policy)
+			for _, op := range history {
+				if IsPending(op) {
+					t.Fatalf("%s: policy %d left pending operation %+v", c.name, p.policy, op)
+				}
+			}
+			if ok := CheckOperations(KvModel(), history); ok != p.want {
+				t.Fatalf("%s: policy %d: checker returned %v, want %v", c.name, p.policy, ok, p.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package linearizability
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CheckResult is the verdict of a check that may run out of time.
+type CheckResult int
+
+const (
+	Unknown CheckResult = iota // The check gave up before reaching a verdict.
+	Ok                         // The history is linearizable.
+	Illegal                    // The history is not linearizable.
+)
+
+// String returns the name of the verdict.
+func (r CheckResult) String() string {
+	switch r {
+	case Ok:
+		return "Ok"
+	case Illegal:
+		return "Illegal"
+	default:
+		return "Unknown"
+	}
+}
+
+// ParallelOptions tunes CheckOperationsParallel. The zero value checks every partition to
+// completion, with one worker per CPU.
+type ParallelOptions struct {
+	Workers          int           // Partitions checked at once; zero or less means runtime.NumCPU().
+	Timeout          time.Duration // Budget for the whole check, if positive.
+	PartitionTimeout time.Duration // Budget for each partition, from when a worker picks it up, if positive.
+
+	// OnPartition, if set, is called with each partition's verdict as soon as it is reached,
+	// from the worker that reached it, so a caller can report progress on a long check.
+	OnPartition func(partition int, result CheckResult)
+}
+
+// ParallelResult is the outcome of CheckOperationsParallel.
+type ParallelResult struct {
+	// Result is Illegal if any partition is, otherwise Unknown if any partition is, otherwise Ok.
+	Result CheckResult
+	// Partitions holds the verdict of each partition, in the order model.Partition returned them.
+	// Partitions no worker reached before the global timeout are Unknown.
+	Partitions []CheckResult
+}
+
+// CheckOperationsParallel checks the partitions of a history on a pool of workers, each under
+// its own deadline as well as the global one. Unlike CheckOperationsTimeout, it tells a history
+// found illegal from one it ran out of time on, and it checks every partition rather than
+// stopping at the first illegal one, so the verdict of each is known.
+func CheckOperationsParallel(model Model, history []Operation, opts ParallelOptions) ParallelResult {
+	model = fillDefault(model)
+	partitions := model.Partition(history)
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	results := make([]CheckResult, len(partitions))
+	kills := make([]int32, len(partitions))
+	var expired int32
+	if opts.Timeout > 0 {
+		timer := time.AfterFunc(opts.Timeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			for i := range kills {
+				atomic.StoreInt32(&kills[i], 1)
+			}
+		})
+		defer timer.Stop()
+	}
+
+	next := make(chan int, len(partitions))
+	for i := range partitions {
+		next <- i
+	}
+	close(next)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if atomic.LoadInt32(&expired) != 0 {
+					// left as Unknown, without a callback, like the partitions of an expired check.
+					continue
+				}
+				results[i] = checkPartition(model, partitions[i], &kills[i], opts.PartitionTimeout)
+				if opts.OnPartition != nil {
+					opts.OnPartition(i, results[i])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	aggregate := Ok
+	for _, result := range results {
+		if result == Illegal {
+			aggregate = Illegal
+			break
+		}
+		if result == Unknown {
+			aggregate = Unknown
+		}
+	}
+	return ParallelResult{Result: aggregate, Partitions: results}
+}
+
+// checkPartition checks one partition, giving up with Unknown once kill is set or timeout,
+// if positive, has passed.
+func checkPartition(model Model, subhistory []Operation, kill *int32, timeout time.Duration) CheckResult {
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { atomic.StoreInt32(kill, 1) })
+		defer timer.Stop()
+	}
+	ok, _ := checkSingle(model, makeLinkedEntries(makeEntries(subhistory)), kill)
+	switch {
+	case ok:
+		return Ok
+	case atomic.LoadInt32(kill) != 0:
+		// checkSingle also returns false when it is killed, so the search may not be exhausted.
+		return Unknown
+	default:
+		return Illegal
+	}
+}
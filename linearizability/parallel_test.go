@@ -0,0 +1,70 @@
+package linearizability
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestParallelVerdicts checks CheckOperationsParallel on a history with three keys: one whose
+// operations are quickly found linearizable, one with a get of a value never written, and one
+// with many concurrent appends followed by an impossible get, whose search can't finish within
+// the partition timeout. Each partition must get its own verdict, reported through OnPartition
+// as well, and the aggregate must be Illegal, or Unknown once the illegal key is left out.
+func TestParallelVerdicts(t *testing.T) {
+	op := func(code uint8, key, value string, call, ret int64) Operation {
+		input := KvInput{Op: code, Key: key}
+		output := KvOutput{}
+		if code == 0 {
+			output.Value = value
+		} else {
+			input.Value = value
+		}
+		return Operation{Input: input, Call: call, Output: output, Return: ret}
+	}
+	fast := []Operation{op(1, "fast", "1", 0, 10), op(2, "fast", "2", 5, 20), op(0, "fast", "12", 30, 40)}
+	illegal := []Operation{op(1, "illegal", "1", 0, 10), op(0, "illegal", "never written", 20, 30)}
+	// every order of the appends leaves a different value, so nothing prunes the search.
+	var slow []Operation
+	for i := 0; i < 14; i++ {
+		slow = append(slow, op(2, "slow", strconv.Itoa(i), 0, 100))
+	}
+	slow = append(slow, op(0, "slow", "impossible", 200, 300))
+
+	cases := []struct {
+		name    string
+		history []Operation
+		want    []CheckResult // in key order, as KvModel partitions
+		result  CheckResult
+	}{
+		{"all three", append(append(append([]Operation{}, fast...), illegal...), slow...), []CheckResult{Ok, Illegal, Unknown}, Illegal},
+		{"without the illegal key", append(append([]Operation{}, fast...), slow...), []CheckResult{Ok, Unknown}, Unknown},
+		{"fast only", fast, []CheckResult{Ok}, Ok},
+	}
+	for _, c := range cases {
+		var mu sync.Mutex
+		reported := make([]CheckResult, len(c.want))
+		calls := 0
+		opts := ParallelOptions{
+			Workers:          2,
+			PartitionTimeout: 200 * time.Millisecond,
+			OnPartition: func(partition int, result CheckResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				reported[partition] = result
+				calls++
+			},
+		}
+		got := CheckOperationsParallel(KvModel(), c.history, opts)
+		if got.Result != c.result || !reflect.DeepEqual(got.Partitions, c.want) {
+			t.Fatalf("%s: got %v %v, want %v %v", c.name, got.Result, got.Partitions, c.result, c.want)
+		}
+		mu.Lock()
+		if calls != len(c.want) || !reflect.DeepEqual(reported, c.want) {
+			t.Fatalf("%s: OnPartition reported %v in %d calls, want %v", c.name, reported, calls, c.want)
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,62 @@
+package linearizability
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryRecorder builds an Operation history from operations run on concurrent goroutines.
+// Timestamps are read from the monotonic clock, so wall clock adjustments can't reorder them,
+// and are strictly increasing across the recorder, so a call that starts after another
+// operation returns is never recorded as overlapping it. The zero value is not usable;
+// create recorders with NewHistoryRecorder.
+type HistoryRecorder struct {
+	mu      sync.Mutex
+	base    time.Time // carries the monotonic reading timestamps are measured from
+	last    int64     // latest timestamp handed out
+	history []Operation
+}
+
+// NewHistoryRecorder returns a recorder with an empty history.
+func NewHistoryRecorder() *HistoryRecorder {
+	return &HistoryRecorder{base: time.Now()}
+}
+
+// now returns a timestamp later than every one handed out before it.
+// Must be called with the lock held.
+func (hr *HistoryRecorder) now() int64 {
+	t := int64(time.Since(hr.base))
+	if t <= hr.last {
+		t = hr.last + 1
+	}
+	hr.last = t
+	return t
+}
+
+// Invoke records the call of an operation with the given input, and returns the function
+// to call with the operation's output once it returns. Only returned operations appear in
+// the history; calling the function more than once records the operation once.
+func (hr *HistoryRecorder) Invoke(input interface{}) func(output interface{}) {
+	hr.mu.Lock()
+	call := hr.now()
+	hr.mu.Unlock()
+
+	var once sync.Once
+	return func(output interface{}) {
+		once.Do(func() {
+			hr.mu.Lock()
+			defer hr.mu.Unlock()
+			hr.history = append(hr.history, Operation{Input: input, Call: call, Output: output, Return: hr.now()})
+		})
+	}
+}
+
+// Operations returns a copy of the operations that have returned so far, in the order
+// they returned.
+func (hr *HistoryRecorder) Operations() []Operation {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	history := make([]Operation, len(hr.history))
+	copy(history, hr.history)
+	return history
+}
@@ -0,0 +1,65 @@
+package linearizability
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestRecorderHistory has several goroutines record puts, appends and gets on a store guarded
+// by a mutex, which is linearizable by construction. Every operation must be recorded once,
+// returning after it was called, and CheckOperations must accept the history. A stale get
+// recorded after a put returns must then make the history unlinearizable, since the recorder
+// never lets a later call overlap an earlier return.
+func TestRecorderHistory(t *testing.T) {
+	const nclients, nops = 4, 50
+	var mu sync.Mutex
+	store := make(map[string]string)
+	hr := NewHistoryRecorder()
+
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < nops; i++ {
+				input := KvInput{Op: uint8((c + i) % 3), Key: "k" + strconv.Itoa(i%2), Value: strconv.Itoa(c*nops + i)}
+				done := hr.Invoke(input)
+				mu.Lock()
+				var output KvOutput
+				switch input.Op {
+				case 0:
+					output.Value = store[input.Key]
+				case 1:
+					store[input.Key] = input.Value
+				case 2:
+					store[input.Key] += input.Value
+				}
+				mu.Unlock()
+				done(output)
+				done(output) // a second return must not be recorded
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	history := hr.Operations()
+	if len(history) != nclients*nops {
+		t.Fatalf("recorded %d operations, want %d", len(history), nclients*nops)
+	}
+	for _, op := range history {
+		if op.Return <= op.Call {
+			t.Fatalf("operation %+v returned no later than it was called", op)
+		}
+	}
+	if !CheckOperations(KvModel(), history) {
+		t.Fatalf("history of %d operations on a locked store is not linearizable", len(history))
+	}
+
+	stale := store["k0"]
+	hr.Invoke(KvInput{Op: 1, Key: "k0", Value: "new"})(KvOutput{})
+	hr.Invoke(KvInput{Op: 0, Key: "k0"})(KvOutput{Value: stale})
+	if CheckOperations(KvModel(), hr.Operations()) {
+		t.Fatalf("history with a get that missed a put returned before it stayed linearizable")
+	}
+}
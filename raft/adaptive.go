@@ -0,0 +1,47 @@
+package raft
+
+import "time"
+
+// With cfg.AdaptiveElectionTimeout set, a follower records the gaps between consecutive
+// heartbeats from the leader it follows, and its election timeout starts at half as long again
+// as the longest of the last gapWindow gaps, so that a heartbeat as late as any it has seen
+// lately does not start an election. An average would not do: on a jittery network most
+// heartbeats arrive in bursts, and it is the rare long gap that times a follower out. Gaps
+// spanning a change of leader or term are not recorded, since they time an election rather
+// than the network.
+
+// gapWindow is the number of recent heartbeat gaps a follower keeps, a few seconds' worth.
+const gapWindow = 64
+
+// observeHeartbeatGap records the gap since the previous heartbeat, replacing the oldest once
+// the window is full. Must be called with rf.mu held.
+func (rf *Raft) observeHeartbeatGap(gap time.Duration) {
+	if len(rf.gaps) < gapWindow {
+		rf.gaps = append(rf.gaps, gap)
+	} else {
+		rf.gaps[rf.gapNext] = gap
+	}
+	rf.gapNext = (rf.gapNext + 1) % gapWindow
+}
+
+// shortestElectionTimeout returns the shortest election timeout the peer may draw: half as long
+// again as the longest recent gap between heartbeats, kept between cfg.ElectionTimeoutMin and the
+// bound that lets the drawn timeout stay within cfg.MaxElectionTimeout.
+func (rf *Raft) shortestElectionTimeout() time.Duration {
+	rf.mu.Lock()
+	var longestGap time.Duration
+	for _, gap := range rf.gaps {
+		if gap > longestGap {
+			longestGap = gap
+		}
+	}
+	rf.mu.Unlock()
+	shortest := longestGap * 3 / 2
+	if bound := rf.cfg.maxElectionTimeout() * 2 / 5; shortest > bound {
+		shortest = bound
+	}
+	if least := rf.cfg.electionTimeoutMin(); shortest < least {
+		shortest = least
+	}
+	return shortest
+}
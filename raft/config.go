@@ -1,16 +1,23 @@
 package raft
 
 import (
+	"bytes"
+	"context"
 	"log"
 	"runtime"
 	"sync"
 	"testing"
 
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
 	"github.com/ReshiAdavan/Sentinel/rpc"
 
 	crand "crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -35,6 +42,9 @@ type config struct {
 	saved     []*Persister
 	endnames  [][]string    // the port file names each sends to
 	logs      []map[int]int // copy of each server's committed entries
+	applied   []int         // index each server's current instance has applied up to, snapshots included
+	raftcfg   Config        // configuration every server is started with
+	founders  int           // servers 0..founders-1 start as the cluster, the rest with Config.Join
 	testNum   int32         // for two-minute timeout
 	// begin()/end() statistics
 	t0        time.Time // time at which test_test.go called cfg.begin()
@@ -48,6 +58,17 @@ var ncpu_once sync.Once
 
 // make_config sets up the raft test configuration.
 func make_config(t *testing.T, n int, unreliable bool) *config {
+	return make_config_with(t, n, unreliable, Config{})
+}
+
+// make_config_with is like make_config, but starts every server with raftcfg.
+func make_config_with(t *testing.T, n int, unreliable bool, raftcfg Config) *config {
+	return make_config_members(t, n, n, unreliable, raftcfg)
+}
+
+// make_config_members is like make_config_with, but only the first founders servers start as
+// the cluster; the others are started to join it, and wait for AddServer to add them.
+func make_config_members(t *testing.T, n int, founders int, unreliable bool, raftcfg Config) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -64,6 +85,9 @@ func make_config(t *testing.T, n int, unreliable bool) *config {
 	cfg.saved = make([]*Persister, cfg.n)
 	cfg.endnames = make([][]string, cfg.n)
 	cfg.logs = make([]map[int]int, cfg.n)
+	cfg.applied = make([]int, cfg.n)
+	cfg.raftcfg = raftcfg
+	cfg.founders = founders
 
 	cfg.setunreliable(unreliable)
 
@@ -155,11 +179,24 @@ func (cfg *config) start1(i int) {
 
 	// listen to messages from Raft indicating newly committed messages.
 	applyCh := make(chan ApplyMsg)
+	order := &applyOrder{}
+	cfg.mu.Lock()
+	cfg.applied[i] = 0
+	cfg.mu.Unlock()
 	go func() {
 		for m := range applyCh {
-			err_msg := ""
-			if !m.CommandValid {
-				// ignore other types of ApplyMsg
+			err_msg := order.check(m)
+			if err_msg != "" {
+				err_msg = fmt.Sprintf("server %v %v", i, err_msg)
+			} else if !m.CommandValid {
+				// a snapshot: the entries it covers are checked where they were applied
+				cfg.mu.Lock()
+				cfg.applied[i] = order.last
+				cfg.mu.Unlock()
+			} else if _, ok := (m.Command).(Membership); ok {
+				cfg.mu.Lock()
+				cfg.applied[i] = order.last
+				cfg.mu.Unlock()
 			} else if v, ok := (m.Command).(int); ok {
 				cfg.mu.Lock()
 				for j := 0; j < len(cfg.logs); j++ {
@@ -169,16 +206,12 @@ func (cfg *config) start1(i int) {
 							m.CommandIndex, i, m.Command, j, old)
 					}
 				}
-				_, prevok := cfg.logs[i][m.CommandIndex-1]
 				cfg.logs[i][m.CommandIndex] = v
+				cfg.applied[i] = order.last
 				if m.CommandIndex > cfg.maxIndex {
 					cfg.maxIndex = m.CommandIndex
 				}
 				cfg.mu.Unlock()
-
-				if m.CommandIndex > 1 && !prevok {
-					err_msg = fmt.Sprintf("server %v apply out of order %v", i, m.CommandIndex)
-				}
 			} else {
 				err_msg = fmt.Sprintf("committed command %v is not an int", m.Command)
 			}
@@ -192,7 +225,24 @@ func (cfg *config) start1(i int) {
 		}
 	}()
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	// a founder starts with the other founders as its peers, and a joiner with every server;
+	// either reaches the servers added later through the rest of its ends.
+	raftcfg := cfg.raftcfg
+	raftcfg.PeerEnd = func(server int) *rpc.ClientEnd {
+		if server < len(ends) {
+			return ends[server]
+		}
+		return nil
+	}
+	peers := ends[:cfg.founders]
+	if i >= cfg.founders {
+		raftcfg.Join = true
+		peers = ends
+	}
+	rf, err := MakeWithConfig(peers, i, cfg.saved[i], applyCh, raftcfg)
+	if err != nil {
+		cfg.t.Fatal(err)
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
@@ -204,56 +254,2942 @@ func (cfg *config) start1(i int) {
 	cfg.net.AddServer(i, srv)
 }
 
-func (cfg *config) cleanup() {
-	for i := 0; i < len(cfg.rafts); i++ {
-		if cfg.rafts[i] != nil {
-			cfg.rafts[i].Kill()
+// applyOrder checks, for one instance of a peer, the contract consumers of applyCh rely on:
+// command indexes arrive strictly increasing by one, with no gaps, duplicates, or reordering,
+// except that a snapshot jumps ahead to its own index, and the next command follows it.
+type applyOrder struct {
+	last int // index of the latest command applied, or of the latest snapshot
+}
+
+// check records m and returns how it breaks the order, or "" if it doesn't.
+func (o *applyOrder) check(m ApplyMsg) string {
+	switch {
+	case m.UseSnapshot:
+		if m.SnapshotIndex <= o.last {
+			return fmt.Sprintf("installed a snapshot at %v after applying up to %v", m.SnapshotIndex, o.last)
+		}
+		o.last = m.SnapshotIndex
+	case m.CommandValid:
+		if m.CommandIndex != o.last+1 {
+			return fmt.Sprintf("applied %v after %v", m.CommandIndex, o.last)
 		}
+		o.last = m.CommandIndex
 	}
+	return ""
 }
 
-// connect attaches a server to the network.
-func (cfg *config) connect(i int) {
-	// fmt.Printf("connect(%d)\n", i)
+// snapshot has every live server take a snapshot at the index it has applied up to.
+// The harness keeps its own copy of the log, so the snapshots carry no service data.
+func (cfg *config) snapshot() {
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		rf, index := cfg.rafts[i], cfg.applied[i]
+		cfg.mu.Unlock()
+		if rf != nil {
+			rf.CreateSnapshot(nil, index)
+		}
+	}
+}
 
-	cfg.connected[i] = true
+// checkApplyOrder runs the cluster through rounds of agreement, each followed by snapshots on
+// every server, a change of leader, and the crash and restart of a follower that missed the
+// round, so that peers apply entries, install snapshots from the leader, and recover from their
+// own. Every applyCh is checked with applyOrder throughout, and the run fails on the first
+// message out of order.
+func (cfg *config) checkApplyOrder(rounds int) {
+	cmd := 1
+	for r := 0; r < rounds; r++ {
+		leader := cfg.checkOneLeader()
+		lagging := (leader + 1) % cfg.n
+		cfg.disconnect(lagging)
+		for k := 0; k < 10; k++ {
+			cfg.one(cmd, cfg.n-1, true)
+			cmd++
+		}
+		cfg.snapshot()
 
-	// outgoing ClientEnds
-	for j := 0; j < cfg.n; j++ {
-		if cfg.connected[j] {
-			endname := cfg.endnames[i][j]
-			cfg.net.Enable(endname, true)
+		cfg.disconnect(leader)
+		cfg.connect(lagging)
+		cfg.checkOneLeader()
+		for k := 0; k < 10; k++ {
+			cfg.one(cmd, cfg.n-1, true)
+			cmd++
+		}
+		cfg.connect(leader)
+
+		cfg.crash1(lagging)
+		cfg.start1(lagging)
+		cfg.connect(lagging)
+		cfg.one(cmd, cfg.n, true)
+		cmd++
+		cfg.snapshot()
+	}
+	for i := 0; i < cfg.n; i++ {
+		if cfg.applyErr[i] != "" {
+			cfg.t.Fatal(cfg.applyErr[i])
 		}
 	}
+}
 
-	// incoming ClientEnds
-	for j := 0; j < cfg.n; j++ {
-		if cfg.connected[j] {
-			endname := cfg.endnames[j][i]
-			cfg.net.Enable(endname, true)
+// crashAndRecover crashes server i and restarts it from a copy of its Persister, as crash1 and
+// start1 do, then checks that the new instance carries on from the old one: a term no lower and,
+// in the same term, the same vote, and a log (or snapshot) holding every entry the old instance
+// knew to be committed, with the same commands. The server is reconnected afterwards.
+func (cfg *config) crashAndRecover(i int) {
+	cfg.disconnect(i)
+	cfg.mu.Lock()
+	old := cfg.rafts[i]
+	cfg.mu.Unlock()
+	old.mu.Lock()
+	term, votedFor := old.currentTerm, old.votedFor
+	committed := make(map[int]interface{})
+	for _, e := range old.log[1:] {
+		if e.Index <= old.commitIndex {
+			committed[e.Index] = e.Command
+		}
+	}
+	old.mu.Unlock()
+
+	cfg.start1(i)
+	cfg.mu.Lock()
+	rf := cfg.rafts[i]
+	cfg.mu.Unlock()
+	rf.mu.Lock()
+	if rf.currentTerm < term || rf.currentTerm == term && rf.votedFor != votedFor {
+		cfg.t.Fatalf("server %v recovered term %v vote %v, had term %v vote %v", i, rf.currentTerm, rf.votedFor, term, votedFor)
+	}
+	base := rf.log[0].Index
+	for index, cmd := range committed {
+		if index <= base {
+			continue // covered by the snapshot
+		}
+		if index-base >= len(rf.log) || rf.log[index-base].Command != cmd {
+			cfg.t.Fatalf("server %v lost committed entry %v (%v) in recovery", i, index, cmd)
 		}
 	}
+	rf.mu.Unlock()
+	cfg.connect(i)
 }
 
-// detach server i from the net.
-func (cfg *config) disconnect(i int) {
-	// fmt.Printf("disconnect(%d)\n", i)
+// checkApplyOrderUnderLoad has nclients goroutines start commands on the leader as fast as it
+// takes them for d, while every server snapshots every few heartbeats and each server is cut off
+// and brought back in turn, so that commits from AppendEntries, from the leader's own count and
+// snapshots installed from the leader all race to be applied. Every applyCh is checked with
+// applyOrder throughout, so CommandIndex must still arrive strictly in order on every server.
+func (cfg *config) checkApplyOrderUnderLoad(nclients int, d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for c := 0; c < nclients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for cmd := 1000 * (c + 1); ; cmd++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < cfg.n; i++ {
+					cfg.mu.Lock()
+					rf := cfg.rafts[i]
+					cfg.mu.Unlock()
+					if _, _, isLeader := rf.Start(cmd); isLeader {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(c)
+	}
 
-	cfg.connected[i] = false
+	for start, r := time.Now(), 0; time.Since(start) < d; r++ {
+		follower := r % cfg.n
+		cfg.disconnect(follower)
+		for k := 0; k < 4; k++ {
+			time.Sleep(cfg.raftcfg.heartbeatInterval())
+			cfg.snapshot()
+		}
+		cfg.connect(follower)
+		time.Sleep(cfg.raftcfg.heartbeatInterval())
+	}
+	close(stop)
+	wg.Wait()
 
-	// outgoing ClientEnds
-	for j := 0; j < cfg.n; j++ {
-		if cfg.endnames[i] != nil {
-			endname := cfg.endnames[i][j]
-			cfg.net.Enable(endname, false)
+	cfg.one(2, cfg.n, true)
+	for i := 0; i < cfg.n; i++ {
+		if cfg.applyErr[i] != "" {
+			cfg.t.Fatal(cfg.applyErr[i])
 		}
 	}
+}
 
-	// incoming ClientEnds
-	for j := 0; j < cfg.n; j++ {
-		if cfg.endnames[j] != nil {
-			endname := cfg.endnames[j][i]
-			cfg.net.Enable(endname, false)
+// checkCrashRecovery runs rounds in which the leader is crashed right after it was handed a few
+// commands, mid-replication, and recovered from its copied Persister with crashAndRecover.
+// Each round then commits a command on every server, which, with the harness's check that no
+// two servers apply different commands at an index, shows no committed entry was lost.
+func (cfg *config) checkCrashRecovery(rounds int) {
+	cmd := 1
+	for r := 0; r < rounds; r++ {
+		cfg.one(cmd, cfg.n, true)
+		cmd++
+		leader := cfg.checkOneLeader()
+		cfg.mu.Lock()
+		rf := cfg.rafts[leader]
+		cfg.mu.Unlock()
+		for k := 0; k < 3; k++ {
+			rf.Start(cmd)
+			cmd++
+		}
+		cfg.crashAndRecover(leader)
+		cfg.one(cmd, cfg.n, true)
+		cmd++
+	}
+}
+
+// checkTornSnapshot simulates a crash between saving the Raft state and the snapshot: a
+// follower takes a snapshot, and later a second one that trims its log past the first, and is
+// crashed and restarted with its latest Raft state but the first snapshot. Every other server
+// holds a snapshot too, and the cluster commits more while the follower is down. The restarted
+// follower must notice its log starts past its snapshot and count it in TornStateRecoveries,
+// and then catch up from the leader and commit with the rest of the cluster.
+func (cfg *config) checkTornSnapshot() {
+	cmd := 1
+	for ; cmd <= 3; cmd++ {
+		cfg.one(cmd, cfg.n, true)
+	}
+	leader := cfg.checkOneLeader()
+	torn := (leader + 1) % cfg.n
+	snapshotAll := func() {
+		for i := 0; i < cfg.n; i++ {
+			cfg.mu.Lock()
+			rf, index := cfg.rafts[i], cfg.applied[i]
+			cfg.mu.Unlock()
+			rf.CreateSnapshot([]byte{byte(index)}, index)
+		}
+	}
+	snapshotAll()
+	cfg.mu.Lock()
+	old := cfg.saved[torn].ReadSnapshot()
+	cfg.mu.Unlock()
+	for ; cmd <= 6; cmd++ {
+		cfg.one(cmd, cfg.n, true)
+	}
+	snapshotAll()
+
+	cfg.crash1(torn)
+	cfg.mu.Lock()
+	cfg.saved[torn].SaveStateAndSnapshot(cfg.saved[torn].ReadRaftState(), old)
+	cfg.mu.Unlock()
+	for ; cmd <= 9; cmd++ {
+		cfg.one(cmd, cfg.n-1, true)
+	}
+
+	cfg.start1(torn)
+	if n := cfg.rafts[torn].Metrics().TornStateRecoveries; n != 1 {
+		cfg.t.Fatalf("server %d restarted with its log trimmed past its snapshot and counted %d torn-state recoveries, want 1", torn, n)
+	}
+	cfg.connect(torn)
+	cfg.one(cmd, cfg.n, true)
+}
+
+// checkPersistCommitIndex commits ncmds commands, has a follower snapshot half of them, and
+// kills it. It then restarts the follower twice from copies of its Persister, cut off from every
+// peer, once with cfg.raftcfg.PersistCommitIndex, which the cluster ran with, and once without,
+// and collects what each instance delivers on applyCh within an election timeout. Both must
+// deliver the snapshot first and none of the entries it covers; with the option, the
+// follower must then deliver every entry after it up to the last command, in order, though no
+// leader can reach it, and without it, nothing more.
+func (cfg *config) checkPersistCommitIndex(ncmds int) {
+	var last int
+	for cmd := 1; cmd <= ncmds; cmd++ {
+		last = cfg.one(cmd, cfg.n, true)
+	}
+	leader := cfg.checkOneLeader()
+	i := (leader + 1) % cfg.n
+	cfg.mu.Lock()
+	rf := cfg.rafts[i]
+	cfg.mu.Unlock()
+	snapshotIndex := last - ncmds/2
+	rf.CreateSnapshot(nil, snapshotIndex)
+	cfg.disconnect(i)
+	rf.Kill()
+	persister := cfg.saved[i].Copy()
+
+	for _, persist := range []bool{true, false} {
+		applyCh := make(chan ApplyMsg, 2*ncmds)
+		raftcfg := cfg.raftcfg
+		raftcfg.PersistCommitIndex = persist
+		restarted, err := MakeWithConfig(make([]*rpc.ClientEnd, cfg.n), i, persister.Copy(), applyCh, raftcfg)
+		if err != nil {
+			cfg.t.Fatal(err)
+		}
+		time.Sleep(cfg.raftcfg.electionTimeoutMin())
+		restarted.Kill()
+		close(applyCh)
+
+		var delivered []string
+		for m := range applyCh {
+			if m.UseSnapshot {
+				delivered = append(delivered, fmt.Sprintf("snapshot %d", m.SnapshotIndex))
+			} else {
+				delivered = append(delivered, fmt.Sprintf("%d: %v", m.CommandIndex, m.Command))
+			}
+		}
+		want := []string{fmt.Sprintf("snapshot %d", snapshotIndex)}
+		if persist {
+			for index := snapshotIndex + 1; index <= last; index++ {
+				want = append(want, fmt.Sprintf("%d: %v", index, cfg.logs[i][index]))
+			}
+		}
+		if fmt.Sprint(delivered) != fmt.Sprint(want) {
+			cfg.t.Fatalf("restarted with PersistCommitIndex %v, server %d delivered %v; want %v", persist, i, delivered, want)
+		}
+	}
+}
+
+// persistsPerAppend has the cluster commit ncmds commands and then idle for a second of
+// heartbeats, and returns how many times the followers saved their persistent state per
+// AppendEntries the leader sent them.
+func (cfg *config) persistsPerAppend(ncmds int) float64 {
+	leader := cfg.checkOneLeader()
+	metrics := func() (persists int64, appends int64) {
+		cfg.mu.Lock()
+		defer cfg.mu.Unlock()
+		for i, rf := range cfg.rafts {
+			m := rf.Metrics()
+			if i == leader {
+				appends = m.Heartbeats + m.AppendEntries
+			} else {
+				persists += m.Persists
+			}
+		}
+		return persists, appends
+	}
+	persists0, appends0 := metrics()
+	for cmd := 1; cmd <= ncmds; cmd++ {
+		cfg.one(cmd, cfg.n, true)
+	}
+	time.Sleep(time.Second)
+	persists1, appends1 := metrics()
+	cfg.mu.Lock()
+	rf := cfg.rafts[leader]
+	cfg.mu.Unlock()
+	if _, isLeader, _ := rf.GetState(); !isLeader {
+		cfg.t.Fatalf("leader %d lost its leadership while persists were counted", leader)
+	}
+	return float64(persists1-persists0) / float64(appends1-appends0)
+}
+
+// benchAppendEntriesPersist starts a follower with raftcfg, unreachable by any peer and started
+// with Join so that it never stands for election, hands it a log of 1000 entries, and then
+// calls its AppendEntries handler b.N times with the heartbeats of a leader that has nothing
+// new to send. It reports how many times the follower encoded its persistent state per call.
+func benchAppendEntriesPersist(b *testing.B, raftcfg Config) {
+	raftcfg.Join = true
+	rf, err := MakeWithConfig(make([]*rpc.ClientEnd, 3), 1, MakePersister(), make(chan ApplyMsg, 1000), raftcfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rf.Kill()
+
+	entries := make([]LogEntry, 1000)
+	for i := range entries {
+		entries[i] = LogEntry{Index: i + 1, Term: 1, Command: i}
+	}
+	reply := AppendEntriesReply{}
+	rf.AppendEntries(&AppendEntriesArgs{Term: 1, LeaderId: 0, Entries: entries, LeaderCommit: len(entries)}, &reply)
+	if !reply.Success {
+		b.Fatalf("follower refused the log")
+	}
+	heartbeat := AppendEntriesArgs{Term: 1, LeaderId: 0, PrevLogIndex: len(entries), PrevLogTerm: 1, LeaderCommit: len(entries)}
+
+	persists := rf.Metrics().Persists
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rf.AppendEntries(&heartbeat, &AppendEntriesReply{})
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(rf.Metrics().Persists-persists)/float64(b.N), "encodes/op")
+}
+
+// checkCoalescePersist compares the persists per AppendEntries of cfg, which is expected to
+// have cfg.raftcfg.CoalescePersist set, against a cluster that persists on every handler call.
+// Mostly heartbeats, which change nothing, the coalescing followers must persist less than half
+// as often. Then every server is crashed and recovered with crashAndRecover, which checks that
+// the state it saved is the state it had, and the cluster must go on committing.
+func (cfg *config) checkCoalescePersist() {
+	raftcfg := cfg.raftcfg
+	raftcfg.CoalescePersist = false
+	eager := make_config_with(cfg.t, cfg.n, false, raftcfg)
+	defer eager.cleanup()
+	before := eager.persistsPerAppend(10)
+	after := cfg.persistsPerAppend(10)
+	if after >= before/2 {
+		cfg.t.Fatalf("coalesced handlers persisted %.2f times per AppendEntries, against %.2f", after, before)
+	}
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.crashAndRecover(i)
+		cfg.one(100+i, cfg.n, true)
+	}
+}
+
+// standsDespiteStaleLeader cuts off a follower of an up-to-date cluster and, for up to d, feeds
+// it heartbeats at its own term from a leader whose log is empty. It reports whether the follower
+// stood for election meanwhile, then reconnects it.
+func (cfg *config) standsDespiteStaleLeader(cmd int, d time.Duration) bool {
+	cfg.one(cmd, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % cfg.n
+	cfg.disconnect(follower)
+	defer cfg.connect(follower)
+	cfg.mu.Lock()
+	rf := cfg.rafts[follower]
+	cfg.mu.Unlock()
+	term, _, _ := rf.GetState()
+	for start := time.Now(); time.Since(start) < d; time.Sleep(cfg.raftcfg.heartbeatInterval()) {
+		if current, _, _ := rf.GetState(); current > term {
+			return true
+		}
+		rf.AppendEntries(&AppendEntriesArgs{Term: term, LeaderId: leader}, &AppendEntriesReply{})
+	}
+	return false
+}
+
+// checkStaleLeaderHeartbeats checks that under cfg.raftcfg.HeartbeatPolicy HeartbeatUpToDate, a
+// stale leader's heartbeats no longer keep an up-to-date follower from standing for election
+// within the longest election timeout, while under HeartbeatAny they keep it waiting for good.
+// Once the follower is back, the leader's own heartbeats must still keep every follower from
+// standing for election.
+func (cfg *config) checkStaleLeaderHeartbeats() {
+	raftcfg := cfg.raftcfg
+	raftcfg.HeartbeatPolicy = HeartbeatAny
+	lenient := make_config_with(cfg.t, cfg.n, false, raftcfg)
+	defer lenient.cleanup()
+	if lenient.standsDespiteStaleLeader(1, 2*time.Second) {
+		cfg.t.Fatalf("a follower stood for election through a stale leader's heartbeats under HeartbeatAny")
+	}
+	if !cfg.standsDespiteStaleLeader(1, cfg.raftcfg.electionTimeoutMin()+400*time.Millisecond) {
+		cfg.t.Fatalf("a stale leader's heartbeats kept an up-to-date follower from standing for election")
+	}
+
+	cfg.one(2, cfg.n, true)
+	time.Sleep(cfg.raftcfg.electionTimeoutMin())
+	term := cfg.checkTerms()
+	time.Sleep(time.Second)
+	if current := cfg.checkTerms(); current != term {
+		cfg.t.Fatalf("term moved from %d to %d under a live leader", term, current)
+	}
+	cfg.one(3, cfg.n, true)
+}
+
+// unexportedCommand is a command gob cannot persist: its only field is unexported and the type
+// is never registered.
+type unexportedCommand struct {
+	value int
+}
+
+// checkStragglerCommit checks that the leader commits as soon as a quorum has acknowledged an
+// entry, without waiting for a straggler. One follower is stalled by holding its lock, so that
+// its replies are pending rather than lost; the leader must still commit a new entry, and the
+// other followers apply it, well before the straggler answers. Expects at least three servers.
+func (cfg *config) checkStragglerCommit() {
+	const stall = 2 * time.Second
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	straggler := (leader + 1) % cfg.n
+	cfg.mu.Lock()
+	rl, rs := cfg.rafts[leader], cfg.rafts[straggler]
+	cfg.mu.Unlock()
+
+	rs.mu.Lock()
+	start := time.Now()
+	index, _, ok := rl.Start(2)
+	if !ok {
+		rs.mu.Unlock()
+		cfg.t.Fatalf("leader %d refused a command", leader)
+	}
+	for {
+		rl.mu.Lock()
+		committed := rl.commitIndex >= index
+		rl.mu.Unlock()
+		if committed {
+			break
+		}
+		if time.Since(start) > stall/2 {
+			rs.mu.Unlock()
+			cfg.t.Fatalf("leader %d did not commit index %d within %v while server %d stalled", leader, index, stall/2, straggler)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	for time.Since(start) < stall/2 {
+		if n, _ := cfg.nCommitted(index); n >= cfg.n-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n, _ := cfg.nCommitted(index)
+	time.Sleep(stall - time.Since(start))
+	rs.mu.Unlock()
+	if n < cfg.n-1 {
+		cfg.t.Fatalf("only %d servers applied index %d while server %d stalled", n, index, straggler)
+	}
+	if elapsed >= stall/2 {
+		cfg.t.Fatalf("commit took %v, as long as the straggler's stall", elapsed)
+	}
+
+	cfg.one(3, cfg.n, true)
+}
+
+// checkPauseResume pauses a follower, commits entries without it, and resumes it, once so that
+// it catches up through AppendEntries and once, after every server has snapshotted, through
+// InstallSnapshot. GetState must report the pause, and a paused leader must step down and be
+// replaced.
+func (cfg *config) checkPauseResume() {
+	cmd := 1
+	cfg.one(cmd, cfg.n, true)
+	for _, snapshot := range []bool{false, true} {
+		leader := cfg.checkOneLeader()
+		paused := (leader + 1) % cfg.n
+		cfg.rafts[paused].Pause()
+		if _, isLeader, isPaused := cfg.rafts[paused].GetState(); isLeader || !isPaused {
+			cfg.t.Fatalf("server %d reports leader %v, paused %v after Pause", paused, isLeader, isPaused)
+		}
+		for k := 0; k < 5; k++ {
+			cmd++
+			cfg.one(cmd, cfg.n-1, true)
+		}
+		if snapshot {
+			cfg.snapshot()
+		}
+		cfg.rafts[paused].Resume()
+		if _, _, isPaused := cfg.rafts[paused].GetState(); isPaused {
+			cfg.t.Fatalf("server %d still reports itself paused after Resume", paused)
+		}
+		cmd++
+		cfg.one(cmd, cfg.n, true)
+	}
+
+	leader := cfg.checkOneLeader()
+	cfg.rafts[leader].Pause()
+	if _, isLeader, isPaused := cfg.rafts[leader].GetState(); isLeader || !isPaused {
+		cfg.t.Fatalf("paused leader %d reports leader %v, paused %v", leader, isLeader, isPaused)
+	}
+	if l := cfg.checkOneLeader(); l == leader {
+		cfg.t.Fatalf("no server replaced paused leader %d", leader)
+	}
+	cmd++
+	cfg.one(cmd, cfg.n-1, true)
+	cfg.rafts[leader].Resume()
+	cmd++
+	cfg.one(cmd, cfg.n, true)
+}
+
+// checkSnapshotPacing pauses a follower, has every other server take a snapshot of size
+// bytes, and resumes it, so the leader must send it the snapshot under
+// cfg.raftcfg.SnapshotRateLimit. The transfer must take about as long as the rate allows, in
+// chunks of no more than a heartbeat interval's worth, while the leader keeps committing with
+// the other followers at the usual pace and no election takes place.
+func (cfg *config) checkSnapshotPacing(size int) {
+	rate := cfg.raftcfg.SnapshotRateLimit
+	cmd := 1
+	cfg.one(cmd, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	lagging := (leader + 1) % cfg.n
+	// paused rather than cut off, so that it does not come back with a higher term.
+	cfg.rafts[lagging].Pause()
+	for k := 0; k < 5; k++ {
+		cmd++
+		cfg.one(cmd, cfg.n-1, true)
+	}
+	for i := 0; i < cfg.n; i++ {
+		if i != lagging {
+			cfg.mu.Lock()
+			rf, index := cfg.rafts[i], cfg.applied[i]
+			cfg.mu.Unlock()
+			rf.CreateSnapshot(make([]byte, size), index)
+		}
+	}
+
+	term, _, _ := cfg.rafts[leader].GetState()
+	before := cfg.rafts[leader].Metrics()
+	start := time.Now()
+	cfg.rafts[lagging].Resume()
+	for k := 0; k < 3; k++ {
+		cmd++
+		t0 := time.Now()
+		cfg.one(cmd, cfg.n-1, false)
+		if took := time.Since(t0); took > cfg.raftcfg.electionTimeoutMin() {
+			cfg.t.Fatalf("committing with the other followers took %v during the snapshot transfer", took)
+		}
+	}
+	cmd++
+	cfg.one(cmd, cfg.n, true)
+	elapsed := time.Since(start)
+
+	after := cfg.rafts[leader].Metrics()
+	chunks, bytes := after.SnapshotChunks-before.SnapshotChunks, after.SnapshotBytes-before.SnapshotBytes
+	if least := time.Duration(size) * time.Second / time.Duration(rate) * 3 / 4; elapsed < least {
+		cfg.t.Fatalf("a %d-byte snapshot reached the follower in %v at %d bytes/s; want at least %v", size, elapsed, rate, least)
+	}
+	if most := int64(cfg.raftcfg.snapshotChunkSize()); chunks < 2 || bytes > chunks*most {
+		cfg.t.Fatalf("the snapshot went out in %d chunks of %d bytes; want several of at most %d", chunks, bytes, most)
+	}
+	if t, isLeader, _ := cfg.rafts[leader].GetState(); t != term || !isLeader {
+		cfg.t.Fatalf("leader %d moved from term %d to %d (leader %v) during the snapshot transfer", leader, term, t, isLeader)
+	}
+}
+
+// checkHeartbeatMetrics leaves the cluster idle for d once everything is committed and
+// acknowledged, so the leader sends nothing but heartbeats. Its Heartbeats counter must rise by
+// at least half a round per heartbeat interval for each follower, while BytesReplicated and
+// EntriesReplicated stay where they were. A command committed afterwards must raise both.
+func (cfg *config) checkHeartbeatMetrics(d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	rl := cfg.rafts[leader]
+	// let the acknowledgements of the entry catch up before counting
+	time.Sleep(2 * cfg.raftcfg.heartbeatInterval())
+
+	before := rl.Metrics()
+	time.Sleep(d)
+	idle := rl.Metrics()
+	if least := int64(cfg.n-1) * int64(d/cfg.raftcfg.heartbeatInterval()) / 2; idle.Heartbeats-before.Heartbeats < least {
+		cfg.t.Fatalf("leader sent %d heartbeats in %v idle, want at least %d", idle.Heartbeats-before.Heartbeats, d, least)
+	}
+	if idle.BytesReplicated != before.BytesReplicated || idle.EntriesReplicated != before.EntriesReplicated {
+		cfg.t.Fatalf("heartbeats raised bytes replicated from %d to %d and entries replicated from %d to %d",
+			before.BytesReplicated, idle.BytesReplicated, before.EntriesReplicated, idle.EntriesReplicated)
+	}
+
+	cfg.one(2, cfg.n, true)
+	time.Sleep(2 * cfg.raftcfg.heartbeatInterval())
+	if after := rl.Metrics(); after.BytesReplicated <= idle.BytesReplicated || after.EntriesReplicated <= idle.EntriesReplicated {
+		cfg.t.Fatalf("replicating a command left bytes replicated at %d and entries replicated at %d",
+			after.BytesReplicated, after.EntriesReplicated)
+	}
+}
+
+// checkWriteMetrics commits a few commands and has the leader and a follower write their
+// metrics. Every sample must come with HELP and TYPE lines and carry the peer's index, and its
+// value must match the peer's state: its term, whether it leads, its commit index, and each
+// counter no lower than Metrics reported just before and no higher than just after. Only the
+// leader may report its followers' match indexes, none past its own log.
+func (cfg *config) checkWriteMetrics() {
+	for cmd := 1; cmd <= 3; cmd++ {
+		cfg.one(cmd, cfg.n, true)
+	}
+	leader := cfg.checkOneLeader()
+	for _, i := range []int{leader, (leader + 1) % cfg.n} {
+		rf := cfg.rafts[i]
+		term, isLeader, _ := rf.GetState()
+		before := rf.Metrics()
+		var buf bytes.Buffer
+		if err := rf.WriteMetrics(&buf); err != nil {
+			cfg.t.Fatalf("WriteMetrics on server %d: %v", i, err)
+		}
+		after := rf.Metrics()
+		if t, _, _ := rf.GetState(); t != term {
+			cfg.t.Fatalf("server %d moved from term %d to %d while writing its metrics", i, term, t)
+		}
+
+		samples := make(map[string]int64) // name and labels -> value
+		described := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+				described[strings.Fields(line)[2]+" "+line[2:6]] = true
+				continue
+			}
+			fields := strings.Fields(line)
+			value, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if len(fields) != 2 || err != nil {
+				cfg.t.Fatalf("server %d wrote malformed sample %q", i, line)
+			}
+			name := fields[0][:strings.Index(fields[0], "{")]
+			if !described[name+" HELP"] || !described[name+" TYPE"] {
+				cfg.t.Fatalf("server %d wrote sample %q without HELP and TYPE lines", i, line)
+			}
+			samples[fields[0]] = value
+		}
+		peer := fmt.Sprintf(`{peer="%d"}`, i)
+		sample := func(name string) int64 {
+			value, ok := samples[name+peer]
+			if !ok {
+				cfg.t.Fatalf("server %d wrote no %s%s sample", i, name, peer)
+			}
+			return value
+		}
+
+		leading := int64(0)
+		if isLeader {
+			leading = 1
+		}
+		if got := sample("sentinel_raft_term"); got != int64(term) {
+			cfg.t.Fatalf("server %d reported term %d, want %d", i, got, term)
+		}
+		if got := sample("sentinel_raft_is_leader"); got != leading {
+			cfg.t.Fatalf("server %d reported is_leader %d, want %d", i, got, leading)
+		}
+		if commit := sample("sentinel_raft_commit_index"); commit < 3 || sample("sentinel_raft_last_applied") > commit {
+			cfg.t.Fatalf("server %d reported commit index %d and last applied %d after committing 3 commands",
+				i, commit, sample("sentinel_raft_last_applied"))
+		}
+		for name, count := range map[string]func(Metrics) int64{
+			"sentinel_raft_elections_total":          func(m Metrics) int64 { return m.Elections },
+			"sentinel_raft_heartbeats_total":         func(m Metrics) int64 { return m.Heartbeats },
+			"sentinel_raft_append_entries_total":     func(m Metrics) int64 { return m.AppendEntries },
+			"sentinel_raft_entries_replicated_total": func(m Metrics) int64 { return m.EntriesReplicated },
+			"sentinel_raft_bytes_replicated_total":   func(m Metrics) int64 { return m.BytesReplicated },
+			"sentinel_raft_persists_total":           func(m Metrics) int64 { return m.Persists },
+			"sentinel_raft_votes_granted_total":      func(m Metrics) int64 { return m.VotesGranted },
+		} {
+			if got := sample(name); got < count(before) || got > count(after) {
+				cfg.t.Fatalf("server %d reported %s %d, want %d to %d", i, name, got, count(before), count(after))
+			}
+		}
+
+		cfg.mu.Lock()
+		last := int64(cfg.maxIndex)
+		cfg.mu.Unlock()
+		matches := 0
+		for key, value := range samples {
+			if strings.HasPrefix(key, "sentinel_raft_match_index{") {
+				matches++
+				if value < 3 || value > last {
+					cfg.t.Fatalf("leader %d reported %s %d, want 3 to %d", i, key, value, last)
+				}
+			}
+		}
+		if want := map[bool]int{true: cfg.n - 1, false: 0}[isLeader]; matches != want {
+			cfg.t.Fatalf("server %d (leader %v) reported %d match indexes, want %d", i, isLeader, matches, want)
+		}
+	}
+}
+
+// checkDelayedAppendEntries checks that an AppendEntries arriving late, carrying a prefix of
+// entries the follower already holds, and an empty heartbeat for an earlier index leave the
+// follower's log untouched. Neither may truncate entries that are already in sync. It then cuts
+// a follower off after a change of leader, leaves an entry from the old term at the end of its
+// log, and sends it a heartbeat that matches the entry before and whose LeaderCommit covers it.
+// The follower must keep the entry but not commit it, and replace it once the new leader's own
+// entry reaches it.
+func (cfg *config) checkDelayedAppendEntries() {
+	for cmd := 1; cmd <= 5; cmd++ {
+		cfg.one(cmd, cfg.n, true)
+	}
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % cfg.n
+	term, _, _ := cfg.rafts[leader].GetState()
+
+	rf := cfg.rafts[follower]
+	rf.mu.Lock()
+	base := rf.log[0].Index
+	last := rf.getLastLogIndex()
+	delayed := AppendEntriesArgs{
+		Term:         term,
+		LeaderId:     leader,
+		PrevLogIndex: 2,
+		PrevLogTerm:  rf.log[2-base].Term,
+		Entries:      append([]LogEntry{}, rf.log[3-base]),
+	}
+	heartbeat := AppendEntriesArgs{
+		Term:         term,
+		LeaderId:     leader,
+		PrevLogIndex: 1,
+		PrevLogTerm:  rf.log[1-base].Term,
+	}
+	rf.mu.Unlock()
+
+	for _, args := range []AppendEntriesArgs{delayed, heartbeat} {
+		reply := AppendEntriesReply{}
+		rf.AppendEntries(&args, &reply)
+		if !reply.Success {
+			cfg.t.Fatalf("follower rejected an AppendEntries consistent with its log")
+		}
+		rf.mu.Lock()
+		got := rf.getLastLogIndex()
+		rf.mu.Unlock()
+		if got != last {
+			cfg.t.Fatalf("AppendEntries after index %d cut the follower's log from %d to %d entries", args.PrevLogIndex, last, got)
+		}
+	}
+
+	// entries left over from the old leader's term may outlive it on a follower.
+	cfg.disconnect(leader)
+	cfg.one(6, cfg.n-1, true)
+	cfg.connect(leader)
+	newLeader := cfg.checkOneLeader()
+	newTerm, _, _ := cfg.rafts[newLeader].GetState()
+	follower = (newLeader + 1) % cfg.n
+	rf = cfg.rafts[follower]
+	cfg.one(7, cfg.n, true)
+	cfg.disconnect(follower)
+	rf.mu.Lock()
+	prev := rf.getLastLogIndex()
+	prevTerm := rf.log[prev-rf.log[0].Index].Term
+	rf.log = append(rf.log, LogEntry{Index: prev + 1, Term: term, Command: "stale"})
+	rf.mu.Unlock()
+	index := cfg.one(8, cfg.n-1, true)
+
+	heartbeat = AppendEntriesArgs{
+		Term:         newTerm,
+		LeaderId:     newLeader,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		LeaderCommit: index,
+	}
+	reply := AppendEntriesReply{}
+	rf.AppendEntries(&heartbeat, &reply)
+	rf.mu.Lock()
+	commitIndex, got := rf.commitIndex, rf.getLastLogIndex()
+	rf.mu.Unlock()
+	if !reply.Success || got != prev+1 {
+		cfg.t.Fatalf("follower dropped its stale entry at %d on a heartbeat (success %v, last index %d)", prev+1, reply.Success, got)
+	}
+	if commitIndex > prev {
+		cfg.t.Fatalf("follower committed its stale entry at %d on a heartbeat that did not carry it", prev+1)
+	}
+
+	cfg.connect(follower)
+	cfg.one(9, cfg.n, true)
+}
+
+// checkPreVote cuts off a follower for several election timeouts, and checks that under
+// cfg.raftcfg.PreVote its term stays where it was, so that when it rejoins, the leader keeps
+// both its leadership and its term. It then disconnects the leader and checks that the others
+// still get past their pre-votes and elect a new one.
+func (cfg *config) checkPreVote() {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	term, _, _ := cfg.rafts[leader].GetState()
+	cut := (leader + 1) % cfg.n
+	cfg.disconnect(cut)
+	time.Sleep(5 * cfg.raftcfg.electionTimeoutMax())
+	if t, _, _ := cfg.rafts[cut].GetState(); t != term {
+		cfg.t.Fatalf("server %d, cut off, moved from term %d to %d", cut, term, t)
+	}
+	cfg.connect(cut)
+	cfg.one(2, cfg.n, true)
+	if l := cfg.checkOneLeader(); l != leader {
+		cfg.t.Fatalf("leadership moved from %d to %d when server %d rejoined", leader, l, cut)
+	}
+	if t, _, _ := cfg.rafts[leader].GetState(); t != term {
+		cfg.t.Fatalf("leader %d moved from term %d to %d when server %d rejoined", leader, term, t, cut)
+	}
+
+	cfg.disconnect(leader)
+	if l := cfg.checkOneLeader(); l == leader {
+		cfg.t.Fatalf("no server replaced disconnected leader %d", leader)
+	}
+	cfg.one(3, cfg.n-1, true)
+	cfg.connect(leader)
+	cfg.one(4, cfg.n, true)
+}
+
+// checkTransferLeadership hands leadership over while commands are being started on the
+// leader, and checks that the target takes over in a later term and that every command the
+// old leader accepted commits rather than being dropped. The window between the old leader's
+// last accepted command, or the start of the transfer, and the target's first must be shorter than the minimum election
+// timeout, the least a leader failure would cost. It then cuts a target off, so the
+// transfer times out: meanwhile the leader must refuse commands, and afterwards accept them.
+func (cfg *config) checkTransferLeadership() {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	if err := cfg.rafts[(leader+1)%cfg.n].TransferLeadership(leader); err != ErrNotLeader {
+		cfg.t.Fatalf("transfer from a follower returned %v, expected ErrNotLeader", err)
+	}
+	if err := cfg.rafts[leader].TransferLeadership(leader); err != ErrBadTarget {
+		cfg.t.Fatalf("transfer to the leader itself returned %v, expected ErrBadTarget", err)
+	}
+
+	term, _, _ := cfg.rafts[leader].GetState()
+	target := (leader + 1) % cfg.n
+	stop := make(chan struct{})
+	accepted := make(chan map[int]int)
+	lastAccepted := time.Now()
+	go func() {
+		started := make(map[int]int) // index -> command
+		for cmd := 100; ; cmd++ {
+			select {
+			case <-stop:
+				accepted <- started
+				return
+			default:
+			}
+			if index, _, ok := cfg.rafts[leader].Start(cmd); ok {
+				started[index] = cmd
+				lastAccepted = time.Now()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	err := cfg.rafts[leader].TransferLeadership(target)
+	close(stop)
+	started := <-accepted
+	if err != nil {
+		cfg.t.Fatalf("transfer from %d to %d failed: %v", leader, target, err)
+	}
+	for cmd := 1000; ; cmd++ {
+		if index, _, ok := cfg.rafts[target].Start(cmd); ok {
+			started[index] = cmd
+			break
+		}
+		if time.Since(lastAccepted) > 2*cfg.raftcfg.electionTimeoutMax() {
+			cfg.t.Fatalf("target %d did not accept a command after the transfer", target)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if window, bound := time.Since(lastAccepted), cfg.raftcfg.electionTimeoutMin(); window > bound {
+		cfg.t.Fatalf("no leader accepted commands for %v during the transfer, more than the %v an election would take", window, bound)
+	}
+	if l := cfg.checkOneLeader(); l != target {
+		cfg.t.Fatalf("leadership went to %d, not to target %d", l, target)
+	}
+	if t, _, _ := cfg.rafts[target].GetState(); t <= term {
+		cfg.t.Fatalf("new leader %d is in term %d, not past %d", target, t, term)
+	}
+	cfg.one(2, cfg.n, true)
+	for index, cmd := range started {
+		if n, v := cfg.nCommitted(index); n < cfg.n || v != cmd {
+			cfg.t.Fatalf("command %v accepted at index %d during the transfer was dropped", cmd, index)
+		}
+	}
+
+	leader = target
+	target = (leader + 1) % cfg.n
+	cfg.disconnect(target)
+	cfg.one(3, cfg.n-1, true)
+	done := make(chan error)
+	go func() { done <- cfg.rafts[leader].TransferLeadership(target) }()
+	time.Sleep(transferTimeout / 2)
+	if _, _, ok := cfg.rafts[leader].Start(4); ok {
+		cfg.t.Fatalf("leader %d accepted a command during a transfer", leader)
+	}
+	if _, _, _, err := cfg.rafts[leader].TryStart(4); err != ErrTransferring {
+		cfg.t.Fatalf("TryStart during a transfer returned %v, expected ErrTransferring", err)
+	}
+	if err := cfg.rafts[leader].TransferLeadership(target); err != ErrTransferring {
+		cfg.t.Fatalf("a second transfer returned %v, expected ErrTransferring", err)
+	}
+	if err := <-done; err != ErrTransferTimeout {
+		cfg.t.Fatalf("transfer to disconnected %d returned %v, expected ErrTransferTimeout", target, err)
+	}
+	if l := cfg.checkOneLeader(); l != leader {
+		cfg.t.Fatalf("leadership moved from %d to %d after a failed transfer", leader, l)
+	}
+	cfg.one(5, cfg.n-1, false)
+	cfg.connect(target)
+	cfg.one(6, cfg.n, true)
+}
+
+// checkTimingConfig runs on a cluster made with make_config_with and long timeouts in raftcfg,
+// HeartbeatInterval well below a second and ElectionTimeoutMin of a second or more. It checks
+// that timeouts a follower could mistake for a healthy leader's silence are refused, that the
+// followers of a connected leader never time out, and that once the leader is cut off no
+// follower stands for election before ElectionTimeoutMin has passed since its last heartbeat.
+// Reads through ReadIndex must be confirmed though followers take longer to answer than the
+// default election timeout.
+func (cfg *config) checkTimingConfig() {
+	bad := []Config{
+		{HeartbeatInterval: 100 * time.Millisecond, ElectionTimeoutMin: 250 * time.Millisecond},
+		{ElectionTimeoutMin: 500 * time.Millisecond, ElectionTimeoutMax: 400 * time.Millisecond},
+		{HeartbeatInterval: -time.Millisecond},
+	}
+	for _, raftcfg := range bad {
+		if _, err := MakeWithConfig(make([]*rpc.ClientEnd, cfg.n), 0, MakePersister(), make(chan ApplyMsg), raftcfg); err == nil {
+			cfg.t.Fatalf("MakeWithConfig accepted %+v", raftcfg)
+		}
+	}
+
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	term, _, _ := cfg.rafts[leader].GetState()
+	time.Sleep(3 * cfg.raftcfg.electionTimeoutMax())
+	if t, _, _ := cfg.rafts[leader].GetState(); t != term {
+		cfg.t.Fatalf("term moved from %d to %d under a connected leader", term, t)
+	}
+
+	cfg.net.Jitter(cfg.raftcfg.electionTimeoutMin() * 3 / 5)
+	for i := 0; i < 5; i++ {
+		if _, err := cfg.rafts[leader].ReadIndex(); err != nil {
+			cfg.t.Fatalf("ReadIndex on leader %d with followers slow to answer: %v", leader, err)
+		}
+	}
+	cfg.net.Jitter(0)
+
+	cfg.disconnect(leader)
+	cut := time.Now()
+	for {
+		var elected bool
+		for i := 0; i < cfg.n; i++ {
+			if t, isLeader, _ := cfg.rafts[i].GetState(); i != leader && (isLeader || t > term) {
+				elected = true
+			}
+		}
+		if elected {
+			break
+		}
+		if time.Since(cut) > 3*cfg.raftcfg.electionTimeoutMax() {
+			cfg.t.Fatalf("no follower stood for election within %v of the leader being cut off", time.Since(cut))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d, least := time.Since(cut), cfg.raftcfg.electionTimeoutMin()-cfg.raftcfg.heartbeatInterval(); d < least {
+		cfg.t.Fatalf("a follower stood for election %v after the leader was cut off, before %v", d, least)
+	}
+	cfg.one(2, cfg.n-1, true)
+	cfg.connect(leader)
+	cfg.one(3, cfg.n, true)
+}
+
+// checkFlexibleQuorums runs on a cluster of five with an ElectionQuorum of 4 and a CommitQuorum
+// of 2, under a leaderWatch. Cut off with one follower, the leader must still commit, while
+// the three servers on the other side, short of an election quorum, must elect no one. Cut
+// off alone, the leader must commit nothing, and the four others must elect a leader that
+// keeps the entry the old leader committed without them. Once the network heals, every server
+// must agree on the log, which the harness checks as entries are applied.
+func (cfg *config) checkFlexibleQuorums() {
+	w := cfg.watchLeaders(5 * time.Millisecond)
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % cfg.n
+	var rest []int
+	for i := 0; i < cfg.n; i++ {
+		if i != leader && i != follower {
+			rest = append(rest, i)
+		}
+	}
+
+	cfg.partition([]int{leader, follower}, rest)
+	index, _, ok := cfg.rafts[leader].Start(2)
+	if !ok {
+		cfg.t.Fatalf("leader %d refused a command", leader)
+	}
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		if n, _ := cfg.nCommitted(index); n >= 2 {
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			cfg.t.Fatalf("leader %d and follower %d did not commit index %d, a commit quorum", leader, follower, index)
+		}
+	}
+	time.Sleep(2 * cfg.raftcfg.electionTimeoutMax())
+	for _, i := range rest {
+		if _, isLeader, _ := cfg.rafts[i].GetState(); isLeader {
+			cfg.t.Fatalf("server %d was elected by three of five servers, short of the election quorum", i)
+		}
+	}
+
+	cfg.partition([]int{leader}, append([]int{follower}, rest...))
+	lone, _, _ := cfg.rafts[leader].Start(3)
+	others := cfg.one(4, cfg.n-1, true)
+	if others <= index {
+		cfg.t.Fatalf("the new leader committed at %d, over index %d the old leader committed", others, index)
+	}
+	if n, cmd := cfg.nCommitted(lone); n > 0 && cmd == 3 {
+		cfg.t.Fatalf("leader %d committed index %d alone", leader, lone)
+	}
+	if n, cmd := cfg.nCommitted(index); n < 2 || cmd != 2 {
+		cfg.t.Fatalf("index %d holds %v on %d servers after the leader changed, want 2", index, cmd, n)
+	}
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.connect(i)
+	}
+	cfg.one(5, cfg.n, true)
+	w.stop()
+}
+
+// checkMembershipChange runs on a cluster of five made with make_config_members, of which
+// servers 0-2 are the founders. It adds server 3, checks that every voter learns of it and that
+// commits then need three of the four, and removes a follower, which must not disrupt the
+// leader, and then the leader itself, which must step down for a new leader. The voters must
+// survive a restart, and a change must be refused while another is under way; adding server 4
+// while it is disconnected runs until the join times out.
+func (cfg *config) checkMembershipChange() {
+	cfg.one(1, 3, true)
+	leader := cfg.checkOneLeader()
+	if err := cfg.rafts[(leader+1)%3].RemoveServer(leader); err != ErrNotLeader {
+		cfg.t.Fatalf("removal on a follower returned %v, expected ErrNotLeader", err)
+	}
+	if err := cfg.rafts[leader].RemoveServer(3); err != ErrNotVoter {
+		cfg.t.Fatalf("removal of server 3 before it joined returned %v, expected ErrNotVoter", err)
+	}
+
+	if err := cfg.rafts[leader].AddServer(cfg.rafts[leader].cfg.PeerEnd(3)); err != nil {
+		cfg.t.Fatalf("adding server 3 failed: %v", err)
+	}
+	cfg.one(2, 4, true)
+	cfg.waitVoters([]int{0, 1, 2, 3}, 0, 1, 2, 3)
+
+	// with four voters, the leader and one founder are no longer a commit quorum
+	follower := (leader + 1) % 3
+	cfg.disconnect(3)
+	cfg.disconnect(follower)
+	index, _, ok := cfg.rafts[leader].Start(3)
+	if !ok {
+		cfg.t.Fatalf("leader %d refused a command", leader)
+	}
+	time.Sleep(cfg.raftcfg.electionTimeoutMin())
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		cfg.t.Fatalf("command committed by %d servers without server 3, expected none", n)
+	}
+	cfg.connect(3)
+	cfg.connect(follower)
+	// the follower may have won an election while cut off
+	leader = cfg.settledLeader(4, 4)
+	follower = (leader + 1) % 4
+	term, _, _ := cfg.rafts[leader].GetState()
+	if err := cfg.rafts[leader].RemoveServer(follower); err != nil {
+		cfg.t.Fatalf("removing follower %d failed: %v", follower, err)
+	}
+	var voters []int
+	for i := 0; i < 4; i++ {
+		if i != follower {
+			voters = append(voters, i)
+		}
+	}
+	cfg.waitVoters(voters, voters...)
+	cfg.one(5, 3, true)
+	time.Sleep(time.Second)
+	if l := cfg.checkOneLeader(); l != leader {
+		cfg.t.Fatalf("leadership moved from %d to %d after removing follower %d", leader, l, follower)
+	}
+	if t, _, _ := cfg.rafts[leader].GetState(); t != term {
+		cfg.t.Fatalf("leader %d moved from term %d to %d after removing follower %d", leader, term, t, follower)
+	}
+	cfg.disconnect(follower)
+
+	if err := cfg.rafts[leader].RemoveServer(leader); err != nil {
+		cfg.t.Fatalf("removing leader %d failed: %v", leader, err)
+	}
+	if _, isLeader, _ := cfg.rafts[leader].GetState(); isLeader {
+		cfg.t.Fatalf("leader %d still leads after removing itself", leader)
+	}
+	var rest []int
+	for _, v := range voters {
+		if v != leader {
+			rest = append(rest, v)
+		}
+	}
+	cfg.one(6, 2, true)
+	if l := cfg.checkOneLeader(); l == leader {
+		cfg.t.Fatalf("removed leader %d leads again", leader)
+	}
+	cfg.waitVoters(rest, rest...)
+	cfg.disconnect(leader)
+
+	for _, i := range rest {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	cfg.waitVoters(rest, rest...)
+	cfg.one(7, 2, true)
+
+	leader = cfg.checkOneLeader()
+	cfg.disconnect(4)
+	done := make(chan error)
+	go func() { done <- cfg.rafts[leader].AddServer(cfg.rafts[leader].cfg.PeerEnd(4)) }()
+	time.Sleep(cfg.raftcfg.electionTimeoutMin())
+	if err := cfg.rafts[leader].RemoveServer(rest[0]); err != ErrReconfiguring {
+		cfg.t.Fatalf("removal during a join returned %v, expected ErrReconfiguring", err)
+	}
+	if err := <-done; err != ErrJoinTimeout {
+		cfg.t.Fatalf("adding disconnected server 4 returned %v, expected ErrJoinTimeout", err)
+	}
+	cfg.one(8, 2, true)
+	cfg.waitVoters(rest, rest...)
+}
+
+// checkAddServerRetry runs on a cluster of four made with make_config_members, of which servers
+// 0-2 are the founders. It adds server 3 while it is disconnected, which must time out, and
+// then again once it is connected: the retry must take index 3 again, the one the failed join
+// left outside the configuration, so that server 3 becomes a voter under its own index.
+func (cfg *config) checkAddServerRetry() {
+	cfg.one(1, 3, true)
+	leader := cfg.checkOneLeader()
+	cfg.mu.Lock()
+	rl := cfg.rafts[leader]
+	cfg.mu.Unlock()
+
+	cfg.disconnect(3)
+	if err := rl.AddServer(rl.cfg.PeerEnd(3)); err != ErrJoinTimeout {
+		cfg.t.Fatalf("adding disconnected server 3 returned %v, expected ErrJoinTimeout", err)
+	}
+	cfg.connect(3)
+	if err := rl.AddServer(rl.cfg.PeerEnd(3)); err != nil {
+		cfg.t.Fatalf("adding server 3 again failed: %v", err)
+	}
+	rl.mu.Lock()
+	npeers := len(rl.peers)
+	rl.mu.Unlock()
+	if npeers != 4 {
+		cfg.t.Fatalf("leader %d knows %d peers after two attempts to add server 3, expected 4", leader, npeers)
+	}
+	cfg.one(2, 4, true)
+	cfg.waitVoters([]int{0, 1, 2, 3}, 0, 1, 2, 3)
+}
+
+// checkLearners runs on a cluster of five made with make_config_members, of which servers 0-2
+// are the founders. It adds server 3 as a learner and cuts it off, along with a follower, so it
+// lags ever further behind: the other voters must keep committing at their usual pace, and the
+// learner must not stand for election. With two voters cut off instead, the leader and the
+// learner must not commit. Once reconnected the learner must catch up and be promoted to a
+// voter; server 4 is then added as a learner and removed again.
+func (cfg *config) checkLearners() {
+	cfg.one(1, 3, true)
+	leader := cfg.checkOneLeader()
+	if err := cfg.rafts[leader].PromoteLearner(3); err != ErrNotLearner {
+		cfg.t.Fatalf("promoting server 3 before it was added returned %v, expected ErrNotLearner", err)
+	}
+	if err := cfg.rafts[leader].AddLearner(cfg.rafts[leader].cfg.PeerEnd(3)); err != nil {
+		cfg.t.Fatalf("adding learner 3 failed: %v", err)
+	}
+	cfg.waitVoters([]int{0, 1, 2}, 0, 1, 2, 3)
+	cfg.waitLearners([]int{3}, 0, 1, 2, 3)
+	cfg.one(2, 4, true)
+
+	start := time.Now()
+	for cmd := 10; cmd < 30; cmd++ {
+		cfg.one(cmd, 4, false)
+	}
+	base := time.Since(start)
+	// the leader and one founder are a commit quorum of the three voters, but would not be
+	// one of four if the learner counted
+	follower := without([]int{0, 1, 2}, leader)[0]
+	cfg.disconnect(3)
+	cfg.disconnect(follower)
+	term, _, _ := cfg.rafts[3].GetState()
+	start = time.Now()
+	for cmd := 30; cmd < 50; cmd++ {
+		cfg.one(cmd, 2, false)
+	}
+	if d := time.Since(start); d > base+base/2 {
+		cfg.t.Fatalf("20 commits took %v with learner 3 cut off, against %v with it in step", d, base)
+	}
+	time.Sleep(time.Second)
+	if t, _, _ := cfg.rafts[3].GetState(); t != term {
+		cfg.t.Fatalf("learner 3, cut off, moved from term %d to %d", term, t)
+	}
+	cfg.connect(3)
+	cfg.connect(follower)
+	cfg.one(50, 4, true)
+
+	// the leader and the learner are not a commit quorum of the three voters
+	leader = cfg.checkOneLeader()
+	others := without([]int{0, 1, 2}, leader)
+	cfg.disconnect(others[0])
+	cfg.disconnect(others[1])
+	index, _, ok := cfg.rafts[leader].Start(51)
+	if !ok {
+		cfg.t.Fatalf("leader %d refused a command", leader)
+	}
+	time.Sleep(cfg.raftcfg.electionTimeoutMin())
+	if n, _ := cfg.nCommitted(index); n > 0 {
+		cfg.t.Fatalf("command committed by %d servers with two of three voters cut off", n)
+	}
+	cfg.connect(others[0])
+	cfg.connect(others[1])
+	leader = cfg.settledLeader(52, 4)
+	if err := cfg.rafts[leader].PromoteLearner(3); err != nil {
+		cfg.t.Fatalf("promoting learner 3 failed: %v", err)
+	}
+	cfg.waitVoters([]int{0, 1, 2, 3}, 0, 1, 2, 3)
+	cfg.waitLearners(nil, 0, 1, 2, 3)
+	cfg.one(53, 4, true)
+
+	if err := cfg.rafts[leader].AddLearner(cfg.rafts[leader].cfg.PeerEnd(4)); err != nil {
+		cfg.t.Fatalf("adding learner 4 failed: %v", err)
+	}
+	cfg.one(54, 5, true)
+	if err := cfg.rafts[leader].RemoveServer(4); err != nil {
+		cfg.t.Fatalf("removing learner 4 failed: %v", err)
+	}
+	cfg.waitLearners(nil, 0, 1, 2, 3)
+	cfg.waitVoters([]int{0, 1, 2, 3}, 0, 1, 2, 3)
+}
+
+// checkReconfigPolicy runs on a cluster of four made with make_config_members, of which servers
+// 0-2 are the founders, with cfg.raftcfg.ReconfigPolicy set to ReconfigReject or ReconfigQueue.
+// It pauses both followers and adds server 3, so the change is appended but cannot commit, and
+// calls TryStart meanwhile. ReconfigReject must refuse the command with ErrReconfiguring and
+// leave the log alone; ReconfigQueue must hold it until the followers resume and the change
+// commits, and then append it after the change. The cluster then runs checkApplyOrder.
+func (cfg *config) checkReconfigPolicy() {
+	leader := cfg.settledLeader(1, 3)
+	rl := cfg.rafts[leader]
+	followers := without([]int{0, 1, 2}, leader)
+	for _, i := range followers {
+		cfg.rafts[i].Pause()
+	}
+	added := make(chan error)
+	go func() { added <- rl.AddServer(rl.cfg.PeerEnd(3)) }()
+	var change int
+	for start := time.Now(); change == 0; time.Sleep(10 * time.Millisecond) {
+		rl.mu.Lock()
+		for _, e := range rl.log[1:] {
+			if _, ok := e.Command.(Membership); ok && e.Index > rl.commitIndex {
+				change = e.Index
+			}
+		}
+		rl.mu.Unlock()
+		if time.Since(start) > 2*time.Second {
+			cfg.t.Fatalf("leader %d did not append the change adding server 3", leader)
+		}
+	}
+
+	type started struct {
+		index    int
+		isLeader bool
+		err      error
+	}
+	done := make(chan started, 1)
+	go func() {
+		index, _, isLeader, err := rl.TryStart(2)
+		done <- started{index, isLeader, err}
+	}()
+
+	var s started
+	switch policy := cfg.raftcfg.ReconfigPolicy; policy {
+	case ReconfigReject:
+		s = <-done
+		if s.err != ErrReconfiguring {
+			cfg.t.Fatalf("TryStart during the change returned %v, expected ErrReconfiguring", s.err)
+		}
+		rl.mu.Lock()
+		last := rl.getLastLogIndex()
+		rl.mu.Unlock()
+		if last != change {
+			cfg.t.Fatalf("the log grew from %d to %d though the command was refused", change, last)
+		}
+	case ReconfigQueue:
+		select {
+		case s = <-done:
+			cfg.t.Fatalf("TryStart returned %+v while the change was uncommitted", s)
+		case <-time.After(cfg.raftcfg.electionTimeoutMin()):
+		}
+	default:
+		cfg.t.Fatalf("checkReconfigPolicy: unexpected policy %d", policy)
+	}
+
+	for _, i := range followers {
+		cfg.rafts[i].Resume()
+	}
+	if err := <-added; err != nil {
+		cfg.t.Fatalf("adding server 3 failed: %v", err)
+	}
+	if cfg.raftcfg.ReconfigPolicy == ReconfigQueue {
+		s = <-done
+		if s.err != nil || !s.isLeader || s.index <= change {
+			cfg.t.Fatalf("queued TryStart returned index %d, leader %v, %v; want an index after the change at %d",
+				s.index, s.isLeader, s.err, change)
+		}
+		if v := cfg.wait(s.index, 4, -1); v != 2 {
+			cfg.t.Fatalf("index %d holds %v, not the queued command", s.index, v)
+		}
+	}
+	cfg.waitVoters([]int{0, 1, 2, 3}, 0, 1, 2, 3)
+	cfg.checkApplyOrder(1)
+}
+
+// settledLeader agrees on cmd, as one does, until the leader has committed an entry of its
+// own term, so that it may start a membership change, and returns that leader.
+func (cfg *config) settledLeader(cmd int, expectedServers int) int {
+	for iters := 0; iters < 10; iters++ {
+		cfg.one(cmd, expectedServers, true)
+		leader := cfg.checkOneLeader()
+		rf := cfg.rafts[leader]
+		rf.mu.Lock()
+		settled := rf.log[rf.commitIndex-rf.log[0].Index].Term == rf.currentTerm
+		rf.mu.Unlock()
+		if settled {
+			return leader
+		}
+	}
+	cfg.t.Fatalf("no leader committed an entry of its term")
+	return -1
+}
+
+// waitVoters waits for each of servers to have the given voters.
+func (cfg *config) waitVoters(voters []int, servers ...int) {
+	cfg.waitMembers("voters", (*Raft).Voters, voters, servers)
+}
+
+// waitLearners waits for each of servers to have the given learners.
+func (cfg *config) waitLearners(learners []int, servers ...int) {
+	cfg.waitMembers("learners", (*Raft).Learners, learners, servers)
+}
+
+// waitMembers waits for members to return the peers in wanted on each of servers.
+func (cfg *config) waitMembers(what string, members func(*Raft) []int, wanted []int, servers []int) {
+	want := fmt.Sprint(wanted)
+	for _, i := range servers {
+		var got string
+		for iters := 0; iters < 50; iters++ {
+			if got = fmt.Sprint(members(cfg.rafts[i])); got == want {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if got != want {
+			cfg.t.Fatalf("server %d has %s %v, expected %v", i, what, got, want)
+		}
+	}
+}
+
+// checkInflightAppends stalls one follower for d by holding its lock, so that no RPC to it is
+// answered, and counts the RPCs the network delivers to it meanwhile, every one of which is
+// still outstanding when the stall ends. However many heartbeat rounds go by, there must be at
+// least one and no more than cfg.raftcfg.MaxInflightAppends, which is expected to be set. The
+// follower must then catch up.
+func (cfg *config) checkInflightAppends(d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	slow := (leader + 1) % cfg.n
+	cfg.mu.Lock()
+	rf := cfg.rafts[slow]
+	cfg.mu.Unlock()
+
+	rf.mu.Lock()
+	before := cfg.rpcCount(slow)
+	time.Sleep(d / 2)
+	cfg.rafts[leader].Start(2)
+	time.Sleep(d / 2)
+	inflight := cfg.rpcCount(slow) - before
+	rf.mu.Unlock()
+
+	if limit := cfg.raftcfg.MaxInflightAppends; inflight < 1 || inflight > limit {
+		cfg.t.Fatalf("%d RPCs outstanding to stalled follower %d over %v, want 1 to %d", inflight, slow, d, limit)
+	}
+	cfg.one(3, cfg.n, true)
+}
+
+// checkBackpressure stalls every follower for d by holding their locks, so nothing the leader
+// appends can commit, and has the leader's service propose commands with TryStart throughout.
+// Exactly cfg.raftcfg.MaxUncommittedEntries of them may be appended; the rest must be refused
+// with ErrBusy rather than grow the log, and the backlog must never pass the limit. Once the
+// followers resume, the backlog must drain and the leader accept and commit commands again.
+func (cfg *config) checkBackpressure(d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	cfg.mu.Lock()
+	rl := cfg.rafts[leader]
+	var stalled []*Raft
+	for i := 0; i < cfg.n; i++ {
+		if i != leader {
+			stalled = append(stalled, cfg.rafts[i])
+		}
+	}
+	cfg.mu.Unlock()
+	limit := cfg.raftcfg.MaxUncommittedEntries
+
+	for _, rf := range stalled {
+		rf.mu.Lock()
+	}
+	accepted, busy, worst := 0, 0, 0
+	for start := time.Now(); time.Since(start) < d; time.Sleep(time.Millisecond) {
+		_, _, ok, err := rl.TryStart(100 + accepted + busy)
+		switch {
+		case !ok:
+			cfg.t.Fatalf("leader %d lost leadership while its followers stalled", leader)
+		case err == ErrBusy:
+			busy++
+		case err != nil:
+			cfg.t.Fatalf("TryStart on leader %d: %v", leader, err)
+		default:
+			accepted++
+		}
+		if backlog, _ := rl.Backlog(); backlog > worst {
+			worst = backlog
+		}
+	}
+	for _, rf := range stalled {
+		rf.mu.Unlock()
+	}
+
+	if accepted != limit || busy == 0 {
+		cfg.t.Fatalf("leader accepted %d commands and refused %d while nothing could commit, want %d accepted and the rest refused",
+			accepted, busy, limit)
+	}
+	if worst > limit {
+		cfg.t.Fatalf("leader's backlog reached %d, past MaxUncommittedEntries %d", worst, limit)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if backlog, _ := rl.Backlog(); backlog == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			cfg.t.Fatalf("leader's backlog did not drain after its followers resumed")
+		}
+	}
+	cfg.one(2, cfg.n, true)
+}
+
+// checkBoundedSenders stalls nslow followers for d by holding their locks, so that every RPC
+// the leader sends them hangs. The leader must still commit with the other servers, and its
+// goroutines must level off: each stalled follower may tie up no more than its senders, each
+// blocked in a call with the simulated network's goroutines for it, however many heartbeat
+// rounds go by. The goroutine count, taken halfway through the stall and at its end, must stay
+// within that bound of the count before it, and barely move in between. Expects more than
+// 2*nslow servers and cfg.raftcfg.MaxInflightAppends to be set.
+func (cfg *config) checkBoundedSenders(nslow int, d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	cfg.mu.Lock()
+	rl := cfg.rafts[leader]
+	slow := make([]int, nslow)
+	stalled := make([]*Raft, nslow)
+	for k := range slow {
+		slow[k] = (leader + 1 + k) % cfg.n
+		stalled[k] = cfg.rafts[slow[k]]
+	}
+	cfg.mu.Unlock()
+	_, senders := rl.SenderLoad(slow[0])
+	const slack = 20
+	bound := nslow*senders*3 + slack
+
+	before := runtime.NumGoroutine()
+	for _, rf := range stalled {
+		rf.mu.Lock()
+	}
+	release := func() {
+		for _, rf := range stalled {
+			rf.mu.Unlock()
+		}
+	}
+	time.Sleep(d / 2)
+	mid := runtime.NumGoroutine()
+	index, _, ok := rl.Start(2)
+	if !ok {
+		release()
+		cfg.t.Fatalf("leader %d refused a command", leader)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if n, _ := cfg.nCommitted(index); n >= cfg.n-nslow {
+			break
+		}
+		if time.Since(start) > d/2 {
+			release()
+			cfg.t.Fatalf("index %d was not committed while %d followers stalled", index, nslow)
+		}
+	}
+	time.Sleep(d/2 - 10*time.Millisecond)
+	end := runtime.NumGoroutine()
+	var busy []int
+	for _, server := range slow {
+		n, _ := rl.SenderLoad(server)
+		busy = append(busy, n)
+	}
+	release()
+
+	if mid-before > bound || end-before > bound {
+		cfg.t.Fatalf("goroutines grew from %d to %d and then %d while %d followers stalled; want at most %d more",
+			before, mid, end, nslow, bound)
+	}
+	if end-mid > slack {
+		cfg.t.Fatalf("goroutines kept growing, from %d to %d, while %d followers stalled", mid, end, nslow)
+	}
+	for k, n := range busy {
+		if n != senders {
+			cfg.t.Fatalf("%d of %d senders to stalled server %d were busy", n, senders, slow[k])
+		}
+	}
+	if m := rl.Metrics(); m.SkippedRounds == 0 {
+		cfg.t.Fatalf("no heartbeat round was skipped for the stalled followers")
+	}
+	cfg.one(3, cfg.n, true)
+}
+
+// checkUnboundedSenders stalls a follower for d by holding its lock, with cfg.raftcfg leaving
+// MaxInflightAppends at zero. SenderLoad must report no limit; every heartbeat round must send
+// to the follower, none skipped, so the RPCs waiting on it pile up past what any pool of
+// rounds would allow; and once it is released, the leader must commit with it again.
+func (cfg *config) checkUnboundedSenders(d time.Duration) {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	cfg.mu.Lock()
+	rl := cfg.rafts[leader]
+	slow := (leader + 1) % cfg.n
+	stalled := cfg.rafts[slow]
+	cfg.mu.Unlock()
+	if _, senders := rl.SenderLoad(slow); senders != 0 {
+		cfg.t.Fatalf("SenderLoad reported %d senders; want 0 for no limit", senders)
+	}
+	skipped := rl.Metrics().SkippedRounds
+
+	stalled.mu.Lock()
+	time.Sleep(d)
+	busy, _ := rl.SenderLoad(slow)
+	stalled.mu.Unlock()
+
+	// rounds that were all sent pile up one RPC per heartbeat interval
+	if rounds := int(d / cfg.raftcfg.heartbeatInterval()); busy < rounds/2 {
+		cfg.t.Fatalf("%d RPCs waited on the stalled follower after %d heartbeat rounds; want one a round", busy, rounds)
+	}
+	if m := rl.Metrics(); m.SkippedRounds != skipped {
+		cfg.t.Fatalf("%d heartbeat rounds were skipped with no limit", m.SkippedRounds-skipped)
+	}
+	cfg.one(2, cfg.n, true)
+}
+
+// lowerCaseRecord has a field gob silently drops; only checkStrictGob registers it.
+type lowerCaseRecord struct {
+	Kept    int
+	dropped int
+}
+
+// checkStrictGob checks that, under gobWrapper.SetStrict, registering a struct with a lower-case
+// field panics instead of printing a warning, and that the error is counted. Strict mode is
+// turned off again afterwards.
+func (cfg *config) checkStrictGob() {
+	before := gobWrapper.ErrorCount()
+	gobWrapper.SetStrict(true)
+	defer gobWrapper.SetStrict(false)
+	func() {
+		defer func() {
+			if recover() == nil {
+				cfg.t.Fatalf("strict mode registered a struct with a lower-case field")
+			}
+		}()
+		gobWrapper.Register(lowerCaseRecord{})
+	}()
+	if after := gobWrapper.ErrorCount(); after != before+1 {
+		cfg.t.Fatalf("ErrorCount went from %d to %d for one lower-case field", before, after)
+	}
+}
+
+// checkStrictCommands checks that the leader refuses a command with an unexported field before
+// it reaches the log: TryStart returns an error without appending, and Start returns an index of
+// -1 and isLeader false. A well-formed command still commits afterwards. Expects
+// cfg.raftcfg.StrictCommands.
+func (cfg *config) checkStrictCommands() {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	cfg.mu.Lock()
+	rf := cfg.rafts[leader]
+	cfg.mu.Unlock()
+	rf.mu.Lock()
+	last := rf.getLastLogIndex()
+	rf.mu.Unlock()
+	if _, _, _, err := rf.TryStart(unexportedCommand{1}); err == nil {
+		cfg.t.Fatalf("TryStart accepted a command with an unexported field")
+	}
+	if index, _, isLeader := rf.Start(unexportedCommand{2}); index != -1 || isLeader {
+		cfg.t.Fatalf("Start accepted a command with an unexported field at %d (leader %v)", index, isLeader)
+	}
+	rf.mu.Lock()
+	if rf.getLastLogIndex() != last {
+		rf.mu.Unlock()
+		cfg.t.Fatalf("a refused command was appended to the log")
+	}
+	rf.mu.Unlock()
+
+	cfg.one(2, cfg.n, true)
+}
+
+// checkCallTimeouts checks that Raft waits on an RPC only as long as its timeouts allow. With
+// long reordering delaying most replies, heartbeats under a short RPCTimeout give up soon after
+// it, while snapshot transfers under a long SnapshotTimeout wait for their delayed replies. The
+// calls go to server 0 from a bare Raft holding only the timeouts, and carry term 0, which a
+// server that has seen an election refuses without effect.
+func (cfg *config) checkCallTimeouts() {
+	const short, long = 50 * time.Millisecond, 5 * time.Second
+	cfg.checkOneLeader()
+	endname := randstring(20)
+	end := cfg.net.MakeEnd(endname)
+	cfg.net.Connect(endname, 0)
+	cfg.net.Enable(endname, true)
+	rf := &Raft{peers: []*rpc.ClientEnd{end}, cfg: Config{RPCTimeout: short, SnapshotTimeout: long}}
+	cfg.setlongreordering(true)
+	defer cfg.setlongreordering(false)
+
+	lost := 0
+	for k := 0; k < 10; k++ {
+		start := time.Now()
+		if !rf.call(0, "Raft.AppendEntries", &AppendEntriesArgs{}, &AppendEntriesReply{}) {
+			lost++
+		}
+		if elapsed := time.Since(start); elapsed > short+50*time.Millisecond {
+			cfg.t.Fatalf("heartbeat with a %v timeout took %v", short, elapsed)
+		}
+	}
+	if lost == 0 {
+		cfg.t.Fatalf("no heartbeat timed out under long reordering")
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	slow := 0
+	for k := 0; k < 10; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			if !rf.call(0, "Raft.InstallSnapshot", &InstallSnapshotArgs{}, &InstallSnapshotReply{}) {
+				cfg.t.Errorf("snapshot transfer with a %v timeout failed", long)
+			}
+			if time.Since(start) > short {
+				mu.Lock()
+				slow++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if slow == 0 {
+		cfg.t.Fatalf("no snapshot transfer outlasted the heartbeat timeout")
+	}
+}
+
+// voteRecorder captures the vote events of every server, as Config.OnVote.
+type voteRecorder struct {
+	mu     sync.Mutex
+	events []VoteEvent
+}
+
+// record is the OnVote hook.
+func (r *voteRecorder) record(event VoteEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// recorded returns a copy of the events captured so far.
+func (r *voteRecorder) recorded() []VoteEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]VoteEvent(nil), r.events...)
+}
+
+// leaderWatch polls every server's GetState in the background, for any test to attach with
+// watchLeaders, and records the server it sees leading each term. Election safety allows at
+// most one leader per term, so two servers seen leading the same term, whether in one poll or
+// in different ones, are a violation.
+type leaderWatch struct {
+	cfg       *config
+	mu        sync.Mutex
+	leaders   map[int]int // term -> the server seen leading it
+	polls     int
+	violation string
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// watchLeaders starts polling every server, the ones started after it too, every interval.
+func (cfg *config) watchLeaders(interval time.Duration) *leaderWatch {
+	w := &leaderWatch{
+		cfg:     cfg,
+		leaders: make(map[int]int),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.stopped)
+		for {
+			w.poll()
+			select {
+			case <-w.done:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return w
+}
+
+// poll asks every running server for its state and records the leaders among them.
+func (w *leaderWatch) poll() {
+	w.cfg.mu.Lock()
+	rafts := append([]*Raft(nil), w.cfg.rafts...)
+	w.cfg.mu.Unlock()
+	seen := make(map[int]int)
+	for i, rf := range rafts {
+		if rf == nil {
+			continue
+		}
+		term, isLeader, _ := rf.GetState()
+		if !isLeader {
+			continue
+		}
+		if other, ok := seen[term]; ok {
+			w.violate(fmt.Sprintf("servers %d and %d both lead term %d at once", other, i, term))
+		}
+		seen[term] = i
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.polls++
+	for term, i := range seen {
+		if other, ok := w.leaders[term]; ok && other != i && w.violation == "" {
+			w.violation = fmt.Sprintf("servers %d and %d were both seen leading term %d", other, i, term)
+		}
+		w.leaders[term] = i
+	}
+}
+
+// violate records the first violation seen.
+func (w *leaderWatch) violate(violation string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.violation == "" {
+		w.violation = violation
+	}
+}
+
+// stop ends the polling, fails the test if election safety was ever violated, and returns
+// the number of terms a leader was seen in.
+func (w *leaderWatch) stop() int {
+	close(w.done)
+	<-w.stopped
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.violation != "" {
+		w.cfg.t.Fatalf("election safety violated after %d polls: %s", w.polls, w.violation)
+	}
+	return len(w.leaders)
+}
+
+// checkElectionSafety runs an election storm under a leaderWatch: round after round, the leader
+// and another server chosen at random are cut off for a random while, so that the others must
+// elect a new leader while the old one may still think it leads, over an unreliable network.
+// No term may ever have two leaders, and the storm must go through at least rounds/2 terms with
+// a leader, before the reconnected cluster commits a command.
+func (cfg *config) checkElectionSafety(rounds int) {
+	w := cfg.watchLeaders(5 * time.Millisecond)
+	cfg.setunreliable(true)
+	for r := 0; r < rounds; r++ {
+		cut := map[int]bool{rand.Intn(cfg.n): true}
+		for i := 0; i < cfg.n; i++ {
+			if _, isLeader, _ := cfg.rafts[i].GetState(); isLeader {
+				cut[i] = true
+			}
+		}
+		for i := range cut {
+			cfg.disconnect(i)
+		}
+		time.Sleep(time.Duration(200+rand.Intn(400)) * time.Millisecond)
+		for i := range cut {
+			cfg.connect(i)
+		}
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Millisecond)
+	}
+	cfg.setunreliable(false)
+	cfg.one(rand.Int(), cfg.n, true)
+	if terms := w.stop(); terms < rounds/2 {
+		cfg.t.Fatalf("the storm saw leaders in only %d terms over %d rounds", terms, rounds)
+	}
+}
+
+// checkVoteEvents runs a contested election and checks the vote events rec captured, for a
+// cluster made with make_config_with and OnVote set to rec.record. A follower is cut off while
+// the others commit, so its log falls behind while its term races ahead, and then reconnected:
+// its higher term forces a new election, which it cannot win. The other servers must refuse it
+// for its log, and the new leader must have been granted a quorum of votes in its term. In all
+// events, a voter grants at most one vote per term, and reports every vote it grants or refuses
+// after the request it received.
+func (cfg *config) checkVoteEvents(rec *voteRecorder) {
+	leader := cfg.checkOneLeader()
+	cfg.one(101, cfg.n, true)
+	behind := (leader + 1) % cfg.n
+	cfg.disconnect(behind)
+	cfg.one(102, cfg.n-1, true)
+	cfg.one(103, cfg.n-1, true)
+	time.Sleep(time.Second) // several election timeouts
+	cfg.connect(behind)
+	leader = cfg.checkOneLeader()
+	cfg.one(104, cfg.n, true)
+	term, _, _ := cfg.rafts[leader].GetState()
+
+	quorum := cfg.raftcfg.electionQuorum(cfg.n)
+	var events []VoteEvent
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		// events reach the recorder from each server's notifier, shortly after the fact.
+		events = rec.recorded()
+		refused, granted := false, map[int]bool{}
+		for _, e := range events {
+			if e.Kind == VoteRejected && e.Candidate == behind && e.Reason == RejectLogBehind {
+				refused = true
+			}
+			if e.Kind == VoteGranted && e.Term == term && e.Candidate == leader {
+				granted[e.Voter] = true
+			}
+		}
+		if refused && len(granted)+1 >= quorum {
+			break
+		}
+		if time.Since(start) > time.Second {
+			cfg.t.Fatalf("after the election in term %d: server %d refused for its log: %v; votes for leader %d: %v",
+				term, behind, refused, leader, granted)
+		}
+	}
+
+	type ballot struct{ voter, term int }
+	votes := map[ballot]int{}
+	received := map[VoteEvent]bool{}
+	for _, e := range events {
+		switch e.Kind {
+		case VoteReceived:
+			received[VoteEvent{Term: e.Term, Candidate: e.Candidate, Voter: e.Voter}] = true
+		case VoteGranted, VoteRejected:
+			if !received[VoteEvent{Term: e.Term, Candidate: e.Candidate, Voter: e.Voter}] {
+				cfg.t.Fatalf("%v reported before the request was received", e)
+			}
+			if e.Kind != VoteGranted {
+				break
+			}
+			b := ballot{e.Voter, e.Term}
+			if c, ok := votes[b]; ok && c != e.Candidate {
+				cfg.t.Fatalf("server %d voted for both %d and %d in term %d", e.Voter, c, e.Candidate, e.Term)
+			}
+			votes[b] = e.Candidate
+		}
+	}
+}
+
+// injectDivergence replaces the log of server i after index from with uncommitted entries of
+// the given terms, as if leaders that never committed them had sent them, so tests can reach
+// the AppendEntries conflict resolution without staging the partitions that would leave such a
+// log behind. As in any log Raft could have built, committed entries are left alone, and the
+// terms must not decrease, nor fall below the term of the entry at from, nor exceed the
+// server's current term. The injected commands are negative, so none can pass for a test's.
+func (cfg *config) injectDivergence(i int, from int, terms []int) {
+	cfg.mu.Lock()
+	rf := cfg.rafts[i]
+	cfg.mu.Unlock()
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	base := rf.log[0].Index
+	if from < rf.commitIndex || from < base || from > rf.getLastLogIndex() {
+		cfg.t.Fatalf("injectDivergence: index %v is outside the uncommitted log of server %v (committed %v, last %v)",
+			from, i, rf.commitIndex, rf.getLastLogIndex())
+	}
+	prev := rf.log[from-base].Term
+	for _, term := range terms {
+		if term < prev || term > rf.currentTerm {
+			cfg.t.Fatalf("injectDivergence: term %v cannot follow term %v on server %v in term %v", term, prev, i, rf.currentTerm)
+		}
+		prev = term
+	}
+	rf.log = rf.log[:from-base+1]
+	for k, term := range terms {
+		index := from + 1 + k
+		rf.log = append(rf.log, LogEntry{Index: index, Term: term, Command: -index})
+	}
+	rf.persist()
+}
+
+// checkDivergenceRepair cuts a follower off and has the rest of the cluster move on through two
+// leadership transfers in a row, so that the middle term holds no entries, and then commit
+// entries in the final term. It injects into the follower's log a suffix in its own last term
+// and in the missed middle term, entries some leader could have sent it in those terms but
+// never committed, and reconnects it. The leader must bring the follower's log in line with its
+// own through AppendEntries alone: once a new command commits everywhere, the two logs must
+// hold the same entries.
+func (cfg *config) checkDivergenceRepair() {
+	cmd := 1
+	leader := cfg.checkOneLeader()
+	cfg.one(cmd, cfg.n, true)
+	cmd++
+	behind := (leader + 1) % cfg.n
+	cfg.disconnect(behind)
+	for k := 0; k < 2; k++ {
+		term, _, _ := cfg.rafts[leader].GetState()
+		target := (leader + 1) % cfg.n
+		for target == behind || target == leader {
+			target = (target + 1) % cfg.n
+		}
+		cfg.rafts[leader].TransferLeadership(target)
+		for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+			leader = cfg.checkOneLeader()
+			if t, _, _ := cfg.rafts[leader].GetState(); t > term {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				cfg.t.Fatalf("the term did not advance past %v", term)
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		cfg.one(cmd, cfg.n-1, true)
+		cmd++
+	}
+	time.Sleep(time.Second) // let the follower's own elections raise its term
+
+	cfg.rafts[behind].mu.Lock()
+	from := cfg.rafts[behind].getLastLogIndex()
+	last := cfg.rafts[behind].getLastLogTerm()
+	cfg.rafts[behind].mu.Unlock()
+	cfg.rafts[leader].mu.Lock()
+	used := map[int]bool{}
+	for _, e := range cfg.rafts[leader].log[1:] {
+		used[e.Term] = true
+	}
+	missed := last + 1
+	for used[missed] {
+		missed++
+	}
+	term := cfg.rafts[leader].currentTerm
+	cfg.rafts[leader].mu.Unlock()
+	if missed >= term {
+		cfg.t.Fatalf("no term between %v and the leader's term %v went without entries", last, term)
+	}
+	cfg.injectDivergence(behind, from, []int{last, last, missed, missed, missed, missed})
+
+	cfg.connect(behind)
+	cfg.one(cmd, cfg.n, true)
+	leader = cfg.checkOneLeader()
+
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		diff := cfg.logDiff(leader, behind)
+		if diff == "" {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			cfg.t.Fatalf("server %v's log was not repaired: %v", behind, diff)
+		}
+	}
+}
+
+// rejectionsAfterElection cuts a follower off and moves the rest of the cluster through several
+// leadership transfers, so that the terms in between hold no entries, before it commits more
+// entries in the final term than the follower will hold past their common prefix. It waits for
+// the follower's own elections to catch its term up, injects into its log a suffix of entries
+// in ndiverged of those empty terms, and, if snapshot is set, has every other server take a
+// snapshot of the prefix the logs share, so that the divergence stays in their logs. It then reconnects the follower, which forces an election
+// the follower cannot win. It returns how many AppendEntries the servers rejected for a log
+// mismatch until the new leader had repaired the follower's log.
+func (cfg *config) rejectionsAfterElection(ndiverged int, snapshot bool) int64 {
+	leader := cfg.checkOneLeader()
+	cfg.one(1, cfg.n, true)
+	behind := (leader + 1) % cfg.n
+	cfg.disconnect(behind)
+	for k := 0; k < ndiverged+2; k++ {
+		term, _, _ := cfg.rafts[leader].GetState()
+		target := (leader + 1) % cfg.n
+		for target == behind || target == leader {
+			target = (target + 1) % cfg.n
+		}
+		cfg.rafts[leader].TransferLeadership(target)
+		for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+			leader = cfg.checkOneLeader()
+			if t, _, _ := cfg.rafts[leader].GetState(); t > term {
+				break
+			}
+			if time.Since(start) > 5*time.Second {
+				cfg.t.Fatalf("the term did not advance past %v", term)
+			}
+		}
+	}
+	// more entries than the follower will hold after from, so that the leader walks back
+	// through every divergent term
+	cmd := 2
+	for ; cmd < 2*ndiverged+4; cmd++ {
+		cfg.one(cmd, cfg.n-1, true)
+	}
+	leaderTerm, _, _ := cfg.rafts[leader].GetState()
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if t, _, _ := cfg.rafts[behind].GetState(); t >= leaderTerm {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			cfg.t.Fatalf("server %v's term did not reach %v while it was cut off", behind, leaderTerm)
+		}
+	}
+
+	cfg.rafts[behind].mu.Lock()
+	from := cfg.rafts[behind].getLastLogIndex()
+	last := cfg.rafts[behind].getLastLogTerm()
+	cfg.rafts[behind].mu.Unlock()
+	cfg.rafts[leader].mu.Lock()
+	used := map[int]bool{}
+	for _, e := range cfg.rafts[leader].log[1:] {
+		used[e.Term] = true
+	}
+	cfg.rafts[leader].mu.Unlock()
+	var terms []int
+	for term := last + 1; term < leaderTerm && len(terms) < 2*ndiverged; term++ {
+		if !used[term] {
+			terms = append(terms, term, term)
+		}
+	}
+	if len(terms) < 2*ndiverged {
+		cfg.t.Fatalf("only %d terms between %v and the leader's term %v went without entries, want %d", len(terms)/2, last, leaderTerm, ndiverged)
+	}
+	cfg.injectDivergence(behind, from, terms)
+	for i := 0; snapshot && i < cfg.n; i++ {
+		if i != behind {
+			cfg.rafts[i].CreateSnapshot([]byte{byte(from)}, from)
+		}
+	}
+
+	rejections := func() (total int64) {
+		for i := 0; i < cfg.n; i++ {
+			total += cfg.rafts[i].Metrics().AppendRejections
+		}
+		return total
+	}
+	before := rejections()
+	cfg.connect(behind)
+	cfg.one(cmd, cfg.n, true)
+	leader = cfg.checkOneLeader()
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		diff := cfg.logDiff(leader, behind)
+		if diff == "" {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			cfg.t.Fatalf("server %v's log was not repaired: %v", behind, diff)
+		}
+	}
+	return rejections() - before
+}
+
+// checkProbeOnElection compares the AppendEntries rejections a new leader needs to repair a
+// follower whose log diverges over several terms, with cfg.raftcfg.ProbeOnElection set as
+// expected, against a cluster whose leaders do not probe. The unprobed leader must walk back
+// one term per rejection, and the probing leader must need fewer than half as many.
+func (cfg *config) checkProbeOnElection(ndiverged int) {
+	raftcfg := cfg.raftcfg
+	raftcfg.ProbeOnElection = false
+	unprobed := make_config_with(cfg.t, cfg.n, false, raftcfg)
+	defer unprobed.cleanup()
+	before := unprobed.rejectionsAfterElection(ndiverged, false)
+	after := cfg.rejectionsAfterElection(ndiverged, false)
+	if before < int64(ndiverged) {
+		cfg.t.Fatalf("without the probe, a log diverging over %d terms was repaired after %d rejections", ndiverged, before)
+	}
+	if 2*after >= before {
+		cfg.t.Fatalf("with the probe, the new leader needed %d rejections, against %d without it", after, before)
+	}
+}
+
+// checkSnapshotAfterRejections leaves a follower with a log diverging over ndiverged terms, as
+// checkProbeOnElection does, but with every other server holding a snapshot of the prefix their
+// logs share, and reconnects it.
+// With cfg.raftcfg.SnapshotAfterRejections set below ndiverged, the new leader must give up
+// walking nextIndex back once the follower has rejected that many AppendEntries in a row, and
+// send it the snapshot instead: at least one snapshot fallback, and fewer rejections than the
+// ndiverged a walk back through every term would take. The follower must then commit with the
+// rest of the cluster.
+func (cfg *config) checkSnapshotAfterRejections(ndiverged int) {
+	fallbacks := func() (total int64) {
+		for i := 0; i < cfg.n; i++ {
+			total += cfg.rafts[i].Metrics().SnapshotFallbacks
+		}
+		return total
+	}
+	before := fallbacks()
+	rejected := cfg.rejectionsAfterElection(ndiverged, true)
+	if fallbacks() == before {
+		cfg.t.Fatalf("the leader repaired a log diverging over %d terms without falling back to its snapshot", ndiverged)
+	}
+	if rejected >= int64(ndiverged) {
+		cfg.t.Fatalf("the leader took %d rejections to repair a log diverging over %d terms, with SnapshotAfterRejections %d",
+			rejected, ndiverged, cfg.raftcfg.SnapshotAfterRejections)
+	}
+	cfg.one(100, cfg.n, true)
+}
+
+// logDiff describes the first difference between the logs of servers i and j (see DiffLogs),
+// or returns "" if they hold the same entries.
+func (cfg *config) logDiff(i int, j int) string {
+	cfg.mu.Lock()
+	a, b := cfg.rafts[i], cfg.rafts[j]
+	cfg.mu.Unlock()
+	la, lb := a.LogSnapshot(), b.LogSnapshot()
+
+	index, differ := DiffLogs(la, lb)
+	if !differ {
+		return ""
+	}
+	describe := func(log []LogEntry, server int) string {
+		if index < log[0].Index || index > log[len(log)-1].Index {
+			return fmt.Sprintf("nothing on server %v", server)
+		}
+		e := log[index-log[0].Index]
+		return fmt.Sprintf("%v (term %v) on server %v", e.Command, e.Term, server)
+	}
+	return fmt.Sprintf("index %v holds %v, %v", index, describe(la, i), describe(lb, j))
+}
+
+// checkDiffLogs checks DiffLogs on hand-built logs: ones that share a prefix and then
+// diverge, one that extends the other, ones compacted to different points, and equal ones.
+func (cfg *config) checkDiffLogs() {
+	// build returns a log compacted to base in term baseTerm, followed by entries of the
+	// given terms whose commands are their indexes, except where commands overrides them.
+	build := func(base int, baseTerm int, terms []int, commands map[int]interface{}) []LogEntry {
+		log := []LogEntry{{Index: base, Term: baseTerm}}
+		for k, term := range terms {
+			index := base + k + 1
+			var command interface{} = index
+			if c, ok := commands[index]; ok {
+				command = c
+			}
+			log = append(log, LogEntry{Index: index, Term: term, Command: command})
+		}
+		return log
+	}
+	cases := []struct {
+		name   string
+		a, b   []LogEntry
+		index  int
+		differ bool
+	}{
+		{"terms diverge", build(0, 0, []int{1, 1, 2, 2, 2}, nil), build(0, 0, []int{1, 1, 2, 3, 3}, nil), 4, true},
+		{"commands diverge", build(0, 0, []int{1, 1, 2}, nil), build(0, 0, []int{1, 1, 2}, map[int]interface{}{3: "x"}), 3, true},
+		{"one extends the other", build(0, 0, []int{1, 1, 2}, nil), build(0, 0, []int{1, 1, 2, 2}, nil), 4, true},
+		{"different bases", build(2, 1, []int{2, 2, 3}, nil), build(0, 0, []int{1, 1, 2, 2, 4}, nil), 5, true},
+		{"base disagrees", build(3, 2, []int{2}, nil), build(0, 0, []int{1, 1, 3, 3}, nil), 3, true},
+		{"bases beyond the other's log", build(6, 3, nil, nil), build(0, 0, []int{1, 1}, nil), 3, true},
+		{"equal after compaction", build(2, 1, []int{2, 2}, nil), build(0, 0, []int{1, 1, 2, 2}, nil), -1, false},
+	}
+	for _, c := range cases {
+		for _, swap := range []bool{false, true} {
+			a, b := c.a, c.b
+			if swap {
+				a, b = b, a
+			}
+			if index, differ := DiffLogs(a, b); index != c.index || differ != c.differ {
+				cfg.t.Fatalf("%s: DiffLogs returned %v, %v; want %v, %v", c.name, index, differ, c.index, c.differ)
+			}
+		}
+	}
+}
+
+// checkElectionSeed draws n election timeouts for each of several peers, seeded as
+// MakeWithConfig seeds them. Two runs with the same ElectionSeed must draw the same sequence for
+// every peer, while peers sharing a seed, and runs with different seeds, must not.
+func (cfg *config) checkElectionSeed(n int) {
+	draw := func(seed int64, me int) string {
+		rf := &Raft{cfg: Config{ElectionSeed: seed}, rand: electionRand(seed, me)}
+		timeouts := make([]time.Duration, n)
+		for i := range timeouts {
+			timeouts[i] = rf.electionTimeout()
+		}
+		return fmt.Sprint(timeouts)
+	}
+	for me := 0; me < 3; me++ {
+		first, second := draw(42, me), draw(42, me)
+		if first != second {
+			cfg.t.Fatalf("peer %d drew %v, then %v, from the same seed", me, first, second)
+		}
+		if other := draw(42, me+1); other == first {
+			cfg.t.Fatalf("peers %d and %d drew the same election timeouts %v", me, me+1, first)
+		}
+		if other := draw(43, me); other == first {
+			cfg.t.Fatalf("peer %d drew the same election timeouts %v from seeds 42 and 43", me, first)
+		}
+	}
+}
+
+// checkComputeCommitIndex runs computeCommitIndex on a table of clusters: odd and even sizes,
+// all match indexes equal, a leader alone ahead of its followers, entries from older terms,
+// and commit quorums larger than a majority. Each case gives the term of every log entry, by
+// index, starting from index 0.
+func (cfg *config) checkComputeCommitIndex() {
+	cases := []struct {
+		name        string
+		matchIndex  []int
+		me          int
+		quorum      int
+		commitIndex int
+		currentTerm int
+		terms       []int
+		want        int
+	}{
+		{"odd cluster", []int{0, 5, 3}, 0, 2, 0, 1, []int{0, 1, 1, 1, 1, 1}, 5},
+		{"leader alone ahead", []int{0, 0, 0}, 0, 2, 0, 1, []int{0, 1, 1, 1, 1, 1}, 0},
+		{"even cluster", []int{0, 6, 4, 2}, 0, 3, 0, 1, []int{0, 1, 1, 1, 1, 1, 1}, 4},
+		{"even cluster split in half", []int{0, 6, 2, 2}, 0, 3, 0, 1, []int{0, 1, 1, 1, 1, 1, 1}, 2},
+		{"all equal", []int{3, 3, 3, 3, 3}, 2, 3, 0, 1, []int{0, 1, 1, 1}, 3},
+		{"all equal at the commit index", []int{2, 2, 2}, 1, 2, 2, 1, []int{0, 1, 1}, 2},
+		{"stale own match index", []int{0, 4, 0}, 0, 2, 0, 1, []int{0, 1, 1, 1, 1}, 4},
+		{"leader not first", []int{1, 0, 0, 4, 4}, 2, 3, 0, 1, []int{0, 1, 1, 1, 1}, 4},
+		{"older term only", []int{0, 4, 4}, 0, 2, 1, 3, []int{0, 1, 1, 2, 2}, 1},
+		{"current term commits older", []int{0, 4, 4}, 0, 2, 1, 3, []int{0, 1, 1, 2, 3}, 4},
+		{"larger commit quorum", []int{0, 5, 5, 3, 3}, 0, 4, 0, 1, []int{0, 1, 1, 1, 1, 1}, 3},
+		{"never backwards", []int{0, 3, 3}, 0, 2, 5, 1, []int{0, 1, 1, 1, 1, 1}, 5},
+		{"single peer", []int{0}, 0, 1, 0, 1, []int{0, 1, 1, 1}, 3},
+	}
+	for _, c := range cases {
+		termAt := func(index int) int { return c.terms[index] }
+		lastIndex := len(c.terms) - 1
+		if got := computeCommitIndex(c.matchIndex, c.me, lastIndex, c.quorum, c.commitIndex, c.currentTerm, termAt); got != c.want {
+			cfg.t.Fatalf("%s: computeCommitIndex returned %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// scanCommitIndex is the rule computeCommitIndex replaced: scan down from the last entry while
+// it is from currentTerm, counting the peers that store each index, and stop at the first held
+// by quorum peers. It takes time in proportion to the uncommitted entries of the current term,
+// and is kept only to check that the two rules agree and to measure the difference.
+func scanCommitIndex(matchIndex []int, me int, lastIndex int, quorum int, commitIndex int, currentTerm int, termAt func(index int) int) int {
+	for N := lastIndex; N > commitIndex && termAt(N) == currentTerm; N-- {
+		count := 1
+		for i := range matchIndex {
+			if i != me && matchIndex[i] >= N {
+				count++
+			}
+		}
+		if count >= quorum {
+			return N
+		}
+	}
+	return commitIndex
+}
+
+// checkCommitIndexMatchesScan runs computeCommitIndex and scanCommitIndex on random clusters of
+// one to seven peers, each with a random log whose terms never decrease, random match indexes
+// and commit index, and a commit quorum anywhere from a majority to every peer. The two must
+// always choose the same commit index.
+func (cfg *config) checkCommitIndexMatchesScan(ncases int) {
+	r := rand.New(rand.NewSource(1))
+	for k := 0; k < ncases; k++ {
+		n := 1 + r.Intn(7)
+		terms := []int{0}
+		for len(terms) < 2+r.Intn(40) {
+			terms = append(terms, terms[len(terms)-1]+r.Intn(3)/2)
+		}
+		lastIndex := len(terms) - 1
+		currentTerm := terms[lastIndex] + r.Intn(2)
+		commitIndex := r.Intn(lastIndex + 1)
+		matchIndex := make([]int, n)
+		for i := range matchIndex {
+			matchIndex[i] = r.Intn(lastIndex + 1)
+		}
+		me := r.Intn(n)
+		quorum := n/2 + 1 + r.Intn(n-n/2)
+		termAt := func(index int) int { return terms[index] }
+
+		got := computeCommitIndex(matchIndex, me, lastIndex, quorum, commitIndex, currentTerm, termAt)
+		want := scanCommitIndex(matchIndex, me, lastIndex, quorum, commitIndex, currentTerm, termAt)
+		if got != want {
+			cfg.t.Fatalf("match indexes %v, leader %d, quorum %d, commit index %d, term %d, log terms %v: computeCommitIndex chose %d, the backward scan %d",
+				matchIndex, me, quorum, commitIndex, currentTerm, terms, got, want)
+		}
+	}
+}
+
+// checkFirstLogIndex checks FirstLogIndex and GetAtIndex around a snapshot. It commits a few
+// commands and snapshots every server at the index it has applied up to: FirstLogIndex must
+// then be the snapshot's LastIncludedIndex, GetAtIndex must refuse every index below it and
+// return the snapshot's term at it, and the entries after it must still be readable.
+func (cfg *config) checkFirstLogIndex() {
+	for cmd := 1; cmd <= 5; cmd++ {
+		cfg.one(cmd*100, cfg.n, true)
+	}
+	cfg.snapshot()
+	last := cfg.one(600, cfg.n, true)
+
+	for i := 0; i < cfg.n; i++ {
+		cfg.mu.Lock()
+		rf := cfg.rafts[i]
+		cfg.mu.Unlock()
+		snapshot, err := ParseSnapshot(cfg.saved[i].ReadSnapshot())
+		if err != nil {
+			cfg.t.Fatalf("server %d: %v", i, err)
+		}
+		first := rf.FirstLogIndex()
+		if first != snapshot.LastIncludedIndex || first == 0 {
+			cfg.t.Fatalf("server %d: FirstLogIndex %d, snapshot at %d", i, first, snapshot.LastIncludedIndex)
+		}
+		for index := 0; index < first; index++ {
+			if _, ok := rf.GetAtIndex(index); ok {
+				cfg.t.Fatalf("server %d: GetAtIndex(%d) served an index below FirstLogIndex %d", i, index, first)
+			}
+		}
+		if entry, ok := rf.GetAtIndex(first); !ok || entry.Term != snapshot.LastIncludedTerm {
+			cfg.t.Fatalf("server %d: GetAtIndex(%d) returned %+v, %v; want term %d", i, first, entry, ok, snapshot.LastIncludedTerm)
+		}
+		if entry, ok := rf.GetAtIndex(last); !ok || entry.Command != 600 {
+			cfg.t.Fatalf("server %d: GetAtIndex(%d) returned %+v, %v; want command 600", i, last, entry, ok)
+		}
+		if _, ok := rf.GetAtIndex(last + 1); ok {
+			cfg.t.Fatalf("server %d: GetAtIndex(%d) served an index past the log", i, last+1)
+		}
+	}
+}
+
+// checkLeaseMissedRounds checks that a lease configured with cfg.LeaseMissedRounds survives
+// that many lost heartbeat rounds. Right after a commit quorum acknowledges the leader, its
+// outgoing messages are dropped for LeaseMissedRounds heartbeat intervals, during which the
+// lease is provably valid and every LeaseRead must succeed; a blackout longer than the lease
+// must then let it lapse. Expects a config with leases enabled.
+func (cfg *config) checkLeaseMissedRounds(rounds int) {
+	leader := cfg.checkOneLeader()
+	cfg.one(1, cfg.n, true)
+	cfg.mu.Lock()
+	rf := cfg.rafts[leader]
+	cfg.mu.Unlock()
+	rf.mu.Lock()
+	lease, missed := rf.cfg.LeaseDuration, rf.cfg.LeaseMissedRounds
+	rf.mu.Unlock()
+
+	// blackout drops the leader's outgoing messages for d, calling LeaseRead every few
+	// milliseconds, and returns how many reads were refused and whether the last one was.
+	blackout := func(d time.Duration) (reads int, refused int, lastRefused bool) {
+		for j := 0; j < cfg.n; j++ {
+			if j != leader {
+				cfg.net.Enable(cfg.endnames[leader][j], false)
+			}
+		}
+		for start := time.Now(); time.Since(start) < d; time.Sleep(5 * time.Millisecond) {
+			_, ok := rf.LeaseRead()
+			reads++
+			if lastRefused = !ok; lastRefused {
+				refused++
+			}
+		}
+		for j := 0; j < cfg.n; j++ {
+			if j != leader && cfg.connected[j] {
+				cfg.net.Enable(cfg.endnames[leader][j], true)
+			}
+		}
+		return reads, refused, lastRefused
+	}
+
+	for r := 0; r < rounds; r++ {
+		// wait for a fresh acknowledgement, so the lease covers the whole blackout
+		for t0 := time.Now(); ; time.Sleep(time.Millisecond) {
+			rf.mu.Lock()
+			expiry := rf.leaseExpiry()
+			rf.mu.Unlock()
+			if expiry.After(time.Now().Add(lease - 10*time.Millisecond)) {
+				break
+			}
+			if time.Since(t0) > time.Second {
+				cfg.t.Fatalf("leader %d's lease was not renewed within a second", leader)
+			}
+		}
+		if reads, refused, _ := blackout(time.Duration(missed) * cfg.raftcfg.heartbeatInterval()); refused > 0 {
+			cfg.t.Fatalf("round %d: %d of %d lease reads refused while %d missed rounds should be tolerated",
+				r, refused, reads, missed)
+		}
+		if l := cfg.checkOneLeader(); l != leader {
+			cfg.t.Fatalf("leadership moved from %d to %d during short blackouts", leader, l)
+		}
+		cfg.one(r+2, cfg.n, true)
+	}
+
+	if _, _, lastRefused := blackout(lease + 50*time.Millisecond); !lastRefused {
+		cfg.t.Fatalf("leader %d served a lease read %v after its last acknowledgement", leader, lease+50*time.Millisecond)
+	}
+	cfg.one(rounds+2, cfg.n, true)
+}
+
+// checkWaitForApplied holds cfg.mu, which stalls every server's applyCh reader once it has taken
+// one more message, and starts two commands. WaitForApplied on a follower for the second must
+// not return while the follower has applied only the first, and must return once the reader
+// takes the second. With nothing more started, WaitForApplied must return the context's error
+// when the context expires, and ErrKilled when the follower is killed.
+func (cfg *config) checkWaitForApplied() {
+	cfg.one(1, cfg.n, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % cfg.n
+	cfg.mu.Lock()
+	rl, rf := cfg.rafts[leader], cfg.rafts[follower]
+	first, _, _ := rl.Start(2)
+	second, _, _ := rl.Start(3)
+
+	waited := make(chan error, 1)
+	go func() { waited <- rf.WaitForApplied(context.Background(), second) }()
+	wait := func(what string, want error) {
+		select {
+		case err := <-waited:
+			if err != want {
+				cfg.t.Fatalf("WaitForApplied returned %v %s, want %v", err, what, want)
+			}
+		case <-time.After(time.Second):
+			cfg.t.Fatalf("WaitForApplied still waiting a second %s", what)
+		}
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		rf.mu.Lock()
+		applied := rf.lastApplied
+		rf.mu.Unlock()
+		if applied == first {
+			break
+		}
+		if time.Since(start) > 2*cfg.raftcfg.electionTimeoutMax() {
+			cfg.mu.Unlock()
+			cfg.t.Fatalf("follower %d applied up to %d, want %d", follower, applied, first)
+		}
+	}
+	select {
+	case err := <-waited:
+		cfg.mu.Unlock()
+		cfg.t.Fatalf("WaitForApplied for %d returned %v with only %d applied", second, err, first)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cfg.mu.Unlock()
+	wait(fmt.Sprintf("once %d was taken", second), nil)
+	rf.mu.Lock()
+	applied := rf.lastApplied
+	rf.mu.Unlock()
+	if applied < second {
+		cfg.t.Fatalf("WaitForApplied for %d returned with %d applied", second, applied)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() { waited <- rf.WaitForApplied(ctx, second+1) }()
+	wait("after its context expired", context.DeadlineExceeded)
+
+	go func() { waited <- rf.WaitForApplied(context.Background(), second+1) }()
+	time.Sleep(100 * time.Millisecond)
+	cfg.crash1(follower)
+	wait("after the peer was killed", ErrKilled)
+
+	cfg.start1(follower)
+	cfg.connect(follower)
+	cfg.one(4, cfg.n, true)
+}
+
+// checkKill starts n servers and kills them all while commands are being started on the
+// leader. No server may apply anything once Kill has returned, and the goroutine count must fall
+// back to what it was before the cluster started, but for the harness's applyCh readers, within
+// a few election timeouts of the network being cleaned up.
+func checkKill(t *testing.T, n int) {
+	before := runtime.NumGoroutine()
+	cfg := make_config(t, n, false)
+	cfg.one(1, n, true)
+	leader := cfg.checkOneLeader()
+	stop := make(chan struct{})
+	go func() {
+		for cmd := 2; ; cmd++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cfg.rafts[leader].Start(cmd)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cfg.cleanup()
+	close(stop)
+
+	// a message handed over just before Kill returned may not be counted yet
+	time.Sleep(20 * time.Millisecond)
+	cfg.mu.Lock()
+	applied := append([]int(nil), cfg.applied...)
+	cfg.mu.Unlock()
+	time.Sleep(500 * time.Millisecond)
+	cfg.mu.Lock()
+	for i := range applied {
+		if cfg.applied[i] != applied[i] {
+			t.Fatalf("server %d applied up to %d after it was killed at %d", i, cfg.applied[i], applied[i])
+		}
+	}
+	cfg.mu.Unlock()
+
+	cfg.net.Cleanup()
+	bound := 3 * cfg.raftcfg.electionTimeoutMax()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		left := runtime.NumGoroutine() - before - n
+		if left <= 0 {
+			break
+		}
+		if time.Since(start) > bound {
+			t.Fatalf("%d goroutines still running %v after the cluster was killed", left, bound)
+		}
+	}
+}
+
+// checkTermChange starts a lone follower with an OnTermChange callback, started with Join so
+// that it never stands for election, and advances its term by calling its AppendEntries handler
+// directly with heartbeats: one term at a time, then several at once. Each advance
+// must be reported by exactly one call carrying the new term, and a message in the current
+// term, or an older one, by none.
+func checkTermChange(t *testing.T) {
+	terms := make(chan int, 100)
+	raftcfg := Config{Join: true, OnTermChange: func(term int) { terms <- term }}
+	rf, err := MakeWithConfig(make([]*rpc.ClientEnd, 3), 1, MakePersister(), make(chan ApplyMsg, 100), raftcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Kill()
+
+	expect := func(term int) {
+		select {
+		case got := <-terms:
+			if got != term {
+				t.Fatalf("OnTermChange was called with term %d, want %d", got, term)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnTermChange was not called for term %d", term)
+		}
+		select {
+		case got := <-terms:
+			t.Fatalf("OnTermChange was called again, with term %d, after term %d", got, term)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	for term := 1; term <= 5; term++ {
+		rf.AppendEntries(&AppendEntriesArgs{Term: term, LeaderId: 0}, &AppendEntriesReply{})
+		expect(term)
+		rf.AppendEntries(&AppendEntriesArgs{Term: term, LeaderId: 0}, &AppendEntriesReply{})
+		rf.AppendEntries(&AppendEntriesArgs{Term: term - 1, LeaderId: 2}, &AppendEntriesReply{})
+		select {
+		case got := <-terms:
+			t.Fatalf("OnTermChange was called with term %d while the term stayed at %d", got, term)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	rf.AppendEntries(&AppendEntriesArgs{Term: 9, LeaderId: 2}, &AppendEntriesReply{})
+	expect(9)
+	if term := rf.CurrentTerm(); term != 9 {
+		t.Fatalf("follower is in term %d after OnTermChange reported 9", term)
+	}
+}
+
+// checkApplyQueue starts a lone follower, started with Join so that it never stands for
+// election, with an apply channel of capacity entries that nothing reads, and commits entries
+// to it by calling its AppendEntries handler directly. The depth ApplyQueue reports must follow
+// the number committed up to the capacity and stay there while more commit, and fall back to
+// zero once every entry has been read off the channel, in order.
+func checkApplyQueue(t *testing.T, capacity int) {
+	applyCh := make(chan ApplyMsg, capacity)
+	rf, err := MakeWithConfig(make([]*rpc.ClientEnd, 3), 1, MakePersister(), applyCh, Config{Join: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Kill()
+
+	waitDepth := func(want int) {
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			depth, c := rf.ApplyQueue()
+			if c != capacity {
+				t.Fatalf("ApplyQueue reported capacity %d, want %d", c, capacity)
+			}
+			if depth == want {
+				return
+			}
+			if time.Since(start) > time.Second {
+				t.Fatalf("ApplyQueue reported depth %d, want %d", depth, want)
+			}
+		}
+	}
+
+	var entries []LogEntry
+	for _, committed := range []int{capacity / 4, capacity / 2, capacity, 2 * capacity} {
+		prev := len(entries)
+		for len(entries) < committed {
+			entries = append(entries, LogEntry{Index: len(entries) + 1, Term: 1, Command: len(entries) + 1})
+		}
+		args := AppendEntriesArgs{Term: 1, LeaderId: 0, PrevLogIndex: prev, Entries: entries[prev:], LeaderCommit: committed}
+		if prev > 0 {
+			args.PrevLogTerm = 1
+		}
+		reply := AppendEntriesReply{}
+		rf.AppendEntries(&args, &reply)
+		if !reply.Success {
+			t.Fatalf("follower refused entries %d to %d", prev+1, committed)
+		}
+		want := committed
+		if want > capacity {
+			want = capacity
+		}
+		waitDepth(want)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitDepth(capacity)
+
+	for index := 1; index <= len(entries); index++ {
+		select {
+		case m := <-applyCh:
+			if m.CommandIndex != index {
+				t.Fatalf("applied index %d, want %d", m.CommandIndex, index)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("index %d was not applied once the channel drained", index)
+		}
+	}
+	waitDepth(0)
+}
+
+// checkTraceReplay serves a lone follower, started with Join so that it never stands for
+// election, on a network, and records an exchange with it through a ClientEnd: a vote request,
+// entries and a heartbeat from a leader, and an AppendEntries from a stale term. It saves the
+// trace, loads it back, and replays the same calls, in the same order, through a replay end
+// after the follower is killed and the network cleaned up. Every call must return what it
+// returned live, with the same reply; a call with arguments the trace does not hold must fail,
+// and Diverged report it.
+func checkTraceReplay(t *testing.T) {
+	net := rpc.MakeNetwork()
+	rf, err := MakeWithConfig(make([]*rpc.ClientEnd, 3), 1, MakePersister(), make(chan ApplyMsg, 100), Config{Join: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := rpc.MakeServer()
+	srv.AddService(rpc.MakeService(rf))
+	net.AddServer(1, srv)
+	end := net.MakeEnd("trace")
+	net.Connect("trace", 1)
+	net.Enable("trace", true)
+	trace := rpc.NewTrace()
+	end.Record(trace)
+
+	type call struct {
+		svcMeth string
+		args    interface{}
+		reply   func() interface{}
+	}
+	entries := []LogEntry{{Index: 1, Term: 2, Command: 101}, {Index: 2, Term: 2, Command: 102}}
+	calls := []call{
+		{"Raft.RequestVote", &RequestVoteArgs{Term: 2, CandidateId: 0}, func() interface{} { return &RequestVoteReply{} }},
+		{"Raft.AppendEntries", &AppendEntriesArgs{Term: 2, LeaderId: 0, Entries: entries, LeaderCommit: 1}, func() interface{} { return &AppendEntriesReply{} }},
+		{"Raft.AppendEntries", &AppendEntriesArgs{Term: 2, LeaderId: 0, PrevLogIndex: 2, PrevLogTerm: 2, LeaderCommit: 2}, func() interface{} { return &AppendEntriesReply{} }},
+		{"Raft.AppendEntries", &AppendEntriesArgs{Term: 1, LeaderId: 2}, func() interface{} { return &AppendEntriesReply{} }},
+	}
+	live := make([]interface{}, len(calls))
+	for k, c := range calls {
+		live[k] = c.reply()
+		if !end.Call(c.svcMeth, c.args, live[k]) {
+			t.Fatalf("live call %d to %s failed", k, c.svcMeth)
+		}
+	}
+	rf.Kill()
+	net.Cleanup()
+
+	var saved bytes.Buffer
+	if err := trace.Save(&saved); err != nil {
+		t.Fatalf("saving the trace: %v", err)
+	}
+	loaded, err := rpc.LoadTrace(&saved)
+	if err != nil {
+		t.Fatalf("loading the trace: %v", err)
+	}
+	if got := len(loaded.Entries()); got != len(calls) {
+		t.Fatalf("trace holds %d calls, want %d", got, len(calls))
+	}
+	replay := rpc.MakeReplayEnd(loaded)
+	for k, c := range calls {
+		reply := c.reply()
+		if !replay.Call(c.svcMeth, c.args, reply) {
+			t.Fatalf("replayed call %d to %s failed: %v", k, c.svcMeth, loaded.Diverged())
+		}
+		if !reflect.DeepEqual(reply, live[k]) {
+			t.Fatalf("replayed call %d to %s returned %+v, but %+v live", k, c.svcMeth, reply, live[k])
+		}
+	}
+	if err := loaded.Diverged(); err != nil {
+		t.Fatalf("replay of the recorded calls diverged: %v", err)
+	}
+	if replay.Call("Raft.AppendEntries", &AppendEntriesArgs{Term: 3, LeaderId: 2}, &AppendEntriesReply{}) {
+		t.Fatalf("a call the trace does not hold succeeded")
+	}
+	if loaded.Diverged() == nil {
+		t.Fatalf("Diverged reported nothing after a call the trace does not hold")
+	}
+}
+
+// checkHandlerFlood starts n servers with adaptive election timeouts, under which Run takes the
+// lock between heartbeats, and an RPCTimeout, cuts a follower off from the network, and for d has
+// flooders goroutines call its handlers directly with the leader's heartbeats, log probes and
+// vote requests, each of which signals Run. No call may take longer than the RPCTimeout, nor be
+// left blocked once the flood stops, and the flood alone must keep the follower from standing
+// for election. The follower must then rejoin the cluster.
+func checkHandlerFlood(t *testing.T, n int, flooders int, d time.Duration) {
+	cfg := make_config_with(t, n, false, Config{AdaptiveElectionTimeout: true, RPCTimeout: 100 * time.Millisecond})
+	defer cfg.cleanup()
+	cfg.one(1, n, true)
+	leader := cfg.checkOneLeader()
+	follower := (leader + 1) % n
+	cfg.disconnect(follower)
+	rf := cfg.rafts[follower]
+	term, _, _ := rf.GetState()
+	cfg.rafts[leader].mu.Lock()
+	lastIndex, lastTerm := cfg.rafts[leader].getLastLogIndex(), cfg.rafts[leader].getLastLogTerm()
+	cfg.rafts[leader].mu.Unlock()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var slowest time.Duration
+	for f := 0; f < flooders; f++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; ; k++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				switch k % 3 {
+				case 0:
+					args := &AppendEntriesArgs{Term: term, LeaderId: leader, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+					rf.AppendEntries(args, &AppendEntriesReply{})
+				case 1:
+					rf.ProbeLog(&ProbeLogArgs{Term: term, LeaderId: leader}, &ProbeLogReply{})
+				case 2:
+					// the leader asking again, so the vote is granted
+					args := &RequestVoteArgs{Term: term, CandidateId: leader, LastLogIndex: lastIndex, LastLogTerm: lastTerm}
+					rf.RequestVote(args, &RequestVoteReply{})
+				}
+				mu.Lock()
+				if took := time.Since(start); took > slowest {
+					slowest = took
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	time.Sleep(d)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(cfg.raftcfg.RPCTimeout):
+		t.Fatalf("the follower's handlers were still blocked %v after the flood stopped", cfg.raftcfg.RPCTimeout)
+	}
+	if slowest > cfg.raftcfg.RPCTimeout {
+		t.Fatalf("a handler took %v under the flood, longer than the RPCTimeout of %v", slowest, cfg.raftcfg.RPCTimeout)
+	}
+	if current, _, _ := rf.GetState(); current != term {
+		t.Fatalf("the follower stood for election, reaching term %d from %d, while flooded with heartbeats", current, term)
+	}
+
+	cfg.connect(follower)
+	cfg.one(2, n, true)
+}
+
+// electionsUnderJitter starts n servers with raftcfg on a network whose latency wanders up to
+// jitter, waits for a leader and then for warmup, and returns the cluster, still running, with
+// the number of elections its servers started over the following d.
+func electionsUnderJitter(t *testing.T, n int, raftcfg Config, jitter time.Duration, warmup time.Duration, d time.Duration) (*config, int64) {
+	cfg := make_config_with(t, n, false, raftcfg)
+	cfg.net.Jitter(jitter)
+	cfg.checkOneLeader()
+	time.Sleep(warmup)
+	elections := func() (total int64) {
+		for i := 0; i < cfg.n; i++ {
+			total += cfg.rafts[i].Metrics().Elections
+		}
+		return total
+	}
+	before := elections()
+	time.Sleep(d)
+	return cfg, elections() - before
+}
+
+// checkAdaptiveElectionTimeout runs a cluster with fixed election timeouts and then one with
+// adaptive timeouts on a network whose latency wanders up to jitter. Once the adaptive followers
+// have had warmup to observe the jitter, the adaptive cluster must start fewer elections over d
+// than the fixed one, whose leader is just as stable. It then disconnects the adaptive
+// cluster's leader and checks that another is elected within two MaxElectionTimeouts, which
+// leave room for one split vote, give or take the jitter of the election's messages.
+func checkAdaptiveElectionTimeout(t *testing.T, jitter time.Duration, warmup time.Duration, d time.Duration) {
+	fixed, baseline := electionsUnderJitter(t, 3, Config{}, jitter, warmup, d)
+	fixed.cleanup()
+	raftcfg := Config{AdaptiveElectionTimeout: true, MaxElectionTimeout: 2 * time.Second}
+	cfg, adaptive := electionsUnderJitter(t, 3, raftcfg, jitter, warmup, d)
+	defer cfg.cleanup()
+	if baseline == 0 {
+		t.Fatalf("a jitter of %v started no elections with fixed timeouts; nothing to improve on", jitter)
+	}
+	if adaptive >= baseline {
+		t.Fatalf("adaptive timeouts started %d elections in %v; fixed timeouts started %d", adaptive, d, baseline)
+	}
+
+	leader := cfg.checkOneLeader()
+	cfg.disconnect(leader)
+	bound := 2*raftcfg.MaxElectionTimeout + 2*jitter
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		elected := false
+		for i := 0; i < cfg.n; i++ {
+			if _, isLeader, _ := cfg.rafts[i].GetState(); i != leader && isLeader {
+				elected = true
+			}
+		}
+		if elected {
+			break
+		}
+		if time.Since(start) > bound {
+			t.Fatalf("no new leader within %v of disconnecting leader %d", bound, leader)
+		}
+	}
+}
+
+func (cfg *config) cleanup() {
+	for i := 0; i < len(cfg.rafts); i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].Kill()
+		}
+	}
+}
+
+// connect attaches a server to the network.
+func (cfg *config) connect(i int) {
+	// fmt.Printf("connect(%d)\n", i)
+
+	cfg.connected[i] = true
+
+	// outgoing ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.connected[j] {
+			endname := cfg.endnames[i][j]
+			cfg.net.Enable(endname, true)
+		}
+	}
+
+	// incoming ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.connected[j] {
+			endname := cfg.endnames[j][i]
+			cfg.net.Enable(endname, true)
+		}
+	}
+}
+
+// detach server i from the net.
+func (cfg *config) disconnect(i int) {
+	// fmt.Printf("disconnect(%d)\n", i)
+
+	cfg.connected[i] = false
+
+	// outgoing ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.endnames[i] != nil {
+			endname := cfg.endnames[i][j]
+			cfg.net.Enable(endname, false)
+		}
+	}
+
+	// incoming ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.endnames[j] != nil {
+			endname := cfg.endnames[j][i]
+			cfg.net.Enable(endname, false)
+		}
+	}
+}
+
+// partition splits the network into groups: every server is connected, but reaches only the
+// servers of its own group. Connecting every server again heals it.
+func (cfg *config) partition(groups ...[]int) {
+	group := make([]int, cfg.n)
+	for g, servers := range groups {
+		for _, i := range servers {
+			group[i] = g
+		}
+	}
+	for i := 0; i < cfg.n; i++ {
+		cfg.connected[i] = true
+		for j := 0; j < cfg.n; j++ {
+			cfg.net.Enable(cfg.endnames[i][j], group[i] == group[j])
 		}
 	}
 }
@@ -285,7 +3221,7 @@ func (cfg *config) checkOneLeader() int {
 		leaders := make(map[int][]int)
 		for i := 0; i < cfg.n; i++ {
 			if cfg.connected[i] {
-				if t, leader := cfg.rafts[i].GetState(); leader {
+				if t, leader, _ := cfg.rafts[i].GetState(); leader {
 					leaders[t] = append(leaders[t], i)
 				}
 			}
@@ -314,7 +3250,7 @@ func (cfg *config) checkTerms() int {
 	term := -1
 	for i := 0; i < cfg.n; i++ {
 		if cfg.connected[i] {
-			xterm, _ := cfg.rafts[i].GetState()
+			xterm, _, _ := cfg.rafts[i].GetState()
 			if term == -1 {
 				term = xterm
 			} else if term != xterm {
@@ -329,7 +3265,7 @@ func (cfg *config) checkTerms() int {
 func (cfg *config) checkNoLeader() {
 	for i := 0; i < cfg.n; i++ {
 		if cfg.connected[i] {
-			_, is_leader := cfg.rafts[i].GetState()
+			_, is_leader, _ := cfg.rafts[i].GetState()
 			if is_leader {
 				cfg.t.Fatalf("expected no leader, but %v claims to be leader", i)
 			}
@@ -376,7 +3312,7 @@ func (cfg *config) wait(index int, n int, startTerm int) interface{} {
 		}
 		if startTerm > -1 {
 			for _, r := range cfg.rafts {
-				if t, _ := r.GetState(); t > startTerm {
+				if t, _, _ := r.GetState(); t > startTerm {
 					// someone has moved on
 					// can no longer guarantee that we'll "win"
 					return -1
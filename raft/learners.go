@@ -0,0 +1,118 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// Learners are peers that receive the log without voting: the leader replicates to them as to
+// any follower, but they count toward neither the election nor the commit quorum, so a learner
+// that lags far behind, or is unreachable, never holds back a commit. Nor do they stand for
+// election, as they are not voters. A learner is added with AddLearner, by the same kind of
+// Membership entry as a voter, and made a voter with PromoteLearner once it has nearly caught
+// up, so a new peer can copy the log at its own pace before it counts toward quorums.
+
+// errors returned by PromoteLearner.
+var (
+	ErrNotLearner = errors.New("raft: server is not a learner")
+)
+
+// how far behind the leader's last log index a learner may be when PromoteLearner makes it a
+// voter; it then catches up as quickly as any follower that missed a few appends.
+const promoteLag = 16
+
+/*
+ * AddLearner adds the peer reached through peer to the cluster as a learner, and returns once
+ * the change is committed. The peer takes its index, and must be started, as for AddServer;
+ * it is not caught up first, as it does not count toward quorums. Fails as AddServer does,
+ * but never with ErrJoinTimeout.
+ */
+
+func (rf *Raft) AddLearner(peer *rpc.ClientEnd) error {
+	rf.mu.Lock()
+	if err := rf.canReconfigure(); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	id := len(rf.peers)
+	rf.growPeers(id + 1)
+	rf.peers[id] = peer
+	index, term, _ := rf.start(Membership{Voters: rf.voters, Learners: append(rf.learnerList(), id)})
+	rf.mu.Unlock()
+	return rf.awaitMembership(index, term, time.Now().Add(membershipTimeout))
+}
+
+/*
+ * PromoteLearner makes the learner with index id a voter, once its log is within promoteLag
+ * entries of the leader's, and returns when the change is committed.
+ * Returns ErrNotLearner if id is not a learner, ErrJoinTimeout if it does not catch up within
+ * membershipTimeout, and otherwise fails as AddServer does.
+ */
+
+func (rf *Raft) PromoteLearner(id int) error {
+	rf.mu.Lock()
+	if err := rf.canReconfigure(); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	term := rf.currentTerm
+	rf.mu.Unlock()
+
+	deadline := time.Now().Add(membershipTimeout)
+	for {
+		rf.mu.Lock()
+		if rf.state != STATE_LEADER || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		if !rf.learners[id] {
+			rf.mu.Unlock()
+			return ErrNotLearner
+		}
+		if !rf.ackedAt[id].IsZero() && rf.matchIndex[id] >= rf.getLastLogIndex()-promoteLag {
+			// another change may have started while the learner caught up
+			if err := rf.canReconfigure(); err != nil {
+				rf.mu.Unlock()
+				return err
+			}
+			voters := append([]int{id}, rf.voters...)
+			sort.Ints(voters)
+			index, _, _ := rf.start(Membership{Voters: voters, Learners: without(rf.learnerList(), id)})
+			rf.mu.Unlock()
+			return rf.awaitMembership(index, term, deadline)
+		}
+		rf.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return ErrJoinTimeout
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+/*
+ * Learners returns the indexes of the learners, in increasing order, as far as this peer knows.
+ */
+
+func (rf *Raft) Learners() []int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.learnerList()
+}
+
+/*
+ * Return the learners in increasing order.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) learnerList() []int {
+	learners := make([]int, 0, len(rf.learners))
+	for l := range rf.learners {
+		learners = append(learners, l)
+	}
+	sort.Ints(learners)
+	return learners
+}
@@ -0,0 +1,57 @@
+package raft
+
+import "reflect"
+
+// LogSnapshot returns a copy of the peer's log. Its first entry stands for the last entry
+// covered by the latest snapshot, or for the empty log's index 0: only its index and term are
+// meaningful. The entries after it are the log proper, committed or not.
+func (rf *Raft) LogSnapshot() []LogEntry {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return append([]LogEntry(nil), rf.log...)
+}
+
+// FirstLogIndex returns the index of the first entry of the peer's log: the last index covered
+// by the latest snapshot, or 0 if the peer has none. Entries before it were compacted away, and
+// of the entry at it only the term is kept.
+func (rf *Raft) FirstLogIndex() int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.log[0].Index
+}
+
+// GetAtIndex returns the entry at index in the peer's log, committed or not. ok is false if the
+// index was compacted into a snapshot, below FirstLogIndex, or is past the end of the log. At
+// FirstLogIndex itself only the entry's index and term are meaningful.
+func (rf *Raft) GetAtIndex(index int) (entry LogEntry, ok bool) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	base := rf.log[0].Index
+	if index < base || index > rf.getLastLogIndex() {
+		return LogEntry{}, false
+	}
+	return rf.log[index-base], true
+}
+
+// DiffLogs compares two logs taken with LogSnapshot, possibly from peers that compacted them
+// to different points, and returns the first index at which they differ: the first index both
+// hold with a different term or command, or else the first index only one of them holds. The
+// entries each log begins with are compared by term only, as their commands were compacted
+// away, and indexes both logs have compacted are taken to agree. differ is false, and index
+// -1, if the logs agree on every index either holds.
+func DiffLogs(a []LogEntry, b []LogEntry) (index int, differ bool) {
+	lastA, lastB := a[len(a)-1].Index, b[len(b)-1].Index
+	for index = max(a[0].Index, b[0].Index); index <= min(lastA, lastB); index++ {
+		ea, eb := a[index-a[0].Index], b[index-b[0].Index]
+		if ea.Term != eb.Term {
+			return index, true
+		}
+		if index != a[0].Index && index != b[0].Index && !reflect.DeepEqual(ea.Command, eb.Command) {
+			return index, true
+		}
+	}
+	if lastA != lastB {
+		return min(lastA, lastB) + 1, true
+	}
+	return -1, false
+}
@@ -0,0 +1,353 @@
+package raft
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// Single-server membership changes. The peers that vote, and count toward the election and
+// commit quorums, are the voters of the latest Membership entry a peer knows to be committed,
+// or every peer it was started with while there is none. AddServer has the leader first catch
+// the new peer up as a replica that does not vote, so it cannot hold back commits while it
+// copies the log, and only then append an entry adding it; RemoveServer appends one without
+// the peer. A peer adopts the new voters when it learns the entry is committed, updating its
+// peer list and the leader's per-peer state together under its lock. Only one change may be
+// uncommitted at a time, so the quorums of consecutive configurations always overlap.
+//
+// Peers are known by their index, which never changes: a new peer takes the next index after
+// every peer the leader knows, and a removed peer's index is not reused. A failed AddServer
+// leaves its index outside the configuration, and the next AddServer takes it again, so that
+// a retry adds the server that was started with it. The new server is
+// started with Config.Join, and every peer needs Config.PeerEnd to reach the peers added
+// after it started. The configuration is persisted with the log, and sent along with a
+// snapshot, as the entry that set it may have been compacted. A peer outside the configuration never
+// stands for election, and voters refuse candidates outside theirs, so a removed peer that
+// missed its removal cannot disrupt the cluster.
+
+// Membership is the command of a configuration entry: the peers, by index, that vote once the
+// entry is committed, and the learners, which receive the log without voting; see learners.go.
+// Like any command it is delivered on applyCh, so that the service sees every index; it has
+// nothing for the service to apply.
+type Membership struct {
+	Voters   []int
+	Learners []int
+}
+
+// IsConfigChange makes an uncommitted Membership entry a configuration change, for
+// Config.ReconfigPolicy.
+func (Membership) IsConfigChange() bool {
+	return true
+}
+
+// errors returned by AddServer and RemoveServer.
+var (
+	ErrFixedQuorum   = errors.New("raft: membership changes need majority quorums")
+	ErrNotVoter      = errors.New("raft: server is not a voter")
+	ErrLastVoter     = errors.New("raft: cannot remove the last voter")
+	ErrJoinTimeout   = errors.New("raft: new server did not catch up in time")
+	ErrChangeTimeout = errors.New("raft: membership change did not commit in time")
+)
+
+// how long AddServer waits for the new server to catch up, and a change to commit.
+const membershipTimeout = 5 * time.Second
+
+/*
+ * AddServer adds the peer reached through peer to the cluster, as a voter, and returns once
+ * the change is committed. The peer takes the next index after every peer the leader knows,
+ * which is len(peers) on a cluster that has not changed, or the index an earlier AddServer on
+ * this leader failed to add, and must be started with that index and Config.Join. The leader replicates its log to it until it holds every committed entry,
+ * and only then appends the entry that makes it a voter.
+ * Returns ErrNotLeader if this peer is not the leader or loses leadership meanwhile,
+ * ErrReconfiguring while another change is under way or until the leader has committed an
+ * entry of its term, ErrJoinTimeout if the peer does not catch up, and ErrChangeTimeout if
+ * the change does not commit, within membershipTimeout.
+ */
+
+func (rf *Raft) AddServer(peer *rpc.ClientEnd) (err error) {
+	rf.mu.Lock()
+	if err := rf.canReconfigure(); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	id := rf.abandoned
+	// no change is uncommitted, so one that added the abandoned peer after all has committed
+	if id < 0 || rf.isVoter(id) || rf.learners[id] {
+		id = len(rf.peers)
+		rf.growPeers(id + 1)
+	} else {
+		rf.resetPeer(id)
+	}
+	rf.abandoned = -1
+	rf.peers[id] = peer
+	rf.joining = id
+	term := rf.currentTerm
+	rf.mu.Unlock()
+
+	defer func() {
+		rf.mu.Lock()
+		if rf.joining == id {
+			rf.joining = -1
+		}
+		if err != nil {
+			rf.abandoned = id
+		}
+		rf.mu.Unlock()
+	}()
+	deadline := time.Now().Add(membershipTimeout)
+	for {
+		rf.mu.Lock()
+		if rf.state != STATE_LEADER || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		// the peer has answered, and holds every entry committed so far
+		if !rf.ackedAt[id].IsZero() && rf.matchIndex[id] >= rf.commitIndex {
+			voters := append([]int{id}, rf.voters...)
+			sort.Ints(voters)
+			index, _, _ := rf.start(Membership{Voters: voters, Learners: rf.learnerList()})
+			rf.mu.Unlock()
+			return rf.awaitMembership(index, term, deadline)
+		}
+		rf.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return ErrJoinTimeout
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+/*
+ * RemoveServer removes the peer with index id from the voters, or from the learners, and
+ * returns once the change is committed. The leader may remove itself: it steps down once the
+ * change commits, and the remaining voters elect a new leader. Returns ErrNotVoter if id is
+ * neither a voter nor a learner, ErrLastVoter if it is the only voter, and otherwise fails as
+ * AddServer does.
+ */
+
+func (rf *Raft) RemoveServer(id int) error {
+	rf.mu.Lock()
+	if err := rf.canReconfigure(); err != nil {
+		rf.mu.Unlock()
+		return err
+	}
+	if rf.learners[id] {
+		m := Membership{Voters: rf.voters, Learners: without(rf.learnerList(), id)}
+		index, term, _ := rf.start(m)
+		rf.mu.Unlock()
+		return rf.awaitMembership(index, term, time.Now().Add(membershipTimeout))
+	}
+	if !rf.isVoter(id) {
+		rf.mu.Unlock()
+		return ErrNotVoter
+	}
+	if len(rf.voters) == 1 {
+		rf.mu.Unlock()
+		return ErrLastVoter
+	}
+	index, term, _ := rf.start(Membership{Voters: without(rf.voters, id), Learners: rf.learnerList()})
+	rf.mu.Unlock()
+	return rf.awaitMembership(index, term, time.Now().Add(membershipTimeout))
+}
+
+/*
+ * Report why the leader cannot start a membership change now, if it cannot.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) canReconfigure() error {
+	switch {
+	case rf.state != STATE_LEADER || rf.paused:
+		return ErrNotLeader
+	case rf.cfg.ElectionQuorum > 0 || rf.cfg.CommitQuorum > 0:
+		return ErrFixedQuorum
+	case rf.transferring:
+		return ErrTransferring
+	case rf.joining >= 0 || rf.reconfiguring():
+		return ErrReconfiguring
+	case rf.log[rf.commitIndex-rf.log[0].Index].Term != rf.currentTerm:
+		// until the leader commits an entry of its own term, a change a previous leader left
+		// uncommitted may yet commit, and the two would not share a quorum
+		return ErrReconfiguring
+	}
+	return nil
+}
+
+/*
+ * Wait until the Membership entry the leader appended at index in term is committed.
+ */
+
+func (rf *Raft) awaitMembership(index int, term int, deadline time.Time) error {
+	for {
+		rf.mu.Lock()
+		// checked first, since a leader that removed itself steps down as the entry commits
+		committed := rf.votersIndex >= index && rf.currentTerm == term
+		steppedDown := rf.state != STATE_LEADER || rf.currentTerm != term
+		rf.mu.Unlock()
+
+		switch {
+		case committed:
+			return nil
+		case steppedDown:
+			return ErrNotLeader
+		case time.Now().After(deadline):
+			return ErrChangeTimeout
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+/*
+ * Voters returns the indexes of the peers that vote, in increasing order, as far as this peer
+ * knows. It is empty on a peer started with Config.Join until it learns the configuration.
+ */
+
+func (rf *Raft) Voters() []int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return append([]int(nil), rf.voters...)
+}
+
+/*
+ * Report whether server votes in this peer's configuration.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) isVoter(server int) bool {
+	i := sort.SearchInts(rf.voters, server)
+	return i < len(rf.voters) && rf.voters[i] == server
+}
+
+/*
+ * Return the other voters, to which a candidate sends RequestVote.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) otherVoters() []int {
+	return without(rf.voters, rf.me)
+}
+
+/*
+ * Return the peers the leader replicates its log to: the other voters, the learners, and the
+ * peer AddServer is catching up.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) replicas() []int {
+	replicas := append(rf.otherVoters(), rf.learnerList()...)
+	if rf.joining >= 0 {
+		replicas = append(replicas, rf.joining)
+	}
+	return replicas
+}
+
+/*
+ * Adopt the voters of the last Membership entry in (from, to], just committed.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) applyMembership(from int, to int) {
+	baseIndex := rf.log[0].Index
+	for i := to; i > max(from, baseIndex); i-- {
+		if m, ok := rf.log[i-baseIndex].Command.(Membership); ok {
+			if i > rf.votersIndex {
+				rf.setMembership(m, i)
+			}
+			return
+		}
+	}
+}
+
+/*
+ * Switch to the configuration set by the entry at index, reaching any peer it has no end for
+ * through cfg.PeerEnd. A leader that is no longer a voter steps down.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) setMembership(m Membership, index int) {
+	rf.voters = append([]int(nil), m.Voters...)
+	sort.Ints(rf.voters)
+	rf.learners = make(map[int]bool, len(m.Learners))
+	for _, l := range m.Learners {
+		rf.learners[l] = true
+	}
+	rf.votersIndex = index
+	rf.dirty = true
+
+	for _, v := range append(append([]int(nil), rf.voters...), m.Learners...) {
+		if v >= len(rf.peers) {
+			rf.growPeers(v + 1)
+		}
+		// the leader adding v already has the end it was given
+		if v != rf.me && rf.peers[v] == nil && rf.cfg.PeerEnd != nil {
+			rf.peers[v] = rf.cfg.PeerEnd(v)
+		}
+	}
+	if rf.state == STATE_LEADER && !rf.isVoter(rf.me) {
+		rf.state = STATE_FOLLOWER
+		rf.leaderId = -1
+	}
+}
+
+/*
+ * Extend the per-peer state to n peers, and start the senders of the new ones. Their ends
+ * are nil until set.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) growPeers(n int) {
+	// copied, rather than appended to, so as not to write to the caller's array
+	peers := make([]*rpc.ClientEnd, len(rf.peers), n)
+	copy(peers, rf.peers)
+	rf.peers = peers
+	for server := len(rf.peers); server < n; server++ {
+		rf.peers = append(rf.peers, nil)
+		rf.wake = append(rf.wake, make(chan struct{}, 1))
+		rf.busy = append(rf.busy, 0)
+		rf.rejections = append(rf.rejections, 0)
+		rf.snapshotWanted = append(rf.snapshotWanted, false)
+		rf.snapshotSent = append(rf.snapshotSent, snapshotProgress{})
+		// the leader's state is only extended if it has been made, for a term led
+		if rf.nextIndex != nil {
+			rf.nextIndex = append(rf.nextIndex, rf.getLastLogIndex()+1)
+			rf.matchIndex = append(rf.matchIndex, 0)
+			rf.ackedAt = append(rf.ackedAt, time.Time{})
+		}
+		for i := 0; i < rf.cfg.sendersPerPeer(); i++ {
+			go rf.sender(server)
+		}
+	}
+}
+
+/*
+ * Forget what the leader knows of server, so that a new peer can take its index.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) resetPeer(server int) {
+	rf.rejections[server] = 0
+	rf.snapshotWanted[server] = false
+	rf.snapshotSent[server] = snapshotProgress{}
+	if rf.nextIndex != nil {
+		rf.nextIndex[server] = rf.getLastLogIndex() + 1
+		rf.matchIndex[server] = 0
+		rf.ackedAt[server] = time.Time{}
+	}
+}
+
+/*
+ * Return servers, in order, without server.
+ */
+
+func without(servers []int, server int) []int {
+	rest := make([]int, 0, len(servers))
+	for _, s := range servers {
+		if s != server {
+			rest = append(rest, s)
+		}
+	}
+	return rest
+}
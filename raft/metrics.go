@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+)
+
+// Metrics is a point-in-time copy of a peer's counters, as returned by Raft.Metrics.
+// Counters only ever grow over the lifetime of the peer.
+type Metrics struct {
+	Heartbeats        int64 // AppendEntries sent as leader without log entries
+	AppendEntries     int64 // AppendEntries sent as leader carrying log entries
+	EntriesReplicated int64 // log entries acknowledged by followers
+	BytesReplicated   int64 // encoded size of the log entries acknowledged by followers
+	AppendRejections  int64 // AppendEntries rejected by followers for a log mismatch
+	Elections         int64 // elections started as candidate
+	SnapshotFallbacks int64 // InstallSnapshot sent to a follower that kept rejecting or asked for it
+	SnapshotChunks    int64 // InstallSnapshot sent as leader, one per chunk of a snapshot sent in parts
+	SnapshotBytes     int64 // snapshot bytes sent in InstallSnapshot as leader
+	SkippedRounds     int64 // heartbeat rounds that found every sender to a follower busy
+
+	TornStateRecoveries int64 // restarts that found the log trimmed past the snapshot and dropped it
+	Persists            int64 // times the persistent state was encoded and saved
+
+	VotesRequested       int64 // RequestVote sent as candidate
+	VoteRequestsReceived int64 // RequestVote received as voter
+	VotesGranted         int64 // votes granted as voter
+	VotesRejected        int64 // votes refused as voter
+}
+
+// Metrics returns a copy of the peer's current counters.
+func (rf *Raft) Metrics() Metrics {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.metrics
+}
+
+// ApplyQueue returns the number of messages waiting in the apply channel and its buffer size.
+// When the depth reaches the capacity, applying blocks until the service catches up.
+func (rf *Raft) ApplyQueue() (depth int, capacity int) {
+	return len(rf.chanApply), cap(rf.chanApply)
+}
+
+// SenderLoad returns the number of sender goroutines waiting on an RPC to follower, and the
+// number the peer runs per follower, Config.MaxInflightAppends. A follower whose senders are all
+// busy is slow or unreachable, and heartbeat rounds skip it until one is free. With no limit,
+// senders is 0 and busy counts every round still waiting on the follower.
+func (rf *Raft) SenderLoad(follower int) (busy int, senders int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.busy[follower], rf.cfg.sendersPerPeer()
+}
+
+// WriteMetrics writes the peer's state and counters to w in the Prometheus text exposition
+// format, every sample labelled with the peer's index, so that operators can scrape a peer
+// directly. The leader also reports the match index of each follower.
+func (rf *Raft) WriteMetrics(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	peer := fmt.Sprintf(`peer="%d"`, rf.me)
+
+	rf.mu.Lock()
+	isLeader := int64(0)
+	if rf.state == STATE_LEADER && !rf.paused {
+		isLeader = 1
+	}
+	writeMetric(buf, "sentinel_raft_term", "gauge", "Current term of the peer.", peer, int64(rf.currentTerm))
+	writeMetric(buf, "sentinel_raft_is_leader", "gauge", "Whether the peer believes it is the leader.", peer, isLeader)
+	writeMetric(buf, "sentinel_raft_commit_index", "gauge", "Highest log index known to be committed.", peer, int64(rf.commitIndex))
+	writeMetric(buf, "sentinel_raft_last_applied", "gauge", "Highest log index delivered to the service.", peer, int64(rf.lastApplied))
+	writeMetric(buf, "sentinel_raft_elections_total", "counter", "Elections started as candidate.", peer, rf.metrics.Elections)
+	writeMetric(buf, "sentinel_raft_heartbeats_total", "counter", "AppendEntries sent as leader without log entries.", peer, rf.metrics.Heartbeats)
+	writeMetric(buf, "sentinel_raft_append_entries_total", "counter", "AppendEntries sent as leader carrying log entries.", peer, rf.metrics.AppendEntries)
+	writeMetric(buf, "sentinel_raft_entries_replicated_total", "counter", "Log entries acknowledged by followers.", peer, rf.metrics.EntriesReplicated)
+	writeMetric(buf, "sentinel_raft_bytes_replicated_total", "counter", "Encoded bytes of log entries acknowledged by followers.", peer, rf.metrics.BytesReplicated)
+	writeMetric(buf, "sentinel_raft_append_rejections_total", "counter", "AppendEntries rejected by followers for a log mismatch.", peer, rf.metrics.AppendRejections)
+	writeMetric(buf, "sentinel_raft_snapshot_fallbacks_total", "counter", "Snapshots sent to followers that kept rejecting AppendEntries or asked for one.", peer, rf.metrics.SnapshotFallbacks)
+	writeMetric(buf, "sentinel_raft_snapshot_chunks_total", "counter", "InstallSnapshot sent as leader, one per chunk.", peer, rf.metrics.SnapshotChunks)
+	writeMetric(buf, "sentinel_raft_snapshot_bytes_total", "counter", "Snapshot bytes sent in InstallSnapshot as leader.", peer, rf.metrics.SnapshotBytes)
+	writeMetric(buf, "sentinel_raft_skipped_rounds_total", "counter", "Heartbeat rounds that found every sender to a follower busy.", peer, rf.metrics.SkippedRounds)
+	writeMetric(buf, "sentinel_raft_torn_state_recoveries_total", "counter", "Restarts that found the log trimmed past the snapshot.", peer, rf.metrics.TornStateRecoveries)
+	writeMetric(buf, "sentinel_raft_persists_total", "counter", "Times the persistent state was encoded and saved.", peer, rf.metrics.Persists)
+	writeMetric(buf, "sentinel_raft_votes_requested_total", "counter", "RequestVote sent as candidate.", peer, rf.metrics.VotesRequested)
+	writeMetric(buf, "sentinel_raft_vote_requests_received_total", "counter", "RequestVote received as voter.", peer, rf.metrics.VoteRequestsReceived)
+	writeMetric(buf, "sentinel_raft_votes_granted_total", "counter", "Votes granted as voter.", peer, rf.metrics.VotesGranted)
+	writeMetric(buf, "sentinel_raft_votes_rejected_total", "counter", "Votes refused as voter.", peer, rf.metrics.VotesRejected)
+	if isLeader == 1 {
+		fmt.Fprintf(buf, "# HELP sentinel_raft_match_index Highest log index known to be stored on each follower.\n")
+		fmt.Fprintf(buf, "# TYPE sentinel_raft_match_index gauge\n")
+		for i := range rf.peers {
+			if i != rf.me {
+				fmt.Fprintf(buf, "sentinel_raft_match_index{%s,follower=\"%d\"} %d\n", peer, i, rf.matchIndex[i])
+			}
+		}
+	}
+	rf.mu.Unlock()
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeMetric writes a metric with a single sample in the Prometheus text exposition format.
+func writeMetric(buf *bytes.Buffer, name string, kind string, help string, labels string, value int64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %d\n", name, help, name, kind, name, labels, value)
+}
+
+// entriesSize returns the encoded size of entries, as they would be sent over RPC.
+func entriesSize(entries []LogEntry) int {
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(entries)
+	return w.Len()
+}
@@ -0,0 +1,343 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ReshiAdavan/Sentinel/rpc"
+)
+
+// Config holds the tunable parameters of a Raft peer.
+// The zero value of every field selects the default behaviour, so MakeWithConfig with
+// an empty Config is equivalent to Make.
+type Config struct {
+	// SnapshotRateLimit caps the rate, in bytes per second, at which the leader sends
+	// InstallSnapshot data to its followers. A limited leader splits its snapshot into chunks of
+	// one heartbeat interval's worth of the rate, sends each follower at most one chunk per
+	// heartbeat round, and holds back a chunk that would take the leader over the rate, sending
+	// an empty AppendEntries in its place so that the follower's election timer does not fire.
+	// Zero means unlimited, and every snapshot goes out whole.
+	SnapshotRateLimit int
+
+	// ElectionQuorum and CommitQuorum are the number of peers, counting the candidate or
+	// leader itself, that must grant a vote or store an entry before an election is won or
+	// the entry is committed. Zero means a strict majority. Flexible quorums are safe as long
+	// as every election quorum intersects every commit quorum (ElectionQuorum + CommitQuorum
+	// exceeds the cluster size) and any two election quorums intersect, so that a term can
+	// still have at most one leader.
+	ElectionQuorum int
+	CommitQuorum   int
+
+	// MaxInflightAppends, if positive, is the number of goroutines a peer runs, per follower, to
+	// send its AppendEntries and InstallSnapshot when it leads, and so caps the RPCs it keeps
+	// outstanding to any single follower. A heartbeat round wakes a free sender, which builds the
+	// message from the leader's state when it sends it; rounds that find every sender busy are
+	// skipped, so a slow follower neither piles up overlapping RPCs carrying the same entries nor
+	// ties up more goroutines as rounds go by. Zero leaves it unlimited: every round sends from a
+	// goroutine of its own, however many earlier ones are still waiting on the follower.
+	MaxInflightAppends int
+
+	// SnapshotAfterRejections, if positive, makes the leader send its snapshot to a follower that
+	// has rejected that many AppendEntries in a row for a log mismatch, even though the entries it
+	// needs are still in the log. A badly diverged follower then catches up in one transfer rather
+	// than one rejected round trip per term of divergence. Zero sends a snapshot only when the
+	// follower needs entries the log no longer has.
+	SnapshotAfterRejections int
+
+	// ProbeOnElection makes a newly elected leader ask every follower for its last log index
+	// and term in one parallel round, and start nextIndex from the answers instead of from the
+	// end of its own log. Divergent followers then converge without walking nextIndex back one
+	// rejected AppendEntries at a time.
+	ProbeOnElection bool
+
+	// ElectionSeed seeds the peer's own source of randomized election timeouts, combined with
+	// the peer's index so that peers sharing a seed still draw different timeouts. A fixed seed
+	// makes the sequence of timeouts reproducible across runs. Zero seeds from the clock.
+	ElectionSeed int64
+
+	// HeartbeatPolicy chooses which AppendEntries reset a follower's election timer. The zero
+	// value, HeartbeatAny, resets it for every AppendEntries of the follower's term or later.
+	// HeartbeatUpToDate resets it only for one from a leader whose log is at least as up to date
+	// as the follower's, by the rule votes are granted by, so that a stale leader still at the
+	// follower's term cannot keep an up-to-date follower from standing for election. A leader
+	// elected without entries the follower holds, which has yet to replicate one of its own, is
+	// then ignored too and may see the follower stand for election: that costs an election, not
+	// safety.
+	HeartbeatPolicy HeartbeatPolicy
+
+	// HeartbeatInterval is how often the leader sends AppendEntries to every follower, and a
+	// follower that hears nothing stands for election after a timeout drawn at random between
+	// ElectionTimeoutMin and ElectionTimeoutMax. Zero means 60 milliseconds, 200 milliseconds,
+	// and two and a half times ElectionTimeoutMin respectively. On a high-latency network all
+	// three must grow with the round-trip time, keeping the heartbeat interval at most a third
+	// of the minimum election timeout, so that a follower times out only after missing several
+	// heartbeats in a row.
+	HeartbeatInterval  time.Duration
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+
+	// AdaptiveElectionTimeout makes a follower fit its election timeout to the heartbeats it
+	// receives from its leader, rather than drawing it between ElectionTimeoutMin and
+	// ElectionTimeoutMax. The follower records the gaps between recent heartbeats and draws its
+	// timeout from a range two and a half times as long as it starts, starting at half as long
+	// again as the longest gap, or at ElectionTimeoutMin if that is longer. On a steady network
+	// that is the default range; on a jittery one, late heartbeats rarely start an election.
+	// MaxElectionTimeout bounds the timeouts drawn, and so how long a leader failure can go
+	// unnoticed. Zero means seven and a half times ElectionTimeoutMin, 1.5 seconds by default.
+	AdaptiveElectionTimeout bool
+	MaxElectionTimeout      time.Duration
+
+	// PreVote makes a peer whose election timer fires ask its peers, in a RequestPreVote round
+	// that changes no one's term, whether a quorum would vote for it, and stand for election
+	// only if so. A peer grants a pre-vote only if it has not heard from a leader within the
+	// minimum election timeout and the candidate's log is up to date. A partitioned follower
+	// then does not inflate its term, and cannot depose a stable leader when it rejoins. The
+	// pre-vote is volatile state only, and elections started by TimeoutNow skip it.
+	PreVote bool
+
+	// MaxUncommittedEntries caps how far the leader's log may run ahead of its commit index.
+	// Once the gap reaches the cap, TryStart reports the leader as busy instead of appending,
+	// so a service can shed load rather than grow the log and replication lag without bound.
+	// Start is not limited. Zero means unlimited.
+	MaxUncommittedEntries int
+
+	// PersistCommitIndex saves the commit index along with the rest of the persistent state,
+	// so a restarted peer knows at once how far its log is committed and hands those entries to
+	// the service right away, rather than waiting for a leader to tell it again, or for good if
+	// it restarts cut off from the cluster. It does not spare the service re-applying them: Raft
+	// cannot tell how much of the log the service's state still reflects after a crash, so a
+	// restarted peer delivers its snapshot and then every committed entry after it, with or
+	// without the option, and only the entries the snapshot covers are never re-delivered. A
+	// service that wants fewer entries re-applied on restart must snapshot more often. The
+	// commit index is saved together with the log, so it is never ahead of the durable log.
+	PersistCommitIndex bool
+
+	// CoalescePersist has the RequestVote and AppendEntries handlers, and the candidate handling
+	// a vote, save the persistent state at most once per call, and only if they changed it,
+	// rather than re-encoding it on every call: a heartbeat that changes nothing then costs no
+	// encoding at all. The state is still saved before the reply is sent, so a peer never
+	// acknowledges anything it has not made durable.
+	CoalescePersist bool
+
+	// OnTermChange, if set, is called with the new term each time this peer's term advances,
+	// e.g. to fence external resources against stale leaders using the term as a token. It runs
+	// on its own goroutine, outside the peer's lock, and always sees increasing terms; advances
+	// that happen while a call is still running are coalesced into one call with the latest term.
+	OnTermChange func(term int)
+
+	// OnVote, if set, is called with every step of every election this peer takes part in:
+	// each RequestVote it sends as a candidate, and each one it receives as a voter, with the
+	// vote it granted or the reason it refused, so that operators can tell why elections fail
+	// to converge. Like OnTermChange it runs on its own goroutine, outside the peer's lock, but
+	// every event is delivered, in the order the peer recorded them.
+	OnVote func(event VoteEvent)
+
+	// ReconfigPolicy chooses what TryStart does with a command while a configuration change
+	// is in the leader's log but not yet committed. Start is not affected. The zero value,
+	// ReconfigAllow, appends the command as usual.
+	ReconfigPolicy ReconfigPolicy
+
+	// LeaseDuration enables leader leases for LeaseRead. A leader holds its lease for this long
+	// from the moment it sent the latest AppendEntries acknowledged by a commit quorum, and a
+	// follower that has heard from its leader within the minimum election timeout refuses to
+	// vote for anyone else, so no other leader can be elected while the lease lasts. Safety rests
+	// on bounded clock drift: the duration must be shorter than the minimum election timeout,
+	// with a margin for the drift between peers' clocks. Zero disables leases.
+	LeaseDuration time.Duration
+
+	// LeaseMissedRounds is the number of heartbeat rounds in a row a commit quorum may fail to
+	// acknowledge without the lease lapsing, so that reads stay local through brief message
+	// loss. The lease is renewed by any acknowledgement in the leader's term, so it outlasts
+	// that many lost rounds only if LeaseDuration exceeds LeaseMissedRounds+1 heartbeat
+	// intervals; as LeaseDuration must stay below the minimum election timeout, at most two
+	// rounds can be tolerated with the default timeouts. Zero puts no lower bound on
+	// LeaseDuration.
+	LeaseMissedRounds int
+
+	// RPCTimeout bounds how long a peer waits for the reply to any RPC but InstallSnapshot, and
+	// SnapshotTimeout how long the leader waits for a follower to take a snapshot, which may
+	// take far longer than a heartbeat. A call that times out counts as lost. Zero waits as
+	// long as the transport does; the simulated network always returns eventually, but a real
+	// transport may not.
+	RPCTimeout      time.Duration
+	SnapshotTimeout time.Duration
+
+	// StrictCommands makes Start and TryStart check every command with
+	// gobWrapper.ValidateEncodable before appending it, so a command that would persist as bytes
+	// that fail to decode on restart is caught when it is started rather than after a crash.
+	// Start logs the error and refuses such a command as if it were not the leader; TryStart
+	// returns the error. Neither appends it. The check
+	// encodes each command an extra time, so it is meant for debugging and tests.
+	StrictCommands bool
+
+	// Join starts a peer that is being added to a running cluster by AddServer. It starts with
+	// no voters, so it never stands for election, and learns the configuration from the leader.
+	Join bool
+
+	// PeerEnd returns the end through which to reach the peer with the given index, for the
+	// peers a membership change adds after this one started. Without it, such a peer can only
+	// be reached by the leader that added it with AddServer.
+	PeerEnd func(server int) *rpc.ClientEnd
+}
+
+// ReconfigPolicy is the behaviour of TryStart during an uncommitted configuration change.
+type ReconfigPolicy int
+
+const (
+	ReconfigAllow  ReconfigPolicy = iota // append the command as usual
+	ReconfigReject                       // refuse the command with ErrReconfiguring
+	ReconfigQueue                        // hold the command until the change commits, then append it
+)
+
+// HeartbeatPolicy is how strictly a follower decides that an AppendEntries comes from a leader
+// worth following, and so resets its election timer.
+type HeartbeatPolicy int
+
+const (
+	HeartbeatAny      HeartbeatPolicy = iota // any AppendEntries of the follower's term or later
+	HeartbeatUpToDate                        // only those from a leader whose log is not behind the follower's
+)
+
+// ConfigChange is implemented by commands that change the cluster's configuration.
+// While such a command is in the leader's log past its commit index, the leader is
+// reconfiguring and TryStart applies Config.ReconfigPolicy to every new command,
+// including further configuration changes.
+type ConfigChange interface {
+	IsConfigChange() bool
+}
+
+// validate reports the first invalid setting in the configuration, if any,
+// for a cluster of npeers peers.
+func (cfg Config) validate(npeers int) error {
+	if cfg.SnapshotRateLimit < 0 {
+		return fmt.Errorf("raft: SnapshotRateLimit must not be negative, got %d", cfg.SnapshotRateLimit)
+	}
+	if cfg.ElectionQuorum < 0 || cfg.ElectionQuorum > npeers {
+		return fmt.Errorf("raft: ElectionQuorum must be between 0 and %d, got %d", npeers, cfg.ElectionQuorum)
+	}
+	if cfg.CommitQuorum < 0 || cfg.CommitQuorum > npeers {
+		return fmt.Errorf("raft: CommitQuorum must be between 0 and %d, got %d", npeers, cfg.CommitQuorum)
+	}
+	if cfg.MaxInflightAppends < 0 {
+		return fmt.Errorf("raft: MaxInflightAppends must not be negative, got %d", cfg.MaxInflightAppends)
+	}
+	if cfg.SnapshotAfterRejections < 0 {
+		return fmt.Errorf("raft: SnapshotAfterRejections must not be negative, got %d", cfg.SnapshotAfterRejections)
+	}
+	if cfg.MaxUncommittedEntries < 0 {
+		return fmt.Errorf("raft: MaxUncommittedEntries must not be negative, got %d", cfg.MaxUncommittedEntries)
+	}
+	if cfg.HeartbeatInterval < 0 || cfg.ElectionTimeoutMin < 0 || cfg.ElectionTimeoutMax < 0 {
+		return fmt.Errorf("raft: HeartbeatInterval, ElectionTimeoutMin and ElectionTimeoutMax must not be negative")
+	}
+	if hb, shortest := cfg.heartbeatInterval(), cfg.electionTimeoutMin(); 3*hb > shortest {
+		return fmt.Errorf("raft: HeartbeatInterval %v must be at most a third of ElectionTimeoutMin %v", hb, shortest)
+	}
+	if shortest, longest := cfg.electionTimeoutMin(), cfg.electionTimeoutMax(); longest <= shortest {
+		return fmt.Errorf("raft: ElectionTimeoutMax %v must exceed ElectionTimeoutMin %v", longest, shortest)
+	}
+	if cfg.LeaseDuration < 0 || cfg.LeaseDuration >= cfg.electionTimeoutMin() {
+		return fmt.Errorf("raft: LeaseDuration must be between 0 and %v, got %v", cfg.electionTimeoutMin(), cfg.LeaseDuration)
+	}
+	if cfg.LeaseMissedRounds < 0 {
+		return fmt.Errorf("raft: LeaseMissedRounds must not be negative, got %d", cfg.LeaseMissedRounds)
+	}
+	if cfg.LeaseMissedRounds > 0 {
+		need := time.Duration(cfg.LeaseMissedRounds+1) * cfg.heartbeatInterval()
+		if need >= cfg.electionTimeoutMin() {
+			return fmt.Errorf("raft: %d missed rounds need a lease longer than %v, which would not be shorter than the election timeout %v", cfg.LeaseMissedRounds, need, cfg.electionTimeoutMin())
+		}
+		if cfg.LeaseDuration <= need {
+			return fmt.Errorf("raft: LeaseDuration must exceed %v to tolerate %d missed rounds, got %v", need, cfg.LeaseMissedRounds, cfg.LeaseDuration)
+		}
+	}
+	if cfg.MaxElectionTimeout != 0 && cfg.MaxElectionTimeout < cfg.electionTimeoutMin()*5/2 {
+		return fmt.Errorf("raft: MaxElectionTimeout must be at least %v, got %v", cfg.electionTimeoutMin()*5/2, cfg.MaxElectionTimeout)
+	}
+	if cfg.RPCTimeout < 0 || cfg.SnapshotTimeout < 0 {
+		return fmt.Errorf("raft: RPCTimeout and SnapshotTimeout must not be negative, got %v and %v", cfg.RPCTimeout, cfg.SnapshotTimeout)
+	}
+	if cfg.ReconfigPolicy < ReconfigAllow || cfg.ReconfigPolicy > ReconfigQueue {
+		return fmt.Errorf("raft: unknown ReconfigPolicy %d", cfg.ReconfigPolicy)
+	}
+	if cfg.HeartbeatPolicy < HeartbeatAny || cfg.HeartbeatPolicy > HeartbeatUpToDate {
+		return fmt.Errorf("raft: unknown HeartbeatPolicy %d", cfg.HeartbeatPolicy)
+	}
+	qe, qr := cfg.electionQuorum(npeers), cfg.commitQuorum(npeers)
+	if qe+qr <= npeers {
+		return fmt.Errorf("raft: election quorum %d and commit quorum %d do not intersect in a cluster of %d", qe, qr, npeers)
+	}
+	if 2*qe <= npeers {
+		return fmt.Errorf("raft: election quorum %d allows two leaders per term in a cluster of %d", qe, npeers)
+	}
+	return nil
+}
+
+// heartbeatInterval returns how often the leader sends AppendEntries.
+func (cfg Config) heartbeatInterval() time.Duration {
+	if cfg.HeartbeatInterval > 0 {
+		return cfg.HeartbeatInterval
+	}
+	return 60 * time.Millisecond
+}
+
+// electionTimeoutMin returns the shortest election timeout a peer draws, which also bounds
+// leader leases.
+func (cfg Config) electionTimeoutMin() time.Duration {
+	if cfg.ElectionTimeoutMin > 0 {
+		return cfg.ElectionTimeoutMin
+	}
+	return 200 * time.Millisecond
+}
+
+// electionTimeoutMax returns the bound below the election timeouts a peer draws, unless
+// adaptive.
+func (cfg Config) electionTimeoutMax() time.Duration {
+	if cfg.ElectionTimeoutMax > 0 {
+		return cfg.ElectionTimeoutMax
+	}
+	return cfg.electionTimeoutMin() * 5 / 2
+}
+
+// maxElectionTimeout returns the longest election timeout an adaptive follower draws.
+func (cfg Config) maxElectionTimeout() time.Duration {
+	if cfg.MaxElectionTimeout > 0 {
+		return cfg.MaxElectionTimeout
+	}
+	return cfg.electionTimeoutMin() * 15 / 2
+}
+
+// snapshotChunkSize returns the most snapshot bytes the leader sends in one InstallSnapshot,
+// or zero to send the whole snapshot at once.
+func (cfg Config) snapshotChunkSize() int {
+	if cfg.SnapshotRateLimit <= 0 {
+		return 0
+	}
+	size := int(int64(cfg.SnapshotRateLimit) * int64(cfg.heartbeatInterval()) / int64(time.Second))
+	if size < 1 {
+		return 1
+	}
+	return size
+}
+
+// sendersPerPeer returns the number of sender goroutines a peer runs per follower, or 0 if
+// MaxInflightAppends leaves the RPCs to a follower unlimited.
+func (cfg Config) sendersPerPeer() int {
+	return cfg.MaxInflightAppends
+}
+
+// electionQuorum returns the number of votes a candidate needs to win an election.
+func (cfg Config) electionQuorum(npeers int) int {
+	if cfg.ElectionQuorum > 0 {
+		return cfg.ElectionQuorum
+	}
+	return npeers/2 + 1
+}
+
+// commitQuorum returns the number of peers that must store an entry before it is committed.
+func (cfg Config) commitQuorum(npeers int) int {
+	if cfg.CommitQuorum > 0 {
+		return cfg.CommitQuorum
+	}
+	return npeers/2 + 1
+}
@@ -0,0 +1,93 @@
+package raft
+
+import "time"
+
+// With cfg.PreVote set, a follower whose election timer fires first asks its peers whether they
+// would vote for it at the next term, with the same RequestVoteArgs a real election sends, and
+// stands for election only if a quorum would. A peer grants a pre-vote only if it has not heard
+// from a leader within the minimum election timeout and the candidate's log is up to date, and
+// neither side changes its term, vote or any other persistent state for it. A follower cut off
+// from the cluster then keeps its term while its timer fires again and again, and when it
+// rejoins it cannot force a stable leader to step down. Elections started by TimeoutNow skip
+// the pre-vote, since the leader handing over has just been heard from by every follower.
+
+/*
+ * RequestPreVote RPC handler: would this peer vote for the candidate at args.Term?
+ */
+
+func (rf *Raft) RequestPreVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+	reply.Term = rf.currentTerm
+	reply.VoteGranted = args.Term > rf.currentTerm &&
+		rf.state != STATE_LEADER &&
+		rf.isVoter(args.CandidateId) &&
+		time.Since(rf.heardAt) >= rf.cfg.electionTimeoutMin() &&
+		rf.isUpToDate(args.LastLogTerm, args.LastLogIndex)
+}
+
+/*
+ * Run a pre-vote round and report whether a quorum of peers, this one included, would vote for
+ * it at the next term. Gives up early if the peer hears from a leader, grants its vote, or learns
+ * of a later term, and after an election timeout. Only called from the Run goroutine.
+ */
+
+func (rf *Raft) winPreVote() bool {
+	rf.mu.Lock()
+	args := &RequestVoteArgs{}
+	args.Term = rf.currentTerm + 1
+	args.CandidateId = rf.me
+	args.LastLogIndex = rf.getLastLogIndex()
+	args.LastLogTerm = rf.getLastLogTerm()
+	quorum := rf.cfg.electionQuorum(len(rf.voters))
+	voters := rf.otherVoters()
+	rf.mu.Unlock()
+
+	granted := make(chan bool, len(voters))
+	for _, server := range voters {
+		go func(server int) {
+			reply := &RequestVoteReply{}
+			ok := rf.call(server, "Raft.RequestPreVote", args, reply) && !reply.Paused
+			if ok && reply.Term >= args.Term {
+				// the peer is already at the term we would stand in, or later
+				rf.mu.Lock()
+				if reply.Term > rf.currentTerm {
+					rf.state = STATE_FOLLOWER
+					rf.setTerm(reply.Term)
+					rf.votedFor = -1
+					rf.persist()
+				}
+				rf.mu.Unlock()
+			}
+			granted <- ok && reply.VoteGranted
+		}(server)
+	}
+
+	votes := 1
+	timeout := time.After(rf.electionTimeout())
+	for replies := 0; votes < quorum && replies < len(voters); replies++ {
+		select {
+		case g := <-granted:
+			if g {
+				votes++
+			}
+		case <-rf.chanHeartbeat:
+			return false
+		case <-rf.chanGrantVote:
+			return false
+		case <-rf.done:
+			return false
+		case <-timeout:
+			return false
+		}
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return votes >= quorum && rf.state == STATE_CANDIDATE
+}
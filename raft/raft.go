@@ -8,8 +8,8 @@ package raft
 	*rf.Start(command interface{}) (index, term, isleader)
 		**Start agreement on a new log entry.
 
-	*rf.GetState() (term, isLeader)
-		**Ask a Raft for its current term, and whether it thinks it is leader.
+	*rf.GetState() (term, isLeader, paused)
+		**Ask a Raft for its current term, whether it thinks it is leader, and whether it is paused.
 
 	*ApplyMsg
 		**When a new entry is committed to the log, each Raft peer sends an ApplyMsg to the service in the same server.
@@ -17,8 +17,13 @@ package raft
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"log"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReshiAdavan/Sentinel/gobWrapper"
@@ -53,6 +58,8 @@ type ApplyMsg struct {
 	Command      interface{}
 	UseSnapshot bool
 	Snapshot    []byte
+
+	SnapshotIndex int // with UseSnapshot, the index of the last entry the snapshot covers
 }
 
 type Raft struct {
@@ -60,41 +67,201 @@ type Raft struct {
 	peers     []*rpc.ClientEnd // RPC end points of all peers
 	persister *Persister          // Object to hold this peer's persisted state
 	me        int                 // this peer's index into peers[]
+	cfg       Config              // tunable parameters supplied at construction
 
 	// state a Raft server must maintain.
 	state     int
 	voteCount int
+	paused    bool // true while taken out of service by Pause()
+	leaderId  int  // leader of the current term as far as this peer knows, or -1
 
 	// Persistent state on all servers.
 	currentTerm int
+	term        int64 // copy of currentTerm for CurrentTerm(), accessed atomically
 	votedFor    int
 	log         []LogEntry
 
 	// Volatile state on all servers.
 	commitIndex int
 	lastApplied int
+	applyCond   *sync.Cond // broadcast whenever lastApplied advances
+	commitCond  *sync.Cond // signalled for the applier whenever commitIndex advances
+
+	// A snapshot installed from the leader, for the applier to deliver before any later entry.
+	pendingSnapshot *ApplyMsg
 
 	// Volatile state on leaders.
 	nextIndex  []int
 	matchIndex []int
 
-	// Channels between raft peers.
-	chanApply     chan ApplyMsg
-	chanGrantVote chan bool
-	chanWinElect  chan bool
-	chanHeartbeat chan bool
+	// Cluster membership; see membership.go. voters lists, in increasing order, the peers that
+	// vote as of the committed Membership entry at votersIndex, which is 0 while they are the
+	// peers this one was started with, and learners the peers that only replicate the log.
+	// joining is the peer AddServer is catching up, or -1, and abandoned the index of a peer
+	// an AddServer that failed left outside the configuration, for the next one to take, or -1.
+	voters      []int
+	learners    map[int]bool
+	votersIndex int
+	joining     int
+	abandoned   int
+
+	// Wake-ups for the sender goroutines of each peer, buffered by one so that heartbeat
+	// rounds that find every sender busy coalesce into a single pending wake-up, and the
+	// number of RPCs to each peer still waiting on a reply, at most cfg.sendersPerPeer() if set.
+	wake []chan struct{}
+	busy []int
+
+	// Number of consecutive AppendEntries each peer has rejected for a log mismatch,
+	// compared against cfg.SnapshotAfterRejections.
+	rejections []int
+
+	// needSnapshot is set when this peer restarted with a log that begins past its snapshot,
+	// and asks the leader for a snapshot until one is installed or the log is repaired.
+	// snapshotWanted records, on the leader, which followers asked.
+	needSnapshot   bool
+	snapshotWanted []bool
+
+	// Leader leases, with cfg.LeaseDuration set. ackedAt holds, for each peer, the time the
+	// leader sent the latest AppendEntries the peer answered in the leader's term. heardAt is
+	// when this peer last heard from a leader, and transferElection marks an election started
+	// by TimeoutNow, which voters must not refuse on account of a lease.
+	ackedAt          []time.Time
+	leaseRevoked     bool // set once the leader starts handing over leadership
+	heardAt          time.Time
+	transferElection bool
+	transferring     bool // set on the leader while TransferLeadership runs
+
+	// Time at which the leader may send its next snapshot chunk without exceeding
+	// cfg.SnapshotRateLimit, how much of its snapshot each follower holds, and, on a follower,
+	// the chunks received so far of the snapshot at chunksIndex and chunksTerm.
+	snapshotFreeAt time.Time
+	snapshotSent   []snapshotProgress
+	chunks         []byte
+	chunksIndex    int
+	chunksTerm     int
+
+	// Counters reported by Metrics().
+	metrics Metrics
+
+	// Set when the persistent state changes, and cleared when it is saved; with
+	// cfg.CoalescePersist, handlers only save it when set.
+	dirty bool
+
+	// Signalled when the term advances, to wake the goroutine running cfg.OnTermChange.
+	termChanged chan struct{}
+
+	// Vote events waiting to be passed to cfg.OnVote, and the signal that wakes the
+	// goroutine passing them on.
+	pendingVotes []VoteEvent
+	votesQueued  chan struct{}
+
+	// Recent gaps between the heartbeats this peer received from its leader, with
+	// cfg.AdaptiveElectionTimeout set, and the slot the next one goes in once gapWindow are kept.
+	gaps    []time.Duration
+	gapNext int
+
+	// Source of randomized election timeouts, only used by the Run goroutine.
+	rand *rand.Rand
+
+	// Closed by Kill, to stop the peer's goroutines, and by the applier as it exits.
+	done        chan struct{}
+	killOnce    sync.Once
+	applierDone chan struct{}
+
+	// Channels between raft peers. Those Run waits on hold at most one pending signal, and are
+	// sent to with signal, so an RPC handler holding the lock never waits on Run.
+	chanApply      chan ApplyMsg
+	chanGrantVote  chan bool
+	chanWinElect   chan bool
+	chanHeartbeat  chan bool
+	chanTimeoutNow chan bool
+}
+
+/*
+ * Send to one of the channels Run waits on without blocking. If the channel is full, Run has
+ * yet to take a signal that resets its timer as well as this one would, so it is dropped.
+ */
+
+func signal(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
 }
 
 /* 
- * Return currentTerm and whether this server believes it is the leader.
+ * Return currentTerm, whether this server believes it is the leader, and whether it is paused.
+ * A paused server never reports itself as leader.
  */
 
-func (rf *Raft) GetState() (int, bool) {
+func (rf *Raft) GetState() (int, bool, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 	term := rf.currentTerm
 	isleader := (rf.state == STATE_LEADER)
-	return term, isleader
+	return term, isleader, rf.paused
+}
+
+/*
+ * Return currentTerm without taking the peer's lock.
+ * Terms only ever increase, so the result can serve as a fencing token.
+ */
+
+func (rf *Raft) CurrentTerm() int {
+	return int(atomic.LoadInt64(&rf.term))
+}
+
+/*
+ * Advance currentTerm to term, forget the previous term's leader, and wake the
+ * OnTermChange notifier if there is one.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) setTerm(term int) {
+	rf.currentTerm = term
+	rf.dirty = true
+	rf.leaderId = -1
+	atomic.StoreInt64(&rf.term, int64(term))
+	// a leader stepping down must release commands queued in TryStart.
+	rf.applyCond.Broadcast()
+	if rf.termChanged != nil {
+		select {
+		case rf.termChanged <- struct{}{}:
+		default:
+			// the notifier is already due to run
+		}
+	}
+}
+
+/*
+ * Call cfg.OnTermChange, outside the lock, each time the term advances past notified, the
+ * term the peer started in; it is passed in, rather than read here, so that an advance made
+ * before this goroutine first runs is not mistaken for the starting term.
+ */
+
+func (rf *Raft) notifyTermChanges(notified int) {
+	for {
+		select {
+		case <-rf.termChanged:
+		case <-rf.done:
+			return
+		}
+		if term := rf.CurrentTerm(); term > notified {
+			notified = term
+			rf.cfg.OnTermChange(term)
+		}
+	}
+}
+
+/*
+ * Return the index of the peer this server believes to be the current leader, or -1 if it
+ * doesn't know, so that a server can redirect clients instead of just turning them away.
+ */
+
+func (rf *Raft) GetLeaderHint() int {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.leaderId
 }
 
 func (rf *Raft) getLastLogTerm() int {
@@ -105,6 +272,34 @@ func (rf *Raft) getLastLogIndex() int {
 	return rf.log[len(rf.log)-1].Index
 }
 
+/*
+ * Take this peer out of service without killing it.
+ * While paused the peer answers every RPC as if it were unreachable and never starts an election;
+ * a paused leader steps down. Persisted state is left untouched.
+ */
+
+func (rf *Raft) Pause() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.paused = true
+	rf.state = STATE_FOLLOWER
+	rf.leaderId = -1
+	rf.applyCond.Broadcast()
+}
+
+/*
+ * Return a paused peer to service. It rejoins as a follower and catches up from the leader.
+ */
+
+func (rf *Raft) Resume() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.paused = false
+	// give the leader a full timeout to reach it before it stands for election
+	rf.heardAt = time.Now()
+	signal(rf.chanHeartbeat)
+}
+
 /*
  * Save Raft's persistent state to stable storage, 
  where it can later be retrieved after a crash and restart.
@@ -113,6 +308,19 @@ func (rf *Raft) getLastLogIndex() int {
 func (rf *Raft) persist() {
 	data := rf.getRaftState()
 	rf.persister.SaveRaftState(data)
+	rf.metrics.Persists++
+	rf.dirty = false
+}
+
+/*
+ * Save persistent state at the end of an RPC handler: every time, or with cfg.CoalescePersist
+ * only if the handler changed it.
+ */
+
+func (rf *Raft) flushPersist() {
+	if !rf.cfg.CoalescePersist || rf.dirty {
+		rf.persist()
+	}
 }
 
 /*
@@ -128,6 +336,41 @@ func (rf *Raft) readPersist(data []byte) {
 	d.Decode(&rf.currentTerm)
 	d.Decode(&rf.votedFor)
 	d.Decode(&rf.log)
+
+	// state saved without a commit index decodes as 0, which is always safe.
+	var commitIndex int
+	if d.Decode(&commitIndex) == nil && rf.cfg.PersistCommitIndex {
+		rf.commitIndex = commitIndex
+	}
+	var m Membership
+	var votersIndex int
+	if d.Decode(&m.Voters) == nil && d.Decode(&votersIndex) == nil && len(m.Voters) > 0 {
+		// state saved before learners existed has none
+		d.Decode(&m.Learners)
+		rf.setMembership(m, votersIndex)
+	}
+}
+
+/*
+ * ParseRaftState decodes the state a peer saved to its Persister, for tools that inspect
+ * a persister without starting a peer on it. The log begins with the entry standing for
+ * the last one the snapshot covers, as LogSnapshot's does.
+ */
+
+func ParseRaftState(data []byte) (term int, votedFor int, log []LogEntry, err error) {
+	d := gobWrapper.NewDecoder(bytes.NewBuffer(data))
+	if err = d.Decode(&term); err == nil {
+		if err = d.Decode(&votedFor); err == nil {
+			err = d.Decode(&log)
+		}
+	}
+	if err != nil {
+		return 0, 0, nil, errors.New("raft: unreadable state: " + err.Error())
+	}
+	if len(log) == 0 {
+		return 0, 0, nil, errors.New("raft: state holds an empty log")
+	}
+	return term, votedFor, log, nil
 }
 
 /*
@@ -140,6 +383,15 @@ func (rf *Raft) getRaftState() []byte {
 	e.Encode(rf.currentTerm)
 	e.Encode(rf.votedFor)
 	e.Encode(rf.log)
+	commitIndex := 0
+	if rf.cfg.PersistCommitIndex {
+		// saved together with the log, so it is never ahead of the durable log.
+		commitIndex = rf.commitIndex
+	}
+	e.Encode(commitIndex)
+	e.Encode(rf.voters)
+	e.Encode(rf.votersIndex)
+	e.Encode(rf.learnerList())
 	return w.Bytes()
 }
 
@@ -166,37 +418,48 @@ func (rf *Raft) CreateSnapshot(kvSnapshot []byte, index int) {
 	}
 	rf.trimLog(index, rf.log[index-baseIndex].Term)
 
-	w := new(bytes.Buffer)
-	e := gobWrapper.NewEncoder(w)
-	e.Encode(rf.log[0].Index)
-	e.Encode(rf.log[0].Term)
-	snapshot := append(w.Bytes(), kvSnapshot...)
+	snapshot := encodeSnapshot(rf.log[0].Index, rf.log[0].Term, kvSnapshot)
 
 	rf.persister.SaveStateAndSnapshot(rf.getRaftState(), snapshot)
 }
 
 /*
  * Recover from previous raft snapshot.
+ * A crash between saving the raft state and the snapshot, with a persister that can't save both
+ * atomically, can leave a log that was trimmed past the snapshot. The entries in between are then
+ * in neither, so the log is dropped back to the snapshot, the lower point that is consistent, and
+ * the peer asks the leader for a fresh snapshot to catch up.
  */
 
 func (rf *Raft) recoverFromSnapshot(snapshot []byte) {
-	if snapshot == nil || len(snapshot) < 1 {
+	var parsed Snapshot
+	if len(snapshot) > 0 {
+		var err error
+		if parsed, err = ParseSnapshot(snapshot); err != nil {
+			DPrintf("raft %d: ignoring unreadable snapshot: %v", rf.me, err)
+			snapshot = nil
+		}
+	}
+	if baseIndex := rf.log[0].Index; baseIndex > parsed.LastIncludedIndex {
+		DPrintf("raft %d: log starts at %d, past the snapshot at %d; dropping it and asking for a snapshot",
+			rf.me, baseIndex, parsed.LastIncludedIndex)
+		rf.log = []LogEntry{{Index: parsed.LastIncludedIndex, Term: parsed.LastIncludedTerm}}
+		rf.commitIndex = parsed.LastIncludedIndex
+		rf.needSnapshot = true
+		rf.metrics.TornStateRecoveries++
+	}
+	if len(snapshot) == 0 {
 		return
 	}
 
-	var lastIncludedIndex, lastIncludedTerm int
-	r := bytes.NewBuffer(snapshot)
-	d := gobWrapper.NewDecoder(r)
-	d.Decode(&lastIncludedIndex)
-	d.Decode(&lastIncludedTerm)
-
-	rf.lastApplied = lastIncludedIndex
-	rf.commitIndex = lastIncludedIndex
-	rf.trimLog(lastIncludedIndex, lastIncludedTerm)
+	rf.lastApplied = parsed.LastIncludedIndex
+	rf.commitIndex = max(rf.commitIndex, parsed.LastIncludedIndex)
+	rf.trimLog(parsed.LastIncludedIndex, parsed.LastIncludedTerm)
+	rf.applyCond.Broadcast()
 
 	// send snapshot to kv server
-	msg := ApplyMsg{UseSnapshot: true, Snapshot: snapshot}
-	rf.chanApply <- msg
+	msg := ApplyMsg{UseSnapshot: true, Snapshot: snapshot, SnapshotIndex: parsed.LastIncludedIndex}
+	rf.deliver(msg)
 }
 
 /*
@@ -204,10 +467,11 @@ func (rf *Raft) recoverFromSnapshot(snapshot []byte) {
  */
 
 type RequestVoteArgs struct {
-	Term         int
-	CandidateId  int
-	LastLogIndex int
-	LastLogTerm  int
+	Term               int
+	CandidateId        int
+	LastLogIndex       int
+	LastLogTerm        int
+	LeadershipTransfer bool // the candidate was asked to run by the leader, through TimeoutNow
 }
 
 /*
@@ -217,6 +481,7 @@ type RequestVoteArgs struct {
 type RequestVoteReply struct {
 	Term        int
 	VoteGranted bool
+	Paused      bool // the voter is paused; treat the RPC as lost
 }
 
 /*
@@ -225,30 +490,63 @@ type RequestVoteReply struct {
 func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	defer rf.persist()
+	defer rf.flushPersist()
+
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+	rf.recordVote(VoteEvent{Kind: VoteReceived, Term: args.Term, Candidate: args.CandidateId, Voter: rf.me, VoterTerm: rf.currentTerm})
 
 	if args.Term < rf.currentTerm {
 		// reject request with stale term number
 		reply.Term = rf.currentTerm
 		reply.VoteGranted = false
+		rf.rejectVote(args, RejectStaleTerm)
+		return
+	}
+
+	if !rf.isVoter(args.CandidateId) {
+		// a peer outside the configuration, perhaps removed without knowing it; don't let
+		// it disturb the cluster by taking on its term.
+		reply.Term = rf.currentTerm
+		reply.VoteGranted = false
+		rf.rejectVote(args, RejectNotVoter)
+		return
+	}
+
+	if rf.cfg.LeaseDuration > 0 && !args.LeadershipTransfer && time.Since(rf.heardAt) < rf.cfg.electionTimeoutMin() {
+		// the leader we heard from may still hold a lease; don't help replace it,
+		// nor take on the candidate's term.
+		reply.Term = rf.currentTerm
+		reply.VoteGranted = false
+		rf.rejectVote(args, RejectLease)
 		return
 	}
 
 	if args.Term > rf.currentTerm {
 		// become follower and update current term
 		rf.state = STATE_FOLLOWER
-		rf.currentTerm = args.Term
+		rf.setTerm(args.Term)
 		rf.votedFor = -1
 	}
 
 	reply.Term = rf.currentTerm
 	reply.VoteGranted = false
 
-	if (rf.votedFor == -1 || rf.votedFor == args.CandidateId) && rf.isUpToDate(args.LastLogTerm, args.LastLogIndex) {
+	switch {
+	case rf.votedFor != -1 && rf.votedFor != args.CandidateId:
+		rf.rejectVote(args, RejectVoted)
+	case !rf.isUpToDate(args.LastLogTerm, args.LastLogIndex):
+		rf.rejectVote(args, RejectLogBehind)
+	default:
 		// vote for the candidate
 		rf.votedFor = args.CandidateId
+		rf.dirty = true
 		reply.VoteGranted = true
-		rf.chanGrantVote <- true
+		signal(rf.chanGrantVote)
+		rf.recordVote(VoteEvent{Kind: VoteGranted, Term: args.Term, Candidate: args.CandidateId, Voter: rf.me, VoterTerm: rf.currentTerm})
 	}
 }
 
@@ -275,13 +573,17 @@ func (rf *Raft) isUpToDate(candidateTerm int, candidateIndex int) bool {
    a live server that can't be reached, a lost request, or a lost reply.
    ** Call() is guaranteed to return (perhaps after a delay) *except* if the handler function on the server side 
    does not return. Thus there is no need to implement your own timeouts around Call().
+   ** With cfg.RPCTimeout or cfg.SnapshotTimeout set, a call gives up after that long, see call.
 */ 
 
 func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
+	rf.mu.Lock()
+	rf.recordVote(VoteEvent{Kind: VoteRequested, Term: args.Term, Candidate: rf.me, Voter: server})
+	rf.mu.Unlock()
+	ok := rf.call(server, "Raft.RequestVote", args, reply) && !reply.Paused
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	defer rf.persist()
+	defer rf.flushPersist()
 
 	if ok {
 		if rf.state != STATE_CANDIDATE || rf.currentTerm != args.Term {
@@ -291,24 +593,31 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 		if rf.currentTerm < reply.Term {
 			// revert to follower state and update current term
 			rf.state = STATE_FOLLOWER
-			rf.currentTerm = reply.Term
+			rf.setTerm(reply.Term)
 			rf.votedFor = -1
 			return ok
 		}
 
-		if reply.VoteGranted {
+		if reply.VoteGranted && rf.isVoter(server) {
 			rf.voteCount++
-			if rf.voteCount > len(rf.peers)/2 {
+			if rf.voteCount >= rf.cfg.electionQuorum(len(rf.voters)) {
 				// win the election
 				rf.state = STATE_LEADER
-				rf.persist()
+				rf.leaderId = rf.me
 				rf.nextIndex = make([]int, len(rf.peers))
 				rf.matchIndex = make([]int, len(rf.peers))
+				rf.ackedAt = make([]time.Time, len(rf.peers))
+				rf.rejections = make([]int, len(rf.peers))
+				rf.snapshotSent = make([]snapshotProgress, len(rf.peers))
+				rf.leaseRevoked = false
 				nextIndex := rf.getLastLogIndex() + 1
 				for i := range rf.nextIndex {
 					rf.nextIndex[i] = nextIndex
 				}
-				rf.chanWinElect <- true
+				if rf.cfg.ProbeOnElection {
+					go rf.broadcastProbeLog()
+				}
+				signal(rf.chanWinElect)
 			}
 		}
 	}
@@ -316,17 +625,20 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 	return ok
 }
 
-func (rf *Raft) broadcastRequestVote() {
+func (rf *Raft) broadcastRequestVote(transfer bool) {
 	rf.mu.Lock()
 	args := &RequestVoteArgs{}
 	args.Term = rf.currentTerm
 	args.CandidateId = rf.me
 	args.LastLogIndex = rf.getLastLogIndex()
 	args.LastLogTerm = rf.getLastLogTerm()
+	args.LeadershipTransfer = transfer
+	voters := rf.otherVoters()
+	candidate := rf.state == STATE_CANDIDATE
 	rf.mu.Unlock()
 
-	for server := range rf.peers {
-		if server != rf.me && rf.state == STATE_CANDIDATE {
+	for _, server := range voters {
+		if candidate {
 			go rf.sendRequestVote(server, args, &RequestVoteReply{})
 		}
 	}
@@ -339,21 +651,53 @@ type AppendEntriesArgs struct {
 	PrevLogTerm  int
 	Entries      []LogEntry
 	LeaderCommit int
+	LastLogIndex int // index of the leader's last entry, for Config.HeartbeatPolicy
+	LastLogTerm  int // term of the leader's last entry
 }
 
 type AppendEntriesReply struct {
 	Term         int
 	Success      bool
 	NextTryIndex int
+	Paused       bool // the follower is paused; treat the RPC as lost
+	NeedSnapshot bool // the follower lost log entries on restart and asks for a snapshot
+}
+
+/*
+ * Merge entries that follow an entry matching the leader's into the log.
+ * The log is truncated only at the first entry whose term conflicts with the leader's, as
+ * Figure 2 asks: RPCs may be delayed or reordered, so an AppendEntries carrying fewer entries
+ * than the follower already holds, or none at all, must not drop the entries after them.
+ * Those may have come from a newer AppendEntries, and the leader may count them as matched.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) mergeEntries(entries []LogEntry) {
+	baseIndex := rf.log[0].Index
+	for i, entry := range entries {
+		pos := entry.Index - baseIndex
+		if pos < len(rf.log) && rf.log[pos].Term == entry.Term {
+			continue
+		}
+		rf.log = append(rf.log[:pos], entries[i:]...)
+		rf.dirty = true
+		return
+	}
 }
 
 func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
-	defer rf.persist()
+	defer rf.flushPersist()
 
 	reply.Success = false
 
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+
 	if args.Term < rf.currentTerm {
 		// reject requests with stale term number
 		reply.Term = rf.currentTerm
@@ -361,17 +705,28 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		return
 	}
 
+	// the gap since the last heartbeat is only the leader's to measure if it led all along
+	steady := rf.state == STATE_FOLLOWER && args.Term == rf.currentTerm && args.LeaderId == rf.leaderId
+
 	if args.Term > rf.currentTerm {
 		// become follower and update current term
 		rf.state = STATE_FOLLOWER
-		rf.currentTerm = args.Term
+		rf.setTerm(args.Term)
 		rf.votedFor = -1
 	}
 
-	// confirm heartbeat to refresh timeout
-	rf.chanHeartbeat <- true
+	// confirm heartbeat to refresh timeout, unless the policy finds the leader's log behind
+	rf.leaderId = args.LeaderId
+	if rf.cfg.HeartbeatPolicy == HeartbeatAny || rf.isUpToDate(args.LastLogTerm, args.LastLogIndex) {
+		if steady && rf.cfg.AdaptiveElectionTimeout {
+			rf.observeHeartbeatGap(time.Since(rf.heardAt))
+		}
+		rf.heardAt = time.Now()
+		signal(rf.chanHeartbeat)
+	}
 
 	reply.Term = rf.currentTerm
+	reply.NeedSnapshot = rf.needSnapshot
 
 	if args.PrevLogIndex > rf.getLastLogIndex() {
 		reply.NextTryIndex = rf.getLastLogIndex() + 1
@@ -392,43 +747,117 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		}
 	} else if args.PrevLogIndex >= baseIndex-1 {
 		// otherwise log up to prevLogIndex are safe.
-		// merge lcoal log and entries from leader, and apply log if commitIndex changes.
-		rf.log = rf.log[:args.PrevLogIndex-baseIndex+1]
-		rf.log = append(rf.log, args.Entries...)
+		rf.mergeEntries(args.Entries)
 
 		reply.Success = true
 		reply.NextTryIndex = args.PrevLogIndex + len(args.Entries)
+		// the leader's entries now follow the snapshot directly, so nothing is missing any more.
+		rf.needSnapshot = false
+		reply.NeedSnapshot = false
 
-		if rf.commitIndex < args.LeaderCommit {
+		// only entries known to match the leader may be committed: entries kept after
+		// lastNewIndex may be left over from an older term and not yet overwritten.
+		if lastNewIndex := args.PrevLogIndex + len(args.Entries); rf.commitIndex < min(args.LeaderCommit, lastNewIndex) {
 			// update commitIndex and apply log
-			rf.commitIndex = min(args.LeaderCommit, rf.getLastLogIndex())
-			go rf.applyLog()
+			committed := rf.commitIndex
+			rf.commitIndex = min(args.LeaderCommit, lastNewIndex)
+			rf.dirty = rf.dirty || rf.cfg.PersistCommitIndex
+			rf.applyMembership(committed, rf.commitIndex)
+			rf.commitCond.Signal()
 		}
 	}
 }
 
 /*
- * Apply log entries with index in range [lastApplied + 1, commitIndex]
+ * The applier hands the service, on applyCh, each committed entry in index order, and the
+ * snapshots installed from the leader in their place among them. It is the only goroutine that
+ * sends on applyCh once Make returns, and sends without the lock, so a slow service holds up
+ * neither the RPC handlers nor the leader; lastApplied advances once each message is taken.
  */
 
-func (rf *Raft) applyLog() {
+func (rf *Raft) applier() {
+	defer close(rf.applierDone)
+
 	rf.mu.Lock()
-	defer rf.mu.Unlock()
+	for {
+		for !rf.killed() && rf.pendingSnapshot == nil && rf.lastApplied >= rf.commitIndex {
+			rf.commitCond.Wait()
+		}
+		if rf.killed() {
+			rf.mu.Unlock()
+			return
+		}
+		var msg ApplyMsg
+		if rf.pendingSnapshot != nil {
+			msg = *rf.pendingSnapshot
+			rf.pendingSnapshot = nil
+		} else if index := rf.lastApplied + 1; index > rf.log[0].Index {
+			msg = ApplyMsg{CommandValid: true, CommandIndex: index, Command: rf.log[index-rf.log[0].Index].Command}
+		} else {
+			// covered by the snapshot the log starts at, which the service already has
+			rf.lastApplied = rf.log[0].Index
+			continue
+		}
+		rf.mu.Unlock()
 
-	baseIndex := rf.log[0].Index
+		if !rf.deliver(msg) {
+			return
+		}
+
+		rf.mu.Lock()
+		if msg.UseSnapshot {
+			rf.lastApplied = max(rf.lastApplied, msg.SnapshotIndex)
+		} else {
+			rf.lastApplied = max(rf.lastApplied, msg.CommandIndex)
+		}
+		rf.applyCond.Broadcast()
+	}
+}
+
+// error returned by WaitForApplied when the peer is killed while it waits.
+var ErrKilled = errors.New("raft: peer was killed")
+
+/*
+ * Block until this peer has applied the log up to and including index, or ctx is done.
+ * Returns ctx.Err() if ctx ends first, and ErrKilled if the peer is killed first, as nothing
+ * more will be applied.
+ */
+
+func (rf *Raft) WaitForApplied(ctx context.Context, index int) error {
+	// wake the waiter below when ctx ends, since a condition variable can't select on it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			rf.mu.Lock()
+			rf.applyCond.Broadcast()
+			rf.mu.Unlock()
+		case <-done:
+		}
+	}()
 
-	for i := rf.lastApplied + 1; i <= rf.commitIndex; i++ {
-		msg := ApplyMsg{}
-		msg.CommandIndex = i
-		msg.CommandValid = true
-		msg.Command = rf.log[i-baseIndex].Command
-		rf.chanApply <- msg
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	for rf.lastApplied < index {
+		if rf.killed() {
+			return ErrKilled
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rf.applyCond.Wait()
 	}
-	rf.lastApplied = rf.commitIndex
+	return nil
 }
 
 func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
+	size := 0
+	if len(args.Entries) > 0 {
+		size = entriesSize(args.Entries)
+	}
+	sent := time.Now()
+	ok := rf.call(server, "Raft.AppendEntries", args, reply) && !reply.Paused
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
@@ -438,174 +867,866 @@ func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *Ap
 	}
 	if reply.Term > rf.currentTerm {
 		// become follower and update current term
-		rf.currentTerm = reply.Term
+		rf.setTerm(reply.Term)
 		rf.state = STATE_FOLLOWER
 		rf.votedFor = -1
 		rf.persist()
 		return ok
 	}
 
+	// the follower answered in our term, so it won't vote for another leader for a while.
+	rf.renewLease(server, sent)
+
 	if reply.Success {
+		rf.rejections[server] = 0
 		if len(args.Entries) > 0 {
 			rf.nextIndex[server] = args.Entries[len(args.Entries)-1].Index + 1
-			rf.matchIndex[server] = rf.nextIndex[server] - 1
+			rf.advanceMatchIndex(server, rf.nextIndex[server]-1)
+			rf.metrics.EntriesReplicated += int64(len(args.Entries))
+			rf.metrics.BytesReplicated += int64(size)
+		} else {
+			// a successful heartbeat still shows the follower's log matches up to PrevLogIndex.
+			rf.advanceMatchIndex(server, args.PrevLogIndex)
 		}
 	} else {
+		rf.metrics.AppendRejections++
+		rf.rejections[server]++
 		rf.nextIndex[server] = min(reply.NextTryIndex, rf.getLastLogIndex())
-	}
-
-	// Commit phase 
-	baseIndex := rf.log[0].Index
-	for N := rf.getLastLogIndex(); N > rf.commitIndex && rf.log[N-baseIndex].Term == rf.currentTerm; N-- {
-		// find if there exists an N to update commitIndex
-		count := 1
-		for i := range rf.peers {
-			if i != rf.me && rf.matchIndex[i] >= N {
-				count++
-			}
-		}
-		if count > len(rf.peers)/2 {
-			rf.commitIndex = N
-			go rf.applyLog()
-			break
-		}
+		rf.snapshotWanted[server] = reply.NeedSnapshot
 	}
 
 	return ok
 }
 
-type InstallSnapshotArgs struct {
-	Term              int
-	LeaderId          int
-	LastIncludedIndex int
-	LastIncludedTerm  int
-	Data              []byte
-}
+/*
+ * Record that server's log matches the leader's up to index, and re-evaluate the commit index
+ * at once if that advanced the server's match. Commit then follows from whichever replies
+ * complete a quorum, as soon as they do, however late the remaining followers answer. Replies
+ * may arrive out of order, so a match never moves back.
+ * Must be called with the lock held, as the leader.
+ */
 
-type InstallSnapshotReply struct {
-	Term int
+func (rf *Raft) advanceMatchIndex(server int, index int) {
+	if index <= rf.matchIndex[server] {
+		return
+	}
+	rf.matchIndex[server] = index
+	rf.advanceCommitIndex()
 }
 
-func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
-	rf.mu.Lock()
-	defer rf.mu.Unlock()
+/*
+ * Advance commitIndex to the highest index stored on a commit quorum, if that entry is from
+ * the current term; see computeCommitIndex.
+ */
 
-	if args.Term < rf.currentTerm {
-		// reject requests with stale term number
-		reply.Term = rf.currentTerm
+func (rf *Raft) advanceCommitIndex() {
+	// only the voters' matches count, the leader's own among them
+	matches, self := make([]int, 0, len(rf.voters)), -1
+	for _, v := range rf.voters {
+		if v == rf.me {
+			self = len(matches)
+		}
+		matches = append(matches, rf.matchIndex[v])
+	}
+	if self < 0 {
 		return
 	}
-	// cannot be leader if I have term number less that someone 
-	if args.Term > rf.currentTerm {
-		// become follower and update current term
-		rf.state = STATE_FOLLOWER
-		rf.currentTerm = args.Term
-		rf.votedFor = -1
-		rf.persist()
+	baseIndex := rf.log[0].Index
+	termAt := func(index int) int { return rf.log[index-baseIndex].Term }
+	N := computeCommitIndex(matches, self, rf.getLastLogIndex(), rf.cfg.commitQuorum(len(rf.voters)),
+		rf.commitIndex, rf.currentTerm, termAt)
+	if N > rf.commitIndex {
+		committed := rf.commitIndex
+		rf.commitIndex = N
+		rf.applyMembership(committed, N)
+		if rf.cfg.PersistCommitIndex || rf.dirty {
+			rf.persist()
+		}
+		rf.commitCond.Signal()
 	}
+}
 
-	// confirm heartbeat to refresh timeout
-	rf.chanHeartbeat <- true
-
-	reply.Term = rf.currentTerm
+/*
+ * Return the commit index a leader may advance to: the highest index stored on quorum peers,
+ * if that entry is from currentTerm, and commitIndex otherwise. matchIndex holds each peer's
+ * match index; the leader, at position me, counts as storing its whole log up to lastIndex,
+ * whatever matchIndex[me] says. Sorting the match indexes in decreasing order puts the answer
+ * at position quorum-1, in time independent of the length of the log, and leaves no tie to
+ * break: peers with equal match indexes count alike, however many of them there are. An
+ * older-term entry is never committed by counting replicas. termAt returns the term of an
+ * entry in the log, and is only asked about indexes above commitIndex.
+ */
 
-	if args.LastIncludedIndex > rf.commitIndex {
-		rf.trimLog(args.LastIncludedIndex, args.LastIncludedTerm)
-		rf.lastApplied = args.LastIncludedIndex
-		rf.commitIndex = args.LastIncludedIndex
-		rf.persister.SaveStateAndSnapshot(rf.getRaftState(), args.Data)
+func computeCommitIndex(matchIndex []int, me int, lastIndex int, quorum int, commitIndex int, currentTerm int, termAt func(index int) int) int {
+	matches := make([]int, len(matchIndex))
+	copy(matches, matchIndex)
+	matches[me] = lastIndex
+	sort.Sort(sort.Reverse(sort.IntSlice(matches)))
 
-		// send snapshot to kv server
-		msg := ApplyMsg{UseSnapshot: true, Snapshot: args.Data}
-		rf.chanApply <- msg
+	N := matches[quorum-1]
+	if N > commitIndex && termAt(N) == currentTerm {
+		return N
 	}
+	return commitIndex
 }
 
+// errors returned by ReadIndex.
+var (
+	ErrNoTermCommit = errors.New("raft: leader has not committed an entry of its term")
+	ErrUnconfirmed  = errors.New("raft: leadership not confirmed by a quorum")
+)
+
 /*
- * Discard old log entries up to lastIncludedIndex.
+ * ReadIndex returns an index such that, once this peer has applied the log up to it,
+ * the service may answer a read from its local state as if the read had gone through the log.
+ * It confirms this peer is still leader with a round of empty AppendEntries acknowledged by a
+ * quorum, so it blocks for about one round trip.
+ * Returns ErrNotLeader if this peer is not the leader or learns during the round that it no
+ * longer is, ErrNoTermCommit if it has not yet committed an entry from its own term and so
+ * cannot know how far the log is committed, and ErrUnconfirmed if a quorum does not
+ * acknowledge it within the shortest election timeout.
  */
 
-func (rf *Raft) trimLog(lastIncludedIndex int, lastIncludedTerm int) {
-	newLog := make([]LogEntry, 0)
-	newLog = append(newLog, LogEntry{Index: lastIncludedIndex, Term: lastIncludedTerm})
+func (rf *Raft) ReadIndex() (int, error) {
+	rf.mu.Lock()
+	baseIndex := rf.log[0].Index
+	if rf.state != STATE_LEADER || rf.paused {
+		rf.mu.Unlock()
+		return -1, ErrNotLeader
+	}
+	if rf.log[rf.commitIndex-baseIndex].Term != rf.currentTerm {
+		rf.mu.Unlock()
+		return -1, ErrNoTermCommit
+	}
+	readIndex := rf.commitIndex
+	args := &AppendEntriesArgs{}
+	args.Term = rf.currentTerm
+	args.LeaderId = rf.me
+	args.PrevLogIndex = baseIndex
+	args.PrevLogTerm = rf.log[0].Term
+	args.LeaderCommit = rf.commitIndex
+	args.LastLogIndex = rf.getLastLogIndex()
+	args.LastLogTerm = rf.getLastLogTerm()
+	quorum := rf.cfg.commitQuorum(len(rf.voters))
+	voters := rf.otherVoters()
+	rf.mu.Unlock()
 
-	for i := len(rf.log) - 1; i >= 0; i-- {
-		if rf.log[i].Index == lastIncludedIndex && rf.log[i].Term == lastIncludedTerm {
-			newLog = append(newLog, rf.log[i+1:]...)
-			break
+	sent := time.Now()
+	acks := make(chan bool, len(voters))
+	for _, server := range voters {
+		go func(server int) {
+			reply := &AppendEntriesReply{}
+			ok := rf.call(server, "Raft.AppendEntries", args, reply) && !reply.Paused
+			if ok && reply.Term > args.Term {
+				rf.mu.Lock()
+				if reply.Term > rf.currentTerm {
+					// become follower and update current term
+					rf.setTerm(reply.Term)
+					rf.state = STATE_FOLLOWER
+					rf.votedFor = -1
+					rf.persist()
+				}
+				rf.mu.Unlock()
+			} else if ok && reply.Term == args.Term {
+				// the round doubles as a heartbeat for the lease
+				rf.mu.Lock()
+				if rf.state == STATE_LEADER && rf.currentTerm == args.Term {
+					rf.renewLease(server, sent)
+				}
+				rf.mu.Unlock()
+			}
+			// a follower that answers in our term still recognizes us as leader.
+			acks <- ok && reply.Term == args.Term
+		}(server)
+	}
+
+	// a follower that has not answered within an election timeout may as well have elected
+	// another leader, so the round is given as long.
+	count, replies := 1, 0
+	timeout := time.After(rf.cfg.electionTimeoutMin())
+	for count < quorum && replies < len(voters) {
+		select {
+		case ack := <-acks:
+			replies++
+			if ack {
+				count++
+			}
+		case <-timeout:
+			return -1, ErrUnconfirmed
 		}
 	}
-	rf.log = newLog
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != STATE_LEADER || rf.currentTerm != args.Term {
+		return -1, ErrNotLeader
+	}
+	if count < quorum {
+		return -1, ErrUnconfirmed
+	}
+	return readIndex, nil
 }
 
-func (rf *Raft) sendInstallSnapshot(server int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
-	ok := rf.peers[server].Call("Raft.InstallSnapshot", args, reply)
+/*
+ * LeaseRead is like ReadIndex, but relies on the leader's lease, with cfg.LeaseDuration set,
+ * instead of a round of AppendEntries, so it returns at once. The second return value is false
+ * if leases are disabled, this peer is not the leader, its lease has lapsed or was given up to
+ * a leadership transfer, or it has not yet committed an entry from its own term.
+ */
+
+func (rf *Raft) LeaseRead() (int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
-	if !ok || rf.state != STATE_LEADER || args.Term != rf.currentTerm {
-		// invalid request
-		return ok
+	if rf.cfg.LeaseDuration <= 0 || rf.state != STATE_LEADER || rf.paused || rf.leaseRevoked {
+		return -1, false
 	}
-
-	if reply.Term > rf.currentTerm {
-		// become follower and update current term
-		rf.currentTerm = reply.Term
-		rf.state = STATE_FOLLOWER
-		rf.votedFor = -1
-		rf.persist()
-		return ok
+	if rf.log[rf.commitIndex-rf.log[0].Index].Term != rf.currentTerm || !time.Now().Before(rf.leaseExpiry()) {
+		return -1, false
 	}
+	return rf.commitIndex, true
+}
 
-	rf.nextIndex[server] = args.LastIncludedIndex + 1
-	rf.matchIndex[server] = args.LastIncludedIndex
+/*
+ * HoldsLease reports whether this peer is the leader and may serve a read under its lease
+ * right now, that is whether LeaseRead would succeed. The answer may be stale by the time it
+ * is used; a service reading locally should call LeaseRead, which also returns the index the
+ * read must wait for.
+ */
+
+func (rf *Raft) HoldsLease() bool {
+	_, ok := rf.LeaseRead()
 	return ok
 }
 
 /*
- * Broadcast heartbeat to all followers.
- * The heartbeat may be AppendEntries or InstallSnapshot.
+ * Return when the leader's lease runs out: LeaseDuration after the latest time at which
+ * a commit quorum, counting the leader itself, had acknowledged it.
+ * Must be called with the lock held.
  */
 
-func (rf *Raft) broadcastHeartbeat() {
-	rf.mu.Lock()
-	defer rf.mu.Unlock()
+func (rf *Raft) leaseExpiry() time.Time {
+	others := rf.cfg.commitQuorum(len(rf.voters)) - 1
+	if others == 0 {
+		return time.Now().Add(rf.cfg.LeaseDuration)
+	}
+	acked := make([]time.Time, 0, len(rf.voters))
+	for _, i := range rf.otherVoters() {
+		acked = append(acked, rf.ackedAt[i])
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i].After(acked[j]) })
+	return acked[others-1].Add(rf.cfg.LeaseDuration)
+}
 
-	baseIndex := rf.log[0].Index
-	snapshot := rf.persister.ReadSnapshot()
+/*
+ * Renew the lease with server's acknowledgement of an AppendEntries sent at sent. Any answer
+ * in the leader's term counts, whether to a heartbeat, to entries or to a ReadIndex round.
+ * Must be called with the lock held, as the leader.
+ */
 
-	for server := range rf.peers {
-		if server != rf.me && rf.state == STATE_LEADER {
-			if rf.nextIndex[server] > baseIndex {
-				args := &AppendEntriesArgs{}
-				args.Term = rf.currentTerm
-				args.LeaderId = rf.me
-				args.PrevLogIndex = rf.nextIndex[server] - 1
-				if args.PrevLogIndex >= baseIndex {
-					args.PrevLogTerm = rf.log[args.PrevLogIndex-baseIndex].Term
-				}
-				if rf.nextIndex[server] <= rf.getLastLogIndex() {
-					args.Entries = rf.log[rf.nextIndex[server]-baseIndex:]
-				}
-				args.LeaderCommit = rf.commitIndex
-
-				go rf.sendAppendEntries(server, args, &AppendEntriesReply{})
-			} else {
-				args := &InstallSnapshotArgs{}
-				args.Term = rf.currentTerm
-				args.LeaderId = rf.me
-				args.LastIncludedIndex = rf.log[0].Index
-				args.LastIncludedTerm = rf.log[0].Term
-				args.Data = snapshot
-
-				go rf.sendInstallSnapshot(server, args, &InstallSnapshotReply{})
-			}
-		}
+func (rf *Raft) renewLease(server int, sent time.Time) {
+	if sent.After(rf.ackedAt[server]) {
+		rf.ackedAt[server] = sent
 	}
 }
 
+// errors returned by TransferLeadership.
+var (
+	ErrNotLeader       = errors.New("raft: not the leader")
+	ErrBadTarget       = errors.New("raft: transfer target is not another peer")
+	ErrTransferring    = errors.New("raft: a leadership transfer is under way")
+	ErrTransferTimeout = errors.New("raft: leadership transfer timed out")
+)
+
+// how long TransferLeadership waits for the target to catch up, and then to be elected.
+const transferTimeout = time.Millisecond * 500
+
 /*
- * The service using Raft (e.g. a k/v server) wants to start
+ * TransferLeadership hands leadership over to peer target, e.g. before taking this server
+ * down for maintenance. The leader stops accepting commands, wakes target's senders until its
+ * log has caught up, then tells it through TimeoutNow to start an election immediately, which
+ * it wins with a higher term. Returns once this peer has stepped down, or with ErrNotLeader
+ * if it is not the leader, ErrBadTarget if target is not another peer, and ErrTransferring if
+ * a transfer is already under way. If target does not catch up, or is not elected, within
+ * transferTimeout, the leader accepts commands again and ErrTransferTimeout is returned; its
+ * lease, once given up, stays revoked for the rest of its term.
+ * Start refuses commands during the transfer as if this peer were not the leader, and
+ * TryStart with ErrTransferring.
+ */
+
+func (rf *Raft) TransferLeadership(target int) error {
+	rf.mu.Lock()
+	if rf.state != STATE_LEADER || rf.paused {
+		rf.mu.Unlock()
+		return ErrNotLeader
+	}
+	if target == rf.me || !rf.isVoter(target) {
+		rf.mu.Unlock()
+		return ErrBadTarget
+	}
+	if rf.transferring {
+		rf.mu.Unlock()
+		return ErrTransferring
+	}
+	rf.transferring = true
+	term := rf.currentTerm
+	rf.mu.Unlock()
+
+	defer func() {
+		rf.mu.Lock()
+		rf.transferring = false
+		rf.mu.Unlock()
+	}()
+	deadline := time.Now().Add(transferTimeout)
+	if err := rf.catchUp(target, term, deadline); err != nil {
+		return err
+	}
+
+	args := &TimeoutNowArgs{}
+	args.Term = term
+	args.LeaderId = rf.me
+	rf.call(target, "Raft.TimeoutNow", args, &TimeoutNowReply{})
+	for {
+		rf.mu.Lock()
+		steppedDown := rf.state != STATE_LEADER || rf.currentTerm != term
+		rf.mu.Unlock()
+		if steppedDown {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTransferTimeout
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+/*
+ * Wake target's senders until its log matches the leader's, giving up the leader's lease once
+ * it does. Returns ErrNotLeader if the leader steps down first, and ErrTransferTimeout past
+ * deadline. New commands are refused meanwhile, so the log the target must match stays put.
+ */
+
+func (rf *Raft) catchUp(target int, term int, deadline time.Time) error {
+	for {
+		rf.mu.Lock()
+		if rf.state != STATE_LEADER || rf.currentTerm != term {
+			rf.mu.Unlock()
+			return ErrNotLeader
+		}
+		caughtUp := rf.matchIndex[target] >= rf.getLastLogIndex()
+		if caughtUp {
+			// target will be elected at once, without waiting for our lease to lapse.
+			rf.leaseRevoked = true
+		}
+		rf.mu.Unlock()
+
+		if caughtUp {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTransferTimeout
+		}
+		rf.mu.Lock()
+		select {
+		case rf.wake[target] <- struct{}{}:
+		default:
+			// a round to target is already pending
+		}
+		rf.mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term   int
+	Paused bool // the peer is paused; treat the RPC as lost
+}
+
+/*
+ * TimeoutNow RPC handler: the leader of the current term asks this follower to start an election now.
+ */
+
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+
+	reply.Term = rf.currentTerm
+	if args.Term != rf.currentTerm || rf.state != STATE_FOLLOWER || !rf.isVoter(rf.me) {
+		// only the current leader may hand over leadership, and only to a voter
+		return
+	}
+
+	// an election may already be pending
+	signal(rf.chanTimeoutNow)
+}
+
+/*
+ * ProbeLog RPC, sent once by a newly elected leader when cfg.ProbeOnElection is set.
+ * The follower reports the index and term of its last log entry.
+ */
+
+type ProbeLogArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type ProbeLogReply struct {
+	Term         int
+	LastLogIndex int
+	LastLogTerm  int
+	Paused       bool // the follower is paused; treat the RPC as lost
+}
+
+func (rf *Raft) ProbeLog(args *ProbeLogArgs, reply *ProbeLogReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	defer rf.flushPersist()
+
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+
+	if args.Term < rf.currentTerm {
+		// reject requests with stale term number
+		reply.Term = rf.currentTerm
+		return
+	}
+
+	if args.Term > rf.currentTerm {
+		// become follower and update current term
+		rf.state = STATE_FOLLOWER
+		rf.setTerm(args.Term)
+		rf.votedFor = -1
+	}
+
+	// the probe comes from the current leader, so it counts as a heartbeat
+	rf.leaderId = args.LeaderId
+	rf.heardAt = time.Now()
+	signal(rf.chanHeartbeat)
+
+	reply.Term = rf.currentTerm
+	reply.LastLogIndex = rf.getLastLogIndex()
+	reply.LastLogTerm = rf.getLastLogTerm()
+}
+
+/*
+ * Move nextIndex[server] back to the last point where the follower's log can match the leader's.
+ * If the follower's last entry is also in the leader's log, replication resumes right after it;
+ * otherwise the usual AppendEntries conflict handling takes over from the estimate.
+ */
+
+func (rf *Raft) sendProbeLog(server int, args *ProbeLogArgs, reply *ProbeLogReply) bool {
+	ok := rf.call(server, "Raft.ProbeLog", args, reply) && !reply.Paused
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if !ok || rf.state != STATE_LEADER || args.Term != rf.currentTerm {
+		// invalid request
+		return ok
+	}
+	if reply.Term > rf.currentTerm {
+		// become follower and update current term
+		rf.setTerm(reply.Term)
+		rf.state = STATE_FOLLOWER
+		rf.votedFor = -1
+		rf.persist()
+		return ok
+	}
+	if rf.matchIndex[server] > 0 {
+		// replication already made progress; the probe has nothing to add
+		return ok
+	}
+
+	// terms never decrease along a log, so no entry of the leader's with a term above the
+	// follower's last term can be in the follower's log.
+	baseIndex := rf.log[0].Index
+	i := min(reply.LastLogIndex, rf.getLastLogIndex())
+	for i >= baseIndex && rf.log[i-baseIndex].Term > reply.LastLogTerm {
+		i--
+	}
+	next := i + 1
+	// never move nextIndex forward past what AppendEntries rejections have already shown.
+	rf.nextIndex[server] = min(rf.nextIndex[server], next)
+
+	return ok
+}
+
+func (rf *Raft) broadcastProbeLog() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	args := &ProbeLogArgs{}
+	args.Term = rf.currentTerm
+	args.LeaderId = rf.me
+
+	for _, server := range rf.replicas() {
+		if rf.state == STATE_LEADER {
+			go rf.sendProbeLog(server, args, &ProbeLogReply{})
+		}
+	}
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Offset            int // position of Data in the snapshot, with cfg.SnapshotRateLimit set
+	Data              []byte
+	Done              bool  // Data ends the snapshot
+	Voters            []int // the leader's voters, which the snapshot may hide the entry of
+	Learners          []int // and its learners
+	VotersIndex       int   // index of the entry that set them
+}
+
+type InstallSnapshotReply struct {
+	Term     int
+	Paused   bool // the follower is paused; treat the RPC as lost
+	Received int  // bytes of the snapshot the follower holds, to send the next chunk from
+}
+
+// snapshotProgress is how much of the leader's snapshot at index a follower has acknowledged.
+type snapshotProgress struct {
+	index    int
+	received int
+}
+
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.paused || rf.killed() {
+		// behave as if unreachable
+		reply.Paused = true
+		return
+	}
+
+	if args.Term < rf.currentTerm {
+		// reject requests with stale term number
+		reply.Term = rf.currentTerm
+		return
+	}
+	// cannot be leader if I have term number less that someone 
+	if args.Term > rf.currentTerm {
+		// become follower and update current term
+		rf.state = STATE_FOLLOWER
+		rf.setTerm(args.Term)
+		rf.votedFor = -1
+		rf.persist()
+	}
+
+	// confirm heartbeat to refresh timeout
+	rf.leaderId = args.LeaderId
+	rf.heardAt = time.Now()
+	signal(rf.chanHeartbeat)
+
+	reply.Term = rf.currentTerm
+
+	data := args.Data
+	if args.Offset > 0 || !args.Done {
+		var complete bool
+		if data, complete = rf.assembleSnapshot(args, reply); !complete {
+			return
+		}
+	}
+	reply.Received = args.Offset + len(args.Data)
+
+	if parsed, err := ParseSnapshot(data); err != nil ||
+		parsed.LastIncludedIndex != args.LastIncludedIndex || parsed.LastIncludedTerm != args.LastIncludedTerm {
+		// never install a snapshot this peer could not recover from
+		return
+	}
+
+	if args.LastIncludedIndex > rf.commitIndex {
+		rf.needSnapshot = false
+		rf.trimLog(args.LastIncludedIndex, args.LastIncludedTerm)
+		rf.commitIndex = args.LastIncludedIndex
+		if len(args.Voters) > 0 && (args.VotersIndex > rf.votersIndex || len(rf.voters) == 0) {
+			// the leader's voters are committed, so they may be adopted ahead of the log
+			rf.setMembership(Membership{Voters: args.Voters, Learners: args.Learners}, args.VotersIndex)
+		}
+		rf.persister.SaveStateAndSnapshot(rf.getRaftState(), data)
+		rf.applyCond.Broadcast()
+
+		// send snapshot to kv server, after whatever the applier is delivering now; a snapshot
+		// still pending is covered by this one
+		rf.pendingSnapshot = &ApplyMsg{UseSnapshot: true, Snapshot: data, SnapshotIndex: args.LastIncludedIndex}
+		rf.commitCond.Signal()
+	}
+}
+
+/*
+ * Add a chunk of a snapshot sent in parts to those received so far, and return the whole
+ * snapshot once its last chunk is in. Chunks must arrive in order; one that does not follow
+ * on from what this peer holds is dropped, and the reply tells the leader where to resume.
+ */
+
+func (rf *Raft) assembleSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) ([]byte, bool) {
+	if args.Offset == 0 {
+		rf.chunks = nil
+		rf.chunksIndex, rf.chunksTerm = args.LastIncludedIndex, args.LastIncludedTerm
+	}
+	if args.LastIncludedIndex != rf.chunksIndex || args.LastIncludedTerm != rf.chunksTerm {
+		// the chunk is of another snapshot than the one being assembled; start over.
+		reply.Received = 0
+		return nil, false
+	}
+	if args.Offset != len(rf.chunks) {
+		reply.Received = len(rf.chunks)
+		return nil, false
+	}
+	rf.chunks = append(rf.chunks, args.Data...)
+	reply.Received = len(rf.chunks)
+	if !args.Done {
+		return nil, false
+	}
+	data := rf.chunks
+	rf.chunks = nil
+	return data, true
+}
+
+/*
+ * Discard old log entries up to lastIncludedIndex.
+ */
+
+func (rf *Raft) trimLog(lastIncludedIndex int, lastIncludedTerm int) {
+	newLog := make([]LogEntry, 0)
+	newLog = append(newLog, LogEntry{Index: lastIncludedIndex, Term: lastIncludedTerm})
+
+	for i := len(rf.log) - 1; i >= 0; i-- {
+		if rf.log[i].Index == lastIncludedIndex && rf.log[i].Term == lastIncludedTerm {
+			newLog = append(newLog, rf.log[i+1:]...)
+			break
+		}
+	}
+	rf.log = newLog
+}
+
+func (rf *Raft) sendInstallSnapshot(server int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	ok := rf.call(server, "Raft.InstallSnapshot", args, reply) && !reply.Paused
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if !ok || rf.state != STATE_LEADER || args.Term != rf.currentTerm {
+		// invalid request
+		return ok
+	}
+
+	if reply.Term > rf.currentTerm {
+		// become follower and update current term
+		rf.setTerm(reply.Term)
+		rf.state = STATE_FOLLOWER
+		rf.votedFor = -1
+		rf.persist()
+		return ok
+	}
+
+	if sent := &rf.snapshotSent[server]; sent.index == args.LastIncludedIndex {
+		// the next chunk goes from wherever the follower is.
+		sent.received = reply.Received
+	}
+	if !args.Done || reply.Received != args.Offset+len(args.Data) {
+		return ok
+	}
+	rf.snapshotSent[server] = snapshotProgress{}
+	rf.nextIndex[server] = args.LastIncludedIndex + 1
+	rf.advanceMatchIndex(server, args.LastIncludedIndex)
+	return ok
+}
+
+/*
+ * Broadcast heartbeat to all followers, by waking one of each follower's senders, or without
+ * cfg.MaxInflightAppends from a goroutine of its own. The heartbeat may be AppendEntries or
+ * InstallSnapshot.
+ */
+
+func (rf *Raft) broadcastHeartbeat() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.killed() {
+		return
+	}
+
+	for _, server := range rf.replicas() {
+		if rf.state == STATE_LEADER {
+			if rf.cfg.sendersPerPeer() == 0 {
+				go rf.replicate(server)
+				continue
+			}
+			select {
+			case rf.wake[server] <- struct{}{}:
+			default:
+				// no sender has been free since the last round; it will take the next
+				// message from the state as it is then, so one wake-up covers both.
+				rf.metrics.SkippedRounds++
+			}
+		}
+	}
+}
+
+/*
+ * Send the leader's messages to server, one at a time, each time a heartbeat round wakes it.
+ * With cfg.MaxInflightAppends set, the leader runs that many of these per follower for as long
+ * as the peer lives, so a slow or unreachable follower ties up a fixed number of goroutines
+ * however many rounds go by, rather than one per round.
+ */
+
+func (rf *Raft) sender(server int) {
+	rf.mu.Lock()
+	wake := rf.wake[server]
+	rf.mu.Unlock()
+	for {
+		select {
+		case <-rf.done:
+			return
+		case <-wake:
+		}
+		rf.replicate(server)
+	}
+}
+
+/*
+ * Send server the message it needs next, AppendEntries or InstallSnapshot, built from the
+ * leader's state at the moment of sending, and wait for the reply.
+ */
+
+func (rf *Raft) replicate(server int) {
+	rf.mu.Lock()
+	if rf.state != STATE_LEADER {
+		rf.mu.Unlock()
+		return
+	}
+	baseIndex := rf.log[0].Index
+	snapshot := rf.persister.ReadSnapshot()
+	var send func()
+
+	// a follower that keeps rejecting is far behind or diverged; past the threshold,
+	// replace its log with the snapshot instead of walking nextIndex back further.
+	// a transfer under way in chunks is carried through too.
+	fallback := (rf.snapshotWanted[server] || rf.cfg.SnapshotAfterRejections > 0 && rf.rejections[server] >= rf.cfg.SnapshotAfterRejections ||
+		rf.snapshotSent[server].index == baseIndex && rf.snapshotSent[server].received > 0) &&
+		baseIndex > 0 && len(snapshot) > 0
+	if rf.nextIndex[server] > baseIndex && !fallback {
+		args := &AppendEntriesArgs{}
+		args.Term = rf.currentTerm
+		args.LeaderId = rf.me
+		args.PrevLogIndex = rf.nextIndex[server] - 1
+		if args.PrevLogIndex >= baseIndex {
+			args.PrevLogTerm = rf.log[args.PrevLogIndex-baseIndex].Term
+		}
+		if rf.nextIndex[server] <= rf.getLastLogIndex() {
+			args.Entries = rf.log[rf.nextIndex[server]-baseIndex:]
+		}
+		args.LeaderCommit = rf.commitIndex
+		args.LastLogIndex = rf.getLastLogIndex()
+		args.LastLogTerm = rf.getLastLogTerm()
+
+		if len(args.Entries) > 0 {
+			rf.metrics.AppendEntries++
+		} else {
+			rf.metrics.Heartbeats++
+		}
+		send = func() { rf.sendAppendEntries(server, args, &AppendEntriesReply{}) }
+	} else if offset, chunk, ok := rf.nextSnapshotChunk(server, snapshot); ok {
+		if fallback {
+			rf.metrics.SnapshotFallbacks++
+			rf.rejections[server] = 0
+			rf.snapshotWanted[server] = false
+		}
+		args := &InstallSnapshotArgs{}
+		args.Term = rf.currentTerm
+		args.LeaderId = rf.me
+		args.LastIncludedIndex = rf.log[0].Index
+		args.LastIncludedTerm = rf.log[0].Term
+		args.Offset = offset
+		args.Data = chunk
+		args.Done = offset+len(chunk) == len(snapshot)
+		rf.metrics.SnapshotChunks++
+		rf.metrics.SnapshotBytes += int64(len(chunk))
+		args.Voters = rf.voters
+		args.Learners = rf.learnerList()
+		args.VotersIndex = rf.votersIndex
+
+		send = func() { rf.sendInstallSnapshot(server, args, &InstallSnapshotReply{}) }
+	} else {
+		// the snapshot must wait for the rate limit, so keep the follower's
+		// election timer from firing with an empty AppendEntries meanwhile.
+		args := &AppendEntriesArgs{}
+		args.Term = rf.currentTerm
+		args.LeaderId = rf.me
+		args.PrevLogIndex = baseIndex
+		args.PrevLogTerm = rf.log[0].Term
+		args.LeaderCommit = rf.commitIndex
+		args.LastLogIndex = rf.getLastLogIndex()
+		args.LastLogTerm = rf.getLastLogTerm()
+
+		rf.metrics.Heartbeats++
+		send = func() { rf.sendAppendEntries(server, args, &AppendEntriesReply{}) }
+	}
+	rf.busy[server]++
+	rf.mu.Unlock()
+
+	send()
+
+	rf.mu.Lock()
+	rf.busy[server]--
+	rf.mu.Unlock()
+}
+
+/*
+ * Return the next chunk of snapshot to send server and its offset, the whole snapshot unless
+ * cfg.SnapshotRateLimit is set, or false if the chunk would exceed the rate limit.
+ */
+
+func (rf *Raft) nextSnapshotChunk(server int, snapshot []byte) (int, []byte, bool) {
+	sent := &rf.snapshotSent[server]
+	if sent.index != rf.log[0].Index || sent.received >= len(snapshot) {
+		// the leader has snapshotted again since the transfer started, so it starts over.
+		*sent = snapshotProgress{index: rf.log[0].Index}
+	}
+	end := len(snapshot)
+	if size := rf.cfg.snapshotChunkSize(); size > 0 && sent.received+size < end {
+		end = sent.received + size
+	}
+	if !rf.reserveSnapshotTransfer(end - sent.received) {
+		return 0, nil, false
+	}
+	return sent.received, snapshot[sent.received:end], true
+}
+
+/*
+ * Reserve the leader's snapshot bandwidth for a transfer of size bytes.
+ * Returns false if the transfer would exceed the configured SnapshotRateLimit.
+ */
+
+func (rf *Raft) reserveSnapshotTransfer(size int) bool {
+	if rf.cfg.SnapshotRateLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Before(rf.snapshotFreeAt) {
+		return false
+	}
+	rf.snapshotFreeAt = now.Add(time.Duration(size) * time.Second / time.Duration(rf.cfg.SnapshotRateLimit))
+	return true
+}
+
+/*
+ * The service using Raft (e.g. a k/v server) wants to start
  agreement on the next command to be appended to Raft's log. 
  * If this server isn't the leader, returns false. 
  * Otherwise start the agreement and return immediately. 
@@ -614,12 +1735,125 @@ func (rf *Raft) broadcastHeartbeat() {
  * The first return value is the index that the command will appear at if it's ever committed. 
  * The second return value is the current term. 
  * The third return value is true if this server believes it is the leader.
+ * During a leadership transfer the command is refused, as if this server were not the leader.
+ * With cfg.StrictCommands, a command that cannot be persisted intact is logged and refused,
+ as if this server were not the leader; use TryStart to get the error back.
  */ 
 
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
+	if rf.cfg.StrictCommands {
+		if err := gobWrapper.ValidateEncodable(command); err != nil {
+			log.Printf("raft %d: refusing command %T: %v", rf.me, command, err)
+			return -1, rf.currentTerm, false
+		}
+	}
+	if rf.transferring {
+		return -1, rf.currentTerm, false
+	}
+	return rf.start(command)
+}
+
+// errors returned by TryStart when the leader declines to append a command.
+var (
+	ErrBusy          = errors.New("raft: uncommitted backlog is full")
+	ErrReconfiguring = errors.New("raft: a configuration change is uncommitted")
+)
+
+/*
+ * TryStart is like Start, but honours cfg.MaxUncommittedEntries and cfg.ReconfigPolicy.
+ * If this server is the leader but its uncommitted backlog is at the limit, the command is
+ * not appended and the error is ErrBusy; the caller may retry later.
+ * While a configuration change is uncommitted, ReconfigReject refuses the command with
+ * ErrReconfiguring, and ReconfigQueue blocks until the change commits before appending it;
+ * if it has not committed within membershipTimeout, as on a leader cut off from its
+ * followers, the command is refused with ErrReconfiguring after all.
+ * During a leadership transfer the command is refused with ErrTransferring.
+ * A queued command is dropped, with isLeader false, if the leader steps down or is killed
+ * meanwhile.
+ * With cfg.StrictCommands, a command that cannot be persisted intact is refused with the
+ * error from gobWrapper.ValidateEncodable.
+ */
+
+func (rf *Raft) TryStart(command interface{}) (int, int, bool, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.cfg.StrictCommands {
+		if err := gobWrapper.ValidateEncodable(command); err != nil {
+			return -1, rf.currentTerm, rf.state == STATE_LEADER, err
+		}
+	}
+
+	var expiry *time.Timer
+	expired := false
+	for rf.state == STATE_LEADER && !rf.killed() && rf.reconfiguring() {
+		if rf.cfg.ReconfigPolicy == ReconfigReject || expired {
+			return -1, rf.currentTerm, true, ErrReconfiguring
+		}
+		if rf.cfg.ReconfigPolicy != ReconfigQueue {
+			break
+		}
+		if expiry == nil {
+			// a condition variable can't wait with a deadline, so wake the waiter at it.
+			expiry = time.AfterFunc(membershipTimeout, func() {
+				rf.mu.Lock()
+				expired = true
+				rf.applyCond.Broadcast()
+				rf.mu.Unlock()
+			})
+			defer expiry.Stop()
+		}
+		// woken as entries are applied, and when the term changes or the peer is paused or killed.
+		rf.applyCond.Wait()
+	}
+	if rf.killed() {
+		return -1, rf.currentTerm, false, nil
+	}
+	if rf.state == STATE_LEADER && rf.transferring {
+		return -1, rf.currentTerm, true, ErrTransferring
+	}
+	if rf.state == STATE_LEADER && rf.cfg.MaxUncommittedEntries > 0 &&
+		rf.getLastLogIndex()-rf.commitIndex >= rf.cfg.MaxUncommittedEntries {
+		return -1, rf.currentTerm, true, ErrBusy
+	}
+	index, term, isLeader := rf.start(command)
+	return index, term, isLeader, nil
+}
+
+/*
+ * Backlog returns how many entries the leader's log holds past its commit index, along with
+ * cfg.MaxUncommittedEntries, the backlog at which TryStart starts refusing commands.
+ * A peer that is not the leader reports an empty backlog.
+ */
+
+func (rf *Raft) Backlog() (int, int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.state != STATE_LEADER || rf.paused {
+		return 0, rf.cfg.MaxUncommittedEntries
+	}
+	return rf.getLastLogIndex() - rf.commitIndex, rf.cfg.MaxUncommittedEntries
+}
+
+/*
+ * Report whether the log holds a configuration change past the commit index.
+ * Must be called with the lock held.
+ */
+
+func (rf *Raft) reconfiguring() bool {
+	baseIndex := rf.log[0].Index
+	for i := max(rf.commitIndex+1, baseIndex+1); i <= rf.getLastLogIndex(); i++ {
+		if c, ok := rf.log[i-baseIndex].Command.(ConfigChange); ok && c.IsConfigChange() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rf *Raft) start(command interface{}) (int, int, bool) {
 	term, index := -1, -1
 	isLeader := (rf.state == STATE_LEADER)
 
@@ -628,45 +1862,182 @@ func (rf *Raft) Start(command interface{}) (int, int, bool) {
 		index = rf.getLastLogIndex() + 1
 		rf.log = append(rf.log, LogEntry{Index: index, Term: term, Command: command})
 		rf.persist()
+		// the leader's own match advanced, which commits the entry if it alone is a quorum
+		rf.advanceCommitIndex()
 	}
 	return index, term, isLeader
 }
 
 /* 
  * The tester calls Kill() when a Raft instance won't be needed again. 
+ * Its goroutines stop: the main loop within an election timeout, and anything waiting to hand
+ * a message to applyCh at once, as the service may have stopped reading it, as do callers
+ * blocked in WaitForApplied or TryStart. Once Kill returns,
+ * nothing more is sent on applyCh, and the RPC handlers answer as if the peer were unreachable.
  */
+
 func (rf *Raft) Kill() {
-	// Empty
+	rf.killOnce.Do(func() { close(rf.done) })
+	rf.mu.Lock()
+	rf.commitCond.Signal()
+	// lastApplied will not advance again, so release WaitForApplied and commands queued in TryStart
+	rf.applyCond.Broadcast()
+	rf.mu.Unlock()
+	// the applier gives up any delivery under way, or finishes it, before it exits
+	<-rf.applierDone
+}
+
+/*
+ * Report whether Kill has been called.
+ */
+
+func (rf *Raft) killed() bool {
+	select {
+	case <-rf.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * Hand msg to the service on applyCh, unless the peer is killed first.
+ * Returns false if it was not handed over.
+ * Only the applier calls it, but for Make delivering the snapshot it starts from.
+ */
+
+func (rf *Raft) deliver(msg ApplyMsg) bool {
+	if rf.killed() {
+		return false
+	}
+	select {
+	case rf.chanApply <- msg:
+		return true
+	case <-rf.done:
+		return false
+	}
+}
+
+/*
+ * Send an RPC to a peer, waiting at most cfg.SnapshotTimeout for an InstallSnapshot and
+ * cfg.RPCTimeout for anything else. A zero timeout waits as long as the transport does.
+ */
+
+func (rf *Raft) call(server int, svcMeth string, args interface{}, reply interface{}) bool {
+	timeout := rf.cfg.RPCTimeout
+	if svcMeth == "Raft.InstallSnapshot" {
+		timeout = rf.cfg.SnapshotTimeout
+	}
+	rf.mu.Lock()
+	end := rf.peers[server]
+	rf.mu.Unlock()
+	if end == nil {
+		// a peer added without cfg.PeerEnd to reach it by
+		return false
+	}
+	return end.CallWithTimeout(svcMeth, args, reply, timeout)
+}
+
+/*
+ * Return the source peer me draws its election timeouts from, seeded from seed, or from the
+ * clock if seed is zero.
+ */
+
+func electionRand(seed int64, me int) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed + int64(me)))
+}
+
+/*
+ * Draw a randomized election timeout, between cfg.ElectionTimeoutMin and cfg.ElectionTimeoutMax,
+ * from the peer's own source.
+ * With cfg.AdaptiveElectionTimeout the range is scaled to the heartbeats the peer observes.
+ */
+
+func (rf *Raft) electionTimeout() time.Duration {
+	if !rf.cfg.AdaptiveElectionTimeout {
+		shortest := rf.cfg.electionTimeoutMin()
+		return shortest + time.Duration(rf.rand.Int63n(int64(rf.cfg.electionTimeoutMax()-shortest)))
+	}
+	shortest := rf.shortestElectionTimeout()
+	return shortest + time.Duration(rf.rand.Int63n(int64(shortest*3/2)))
 }
 
 func (rf *Raft) Run() {
-	for {
-		switch rf.state {
+	for !rf.killed() {
+		// the RPC handlers change the state too, so it is only read and written under the lock.
+		rf.mu.Lock()
+		state := rf.state
+		rf.mu.Unlock()
+		switch state {
 		case STATE_FOLLOWER:
 			select {
 			case <-rf.chanGrantVote:
 			case <-rf.chanHeartbeat:
-			case <-time.After(time.Millisecond * time.Duration(rand.Intn(300)+200)):
-				rf.state = STATE_CANDIDATE
-				rf.persist()
+			case <-rf.done:
+			case <-rf.chanTimeoutNow:
+				rf.mu.Lock()
+				if !rf.paused && rf.isVoter(rf.me) {
+					// the leader is handing over leadership; don't wait for the timeout
+					rf.state = STATE_CANDIDATE
+					rf.transferElection = true
+					rf.persist()
+				}
+				rf.mu.Unlock()
+			case <-time.After(rf.electionTimeout()):
+				rf.mu.Lock()
+				if !rf.paused && rf.isVoter(rf.me) {
+					// a paused peer never starts an election, nor does one outside the configuration
+					rf.state = STATE_CANDIDATE
+					rf.persist()
+				}
+				rf.mu.Unlock()
 			}
 		case STATE_LEADER:
 			go rf.broadcastHeartbeat()
-			time.Sleep(time.Millisecond * 60)
+			time.Sleep(rf.cfg.heartbeatInterval())
 		case STATE_CANDIDATE:
 			rf.mu.Lock()
-			rf.currentTerm++
+			preVote := rf.cfg.PreVote && !rf.transferElection
+			rf.mu.Unlock()
+			if preVote && !rf.winPreVote() {
+				// too few peers would vote; wait out another timeout at the same term
+				rf.mu.Lock()
+				if rf.state == STATE_CANDIDATE {
+					rf.state = STATE_FOLLOWER
+				}
+				rf.mu.Unlock()
+				continue
+			}
+
+			rf.mu.Lock()
+			if rf.state != STATE_CANDIDATE {
+				// a leader of this term or a later one has been heard from meanwhile
+				rf.mu.Unlock()
+				continue
+			}
+			rf.setTerm(rf.currentTerm + 1)
 			rf.votedFor = rf.me
 			rf.voteCount = 1
+			rf.metrics.Elections++
+			transfer := rf.transferElection
+			rf.transferElection = false
 			rf.persist()
 			rf.mu.Unlock()
-			go rf.broadcastRequestVote()
+			go rf.broadcastRequestVote(transfer)
 
 			select {
 			case <-rf.chanHeartbeat:
-				rf.state = STATE_FOLLOWER
+				rf.mu.Lock()
+				if rf.state == STATE_CANDIDATE {
+					rf.state = STATE_FOLLOWER
+				}
+				rf.mu.Unlock()
 			case <-rf.chanWinElect:
-			case <-time.After(time.Millisecond * time.Duration(rand.Intn(300)+200)):
+			case <-rf.done:
+			case <-time.After(rf.electionTimeout()):
 			}
 		}
 	}
@@ -685,32 +2056,100 @@ func (rf *Raft) Run() {
 
 func Make(peers []*rpc.ClientEnd, me int,
 	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	rf, _ := MakeWithConfig(peers, me, persister, applyCh, Config{})
+	return rf
+}
+
+/*
+ * MakeWithConfig is like Make, but lets the service tune the peer through cfg.
+ * Returns an error, without starting the peer, if cfg is invalid.
+ */
+
+func MakeWithConfig(peers []*rpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg, cfg Config) (*Raft, error) {
+	if err := cfg.validate(len(peers)); err != nil {
+		return nil, err
+	}
+
 	rf := &Raft{}
 	rf.peers = peers
 	rf.persister = persister
 	rf.me = me
+	rf.cfg = cfg
 
 	rf.state = STATE_FOLLOWER
 	rf.voteCount = 0
 
 	rf.currentTerm = 0
 	rf.votedFor = -1
+	rf.leaderId = -1
 	rf.log = append(rf.log, LogEntry{Term: 0})
 
 	rf.commitIndex = 0
 	rf.lastApplied = 0
+	rf.applyCond = sync.NewCond(&rf.mu)
+	rf.commitCond = sync.NewCond(&rf.mu)
+
+	gobWrapper.Register(Membership{})
+	if !cfg.Join {
+		for server := range peers {
+			rf.voters = append(rf.voters, server)
+		}
+	}
+	rf.joining = -1
+	rf.abandoned = -1
+
+	rf.wake = make([]chan struct{}, len(peers))
+	rf.busy = make([]int, len(peers))
+	for server := range peers {
+		rf.wake[server] = make(chan struct{}, 1)
+	}
+	rf.rejections = make([]int, len(peers))
+	rf.snapshotWanted = make([]bool, len(peers))
+	rf.snapshotSent = make([]snapshotProgress, len(peers))
+	// a restarted peer may have acknowledged a leader just before it went down,
+	// so it honours that leader's lease as if it had just heard from it.
+	rf.heardAt = time.Now()
+
+	rf.rand = electionRand(cfg.ElectionSeed, me)
 
 	rf.chanApply = applyCh
-	rf.chanGrantVote = make(chan bool, 100)
-	rf.chanWinElect = make(chan bool, 100)
-	rf.chanHeartbeat = make(chan bool, 100)
+	rf.done = make(chan struct{})
+	rf.applierDone = make(chan struct{})
+	rf.chanGrantVote = make(chan bool, 1)
+	rf.chanWinElect = make(chan bool, 1)
+	rf.chanHeartbeat = make(chan bool, 1)
+	rf.chanTimeoutNow = make(chan bool, 1)
+	if cfg.OnTermChange != nil {
+		rf.termChanged = make(chan struct{}, 1)
+	}
+	if cfg.OnVote != nil {
+		rf.votesQueued = make(chan struct{}, 1)
+	}
 
 	// initialize from state persisted before a crash
 	rf.readPersist(persister.ReadRaftState())
+	atomic.StoreInt64(&rf.term, int64(rf.currentTerm))
 	rf.recoverFromSnapshot(persister.ReadSnapshot())
 	rf.persist()
+	// a persisted commit index lets the entries known to be committed be applied right away
+	go rf.applier()
+
+	if cfg.OnTermChange != nil {
+		go rf.notifyTermChanges(rf.currentTerm)
+	}
+	if cfg.OnVote != nil {
+		go rf.notifyVotes()
+	}
 
+	for server := range peers {
+		if server != me {
+			for i := 0; i < cfg.sendersPerPeer(); i++ {
+				go rf.sender(server)
+			}
+		}
+	}
 	go rf.Run()
 
-	return rf
+	return rf, nil
 }
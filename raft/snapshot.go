@@ -0,0 +1,104 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+)
+
+// A version 2 snapshot is a container: the magic bytes, a version byte, and a sequence of
+// sections, each prefixed with its length as a uvarint. Section 0 holds the gob-encoded
+// lastIncludedIndex and lastIncludedTerm, and section 1 holds the service's data. Readers
+// skip sections they don't know, so later versions can add sections without breaking them.
+//
+// Version 1 snapshots, written before the container existed, are the gob-encoded
+// lastIncludedIndex and lastIncludedTerm directly followed by the service's data.
+const (
+	snapshotMagic   = "SNTL"
+	SnapshotVersion = 2 // version written by CreateSnapshot
+)
+
+// Snapshot is the decoded content of a snapshot, as returned by ParseSnapshot.
+type Snapshot struct {
+	Version           int    // format version the snapshot was read from
+	LastIncludedIndex int    // index of the last log entry the snapshot covers
+	LastIncludedTerm  int    // term of that entry
+	Data              []byte // the service's data, as passed to CreateSnapshot
+}
+
+// encodeSnapshot returns a snapshot of the current version holding data.
+func encodeSnapshot(lastIncludedIndex int, lastIncludedTerm int, data []byte) []byte {
+	w := new(bytes.Buffer)
+	e := gobWrapper.NewEncoder(w)
+	e.Encode(lastIncludedIndex)
+	e.Encode(lastIncludedTerm)
+
+	buf := []byte(snapshotMagic)
+	buf = append(buf, SnapshotVersion)
+	for _, section := range [][]byte{w.Bytes(), data} {
+		var length [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(length[:], uint64(len(section)))
+		buf = append(buf, length[:n]...)
+		buf = append(buf, section...)
+	}
+	return buf
+}
+
+// ParseSnapshot decodes a snapshot of any known version, such as the one delivered in
+// an ApplyMsg with UseSnapshot set.
+func ParseSnapshot(snapshot []byte) (Snapshot, error) {
+	if !bytes.HasPrefix(snapshot, []byte(snapshotMagic)) {
+		return parseSnapshotV1(snapshot)
+	}
+	buf := snapshot[len(snapshotMagic):]
+	if len(buf) < 1 {
+		return Snapshot{}, errors.New("raft: snapshot truncated before its version")
+	}
+	version := int(buf[0])
+	if version != SnapshotVersion {
+		return Snapshot{}, fmt.Errorf("raft: unknown snapshot version %d", version)
+	}
+	buf = buf[1:]
+
+	var sections [][]byte
+	for len(buf) > 0 {
+		length, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < length {
+			return Snapshot{}, fmt.Errorf("raft: snapshot section %d is truncated", len(sections))
+		}
+		sections = append(sections, buf[n:n+int(length)])
+		buf = buf[n+int(length):]
+	}
+	if len(sections) < 2 {
+		return Snapshot{}, fmt.Errorf("raft: snapshot has %d sections, want at least 2", len(sections))
+	}
+
+	s := Snapshot{Version: version, Data: sections[1]}
+	d := gobWrapper.NewDecoder(bytes.NewBuffer(sections[0]))
+	if err := d.Decode(&s.LastIncludedIndex); err != nil {
+		return Snapshot{}, fmt.Errorf("raft: snapshot header: %v", err)
+	}
+	if err := d.Decode(&s.LastIncludedTerm); err != nil {
+		return Snapshot{}, fmt.Errorf("raft: snapshot header: %v", err)
+	}
+	return s, nil
+}
+
+// parseSnapshotV1 decodes a snapshot written before the versioned container.
+func parseSnapshotV1(snapshot []byte) (Snapshot, error) {
+	s := Snapshot{Version: 1}
+	// the decoder reads a bytes.Buffer byte by byte, so what it leaves is exactly the service's data.
+	r := bytes.NewBuffer(snapshot)
+	d := gobWrapper.NewDecoder(r)
+	if err := d.Decode(&s.LastIncludedIndex); err != nil {
+		return Snapshot{}, fmt.Errorf("raft: snapshot header: %v", err)
+	}
+	if err := d.Decode(&s.LastIncludedTerm); err != nil {
+		return Snapshot{}, fmt.Errorf("raft: snapshot header: %v", err)
+	}
+	s.Data = r.Bytes()
+	return s, nil
+}
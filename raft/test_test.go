@@ -0,0 +1,445 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a paused peer catches up once resumed")
+	cfg.checkPauseResume()
+	cfg.end()
+}
+
+func TestSnapshotPacing(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{SnapshotRateLimit: 100000})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: rate-limited snapshot transfers are paced")
+	cfg.checkSnapshotPacing(50000)
+	cfg.end()
+}
+
+func TestHeartbeatMetrics(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: heartbeats are counted but replicate no bytes")
+	cfg.checkHeartbeatMetrics(time.Second)
+	cfg.end()
+}
+
+func TestWriteMetrics(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: the metrics text names every sample and reports current values")
+	cfg.checkWriteMetrics()
+	cfg.end()
+}
+
+func TestDelayedAppendEntries(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a delayed AppendEntries keeps entries in sync")
+	cfg.checkDelayedAppendEntries()
+	cfg.end()
+}
+
+func TestUnboundedSenders(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: zero MaxInflightAppends leaves RPCs to a follower unlimited")
+	cfg.checkUnboundedSenders(time.Second)
+	cfg.end()
+}
+
+func TestApplyOrder(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: entries and snapshots are applied in order")
+	cfg.checkApplyOrder(3)
+	cfg.end()
+}
+
+func TestCrashRecovery(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a leader crashed mid-replication loses no committed entry")
+	cfg.checkCrashRecovery(5)
+	cfg.end()
+}
+
+func TestTornSnapshot(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a peer restarted with its log trimmed past its snapshot catches up")
+	cfg.checkTornSnapshot()
+	cfg.end()
+}
+
+func TestPersistCommitIndex(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{PersistCommitIndex: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a restarted peer applies its persisted commits without a leader")
+	cfg.checkPersistCommitIndex(10)
+	cfg.end()
+}
+
+func TestStrictCommands(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{StrictCommands: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: strict mode refuses commands gob cannot encode")
+	cfg.checkStrictCommands()
+	cfg.end()
+}
+
+func TestCallTimeouts(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: RPCs wait no longer than their timeouts")
+	cfg.checkCallTimeouts()
+	cfg.end()
+}
+
+func TestVoteEvents(t *testing.T) {
+	rec := &voteRecorder{}
+	cfg := make_config_with(t, 3, false, Config{OnVote: rec.record})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: vote events report every vote granted or refused")
+	cfg.checkVoteEvents(rec)
+	cfg.end()
+}
+
+func TestProbeOnElection(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{ProbeOnElection: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: probing followers on election saves rejected AppendEntries")
+	cfg.checkProbeOnElection(4)
+	cfg.end()
+}
+
+func TestSnapshotAfterRejections(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{SnapshotAfterRejections: 2})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a diverged follower is sent a snapshot after SnapshotAfterRejections")
+	cfg.checkSnapshotAfterRejections(5)
+	cfg.end()
+}
+
+func TestDivergenceRepair(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: the leader repairs a follower's divergent suffix")
+	cfg.checkDivergenceRepair()
+	cfg.end()
+}
+
+func TestLeaseMissedRounds(t *testing.T) {
+	raftcfg := Config{HeartbeatInterval: 20 * time.Millisecond, LeaseDuration: 150 * time.Millisecond, LeaseMissedRounds: 2}
+	cfg := make_config_with(t, 3, false, raftcfg)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a lease survives the heartbeat rounds it may miss")
+	cfg.checkLeaseMissedRounds(5)
+	cfg.end()
+}
+
+func TestDiffLogs(t *testing.T) {
+	cfg := make_config(t, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: DiffLogs finds where two logs diverge")
+	cfg.checkDiffLogs()
+	cfg.end()
+}
+
+// strictGobRan is set once TestStrictGob has run: gobWrapper checks each type only once per
+// process, so a repeated run, as with -count, could not see the panic again.
+var strictGobRan bool
+
+func TestStrictGob(t *testing.T) {
+	if strictGobRan {
+		t.Skip("gobWrapper has already checked lowerCaseRecord in this process")
+	}
+	strictGobRan = true
+	cfg := make_config(t, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: strict gob panics on lower-case fields")
+	cfg.checkStrictGob()
+	cfg.end()
+}
+
+func TestStragglerCommit(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: the leader commits without waiting for a straggler")
+	cfg.checkStragglerCommit()
+	cfg.end()
+}
+
+func TestFirstLogIndex(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: FirstLogIndex and GetAtIndex around a snapshot")
+	cfg.checkFirstLogIndex()
+	cfg.end()
+}
+
+func TestCoalescePersist(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{CoalescePersist: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: handlers persist only when they change the state")
+	cfg.checkCoalescePersist()
+	cfg.end()
+}
+
+// BenchmarkAppendEntriesPersist counts the encodes of a follower's persistent state per
+// heartbeat AppendEntries, with handlers that persist on every call and with CoalescePersist.
+func BenchmarkAppendEntriesPersist(b *testing.B) {
+	b.Run("eager", func(b *testing.B) { benchAppendEntriesPersist(b, Config{}) })
+	b.Run("coalesced", func(b *testing.B) { benchAppendEntriesPersist(b, Config{CoalescePersist: true}) })
+}
+
+func TestElectionSeed(t *testing.T) {
+	cfg := make_config(t, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a fixed ElectionSeed reproduces the election timeouts")
+	cfg.checkElectionSeed(20)
+	cfg.end()
+}
+
+func TestComputeCommitIndex(t *testing.T) {
+	cfg := make_config(t, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: computeCommitIndex on a table of clusters")
+	cfg.checkComputeCommitIndex()
+	cfg.end()
+}
+
+func TestCommitIndexMatchesScan(t *testing.T) {
+	cfg := make_config(t, 1, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: computeCommitIndex agrees with the backward scan")
+	cfg.checkCommitIndexMatchesScan(10000)
+	cfg.end()
+}
+
+// BenchmarkCommitIndex measures the work of one AppendEntries reply on a leader five peers
+// strong that is 100000 entries ahead of its followers, all from its term, under the median
+// rule and under the backward scan it replaced.
+func BenchmarkCommitIndex(b *testing.B) {
+	const entries = 100000
+	matchIndex := []int{0, 1, 1, 1, 1}
+	termAt := func(index int) int { return 1 }
+	rules := []struct {
+		name string
+		rule func(matchIndex []int, me int, lastIndex int, quorum int, commitIndex int, currentTerm int, termAt func(index int) int) int
+	}{
+		{"median", computeCommitIndex},
+		{"scan", scanCommitIndex},
+	}
+	for _, r := range rules {
+		b.Run(r.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if N := r.rule(matchIndex, 0, entries, 3, 0, 1, termAt); N != 1 {
+					b.Fatalf("%s committed up to %d, want 1", r.name, N)
+				}
+			}
+		})
+	}
+}
+
+func TestStaleLeaderHeartbeats(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{HeartbeatPolicy: HeartbeatUpToDate})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a stale leader's heartbeats don't hold back an up-to-date follower")
+	cfg.checkStaleLeaderHeartbeats()
+	cfg.end()
+}
+
+func TestAdaptiveElectionTimeout(t *testing.T) {
+	checkAdaptiveElectionTimeout(t, 500*time.Millisecond, 2*time.Second, 8*time.Second)
+}
+
+func TestElectionSafety(t *testing.T) {
+	cfg := make_config(t, 5, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: no term has two leaders through an election storm")
+	cfg.checkElectionSafety(20)
+	cfg.end()
+}
+
+func TestInflightAppends(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{MaxInflightAppends: 2})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: RPCs outstanding to a slow follower stay within MaxInflightAppends")
+	cfg.checkInflightAppends(2 * time.Second)
+	cfg.end()
+}
+
+func TestBackpressure(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{MaxUncommittedEntries: 10})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: sustained writes against stalled followers are refused with ErrBusy")
+	cfg.checkBackpressure(time.Second)
+	cfg.end()
+}
+
+func TestBoundedSenders(t *testing.T) {
+	cfg := make_config_with(t, 5, false, Config{MaxInflightAppends: 8})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: stalled followers tie up a bounded number of senders")
+	cfg.checkBoundedSenders(2, 2*time.Second)
+	cfg.end()
+}
+
+func TestPreVote(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{PreVote: true})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a rejoining follower doesn't depose the leader with PreVote")
+	cfg.checkPreVote()
+	cfg.end()
+}
+
+func TestTransferLeadership(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: leadership transfer under load")
+	cfg.checkTransferLeadership()
+	cfg.end()
+}
+
+func TestFlexibleQuorums(t *testing.T) {
+	cfg := make_config_with(t, 5, false, Config{ElectionQuorum: 4, CommitQuorum: 2})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: asymmetric quorums keep one leader per term through partitions")
+	cfg.checkFlexibleQuorums()
+	cfg.end()
+}
+
+func TestMembershipChange(t *testing.T) {
+	cfg := make_config_members(t, 5, 3, false, Config{})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: adding and removing voters")
+	cfg.checkMembershipChange()
+	cfg.end()
+}
+
+func TestAddServerRetry(t *testing.T) {
+	cfg := make_config_members(t, 4, 3, false, Config{})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: a retried AddServer takes the index of the failed one")
+	cfg.checkAddServerRetry()
+	cfg.end()
+}
+
+func TestLearners(t *testing.T) {
+	cfg := make_config_members(t, 5, 3, false, Config{})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: learners catch up without voting")
+	cfg.checkLearners()
+	cfg.end()
+}
+
+func TestReconfigReject(t *testing.T) {
+	cfg := make_config_members(t, 4, 3, false, Config{ReconfigPolicy: ReconfigReject})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: TryStart refuses commands during a configuration change")
+	cfg.checkReconfigPolicy()
+	cfg.end()
+}
+
+func TestReconfigQueue(t *testing.T) {
+	cfg := make_config_members(t, 4, 3, false, Config{ReconfigPolicy: ReconfigQueue})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: TryStart queues commands until a configuration change commits")
+	cfg.checkReconfigPolicy()
+	cfg.end()
+}
+
+func TestTimingConfig(t *testing.T) {
+	cfg := make_config_with(t, 3, false, Config{
+		HeartbeatInterval:  200 * time.Millisecond,
+		ElectionTimeoutMin: time.Second,
+		ElectionTimeoutMax: 2 * time.Second,
+	})
+	defer cfg.cleanup()
+
+	cfg.begin("Test: long election timeouts on a slow network")
+	cfg.checkTimingConfig()
+	cfg.end()
+}
+
+func TestWaitForApplied(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: WaitForApplied returns once its index is applied, or ctx or Kill ends it")
+	cfg.checkWaitForApplied()
+	cfg.end()
+}
+
+func TestKill(t *testing.T) {
+	checkKill(t, 3)
+}
+
+func TestApplyOrderUnderLoad(t *testing.T) {
+	cfg := make_config(t, 3, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: commands apply in order under load, partitions and snapshots")
+	cfg.checkApplyOrderUnderLoad(5, 3*time.Second)
+	cfg.end()
+}
+
+func TestTermChange(t *testing.T) {
+	checkTermChange(t)
+}
+
+func TestApplyQueue(t *testing.T) {
+	checkApplyQueue(t, 16)
+}
+
+func TestTraceReplay(t *testing.T) {
+	checkTraceReplay(t)
+}
+
+func TestHandlerFlood(t *testing.T) {
+	checkHandlerFlood(t, 3, 8, 2*time.Second)
+}
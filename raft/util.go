@@ -22,3 +22,11 @@ func min(x, y int) int {
 	}
 	return y // Otherwise, return y.
 }
+
+// max returns the maximum of two integers.
+func max(x, y int) int {
+	if x > y {
+		return x // Return x if it is greater than y.
+	}
+	return y // Otherwise, return y.
+}
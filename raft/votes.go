@@ -0,0 +1,109 @@
+package raft
+
+import "fmt"
+
+// VoteEventKind is the step of an election a VoteEvent reports.
+type VoteEventKind int
+
+const (
+	VoteRequested VoteEventKind = iota // a candidate sent RequestVote to a voter
+	VoteReceived                       // a voter received RequestVote from a candidate
+	VoteGranted                        // a voter granted its vote
+	VoteRejected                       // a voter refused its vote, for VoteEvent.Reason
+)
+
+// Reasons a voter refuses its vote, reported in VoteEvent.Reason.
+const (
+	RejectStaleTerm = "stale term"         // the candidate's term is behind the voter's
+	RejectLease     = "leader lease"       // the voter heard from a leader that may still hold a lease
+	RejectVoted     = "already voted"      // the voter has voted for another candidate in the term
+	RejectLogBehind = "log not up to date" // the candidate's log is behind the voter's
+	RejectNotVoter  = "not a voter"        // the candidate is not a voter in the voter's configuration
+)
+
+// String returns the name of the kind.
+func (k VoteEventKind) String() string {
+	switch k {
+	case VoteRequested:
+		return "requested"
+	case VoteReceived:
+		return "received"
+	case VoteGranted:
+		return "granted"
+	case VoteRejected:
+		return "rejected"
+	default:
+		return fmt.Sprintf("VoteEventKind(%d)", int(k))
+	}
+}
+
+// VoteEvent is one step of an election, reported through Config.OnVote by the peer that took
+// it: the candidate for VoteRequested, the voter for the others.
+type VoteEvent struct {
+	Kind      VoteEventKind
+	Term      int    // Term the candidate is running in
+	Candidate int    // Index of the candidate
+	Voter     int    // Index of the voter
+	VoterTerm int    // Voter's term when it handled the request; zero for VoteRequested
+	Reason    string // Why the vote was refused, for VoteRejected
+}
+
+// String describes the event on one line, for logs.
+func (e VoteEvent) String() string {
+	s := fmt.Sprintf("vote %v: term %d candidate %d voter %d", e.Kind, e.Term, e.Candidate, e.Voter)
+	if e.Kind != VoteRequested {
+		s += fmt.Sprintf(" (voter term %d)", e.VoterTerm)
+	}
+	if e.Reason != "" {
+		s += ": " + e.Reason
+	}
+	return s
+}
+
+// rejectVote records the refusal of a vote for reason.
+// Must be called with the lock held.
+func (rf *Raft) rejectVote(args *RequestVoteArgs, reason string) {
+	rf.recordVote(VoteEvent{Kind: VoteRejected, Term: args.Term, Candidate: args.CandidateId, Voter: rf.me, VoterTerm: rf.currentTerm, Reason: reason})
+}
+
+// recordVote counts a vote event and queues it for cfg.OnVote, if set.
+// Must be called with the lock held.
+func (rf *Raft) recordVote(event VoteEvent) {
+	switch event.Kind {
+	case VoteRequested:
+		rf.metrics.VotesRequested++
+	case VoteReceived:
+		rf.metrics.VoteRequestsReceived++
+	case VoteGranted:
+		rf.metrics.VotesGranted++
+	case VoteRejected:
+		rf.metrics.VotesRejected++
+	}
+	if rf.votesQueued == nil {
+		return
+	}
+	rf.pendingVotes = append(rf.pendingVotes, event)
+	select {
+	case rf.votesQueued <- struct{}{}:
+	default:
+		// the notifier is already due to run
+	}
+}
+
+// notifyVotes passes the queued vote events to cfg.OnVote, outside the lock, in order.
+func (rf *Raft) notifyVotes() {
+	for {
+		select {
+		case <-rf.votesQueued:
+		case <-rf.done:
+			return
+		}
+		rf.mu.Lock()
+		events := rf.pendingVotes
+		rf.pendingVotes = nil
+		rf.mu.Unlock()
+		for _, event := range events {
+			rf.cfg.OnVote(event)
+		}
+	}
+}
@@ -13,7 +13,9 @@ package rpc
    ** net.Connect(endname, servername) -- connect a client to a server.
    ** net.Enable(endname, enabled) -- enable/disable a client.
    ** net.Reliable(bool) -- false means drop/delay messages
+   ** net.Jitter(d) -- let each end's latency wander between 0 and d
    ** end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+   ** end.CallWithTimeout("Raft.AppendEntries", &args, &reply, timeout) -- the same, waiting at most timeout.
 
 	-> The "Raft" is the name of the server struct to be called.
 	-> The "AppendEntries" is the name of the method to be called.Call() returns true
@@ -63,8 +65,11 @@ type replyMsg struct {
 
 // ClientEnd represents the client end of an RPC connection.
 type ClientEnd struct {
-	endname interface{} // This end-point's name
-	ch      chan reqMsg // Channel to send requests
+	endname interface{}   // This end-point's name
+	ch      chan reqMsg   // Channel to send requests
+	done    chan struct{} // Closed when the network is cleaned up
+	trace   *Trace        // If set, every call is recorded here
+	replay  *Trace        // If set, calls are answered from this trace instead of the network
 }
 
 /* 
@@ -73,20 +78,54 @@ type ClientEnd struct {
  */ 
 
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallWithTimeout(svcMeth, args, reply, 0)
+}
+
+/*
+ * CallWithTimeout is like Call, but gives up and returns false if no reply has arrived within
+ * timeout, as if the network had lost it; the request may still have been executed. A timeout
+ * of zero or less waits as long as Call does. A replayed call is answered from the trace at once.
+ */
+
+func (e *ClientEnd) CallWithTimeout(svcMeth string, args interface{}, reply interface{}, timeout time.Duration) bool {
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	// buffered, so a reply arriving after the caller has timed out doesn't block the network.
+	req.replyCh = make(chan replyMsg, 1)
 
 	qb := new(bytes.Buffer)
 	qe := gobWrapper.NewEncoder(qb)
 	qe.Encode(args)
 	req.args = qb.Bytes()
 
-	e.ch <- req
+	var rep replyMsg
+	if e.replay != nil {
+		rep = e.replay.replay(svcMeth, req.args)
+	} else {
+		select {
+		case e.ch <- req:
+		case <-e.done:
+			// the network was cleaned up, so nothing will ever answer.
+			req.replyCh <- replyMsg{false, nil}
+		}
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			select {
+			case rep = <-req.replyCh:
+			case <-timer.C:
+				rep = replyMsg{false, nil}
+			}
+			timer.Stop()
+		} else {
+			rep = <-req.replyCh
+		}
+	}
+	if e.trace != nil {
+		e.trace.record(svcMeth, req.args, rep)
+	}
 
-	rep := <-req.replyCh
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := gobWrapper.NewDecoder(rb)
@@ -105,12 +144,15 @@ type Network struct {
 	reliable       bool
 	longDelays     bool                        // pause a long time on send on disabled connection
 	longReordering bool                        // sometimes delay replies a long time
+	jitter         time.Duration               // longest latency an end wanders to
+	latencies      map[interface{}]latency     // current latency, by end name, with jitter
 	ends           map[interface{}]*ClientEnd  // ends, by name
 	enabled        map[interface{}]bool        // by end name
 	servers        map[interface{}]*Server     // servers, by name
 	connections    map[interface{}]interface{} // endname -> servername
 	endCh          chan reqMsg
-	count          int32 // Total RPC count for statistics
+	done           chan struct{} // closed by Cleanup
+	count          int32         // Total RPC count for statistics
 }
 
 func MakeNetwork() *Network {
@@ -121,18 +163,33 @@ func MakeNetwork() *Network {
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
 	rn.endCh = make(chan reqMsg)
+	rn.done = make(chan struct{})
 
 	// single goroutine to handle all ClientEnd.Call()s
 	go func() {
-		for xreq := range rn.endCh {
-			atomic.AddInt32(&rn.count, 1)
-			go rn.ProcessReq(xreq)
+		for {
+			select {
+			case xreq := <-rn.endCh:
+				atomic.AddInt32(&rn.count, 1)
+				go rn.ProcessReq(xreq)
+			case <-rn.done:
+				return
+			}
 		}
 	}()
 
 	return rn
 }
 
+/*
+ * Stop the goroutine that delivers requests. Calls made afterwards fail at once, as if the
+ * network had lost them; calls already under way still get their replies.
+ */
+
+func (rn *Network) Cleanup() {
+	close(rn.done)
+}
+
 func (rn *Network) Reliable(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -154,6 +211,44 @@ func (rn *Network) LongDelays(yes bool) {
 	rn.longDelays = yes
 }
 
+// latency is an end's current delay, and the time until which it holds.
+type latency struct {
+	delay time.Duration
+	until time.Time
+}
+
+/*
+ * Let the latency of each end wander between 0 and d: every request an end delivers, reliable or
+ * not, is delayed by the end's current latency, which is redrawn at random intervals of up to d.
+ * Messages sent at a steady rate then arrive in uneven bursts, with gaps between them as long as
+ * the jumps in latency. Zero turns the jitter off.
+ */
+
+func (rn *Network) Jitter(d time.Duration) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.jitter = d
+	rn.latencies = map[interface{}]latency{}
+}
+
+// delay returns the current latency of an end, redrawing it if it has run out.
+func (rn *Network) delay(endname interface{}) time.Duration {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if rn.jitter <= 0 {
+		return 0
+	}
+	l := rn.latencies[endname]
+	if now := time.Now(); now.After(l.until) {
+		l.delay = time.Duration(rand.Int63n(int64(rn.jitter)))
+		l.until = now.Add(time.Duration(rand.Int63n(int64(rn.jitter))))
+		rn.latencies[endname] = l
+	}
+	return l.delay
+}
+
 func (rn *Network) ReadEndnameInfo(endname interface{}) (enabled bool,
 	servername interface{}, server *Server, reliable bool, longreordering bool,
 ) {
@@ -190,6 +285,10 @@ func (rn *Network) ProcessReq(req reqMsg) {
 			time.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
+		if d := rn.delay(req.endname); d > 0 {
+			time.Sleep(d)
+		}
+
 		if !reliable && (rand.Int()%1000) < 100 {
 			// drop the request, return as if timeout
 			req.replyCh <- replyMsg{false, nil}
@@ -282,6 +381,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e := &ClientEnd{}
 	e.endname = endname
 	e.ch = rn.endCh
+	e.done = rn.done
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
 	rn.connections[endname] = nil
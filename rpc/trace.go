@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ReshiAdavan/Sentinel/gobWrapper"
+)
+
+// TraceEntry is one call made through a ClientEnd, as recorded in a Trace.
+type TraceEntry struct {
+	SvcMeth string // Service and method called, e.g. "Raft.AppendEntries"
+	Args    []byte // gobWrapper encoding of the arguments
+	Reply   []byte // gobWrapper encoding of the reply, if Ok
+	Ok      bool   // What Call returned
+}
+
+// Trace is a record of the calls made through a ClientEnd, in the order they completed.
+// A trace recorded with ClientEnd.Record can be saved, loaded again, and replayed with
+// MakeReplayEnd, which turns a flaky failure into a deterministic reproduction: the peer
+// under test sees exactly the replies, and lost calls, it saw when the trace was recorded.
+type Trace struct {
+	mu       sync.Mutex
+	entries  []TraceEntry
+	used     []bool // Entries already consumed by replay
+	diverged error  // First call during replay that the trace had no answer for
+}
+
+// NewTrace returns an empty trace, ready for recording.
+func NewTrace() *Trace {
+	return &Trace{}
+}
+
+// Record makes the end append every call it completes to t.
+// It must be called before the end is used.
+func (e *ClientEnd) Record(t *Trace) {
+	e.trace = t
+}
+
+// MakeReplayEnd returns an end whose calls never reach a network. Each call is answered
+// with the reply of the first unused entry in t for the same method and arguments, or
+// fails if there is none, which Diverged then reports.
+func MakeReplayEnd(t *Trace) *ClientEnd {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used = make([]bool, len(t.entries))
+	t.diverged = nil
+	return &ClientEnd{replay: t}
+}
+
+// Entries returns a copy of the calls recorded so far.
+func (t *Trace) Entries() []TraceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEntry(nil), t.entries...)
+}
+
+// Diverged returns an error describing the first call made during replay that did not
+// match any recorded call, or nil if the replay has followed the trace so far.
+func (t *Trace) Diverged() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.diverged
+}
+
+// Save writes the trace to w, to be read back with LoadTrace.
+func (t *Trace) Save(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return gobWrapper.NewEncoder(w).Encode(t.entries)
+}
+
+// LoadTrace reads a trace written by Trace.Save.
+func LoadTrace(r io.Reader) (*Trace, error) {
+	t := NewTrace()
+	if err := gobWrapper.NewDecoder(r).Decode(&t.entries); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// record appends a completed call.
+func (t *Trace) record(svcMeth string, args []byte, rep replyMsg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, TraceEntry{SvcMeth: svcMeth, Args: args, Reply: rep.reply, Ok: rep.ok})
+}
+
+// replay answers a call from the first unused matching entry. Matching on the arguments,
+// rather than just taking the next entry, tolerates concurrent calls completing in a
+// different order than they did while recording.
+func (t *Trace) replay(svcMeth string, args []byte) replyMsg {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, entry := range t.entries {
+		if !t.used[i] && entry.SvcMeth == svcMeth && bytes.Equal(entry.Args, args) {
+			t.used[i] = true
+			return replyMsg{entry.Ok, entry.Reply}
+		}
+	}
+	if t.diverged == nil {
+		t.diverged = fmt.Errorf("rpc: replayed call to %s with unrecorded arguments", svcMeth)
+	}
+	return replyMsg{false, nil}
+}